@@ -0,0 +1,222 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"maps"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// maxAdminBody bounds the body of an admin API request.
+const maxAdminBody = 64 << 10
+
+// runtimeTargets are the targets registered through the admin API, one group
+// per URL. When path is set they are persisted there in the format of
+// --targets.file, so they survive restarts.
+type runtimeTargets struct {
+	path string
+	// updateMu serializes updates, so a rollback doesn't undo another
+	// update's change.
+	updateMu sync.Mutex
+
+	mu     sync.Mutex
+	groups map[string]targetGroup
+}
+
+// loadRuntimeTargets returns the targets persisted at path, if any.
+func loadRuntimeTargets(path string) (*runtimeTargets, error) {
+	rt := &runtimeTargets{path: path, groups: map[string]targetGroup{}}
+	if path == "" {
+		return rt, nil
+	}
+	raw, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return rt, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading --admin.targets-file: %v", err)
+	}
+	var groups []targetGroup
+	if err := json.Unmarshal(raw, &groups); err != nil {
+		return nil, fmt.Errorf("parsing --admin.targets-file %s: %v", path, err)
+	}
+	for _, g := range groups {
+		if len(g.Targets) == 1 {
+			rt.groups[g.Targets[0]] = g
+		}
+	}
+	return rt, nil
+}
+
+// current returns the runtime targets sorted by URL.
+func (rt *runtimeTargets) current() []targetGroup {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	urls := slices.Sorted(maps.Keys(rt.groups))
+	groups := make([]targetGroup, 0, len(urls))
+	for _, u := range urls {
+		groups = append(groups, rt.groups[u])
+	}
+	return groups
+}
+
+// update applies change to the runtime targets and calls apply. If apply
+// fails the change is rolled back, otherwise it is persisted.
+func (rt *runtimeTargets) update(change func(map[string]targetGroup), apply func() error) error {
+	rt.updateMu.Lock()
+	defer rt.updateMu.Unlock()
+
+	rt.mu.Lock()
+	prev := maps.Clone(rt.groups)
+	change(rt.groups)
+	rt.mu.Unlock()
+
+	if err := apply(); err != nil {
+		rt.mu.Lock()
+		rt.groups = prev
+		rt.mu.Unlock()
+		return err
+	}
+	return rt.save()
+}
+
+// save writes the runtime targets to path, replacing the file atomically.
+func (rt *runtimeTargets) save() error {
+	if rt.path == "" {
+		return nil
+	}
+	raw, err := json.MarshalIndent(rt.current(), "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(rt.path, append(raw, '\n')); err != nil {
+		return fmt.Errorf("persisting runtime targets: %v", err)
+	}
+	return nil
+}
+
+// adminAPI serves /api/v1/targets, authenticated with a bearer token.
+type adminAPI struct {
+	token   string
+	targets *runtimeTargets
+	r       *reloader
+}
+
+// adminTarget is the JSON representation of a runtime target.
+type adminTarget struct {
+	URL        string            `json:"url"`
+	Strategies []string          `json:"strategies,omitempty"`
+	Labels     map[string]string `json:"labels,omitempty"`
+}
+
+// authorize reports whether the request carries the admin token, answering
+// 401 otherwise.
+func (a *adminAPI) authorize(w http.ResponseWriter, req *http.Request) bool {
+	token, ok := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer ")
+	if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(a.token)) != 1 {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="psi-exporter"`)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+// list serves GET /api/v1/targets with the runtime targets.
+func (a *adminAPI) list(w http.ResponseWriter, req *http.Request) {
+	if !a.authorize(w, req) {
+		return
+	}
+	targets := []adminTarget{}
+	for _, g := range a.targets.current() {
+		targets = append(targets, adminTarget{URL: g.Targets[0], Strategies: g.Strategies, Labels: g.Labels})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(targets)
+}
+
+// add serves POST /api/v1/targets, registering a target or replacing the
+// runtime target with the same URL. The new targets take effect as with a
+// reload; a target that would make the reload fail is rejected.
+func (a *adminAPI) add(w http.ResponseWriter, req *http.Request) {
+	if !a.authorize(w, req) {
+		return
+	}
+	var t adminTarget
+	dec := json.NewDecoder(http.MaxBytesReader(w, req.Body, maxAdminBody))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&t); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid request body: %v", err), http.StatusBadRequest)
+		return
+	}
+	u, err := normalizeTargetURL(t.URL)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	t.URL = u
+	g := targetGroup{Targets: []string{u}, Labels: t.Labels, Strategies: t.Strategies}
+	if _, errs := expandTargetGroups("/api/v1/targets", []targetGroup{g}, a.r.e.strategies, a.r.e.fetchDefaults); len(errs) > 0 {
+		http.Error(w, errors.Join(errs...).Error(), http.StatusBadRequest)
+		return
+	}
+
+	var replaced bool
+	err = a.targets.update(func(groups map[string]targetGroup) {
+		_, replaced = groups[u]
+		groups[u] = g
+	}, a.r.reload)
+	if err != nil {
+		a.r.e.logger.Error("Failed to add runtime target", "site", u, "err", err)
+		http.Error(w, fmt.Sprintf("Failed to add target: %v", err), http.StatusUnprocessableEntity)
+		return
+	}
+	a.r.e.logger.Info("Added runtime target", "site", u, "replaced", replaced)
+
+	w.Header().Set("Content-Type", "application/json")
+	if !replaced {
+		w.WriteHeader(http.StatusCreated)
+	}
+	json.NewEncoder(w).Encode(t)
+}
+
+// remove serves DELETE /api/v1/targets?url=, deregistering a runtime target.
+// Targets from the other sources can't be removed through the API.
+func (a *adminAPI) remove(w http.ResponseWriter, req *http.Request) {
+	if !a.authorize(w, req) {
+		return
+	}
+	u, err := normalizeTargetURL(req.URL.Query().Get("url"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var found bool
+	err = a.targets.update(func(groups map[string]targetGroup) {
+		_, found = groups[u]
+		delete(groups, u)
+	}, func() error {
+		if !found {
+			return nil
+		}
+		return a.r.reload()
+	})
+	if err != nil {
+		a.r.e.logger.Error("Failed to remove runtime target", "site", u, "err", err)
+		http.Error(w, fmt.Sprintf("Failed to remove target: %v", err), http.StatusUnprocessableEntity)
+		return
+	}
+	if !found {
+		http.Error(w, "No runtime target with this URL", http.StatusNotFound)
+		return
+	}
+	a.r.e.logger.Info("Removed runtime target", "site", u)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+
+	"github.com/yahyasahaja/prometheus-exporter-pagespeed-insight/pkg/psi"
+)
+
+// Backends a target's results can come from.
+const (
+	backendPSI         = "psi"
+	backendWebPageTest = "webpagetest"
+	backendLighthouse  = "lighthouse"
+)
+
+// backendNames are the values of the backends of a config file target.
+var backendNames = []string{backendPSI, backendWebPageTest, backendLighthouse}
+
+// backendLabel is the label of the backend of every target, set as soon as
+// a target uses another backend than PSI.
+const backendLabel = "backend"
+
+// backend runs a lab test of a page. psi.Client is the default one.
+type backend interface {
+	Run(ctx context.Context, pageURL, strategy string) (*psi.Result, error)
+}
+
+// validateBackend checks that b is one of backendNames.
+func validateBackend(b string) error {
+	if !slices.Contains(backendNames, b) {
+		return fmt.Errorf("invalid backend %q: must be one of %s", b, strings.Join(backendNames, ", "))
+	}
+	return nil
+}
+
+// labelBackends labels every target with its backend if any target uses
+// another backend than PSI, so the series of both can be told apart.
+func labelBackends(targets []target) {
+	if !slices.ContainsFunc(targets, func(t target) bool { return t.Backend != "" }) {
+		return
+	}
+	for i, t := range targets {
+		if _, ok := t.Labels[backendLabel]; ok {
+			continue
+		}
+		labels := maps.Clone(t.Labels)
+		if labels == nil {
+			labels = map[string]string{}
+		}
+		labels[backendLabel] = cmp.Or(t.Backend, backendPSI)
+		targets[i].Labels = labels
+	}
+}
+
+// validateTargetBackends checks the backends of a config file target with
+// the custom labels labels.
+func validateTargetBackends(backends []string, labels map[string]string) error {
+	for _, b := range backends {
+		if err := validateBackend(b); err != nil {
+			return err
+		}
+	}
+	if _, ok := labels[backendLabel]; ok && slices.ContainsFunc(backends, func(b string) bool { return b != backendPSI }) {
+		return fmt.Errorf("backends and labels.%s are mutually exclusive", backendLabel)
+	}
+	return nil
+}
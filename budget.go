@@ -0,0 +1,147 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/yahyasahaja/prometheus-exporter-pagespeed-insight/pkg/collector"
+)
+
+// budgetMetrics are the values a budget can limit, named like the exported
+// metric without the namespace, with how to read them from a result.
+var budgetMetrics = map[string]func(r *collector.Result) (float64, bool){
+	"performance_score": func(r *collector.Result) (float64, bool) {
+		if r.PerformanceScore == nil {
+			return 0, false
+		}
+		return *r.PerformanceScore, true
+	},
+	"accessibility_score":             categoryValue("accessibility"),
+	"best_practices_score":            categoryValue("best-practices"),
+	"seo_score":                       categoryValue("seo"),
+	"first_contentful_paint":          labValue("first-contentful-paint"),
+	"largest_contentful_paint":        labValue("largest-contentful-paint"),
+	"cumulative_layout_shift":         labValue("cumulative-layout-shift"),
+	"total_blocking_time":             labValue("total-blocking-time"),
+	"speed_index":                     labValue("speed-index"),
+	"server_response_time":            labValue("server-response-time"),
+	"field_first_contentful_paint":    fieldValue("FIRST_CONTENTFUL_PAINT_MS"),
+	"field_largest_contentful_paint":  fieldValue("LARGEST_CONTENTFUL_PAINT_MS"),
+	"field_cumulative_layout_shift":   fieldValue("CUMULATIVE_LAYOUT_SHIFT_SCORE"),
+	"field_interaction_to_next_paint": fieldValue("INTERACTION_TO_NEXT_PAINT"),
+}
+
+func categoryValue(category string) func(r *collector.Result) (float64, bool) {
+	return func(r *collector.Result) (float64, bool) {
+		v, ok := r.CategoryScores[category]
+		return v, ok
+	}
+}
+
+func labValue(audit string) func(r *collector.Result) (float64, bool) {
+	return func(r *collector.Result) (float64, bool) {
+		v, ok := r.Metrics[audit]
+		return v, ok
+	}
+}
+
+// fieldValue reads a CrUX percentile, which the collector already scaled
+// like the exported metric.
+func fieldValue(name string) func(r *collector.Result) (float64, bool) {
+	return func(r *collector.Result) (float64, bool) {
+		v, ok := r.FieldData[name]
+		return v, ok
+	}
+}
+
+// budget limits one metric of a target to at most Max, at least Min, or
+// both.
+type budget struct {
+	Metric   string
+	Min, Max *float64
+}
+
+func (b budget) String() string {
+	var parts []string
+	if b.Min != nil {
+		parts = append(parts, ">="+strconv.FormatFloat(*b.Min, 'g', -1, 64))
+	}
+	if b.Max != nil {
+		parts = append(parts, "<="+strconv.FormatFloat(*b.Max, 'g', -1, 64))
+	}
+	return b.Metric + strings.Join(parts, ",")
+}
+
+// margin returns how far value is within the budget, negative when it
+// exceeds it. With both bounds, the nearer one counts.
+func (b budget) margin(value float64) float64 {
+	var margins []float64
+	if b.Min != nil {
+		margins = append(margins, value-*b.Min)
+	}
+	if b.Max != nil {
+		margins = append(margins, *b.Max-value)
+	}
+	return slices.Min(margins)
+}
+
+// bound returns the bound of the budget nearest to value.
+func (b budget) bound(value float64) float64 {
+	if b.Max == nil || b.Min != nil && value-*b.Min < *b.Max-value {
+		return *b.Min
+	}
+	return *b.Max
+}
+
+// fileBudget is a budget of a config file target.
+type fileBudget struct {
+	Min *float64 `yaml:"min"`
+	Max *float64 `yaml:"max"`
+}
+
+// parseBudgets validates the budgets of a config file target and returns
+// them sorted by metric.
+func parseBudgets(budgets map[string]fileBudget) ([]budget, error) {
+	var parsed []budget
+	for _, metric := range slices.Sorted(maps.Keys(budgets)) {
+		fb := budgets[metric]
+		if _, ok := budgetMetrics[metric]; !ok {
+			return nil, fmt.Errorf("invalid budget metric %q: must be one of %s", metric, strings.Join(slices.Sorted(maps.Keys(budgetMetrics)), ", "))
+		}
+		if fb.Min == nil && fb.Max == nil {
+			return nil, fmt.Errorf("budget of %s needs a min or a max", metric)
+		}
+		if fb.Min != nil && fb.Max != nil && *fb.Min > *fb.Max {
+			return nil, fmt.Errorf("budget of %s has a min above its max", metric)
+		}
+		parsed = append(parsed, budget{Metric: metric, Min: fb.Min, Max: fb.Max})
+	}
+	return parsed, nil
+}
+
+// checkBudgets exports whether r, the result of a successful fetch of t, is
+// within t's budgets. Budgets of metrics r has no value for aren't exported.
+func (e *exporter) checkBudgets(t target, r *collector.Result, logger *slog.Logger) {
+	for _, b := range t.Budgets {
+		value, ok := budgetMetrics[b.Metric](r)
+		if !ok {
+			e.metrics.budgetExceeded.DeleteLabelValues(e.metrics.targetValues(t, b.Metric)...)
+			e.metrics.budgetMargin.DeleteLabelValues(e.metrics.targetValues(t, b.Metric)...)
+			continue
+		}
+		margin := b.margin(value)
+		e.metrics.budgetExceeded.WithLabelValues(e.metrics.targetValues(t, b.Metric)...).Set(boolFloat(margin < 0))
+		e.metrics.budgetMargin.WithLabelValues(e.metrics.targetValues(t, b.Metric)...).Set(margin)
+		if margin < 0 {
+			logger.Warn("Performance budget exceeded", "metric", b.Metric, "value", value, "budget", b)
+		}
+		if e.notifier != nil {
+			e.notifier.update(notification{Kind: "budget", Site: t.URL, Strategy: t.Strategy, Metric: b.Metric, Value: value, Threshold: b.bound(value), Labels: t.Labels, Time: time.Now()}, margin < 0)
+		}
+	}
+}
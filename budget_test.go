@@ -0,0 +1,134 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/yahyasahaja/prometheus-exporter-pagespeed-insight/pkg/collector"
+)
+
+func TestParseBudgets(t *testing.T) {
+	tests := []struct {
+		name    string
+		budgets map[string]fileBudget
+		want    []string
+		// err is a part of the expected error.
+		err string
+	}{
+		{
+			name: "sorted by metric",
+			budgets: map[string]fileBudget{
+				"speed_index":       {Max: ptr(3000)},
+				"performance_score": {Min: ptr(0.9)},
+				"seo_score":         {Min: ptr(0.5), Max: ptr(1)},
+			},
+			want: []string{"performance_score>=0.9", "seo_score>=0.5,<=1", "speed_index<=3000"},
+		},
+		{name: "equal bounds", budgets: map[string]fileBudget{"seo_score": {Min: ptr(1), Max: ptr(1)}}, want: []string{"seo_score>=1,<=1"}},
+		{name: "unknown metric", budgets: map[string]fileBudget{"psi_speed_index": {Max: ptr(1)}}, err: `invalid budget metric "psi_speed_index": must be one of accessibility_score,`},
+		{name: "no bound", budgets: map[string]fileBudget{"speed_index": {}}, err: "budget of speed_index needs a min or a max"},
+		{name: "min above max", budgets: map[string]fileBudget{"speed_index": {Min: ptr(2), Max: ptr(1)}}, err: "budget of speed_index has a min above its max"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			budgets, err := parseBudgets(tt.budgets)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Errorf("got error %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, b := range budgets {
+				got = append(got, b.String())
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("got budgets %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBudgetMargin(t *testing.T) {
+	tests := []struct {
+		budget        budget
+		value         float64
+		margin, bound float64
+	}{
+		{budget{Max: ptr(3000)}, 2500, 500, 3000},
+		{budget{Max: ptr(3000)}, 3000, 0, 3000},
+		{budget{Max: ptr(3000)}, 3500, -500, 3000},
+		{budget{Min: ptr(0.5)}, 0.75, 0.25, 0.5},
+		{budget{Min: ptr(0.5)}, 0.5, 0, 0.5},
+		{budget{Min: ptr(0.5)}, 0.25, -0.25, 0.5},
+		// With both bounds, the nearer one counts.
+		{budget{Min: ptr(0.5), Max: ptr(1)}, 0.625, 0.125, 0.5},
+		{budget{Min: ptr(0.5), Max: ptr(1)}, 0.875, 0.125, 1},
+		{budget{Min: ptr(0.5), Max: ptr(1)}, 0.25, -0.25, 0.5},
+		{budget{Min: ptr(0.5), Max: ptr(1)}, 1.5, -0.5, 1},
+	}
+	for _, tt := range tests {
+		b := tt.budget
+		b.Metric = "seo_score"
+		if got := b.margin(tt.value); got != tt.margin {
+			t.Errorf("%s: margin(%g) = %g, want %g", b, tt.value, got, tt.margin)
+		}
+		if got := b.bound(tt.value); got != tt.bound {
+			t.Errorf("%s: bound(%g) = %g, want %g", b, tt.value, got, tt.bound)
+		}
+	}
+}
+
+func TestCheckBudgets(t *testing.T) {
+	e := &exporter{metrics: newMetrics(collector.Opts{Namespace: "psi", TargetLabels: []string{"team"}}, "")}
+	page := target{
+		URL: "https://example.com", Strategy: "mobile", Labels: map[string]string{"team": "web"},
+		Budgets: []budget{
+			{Metric: "field_largest_contentful_paint", Max: ptr(2500)},
+			{Metric: "performance_score", Min: ptr(0.9)},
+			{Metric: "speed_index", Max: ptr(3000)},
+		},
+	}
+	e.checkBudgets(page, &collector.Result{
+		PerformanceScore: ptr(0.5),
+		Metrics:          map[string]float64{"speed-index": 3000},
+		FieldData:        map[string]float64{"LARGEST_CONTENTFUL_PAINT_MS": 2000},
+	}, discard)
+	want := `
+# HELP psi_budget_exceeded Whether the latest value of the metric of the target is outside its budget (1) or not (0)
+# TYPE psi_budget_exceeded gauge
+psi_budget_exceeded{metric="field_largest_contentful_paint",site="https://example.com",strategy="mobile",team="web"} 0
+psi_budget_exceeded{metric="performance_score",site="https://example.com",strategy="mobile",team="web"} 1
+psi_budget_exceeded{metric="speed_index",site="https://example.com",strategy="mobile",team="web"} 0
+# HELP psi_budget_margin How far the latest value of the metric of the target is within its budget, negative when it exceeds it
+# TYPE psi_budget_margin gauge
+psi_budget_margin{metric="field_largest_contentful_paint",site="https://example.com",strategy="mobile",team="web"} 500
+psi_budget_margin{metric="performance_score",site="https://example.com",strategy="mobile",team="web"} -0.4
+psi_budget_margin{metric="speed_index",site="https://example.com",strategy="mobile",team="web"} 0
+`
+	if err := testutil.CollectAndCompare(e.metrics.budgetExceeded, strings.NewReader(want), "psi_budget_exceeded"); err != nil {
+		t.Error(err)
+	}
+	if err := testutil.CollectAndCompare(e.metrics.budgetMargin, strings.NewReader(want), "psi_budget_margin"); err != nil {
+		t.Error(err)
+	}
+
+	// The budgets of metrics a later result lacks are no longer exported.
+	e.checkBudgets(page, &collector.Result{PerformanceScore: ptr(0.95)}, discard)
+	want = `
+# HELP psi_budget_exceeded Whether the latest value of the metric of the target is outside its budget (1) or not (0)
+# TYPE psi_budget_exceeded gauge
+psi_budget_exceeded{metric="performance_score",site="https://example.com",strategy="mobile",team="web"} 0
+`
+	if err := testutil.CollectAndCompare(e.metrics.budgetExceeded, strings.NewReader(want), "psi_budget_exceeded"); err != nil {
+		t.Error(err)
+	}
+	if n := testutil.CollectAndCount(e.metrics.budgetMargin); n != 1 {
+		t.Errorf("exported %d budget margins, want 1", n)
+	}
+}
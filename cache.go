@@ -0,0 +1,65 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/yahyasahaja/prometheus-exporter-pagespeed-insight/pkg/collector"
+)
+
+// resultCache keeps the most recent successful result per target so that
+// repeated /execute and /probe calls within the TTL don't spend quota.
+type resultCache struct {
+	mu         sync.Mutex
+	entries    map[string]cacheEntry
+	ttl        time.Duration
+	maxEntries int
+	// now returns the current time, replaced by tests.
+	now func() time.Time
+}
+
+type cacheEntry struct {
+	result    *collector.Result
+	fetchedAt time.Time
+}
+
+func newResultCache(ttl time.Duration, maxEntries int) *resultCache {
+	return &resultCache{entries: map[string]cacheEntry{}, ttl: ttl, maxEntries: maxEntries, now: time.Now}
+}
+
+// get returns the cached result for t and when it was fetched, if it is
+// still fresh.
+func (c *resultCache) get(t target) (*collector.Result, time.Time, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[t.key()]
+	if !ok || c.now().Sub(entry.fetchedAt) > c.ttl {
+		return nil, time.Time{}, false
+	}
+	return entry.result, entry.fetchedAt, true
+}
+
+// put stores result for t. Expired entries are dropped, and when the cache
+// is still full the oldest entry is evicted to make room.
+func (c *resultCache) put(t target, result *collector.Result) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := c.now()
+	if _, exists := c.entries[t.key()]; !exists && len(c.entries) >= c.maxEntries {
+		var oldest string
+		var oldestAt time.Time
+		for key, entry := range c.entries {
+			if now.Sub(entry.fetchedAt) > c.ttl {
+				delete(c.entries, key)
+				continue
+			}
+			if oldestAt.IsZero() || entry.fetchedAt.Before(oldestAt) {
+				oldest, oldestAt = key, entry.fetchedAt
+			}
+		}
+		if len(c.entries) >= c.maxEntries {
+			delete(c.entries, oldest)
+		}
+	}
+	c.entries[t.key()] = cacheEntry{result: result, fetchedAt: now}
+}
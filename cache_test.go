@@ -0,0 +1,131 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/yahyasahaja/prometheus-exporter-pagespeed-insight/pkg/collector"
+)
+
+// cacheTarget returns the mobile target of url.
+func cacheTarget(url string) target {
+	return target{URL: url, Strategy: "mobile", Scope: scopePage}
+}
+
+// cachedURLs returns the URLs of the targets among urls with a fresh result
+// in c.
+func cachedURLs(c *resultCache, urls ...string) []string {
+	var cached []string
+	for _, url := range urls {
+		if _, _, ok := c.get(cacheTarget(url)); ok {
+			cached = append(cached, url)
+		}
+	}
+	return cached
+}
+
+func TestResultCacheTTL(t *testing.T) {
+	c := newResultCache(time.Minute, 10)
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	c.now = func() time.Time { return now }
+	result := &collector.Result{}
+	c.put(cacheTarget("https://example.com"), result)
+
+	now = now.Add(time.Minute)
+	got, fetchedAt, ok := c.get(cacheTarget("https://example.com"))
+	if !ok || got != result || !fetchedAt.Equal(now.Add(-time.Minute)) {
+		t.Errorf("got %p fetched at %v, %v after the TTL, want the cached result", got, fetchedAt, ok)
+	}
+	now = now.Add(time.Nanosecond)
+	if _, _, ok := c.get(cacheTarget("https://example.com")); ok {
+		t.Error("got a result past the TTL")
+	}
+	// Other strategies and scopes of the URL are cached apart.
+	if _, _, ok := c.get(target{URL: "https://example.com", Strategy: "desktop", Scope: scopePage}); ok {
+		t.Error("got the mobile result for desktop")
+	}
+}
+
+func TestResultCacheEviction(t *testing.T) {
+	c := newResultCache(time.Minute, 2)
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	c.now = func() time.Time { return now }
+	put := func(url string) {
+		c.put(cacheTarget(url), &collector.Result{})
+		now = now.Add(time.Second)
+	}
+	urls := []string{"https://a.example", "https://b.example", "https://c.example", "https://d.example"}
+
+	put("https://a.example")
+	put("https://b.example")
+	put("https://c.example")
+	if got, want := cachedURLs(c, urls...), []string{"https://b.example", "https://c.example"}; !slices.Equal(got, want) {
+		t.Errorf("cached %q, want the oldest evicted %q", got, want)
+	}
+	// Replacing a result refreshes it without evicting anything.
+	put("https://b.example")
+	if got, want := cachedURLs(c, urls...), []string{"https://b.example", "https://c.example"}; !slices.Equal(got, want) {
+		t.Errorf("cached %q, want %q", got, want)
+	}
+	put("https://d.example")
+	if got, want := cachedURLs(c, urls...), []string{"https://b.example", "https://d.example"}; !slices.Equal(got, want) {
+		t.Errorf("cached %q, want the oldest evicted %q", got, want)
+	}
+
+	// Expired results make room before any fresh one is evicted.
+	now = now.Add(time.Minute - time.Second)
+	put("https://a.example")
+	if len(c.entries) != 2 {
+		t.Errorf("cached %d results, want 2", len(c.entries))
+	}
+	now = now.Add(30 * time.Second)
+	put("https://c.example")
+	if got, want := cachedURLs(c, urls...), []string{"https://a.example", "https://c.example"}; !slices.Equal(got, want) {
+		t.Errorf("cached %q, want the expired results dropped %q", got, want)
+	}
+	if len(c.entries) != 2 {
+		t.Errorf("cached %d results, want 2", len(c.entries))
+	}
+}
+
+func TestEnqueueCache(t *testing.T) {
+	var runs atomic.Int32
+	e := newTestExporter(t, func(w http.ResponseWriter, r *http.Request) {
+		runs.Add(1)
+		answerRun(w, r)
+	})
+	e.cache = newResultCache(time.Minute, 10)
+	cached := &collector.Result{}
+	e.cache.put(cacheTarget("https://example.com"), cached)
+
+	j, err := e.enqueue(cacheTarget("https://example.com"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if view := e.jobs.snapshot(j.ID); !view.Cached || view.Status != jobDone || view.Result != cached {
+		t.Errorf("got job %+v, want the cached result", view)
+	}
+	if n := runs.Load(); n != 0 {
+		t.Errorf("ran PSI %d times for a cached result, want none", n)
+	}
+
+	// A refresh fetches the target anyway and caches the new result.
+	j, err = e.enqueue(cacheTarget("https://example.com"), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitJob(t, e, j.ID)
+	view := e.jobs.snapshot(j.ID)
+	if view.Cached || view.Status != jobDone || view.Result == nil || view.Result == cached {
+		t.Errorf("got job %+v, want a fresh result", view)
+	}
+	if n := runs.Load(); n != 1 {
+		t.Errorf("ran PSI %d times for a refresh, want 1", n)
+	}
+	if result, _, ok := e.cache.get(cacheTarget("https://example.com")); !ok || result != view.Result {
+		t.Errorf("cached %p, want the refreshed result %p", result, view.Result)
+	}
+}
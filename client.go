@@ -0,0 +1,105 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+)
+
+// tlsOptions are the --psi.tls-* settings of the PSI API client.
+type tlsOptions struct {
+	caFile             string
+	certFile           string
+	keyFile            string
+	serverName         string
+	insecureSkipVerify bool
+}
+
+// config returns the TLS configuration of o, or nil when o keeps the
+// defaults.
+func (o tlsOptions) config() (*tls.Config, error) {
+	if o == (tlsOptions{}) {
+		return nil, nil
+	}
+	cfg := &tls.Config{ServerName: o.serverName, InsecureSkipVerify: o.insecureSkipVerify}
+	if o.caFile != "" {
+		pem, err := os.ReadFile(o.caFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading --psi.tls-ca-file: %v", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in --psi.tls-ca-file %s", o.caFile)
+		}
+		cfg.RootCAs = pool
+	}
+	if (o.certFile == "") != (o.keyFile == "") {
+		return nil, errors.New("--psi.tls-cert-file and --psi.tls-key-file must be set together")
+	}
+	if o.certFile != "" {
+		cert, err := tls.LoadX509KeyPair(o.certFile, o.keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("loading --psi.tls-cert-file: %v", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
+}
+
+// newPSIClient returns the HTTP client used for all PSI API requests. When
+// proxyURL is empty the proxy is taken from HTTPS_PROXY/HTTP_PROXY/NO_PROXY in
+// the environment. Credentials embedded in the proxy URL are sent as proxy
+// basic auth. The TLS options also apply to the connection to an HTTPS proxy.
+//
+// The client is shared by every fetch, so it keeps up to concurrency idle
+// connections to the API for reuse instead of the transport's default of two,
+// which would open new connections on every cycle with more concurrent
+// fetches. Like http.DefaultTransport it attempts HTTP/2 and asks for gzip.
+func newPSIClient(proxyURL string, tlsOpts tlsOptions, concurrency int) (*http.Client, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = http.ProxyFromEnvironment
+	transport.MaxIdleConnsPerHost = max(concurrency, http.DefaultMaxIdleConnsPerHost)
+	if proxyURL != "" {
+		u, err := url.Parse(proxyURL)
+		if err != nil {
+			// The error quotes the URL, which may hold a password.
+			var urlErr *url.Error
+			if errors.As(err, &urlErr) {
+				err = urlErr.Err
+			}
+			return nil, fmt.Errorf("invalid --proxy-url: %v", err)
+		}
+		switch u.Scheme {
+		case "http", "https", "socks5":
+		default:
+			return nil, fmt.Errorf("invalid --proxy-url %q: scheme must be http, https or socks5", u.Redacted())
+		}
+		if u.Host == "" {
+			return nil, fmt.Errorf("invalid --proxy-url %q: missing host", u.Redacted())
+		}
+		transport.Proxy = http.ProxyURL(u)
+	}
+	tlsConfig, err := tlsOpts.config()
+	if err != nil {
+		return nil, err
+	}
+	if tlsConfig != nil {
+		transport.TLSClientConfig = tlsConfig
+	}
+	return &http.Client{Transport: transport}, nil
+}
+
+// drainBody reads the rest of an unread response body, up to a limit, and
+// closes it, so the connection goes back to the pool of the client.
+func drainBody(body io.ReadCloser) {
+	io.Copy(io.Discard, io.LimitReader(body, 64<<10))
+	body.Close()
+}
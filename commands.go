@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/yahyasahaja/prometheus-exporter-pagespeed-insight/pkg/collector"
+)
+
+// Subcommands of the binary. Without one, it serves like with serve.
+const (
+	cmdServe    = "serve"
+	cmdFetch    = "fetch"
+	cmdValidate = "validate"
+	cmdRules    = "rules"
+)
+
+// splitCommand returns the subcommand args start with, serve when they don't
+// start with one, and the remaining args.
+func splitCommand(args []string) (string, []string) {
+	if len(args) > 0 && slices.Contains([]string{cmdServe, cmdFetch, cmdValidate, cmdRules}, args[0]) {
+		return args[0], args[1:]
+	}
+	return cmdServe, args
+}
+
+// usage prints the subcommands and the flags of fs.
+func usage(fs *flag.FlagSet) func() {
+	return func() {
+		w := fs.Output()
+		fmt.Fprintf(w, "Usage: %s [command] [flags]\n\n", fs.Name())
+		fmt.Fprintln(w, "Commands:")
+		fmt.Fprintln(w, "  serve                 Run the exporter (default)")
+		fmt.Fprintln(w, "  fetch [flags] URL...  Fetch the URLs once, print the results as JSON and exit")
+		fmt.Fprintln(w, "  validate              Check the configuration like --check-config and exit")
+		fmt.Fprintln(w, "  rules                 Print Prometheus alerting rules of the budgets and SLOs and exit")
+		fmt.Fprintln(w, "\nFlags:")
+		fs.PrintDefaults()
+		fmt.Fprintf(w, "\nEvery flag can also be set with an environment variable, e.g. %s for --fetch.max-retries.\n", envName("fetch.max-retries"))
+	}
+}
+
+// fetchTargets returns the targets of urls, leaving out those of the config
+// file.
+func fetchTargets(targets []target, urls []string) []target {
+	var normalized []string
+	for _, u := range urls {
+		// Invalid URLs were already rejected by resolve.
+		n, _ := normalizeTargetURL(strings.TrimPrefix(u, originPrefix))
+		normalized = append(normalized, n)
+	}
+	return slices.DeleteFunc(slices.Clone(targets), func(t target) bool { return !slices.Contains(normalized, t.URL) })
+}
+
+// fetchOutput is the result of one URL and strategy of the fetch command.
+type fetchOutput struct {
+	URL      string            `json:"url"`
+	Strategy string            `json:"strategy"`
+	Result   *collector.Result `json:"result,omitempty"`
+	Error    string            `json:"error,omitempty"`
+}
+
+// runFetch fetches the targets once, prints their results to stdout as a
+// JSON array and returns the exit code of the process like runOnce.
+func (e *exporter) runFetch(targets []target) int {
+	outputs := make([]fetchOutput, len(targets))
+	var wg sync.WaitGroup
+	for i, t := range targets {
+		wg.Add(1)
+		e.pool.submit(func() {
+			defer wg.Done()
+			outputs[i] = fetchOutput{URL: t.URL, Strategy: t.Strategy}
+			result, err := e.fetchPSIData(t)
+			if err != nil {
+				outputs[i].Error = err.Error()
+				return
+			}
+			outputs[i].Result = result
+		})
+	}
+	wg.Wait()
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(outputs); err != nil {
+		e.logger.Error("Failed to write the results", "err", err)
+		return onceWriteFailed
+	}
+	if slices.ContainsFunc(outputs, func(o fetchOutput) bool { return o.Error != "" }) {
+		return onceFetchFailed
+	}
+	return 0
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/yahyasahaja/prometheus-exporter-pagespeed-insight/pkg/psi"
+)
+
+// targetKeys returns the keys of targets, in order.
+func targetKeys(targets []target) []string {
+	keys := make([]string, len(targets))
+	for i, t := range targets {
+		keys[i] = t.key()
+	}
+	return keys
+}
+
+func TestExpandTargets(t *testing.T) {
+	tests := []struct {
+		name   string
+		urls   []string
+		strats []string
+		want   []string
+		// errs are parts of the expected errors, in order.
+		errs []string
+	}{
+		{
+			name:   "one target per strategy",
+			urls:   []string{"https://example.com/"},
+			strats: []string{"mobile", "desktop"},
+			want:   []string{"https://example.com|mobile|page", "https://example.com|desktop|page"},
+		},
+		{
+			name:   "normalized URLs",
+			urls:   []string{" HTTPS://Example.com:443/Shop/?q=1#top ", "https://bücher.example/"},
+			strats: []string{"mobile"},
+			want:   []string{"https://example.com/Shop?q=1|mobile|page", "https://xn--bcher-kva.example|mobile|page"},
+		},
+		{
+			name:   "origin prefix",
+			urls:   []string{"origin:https://Example.com/", "https://example.com/"},
+			strats: []string{"mobile"},
+			want:   []string{"https://example.com|mobile|origin", "https://example.com|mobile|page"},
+		},
+		{
+			name:   "empty entries",
+			urls:   []string{"", " ", "https://example.com"},
+			strats: []string{"desktop"},
+			want:   []string{"https://example.com|desktop|page"},
+		},
+		{
+			name:   "invalid entries",
+			urls:   []string{"example.com", "https://example.com/", "origin:ftp://example.com", "origin:"},
+			strats: []string{"mobile"},
+			want:   []string{"https://example.com|mobile|page"},
+			errs:   []string{`"example.com": missing scheme`, `"ftp://example.com": scheme must be http or https`, `"": missing scheme`},
+		},
+	}
+	opts := psi.RetryPolicy{Timeout: time.Minute, MaxRetries: 2}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			targets, errs := expandTargets(tt.urls, tt.strats, opts)
+			if got := targetKeys(targets); !slices.Equal(got, tt.want) {
+				t.Errorf("got targets %q, want %q", got, tt.want)
+			}
+			for _, target := range targets {
+				if target.Options != opts {
+					t.Errorf("target %s has options %+v, want %+v", target.key(), target.Options, opts)
+				}
+			}
+			if len(errs) != len(tt.errs) {
+				t.Fatalf("got errors %v, want %q", errs, tt.errs)
+			}
+			for i, err := range errs {
+				if !strings.Contains(err.Error(), tt.errs[i]) {
+					t.Errorf("got error %v, want %q", err, tt.errs[i])
+				}
+			}
+		})
+	}
+}
+
+func TestDedupeTargets(t *testing.T) {
+	tests := []struct {
+		name          string
+		targets       []target
+		kept, dropped []string
+	}{
+		{
+			name: "spellings of the same URL",
+			targets: expand(t,
+				"https://example.com/", "HTTPS://EXAMPLE.COM", "https://example.com:443/#top", "https://Example.com:443"),
+			kept:    []string{"https://example.com|mobile|page"},
+			dropped: []string{"https://example.com|mobile|page", "https://example.com|mobile|page", "https://example.com|mobile|page"},
+		},
+		{
+			name:    "page and origin of the same URL",
+			targets: expand(t, "https://example.com/", "origin:https://example.com/", "origin:https://EXAMPLE.com"),
+			kept:    []string{"https://example.com|mobile|page", "https://example.com|mobile|origin"},
+			dropped: []string{"https://example.com|mobile|origin"},
+		},
+		{
+			name:    "distinct paths, queries and ports",
+			targets: expand(t, "https://example.com/shop", "https://example.com/shop/", "https://example.com/Shop", "https://example.com/shop?q=1", "https://example.com:8443/shop"),
+			kept: []string{
+				"https://example.com/shop|mobile|page",
+				"https://example.com/Shop|mobile|page",
+				"https://example.com/shop?q=1|mobile|page",
+				"https://example.com:8443/shop|mobile|page",
+			},
+			dropped: []string{"https://example.com/shop|mobile|page"},
+		},
+		{
+			name: "strategies",
+			targets: []target{
+				{URL: "https://example.com", Strategy: "mobile", Scope: scopePage},
+				{URL: "https://example.com", Strategy: "desktop", Scope: scopePage},
+				{URL: "https://example.com", Strategy: "mobile", Scope: scopePage},
+			},
+			kept:    []string{"https://example.com|mobile|page", "https://example.com|desktop|page"},
+			dropped: []string{"https://example.com|mobile|page"},
+		},
+		{
+			name: "backends and profiles",
+			targets: []target{
+				{URL: "https://example.com", Strategy: "mobile", Scope: scopePage},
+				{URL: "https://example.com", Strategy: "mobile", Scope: scopePage, Backend: "webpagetest"},
+				{URL: "https://example.com", Strategy: "mobile", Scope: scopePage, Profile: "light"},
+				{URL: "https://example.com", Strategy: "mobile", Scope: scopePage, Profile: "full"},
+				{URL: "https://example.com", Strategy: "mobile", Scope: scopePage, Profile: "light"},
+			},
+			kept: []string{
+				"https://example.com|mobile|page",
+				"https://example.com|mobile|page|webpagetest",
+				"https://example.com|mobile|page|profile=light",
+				"https://example.com|mobile|page|profile=full",
+			},
+			dropped: []string{"https://example.com|mobile|page|profile=light"},
+		},
+		{
+			name: "labels don't tell targets apart",
+			targets: []target{
+				{URL: "https://example.com", Strategy: "mobile", Scope: scopePage, Labels: map[string]string{"team": "a"}},
+				{URL: "https://example.com", Strategy: "mobile", Scope: scopePage, Labels: map[string]string{"team": "b"}},
+			},
+			kept:    []string{"https://example.com|mobile|page"},
+			dropped: []string{"https://example.com|mobile|page"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			kept, dropped := dedupeTargets(tt.targets)
+			if got := targetKeys(kept); !slices.Equal(got, tt.kept) {
+				t.Errorf("kept %q, want %q", got, tt.kept)
+			}
+			if got := targetKeys(dropped); !slices.Equal(got, tt.dropped) {
+				t.Errorf("dropped %q, want %q", got, tt.dropped)
+			}
+		})
+	}
+
+	// The first of the duplicates is kept, with its labels.
+	kept, _ := dedupeTargets([]target{
+		{URL: "https://example.com", Strategy: "mobile", Scope: scopePage, Labels: map[string]string{"team": "a"}},
+		{URL: "https://example.com", Strategy: "mobile", Scope: scopePage, Labels: map[string]string{"team": "b"}},
+	})
+	if team := kept[0].Labels["team"]; team != "a" {
+		t.Errorf("kept the target of team %q, want a", team)
+	}
+	// The same URL in another locale isn't a duplicate.
+	kept, dropped := dedupeTargets([]target{
+		{URL: "https://example.com", Strategy: "mobile", Scope: scopePage, Locale: "de"},
+		{URL: "https://example.com", Strategy: "mobile", Scope: scopePage, Locale: "fr"},
+		{URL: "https://example.com", Strategy: "mobile", Scope: scopePage, Locale: "de"},
+	})
+	if len(kept) != 2 || kept[0].Locale != "de" || kept[1].Locale != "fr" || len(dropped) != 1 || dropped[0].Locale != "de" {
+		t.Errorf("kept %+v and dropped %+v, want one target per locale", kept, dropped)
+	}
+}
+
+// expand returns the mobile targets of urls.
+func expand(t *testing.T, urls ...string) []target {
+	t.Helper()
+	targets, errs := expandTargets(urls, []string{"mobile"}, psi.RetryPolicy{})
+	if len(errs) > 0 {
+		t.Fatal(errs)
+	}
+	return targets
+}
+
+func TestCheckConfigVerifiesKeys(t *testing.T) {
+	var mu sync.Mutex
+	var requested []string
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.URL.Query().Get("key")
+		mu.Lock()
+		requested = append(requested, key)
+		mu.Unlock()
+		if key == "bad" || key == "revoked" {
+			http.Error(w, `{"error": {"code": 403, "message": "API key not valid"}}`, http.StatusForbidden)
+			return
+		}
+		// Accepted keys get an error about the missing url parameter.
+		http.Error(w, `{"error": {"code": 400, "message": "Missing required parameter url"}}`, http.StatusBadRequest)
+	}))
+	defer api.Close()
+	s := &settings{
+		keys:   []string{"global"},
+		apiURL: api.URL,
+		targets: []target{
+			{URL: "https://a.example", Strategy: "mobile", APIKey: "team"},
+			{URL: "https://a.example", Strategy: "desktop", APIKey: "team"},
+			{URL: "https://b.example", Strategy: "mobile", APIKey: "bad"},
+			{URL: "https://c.example", Strategy: "mobile", APIKey: "global"},
+			{URL: "https://d.example", Strategy: "mobile"},
+			{URL: "https://shop.example", Strategy: "mobile", APIKey: "shop", Labels: map[string]string{tenantLabel: "shop"}},
+		},
+		tenants: []tenant{{Name: "shop", APIKey: "shop"}, {Name: "blog", APIKey: "revoked"}, {Name: "docs"}},
+	}
+
+	var out strings.Builder
+	errs := checkConfig(&out, s, true)
+	want := []string{
+		"API key of tenant blog: rejected by the PSI API (HTTP 403)",
+		"API key of target mobile https://b.example: rejected by the PSI API (HTTP 403)",
+	}
+	if len(errs) != len(want) || errs[0].Error() != want[0] || errs[1].Error() != want[1] {
+		t.Errorf("got errors %v, want %q", errs, want)
+	}
+	for _, want := range []string{"API key 0: accepted\n", "API key of tenant shop: accepted\n", "API key of target mobile https://a.example: accepted\n"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("output %q lacks %q", out.String(), want)
+		}
+	}
+	// Every distinct key is checked once, the tenants' before the targets'.
+	if want := []string{"global", "shop", "revoked", "team", "bad"}; !slices.Equal(requested, want) {
+		t.Errorf("checked keys %q, want %q", requested, want)
+	}
+	if strings.Contains(out.String(), "team") || strings.Contains(out.String(), "bad") || strings.Contains(out.String(), "revoked") {
+		t.Errorf("output %q shows a key", out.String())
+	}
+}
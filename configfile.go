@@ -0,0 +1,526 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"maps"
+	"os"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/yahyasahaja/prometheus-exporter-pagespeed-insight/pkg/psi"
+	"github.com/yahyasahaja/prometheus-exporter-pagespeed-insight/pkg/scheduler"
+	"gopkg.in/yaml.v3"
+)
+
+// groupLabel is the label set by the group of config file targets. The
+// group label is taken by psi_mainthread_work_ms.
+const groupLabel = "target_group"
+
+// localeLabel is the label set by the locale of a target.
+const localeLabel = "locale"
+
+// labelNameRE matches valid Prometheus label names.
+var labelNameRE = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// reservedLabels are label names the exporter sets itself and which custom
+// target labels may therefore not use.
+var reservedLabels = map[string]bool{
+	"site":               true,
+	"strategy":           true,
+	"scope":              true,
+	"audit":              true,
+	"lighthouse_version": true,
+	"form_factor":        true,
+	"final_url":          true,
+	"source":             true,
+	"group":              true,
+	"metric":             true,
+	"slo":                true,
+	"window":             true,
+	"report_id":          true,
+	"tenant":             true,
+	"entity":             true,
+	"resource_type":      true,
+	"bucket":             true,
+	"category":           true,
+	"profile":            true,
+}
+
+// fileConfig is the content of the --config.file YAML file. Its settings
+// apply unless the corresponding flag is set on the command line.
+type fileConfig struct {
+	// APIKeys are used instead of --apikey.
+	APIKeys  []string     `yaml:"api_keys"`
+	Schedule fileSchedule `yaml:"schedule"`
+	// Fetch holds the defaults of the per-target fetch options.
+	Fetch   fileFetch    `yaml:"fetch"`
+	Targets []fileTarget `yaml:"targets"`
+	// Tenants are teams sharing the exporter, each with its own targets.
+	Tenants []fileTenant `yaml:"tenants"`
+	// ProbeModules are the modules selectable with /probe?module=.
+	ProbeModules map[string]fileProbeModule `yaml:"probe_modules"`
+	// SLOs apply to every target and require --history.file.
+	SLOs []fileSLO `yaml:"slos"`
+	// SiteRelabel rewrites the site label of every target.
+	SiteRelabel []fileRelabel `yaml:"site_relabel"`
+	// ScanProfiles are the kinds of scans targets may list in profiles.
+	ScanProfiles map[string]fileScanProfile `yaml:"scan_profiles"`
+}
+
+// fileSchedule mirrors --minutes, --interval, --interval-align and the
+// --schedule.* flags.
+type fileSchedule struct {
+	Minutes            []int                   `yaml:"minutes"`
+	Interval           time.Duration           `yaml:"interval"`
+	IntervalAlign      bool                    `yaml:"interval_align"`
+	Cron               string                  `yaml:"cron"`
+	Spread             string                  `yaml:"spread"`
+	Timezone           string                  `yaml:"timezone"`
+	MaintenanceWindows []fileMaintenanceWindow `yaml:"maintenance_windows"`
+}
+
+// fileMaintenanceWindow mirrors a --schedule.maintenance-window.
+type fileMaintenanceWindow struct {
+	Cron     string        `yaml:"cron"`
+	Duration time.Duration `yaml:"duration"`
+}
+
+// fileFetch mirrors the --fetch.* flags.
+type fileFetch struct {
+	Timeout        *time.Duration `yaml:"timeout"`
+	MaxRetries     *int           `yaml:"max_retries"`
+	InitialBackoff *time.Duration `yaml:"initial_backoff"`
+	MaxBackoff     *time.Duration `yaml:"max_backoff"`
+	Jitter         *float64       `yaml:"jitter"`
+	Runs           *int           `yaml:"runs"`
+}
+
+// fileTarget is a monitored URL in the config file.
+type fileTarget struct {
+	URL string `yaml:"url"`
+	// Sitemap replaces URL with the pages listed in a sitemap.
+	Sitemap *fileSitemap `yaml:"sitemap"`
+	// Scope is "page" (default) or "origin", see target.Scope.
+	Scope  string            `yaml:"scope"`
+	Labels map[string]string `yaml:"labels"`
+	// Group is exported as the target_group label, e.g. to compare own sites with
+	// competitors.
+	Group string `yaml:"group"`
+	// Strategies limits the target to some strategies, by default all.
+	Strategies []string `yaml:"strategies"`
+	// Timeout, MaxRetries and InitialBackoff override the --fetch.* flags.
+	Timeout        *time.Duration `yaml:"timeout"`
+	MaxRetries     *int           `yaml:"max_retries"`
+	InitialBackoff *time.Duration `yaml:"initial_backoff"`
+	// Runs overrides --fetch.runs.
+	Runs int `yaml:"runs"`
+	// Categories override --categories.
+	Categories []string `yaml:"categories"`
+	// Locale overrides --locale and labels the target's series.
+	Locale string `yaml:"locale"`
+	// Backends are the sources of the target's results, each a target of
+	// its own, by default PSI alone.
+	Backends []string `yaml:"backends"`
+	// QueryParams are added to the URL of every run, and CacheBust names a
+	// parameter set to a random value on every run, see target.QueryParams.
+	QueryParams map[string]string `yaml:"query_params"`
+	CacheBust   string            `yaml:"cache_bust"`
+	// APIKey bills the target's requests to its own key instead of the
+	// global keys.
+	APIKey string `yaml:"api_key"`
+	// Priority orders the target's fetches in a run, the highest first.
+	Priority int `yaml:"priority"`
+	// Cron replaces the global schedule for the target.
+	Cron string `yaml:"cron"`
+	// Baseline enables regression detection for the target.
+	Baseline *fileBaseline `yaml:"baseline"`
+	// Budgets limit metrics of the target, by metric name.
+	Budgets map[string]fileBudget `yaml:"budgets"`
+	// Profiles are the scan profiles the target is scanned with, each a
+	// target of its own, see fileScanProfile.
+	Profiles []string `yaml:"profiles"`
+}
+
+// fileBaseline is the baseline of a config file target, see baselinePolicy.
+// Runs and Margin default to --regression.baseline-runs and
+// --regression.margin.
+type fileBaseline struct {
+	Score  *float64 `yaml:"score"`
+	Runs   int      `yaml:"runs"`
+	Margin *float64 `yaml:"margin"`
+}
+
+// fileProbeModule is a named set of /probe settings.
+type fileProbeModule struct {
+	// Strategy is used when the request has no strategy, mobile by default.
+	Strategy   string         `yaml:"strategy"`
+	Categories []string       `yaml:"categories"`
+	Locale     string         `yaml:"locale"`
+	Timeout    *time.Duration `yaml:"timeout"`
+}
+
+// loadConfigFile reads and parses the YAML config file at path. Unknown keys
+// are rejected so typos don't go unnoticed.
+func loadConfigFile(path string) (*fileConfig, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading --config.file: %v", err)
+	}
+	var cfg fileConfig
+	dec := yaml.NewDecoder(bytes.NewReader(raw))
+	dec.KnownFields(true)
+	if err := dec.Decode(&cfg); err != nil {
+		return nil, fmt.Errorf("parsing --config.file %s: %v", path, err)
+	}
+	return &cfg, nil
+}
+
+// apply copies the settings of the file to c, except for those whose flag is
+// in set. A schedule given by either --minutes or --interval replaces the
+// file's schedule entirely. Minutes taken from the file are marked in set as
+// if given on the command line.
+func (f *fileConfig) apply(c *config, set map[string]bool) {
+	flagSchedule := set["minutes"] || set["interval"] || set["schedule.cron"]
+	if len(f.APIKeys) > 0 && !set["apikey"] {
+		c.apiKey = strings.Join(f.APIKeys, ",")
+	}
+	if f.Schedule.Minutes != nil && !flagSchedule {
+		minutes := make([]string, len(f.Schedule.Minutes))
+		for i, m := range f.Schedule.Minutes {
+			minutes[i] = strconv.Itoa(m)
+		}
+		c.minutes = strings.Join(minutes, ",")
+		set["minutes"] = true
+	}
+	if f.Schedule.Interval != 0 && !flagSchedule {
+		c.interval = f.Schedule.Interval
+	}
+	if f.Schedule.Cron != "" && !flagSchedule {
+		c.scheduleCron = f.Schedule.Cron
+	}
+	if f.Schedule.IntervalAlign && !set["interval-align"] {
+		c.intervalAlign = true
+	}
+	if f.Schedule.Spread != "" && !set["schedule.spread"] {
+		c.scheduleSpread = f.Schedule.Spread
+	}
+	if f.Schedule.Timezone != "" && !set["schedule.timezone"] {
+		c.scheduleTimezone = f.Schedule.Timezone
+	}
+	if len(f.Schedule.MaintenanceWindows) > 0 && !set["schedule.maintenance-window"] {
+		for _, w := range f.Schedule.MaintenanceWindows {
+			c.maintenanceWindows = append(c.maintenanceWindows, fmt.Sprintf("%s for %s", w.Cron, w.Duration))
+		}
+	}
+	if f.Fetch.Timeout != nil && !set["fetch.timeout"] {
+		c.fetchTimeout = *f.Fetch.Timeout
+	}
+	if f.Fetch.MaxRetries != nil && !set["fetch.max-retries"] {
+		c.fetchMaxRetries = *f.Fetch.MaxRetries
+	}
+	if f.Fetch.InitialBackoff != nil && !set["fetch.initial-backoff"] {
+		c.fetchInitialBackoff = *f.Fetch.InitialBackoff
+	}
+	if f.Fetch.MaxBackoff != nil && !set["fetch.max-backoff"] {
+		c.fetchMaxBackoff = *f.Fetch.MaxBackoff
+	}
+	if f.Fetch.Jitter != nil && !set["fetch.jitter"] {
+		c.fetchJitter = *f.Fetch.Jitter
+	}
+	if f.Fetch.Runs != nil && !set["fetch.runs"] {
+		c.fetchRuns = *f.Fetch.Runs
+	}
+}
+
+// expand validates the config file targets, including those of the tenants,
+// and expands each of them into one target per strategy. Fetch options a
+// target doesn't set are taken from defaults, strategies from
+// defaultStrategies, and schedules are evaluated in loc. Baselines take the
+// runs and margin they don't set from baseline. Targets with scan profiles are
+// expanded into one target per profile too. Every invalid entry is reported.
+func (c *fileConfig) expand(defaults psi.RetryPolicy, defaultStrategies []string, loc *time.Location, baseline baselinePolicy) ([]target, []error) {
+	var targets []target
+	profiles, errs := c.scanProfiles(loc)
+	for _, entry := range c.targetEntries() {
+		ft, path := entry.target, entry.path
+		urls := []string{ft.URL}
+		if ft.Sitemap != nil {
+			if ft.URL != "" {
+				errs = append(errs, fmt.Errorf("%s: url and sitemap are mutually exclusive", path))
+				continue
+			}
+			pages, err := ft.Sitemap.pages()
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %v", path, err))
+				continue
+			}
+			urls = pages
+		}
+		normalized := make([]string, 0, len(urls))
+		for _, raw := range urls {
+			u, err := normalizeTargetURL(raw)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %v", path, err))
+				continue
+			}
+			normalized = append(normalized, u)
+		}
+		scope := ft.Scope
+		switch scope {
+		case "":
+			scope = scopePage
+		case scopePage, scopeOrigin:
+		default:
+			errs = append(errs, fmt.Errorf("%s: invalid scope %q: must be page or origin", path, ft.Scope))
+			continue
+		}
+		if err := validateTargetLabels(ft.Labels); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %v", path, err))
+			continue
+		}
+		labels := ft.Labels
+		if ft.Group != "" {
+			if _, ok := labels[groupLabel]; ok {
+				errs = append(errs, fmt.Errorf("%s: group and labels.%s are mutually exclusive", path, groupLabel))
+				continue
+			}
+			labels = maps.Clone(labels)
+			if labels == nil {
+				labels = map[string]string{}
+			}
+			labels[groupLabel] = ft.Group
+		}
+		if ft.Locale != "" {
+			if err := validateLocale(ft.Locale); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %v", path, err))
+				continue
+			}
+			if _, ok := labels[localeLabel]; ok {
+				errs = append(errs, fmt.Errorf("%s: locale and labels.%s are mutually exclusive", path, localeLabel))
+				continue
+			}
+			labels = maps.Clone(labels)
+			if labels == nil {
+				labels = map[string]string{}
+			}
+			labels[localeLabel] = ft.Locale
+		}
+		if entry.tenant != "" {
+			labels = maps.Clone(labels)
+			if labels == nil {
+				labels = map[string]string{}
+			}
+			labels[tenantLabel] = entry.tenant
+		}
+		opts := defaults
+		if ft.Timeout != nil {
+			opts.Timeout = *ft.Timeout
+		}
+		if ft.MaxRetries != nil {
+			opts.MaxRetries = *ft.MaxRetries
+		}
+		if ft.InitialBackoff != nil {
+			opts.InitialBackoff = *ft.InitialBackoff
+		}
+		if err := validateRetryPolicy(opts); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %v", path, err))
+			continue
+		}
+		backends := ft.Backends
+		if len(backends) == 0 {
+			backends = []string{backendPSI}
+		}
+		if err := validateTargetBackends(backends, labels); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %v", path, err))
+			continue
+		}
+		if err := validateQueryParams(ft.QueryParams, ft.CacheBust); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %v", path, err))
+			continue
+		}
+		if ft.Runs != 0 {
+			if err := validateRuns(ft.Runs); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %v", path, err))
+				continue
+			}
+		}
+		var sched scheduler.Schedule
+		if ft.Cron != "" {
+			var err error
+			if sched, err = scheduler.NewCron(ft.Cron, loc); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %v", path, err))
+				continue
+			}
+		}
+		var policy *baselinePolicy
+		if fb := ft.Baseline; fb != nil {
+			policy = &baselinePolicy{Score: fb.Score, Runs: baseline.Runs, Margin: baseline.Margin}
+			if fb.Runs != 0 {
+				policy.Runs = fb.Runs
+			}
+			if fb.Margin != nil {
+				policy.Margin = *fb.Margin
+			}
+			if err := policy.validate(); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %v", path, err))
+				continue
+			}
+		}
+		budgets, err := parseBudgets(ft.Budgets)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %v", path, err))
+			continue
+		}
+		strats := ft.Strategies
+		if len(strats) == 0 {
+			strats = defaultStrategies
+		}
+		valid := true
+		for _, s := range strats {
+			if err := validateStrategy(s); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %v", path, err))
+				valid = false
+			}
+		}
+		for _, category := range ft.Categories {
+			if err := validateCategory(category); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %v", path, err))
+				valid = false
+			}
+		}
+		for i, name := range ft.Profiles {
+			p, ok := profiles[name]
+			if !ok {
+				if _, defined := c.ScanProfiles[name]; !defined {
+					errs = append(errs, fmt.Errorf("%s: unknown scan profile %q", path, name))
+				}
+				valid = false
+				continue
+			}
+			if slices.Contains(ft.Profiles[:i], name) {
+				errs = append(errs, fmt.Errorf("%s: duplicate scan profile %q", path, name))
+				valid = false
+				continue
+			}
+			if err := validateRetryPolicy(p.apply(target{Options: opts}, name).Options); err != nil {
+				errs = append(errs, fmt.Errorf("%s: scan profile %s: %v", path, name, err))
+				valid = false
+			}
+		}
+		if !valid {
+			continue
+		}
+		for _, u := range normalized {
+			for _, s := range strats {
+				for _, b := range backends {
+					t := target{URL: u, Strategy: s, Scope: scope, Labels: labels, Options: opts, Runs: ft.Runs, Categories: ft.Categories, Locale: ft.Locale, QueryParams: ft.QueryParams, CacheBust: ft.CacheBust, APIKey: strings.TrimSpace(ft.APIKey), Priority: ft.Priority, Schedule: sched, Baseline: policy, Budgets: budgets}
+					if b != backendPSI {
+						t.Backend = b
+					}
+					if len(ft.Profiles) == 0 {
+						targets = append(targets, t)
+					}
+					for _, name := range ft.Profiles {
+						targets = append(targets, profiles[name].apply(t, name))
+					}
+				}
+			}
+		}
+	}
+	return targets, errs
+}
+
+// validateTargetLabels checks that custom labels have valid names that don't
+// clash with the exporter's own labels.
+func validateTargetLabels(labels map[string]string) error {
+	for name := range labels {
+		if !labelNameRE.MatchString(name) {
+			return fmt.Errorf("invalid label name %q", name)
+		}
+		if reservedLabels[name] {
+			return fmt.Errorf("label name %q is reserved by the exporter", name)
+		}
+	}
+	return nil
+}
+
+// targetLabelNames returns the sorted union of the custom label names of all
+// targets and extra. It becomes the label set of every per-target metric;
+// targets missing one of the labels export it as an empty string.
+func targetLabelNames(targets []target, extra ...string) []string {
+	seen := map[string]bool{}
+	names := []string{}
+	for _, name := range extra {
+		if !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	for _, t := range targets {
+		for name := range t.Labels {
+			if !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// probeModules validates the probe modules of the config file. A module's
+// timeout overrides the one of defaults, and modules without categories or
+// locale request the given ones. Every invalid module is reported.
+func (c *fileConfig) probeModules(defaults psi.RetryPolicy, categories []string, locale string) (map[string]probeModule, []error) {
+	modules := map[string]probeModule{}
+	var errs []error
+	for _, name := range slices.Sorted(maps.Keys(c.ProbeModules)) {
+		fm := c.ProbeModules[name]
+		m := probeModule{
+			Strategy: fm.Strategy,
+			Options:  defaults,
+			Request:  psi.RequestOptions{Categories: fm.Categories, Locale: fm.Locale},
+		}
+		if m.Strategy == "" {
+			m.Strategy = "mobile"
+		}
+		if len(m.Request.Categories) == 0 {
+			m.Request.Categories = categories
+		}
+		if m.Request.Locale == "" {
+			m.Request.Locale = locale
+		}
+		if fm.Timeout != nil {
+			m.Options.Timeout = *fm.Timeout
+		}
+		var moduleErrs []error
+		if err := validateStrategy(m.Strategy); err != nil {
+			moduleErrs = append(moduleErrs, err)
+		}
+		for _, category := range fm.Categories {
+			if err := validateCategory(category); err != nil {
+				moduleErrs = append(moduleErrs, err)
+			}
+		}
+		if fm.Locale != "" {
+			if err := validateLocale(fm.Locale); err != nil {
+				moduleErrs = append(moduleErrs, err)
+			}
+		}
+		if err := validateRetryPolicy(m.Options); err != nil {
+			moduleErrs = append(moduleErrs, err)
+		}
+		for _, err := range moduleErrs {
+			errs = append(errs, fmt.Errorf("probe_modules.%s: %v", name, err))
+		}
+		if len(moduleErrs) == 0 {
+			modules[name] = m
+		}
+	}
+	return modules, errs
+}
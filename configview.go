@@ -0,0 +1,210 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"maps"
+	"net/http"
+	"net/url"
+	"slices"
+
+	"github.com/yahyasahaja/prometheus-exporter-pagespeed-insight/pkg/psi"
+)
+
+// configView is the JSON of GET /api/v1/config: the configuration the
+// exporter runs with, after the flags, the config file and the reloads were
+// applied. API keys, tokens and webhook URLs are left out.
+type configView struct {
+	Version    string `json:"version"`
+	ConfigFile string `json:"config_file,omitempty"`
+	PSIAPIURL  string `json:"psi_api_url"`
+	// APIKeys is the number of API keys, ADC the source of the Application
+	// Default Credentials, if any.
+	APIKeys     int             `json:"api_keys"`
+	ADC         string          `json:"adc,omitempty"`
+	Schedule    string          `json:"schedule,omitempty"`
+	Spread      string          `json:"schedule_spread"`
+	Overlap     string          `json:"schedule_overlap"`
+	Maintenance []string        `json:"maintenance_windows,omitempty"`
+	Strategies  []string        `json:"strategies"`
+	Categories  []string        `json:"categories"`
+	Locale      string          `json:"locale,omitempty"`
+	Runs        int             `json:"runs"`
+	Fetch       retryPolicyView `json:"fetch"`
+	// MaxConcurrency is the number of fetches at once.
+	MaxConcurrency int                        `json:"max_concurrency"`
+	LabelNames     []string                   `json:"label_names"`
+	ConstLabels    map[string]string          `json:"const_labels,omitempty"`
+	Reports        string                     `json:"reports,omitempty"`
+	ProbeModules   map[string]probeModuleView `json:"probe_modules,omitempty"`
+	SLOs           []string                   `json:"slos,omitempty"`
+	Tenants        []tenantView               `json:"tenants,omitempty"`
+	Targets        []configTarget             `json:"targets"`
+}
+
+// retryPolicyView is the JSON of a psi.RetryPolicy.
+type retryPolicyView struct {
+	Timeout        string  `json:"timeout"`
+	MaxRetries     int     `json:"max_retries"`
+	InitialBackoff string  `json:"initial_backoff"`
+	MaxBackoff     string  `json:"max_backoff,omitempty"`
+	Jitter         float64 `json:"jitter,omitempty"`
+}
+
+func newRetryPolicyView(p psi.RetryPolicy) retryPolicyView {
+	v := retryPolicyView{Timeout: p.Timeout.String(), MaxRetries: p.MaxRetries, InitialBackoff: p.InitialBackoff.String(), Jitter: p.Jitter}
+	if p.MaxBackoff > 0 {
+		v.MaxBackoff = p.MaxBackoff.String()
+	}
+	return v
+}
+
+type probeModuleView struct {
+	Strategy   string          `json:"strategy"`
+	Fetch      retryPolicyView `json:"fetch"`
+	Categories []string        `json:"categories,omitempty"`
+	Locale     string          `json:"locale,omitempty"`
+}
+
+// tenantView is a tenant, Token telling whether /metrics/<tenant> requires
+// one.
+type tenantView struct {
+	Name  string `json:"name"`
+	Token bool   `json:"token"`
+}
+
+// configTarget is a target of configView.
+type configTarget struct {
+	URL      string `json:"url"`
+	Strategy string `json:"strategy"`
+	Scope    string `json:"scope"`
+	Site     string `json:"site,omitempty"`
+	Backend  string `json:"backend"`
+	Profile  string `json:"profile,omitempty"`
+	// Schedule is the target's own schedule, empty for the global one.
+	Schedule   string          `json:"schedule,omitempty"`
+	Fetch      retryPolicyView `json:"fetch"`
+	Runs       int             `json:"runs,omitempty"`
+	Categories []string        `json:"categories,omitempty"`
+	Locale     string          `json:"locale,omitempty"`
+	Priority   int             `json:"priority,omitempty"`
+	// QueryParams are the names of the parameters added to the URL, whose
+	// values may be secret, e.g. preview tokens.
+	QueryParams []string          `json:"query_params,omitempty"`
+	CacheBust   string            `json:"cache_bust,omitempty"`
+	OwnAPIKey   bool              `json:"own_api_key,omitempty"`
+	Labels      map[string]string `json:"labels,omitempty"`
+	Budgets     []string          `json:"budgets,omitempty"`
+	Baseline    string            `json:"baseline,omitempty"`
+}
+
+func newConfigTarget(t target) configTarget {
+	ct := configTarget{
+		URL:         t.URL,
+		Strategy:    t.Strategy,
+		Scope:       t.Scope,
+		Site:        t.Site,
+		Backend:     cmp.Or(t.Backend, backendPSI),
+		Profile:     t.Profile,
+		Schedule:    scheduleName(t.Schedule),
+		Fetch:       newRetryPolicyView(t.Options),
+		Runs:        t.Runs,
+		Categories:  t.Categories,
+		Locale:      t.Locale,
+		Priority:    t.Priority,
+		QueryParams: slices.Sorted(maps.Keys(t.QueryParams)),
+		CacheBust:   t.CacheBust,
+		OwnAPIKey:   t.APIKey != "",
+		Labels:      t.Labels,
+	}
+	for _, b := range t.Budgets {
+		ct.Budgets = append(ct.Budgets, b.String())
+	}
+	if t.Baseline != nil {
+		ct.Baseline = t.Baseline.String()
+	}
+	return ct
+}
+
+// newConfigView returns the view of the startup configuration, without the
+// targets and tenants, which serveConfig adds as they are reloaded.
+func newConfigView(c *config, s *settings) configView {
+	v := configView{
+		Version:        version,
+		ConfigFile:     c.configFile,
+		PSIAPIURL:      redactEndpoint(s.apiURL),
+		APIKeys:        len(s.keys),
+		Spread:         s.spread,
+		Overlap:        c.scheduleOverlap,
+		Strategies:     s.strategies,
+		Categories:     s.categories,
+		Locale:         s.locale,
+		Runs:           s.runs,
+		Fetch:          newRetryPolicyView(s.fetchDefaults),
+		MaxConcurrency: c.maxConcurrency,
+		LabelNames:     s.labelNames,
+		ConstLabels:    s.constLabels,
+	}
+	if s.credentials != nil {
+		v.ADC = s.credentials.Source
+	}
+	if s.schedule != nil {
+		v.Schedule = s.schedule.String()
+	}
+	for _, mw := range s.maintenance {
+		v.Maintenance = append(v.Maintenance, mw.String())
+	}
+	if s.reports != nil {
+		v.Reports = s.reports.String()
+	}
+	for name, m := range s.probeModules {
+		if v.ProbeModules == nil {
+			v.ProbeModules = map[string]probeModuleView{}
+		}
+		v.ProbeModules[name] = probeModuleView{Strategy: m.Strategy, Fetch: newRetryPolicyView(m.Options), Categories: m.Request.Categories, Locale: m.Request.Locale}
+	}
+	for _, o := range s.slos {
+		v.SLOs = append(v.SLOs, o.String())
+	}
+	return v
+}
+
+// redactEndpoint returns rawURL without its credentials and the value of a
+// key parameter.
+func redactEndpoint(rawURL string) string {
+	u, err := url.Parse(psi.RedactURL(rawURL))
+	if err != nil {
+		return rawURL
+	}
+	return u.Redacted()
+}
+
+func (e *exporter) currentConfig() configView {
+	e.targetsMu.RLock()
+	defer e.targetsMu.RUnlock()
+	return e.config
+}
+
+func (e *exporter) setConfig(v configView) {
+	e.targetsMu.Lock()
+	defer e.targetsMu.Unlock()
+	e.config = v
+}
+
+// serveConfig serves GET /api/v1/config with the configuration and the
+// current targets and tenants.
+func (e *exporter) serveConfig(w http.ResponseWriter, r *http.Request) {
+	v := e.currentConfig()
+	v.Targets = []configTarget{}
+	for _, t := range e.currentTargets() {
+		v.Targets = append(v.Targets, newConfigTarget(t))
+	}
+	tenants := e.currentTenants()
+	for _, name := range slices.Sorted(maps.Keys(tenants)) {
+		v.Tenants = append(v.Tenants, tenantView{Name: name, Token: tenants[name].Token != ""})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
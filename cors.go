@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// corsMaxAge is how long browsers may cache the answer to a preflight
+// request, in seconds.
+const corsMaxAge = "600"
+
+// corsPolicy adds the CORS headers of --web.cors-origins to the JSON
+// endpoints, so browser applications on those origins can call them.
+type corsPolicy struct {
+	// origins are the allowed origins, "*" allowing any. Without origins no
+	// headers are added.
+	origins []string
+
+	mu sync.Mutex
+	// methods are the methods registered for each path, answered to the
+	// preflight requests of the path.
+	methods map[string][]string
+}
+
+// parseCORSOrigins parses the comma-separated origins of
+// --web.cors-origins, each "*" or a scheme and host without a path.
+func parseCORSOrigins(raw string) ([]string, error) {
+	var origins []string
+	for _, o := range strings.Split(raw, ",") {
+		o = strings.TrimSpace(o)
+		if o == "" {
+			continue
+		}
+		if o != "*" {
+			u, err := url.Parse(o)
+			if err != nil || u.Scheme == "" || u.Host == "" || u.Path != "" || u.RawQuery != "" || u.Fragment != "" {
+				return nil, fmt.Errorf("%q must be * or an origin like https://dashboard.example.com", o)
+			}
+		}
+		origins = append(origins, o)
+	}
+	return origins, nil
+}
+
+// allowOrigin returns the value of the Access-Control-Allow-Origin header
+// for a request from origin, empty if it isn't allowed.
+func (p *corsPolicy) allowOrigin(origin string) string {
+	switch {
+	case origin == "":
+		return ""
+	case slices.Contains(p.origins, "*"):
+		return "*"
+	case slices.Contains(p.origins, origin):
+		return origin
+	}
+	return ""
+}
+
+// handle registers h for pattern, a method and a path, with the CORS
+// headers and the preflight requests of the path answered.
+func (p *corsPolicy) handle(pattern string, h http.HandlerFunc) {
+	if len(p.origins) == 0 {
+		http.HandleFunc(pattern, h)
+		return
+	}
+	method, path, _ := strings.Cut(pattern, " ")
+	p.mu.Lock()
+	if p.methods == nil {
+		p.methods = map[string][]string{}
+	}
+	if _, ok := p.methods[path]; !ok {
+		http.HandleFunc("OPTIONS "+path, p.preflight(path))
+	}
+	p.methods[path] = append(p.methods[path], method)
+	p.mu.Unlock()
+
+	http.HandleFunc(pattern, func(w http.ResponseWriter, r *http.Request) {
+		p.setHeaders(w, r)
+		h(w, r)
+	})
+}
+
+// setHeaders sets the CORS headers of the response to r, reporting whether
+// its origin is allowed.
+func (p *corsPolicy) setHeaders(w http.ResponseWriter, r *http.Request) bool {
+	w.Header().Add("Vary", "Origin")
+	allow := p.allowOrigin(r.Header.Get("Origin"))
+	if allow == "" {
+		return false
+	}
+	w.Header().Set("Access-Control-Allow-Origin", allow)
+	return true
+}
+
+// preflight answers the preflight requests of path with its methods.
+func (p *corsPolicy) preflight(path string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if p.setHeaders(w, r) {
+			p.mu.Lock()
+			methods := strings.Join(p.methods[path], ", ")
+			p.mu.Unlock()
+			w.Header().Set("Access-Control-Allow-Methods", methods)
+			w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
+			w.Header().Set("Access-Control-Max-Age", corsMaxAge)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+
+	"github.com/yahyasahaja/prometheus-exporter-pagespeed-insight/pkg/crux"
+)
+
+// sourceCrUXHistory is the source of the history points backfilled from the
+// CrUX History API.
+const sourceCrUXHistory = "crux_history"
+
+// cruxFieldData maps the metrics of the CrUX History API to the field data
+// of a result, already in the units of the exported metrics.
+var cruxFieldData = map[string]string{
+	"first_contentful_paint":    "FIRST_CONTENTFUL_PAINT_MS",
+	"largest_contentful_paint":  "LARGEST_CONTENTFUL_PAINT_MS",
+	"cumulative_layout_shift":   "CUMULATIVE_LAYOUT_SHIFT_SCORE",
+	"interaction_to_next_paint": "INTERACTION_TO_NEXT_PAINT",
+}
+
+// cruxFormFactors maps the strategies to the form factors of CrUX.
+var cruxFormFactors = map[string]string{
+	"mobile":  "PHONE",
+	"desktop": "DESKTOP",
+}
+
+// cruxQuery returns the query of the field data of t, by URL or by origin
+// like the field data its fetches export.
+func cruxQuery(t target, periods int) crux.Query {
+	q := crux.Query{URL: t.URL, FormFactor: cruxFormFactors[t.Strategy], Periods: periods}
+	if t.Scope == scopeOrigin {
+		if u, err := url.Parse(t.URL); err == nil {
+			q = crux.Query{Origin: u.Scheme + "://" + u.Host, FormFactor: q.FormFactor, Periods: periods}
+		}
+	}
+	return q
+}
+
+// cruxPoints converts the collection periods of t into history points, each
+// at the end of the last day of its period.
+func cruxPoints(t target, periods []crux.Period) []historyPoint {
+	var points []historyPoint
+	for _, p := range periods {
+		fieldData := map[string]float64{}
+		for id, v := range p.P75 {
+			if name, ok := cruxFieldData[id]; ok {
+				fieldData[name] = v
+			}
+		}
+		if len(fieldData) == 0 {
+			continue
+		}
+		points = append(points, historyPoint{
+			Time:      p.LastDate.AddDate(0, 0, 1),
+			URL:       t.URL,
+			Strategy:  t.Strategy,
+			Profile:   t.Profile,
+			FieldData: fieldData,
+			Source:    sourceCrUXHistory,
+		})
+	}
+	return points
+}
+
+// cruxBackfill is the outcome of a backfill.
+type cruxBackfill struct {
+	// Targets is the number of targets whose field data was queried, and
+	// Points the number of points added to the history.
+	Targets int `json:"targets"`
+	Points  int `json:"points"`
+	// Errors are those of the targets whose queries failed.
+	Errors []string `json:"errors,omitempty"`
+}
+
+// backfillCrUX adds the weekly field data of the last periods of every PSI
+// target to the history, so newly added targets have their trend from the
+// start. Periods already in the history aren't added again.
+func (e *exporter) backfillCrUX(ctx context.Context) cruxBackfill {
+	var out cruxBackfill
+	for _, t := range e.currentTargets() {
+		// Other backends have no field data.
+		if t.Backend != "" {
+			continue
+		}
+		out.Targets++
+		logger := e.logger.With("site", t.URL, "strategy", t.Strategy)
+		periods, err := e.crux.History(ctx, cruxQuery(t, e.cruxPeriods))
+		if errors.Is(err, crux.ErrNotFound) {
+			logger.Debug("No CrUX history for the target")
+			continue
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				break
+			}
+			logger.Warn("Failed to query the CrUX history", "err", err)
+			out.Errors = append(out.Errors, t.URL+" ("+t.Strategy+"): "+err.Error())
+			continue
+		}
+		added, err := e.history.backfill(cruxPoints(t, periods))
+		if err != nil {
+			logger.Error("Failed to record the CrUX history", "err", err)
+			out.Errors = append(out.Errors, t.URL+" ("+t.Strategy+"): "+err.Error())
+			continue
+		}
+		out.Points += added
+		logger.Debug("Backfilled the CrUX history of a target", "periods", len(periods), "points", added)
+	}
+	e.logger.Info("Backfilled the CrUX history", "targets", out.Targets, "points", out.Points, "errors", len(out.Errors))
+	return out
+}
+
+// serveCrUXBackfill serves POST /api/v1/history/backfill, backfilling the
+// CrUX history of every target like --crux.backfill does on startup.
+func (e *exporter) serveCrUXBackfill(w http.ResponseWriter, r *http.Request) {
+	if !e.guard.authorize(w, r) {
+		return
+	}
+	out := e.backfillCrUX(r.Context())
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(out)
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+)
+
+// envPrefix is the prefix of the environment variables mirroring the flags.
+const envPrefix = "PSI_EXPORTER_"
+
+// envName returns the environment variable of the flag name, e.g.
+// PSI_EXPORTER_FETCH_MAX_RETRIES for fetch.max-retries.
+func envName(name string) string {
+	return envPrefix + strings.ToUpper(strings.NewReplacer(".", "_", "-", "_").Replace(name))
+}
+
+// applyEnv sets the flags of fs that weren't given on the command line from
+// their environment variables. They then count as set, so the flags keep
+// precedence over the environment and the environment over the config file.
+func applyEnv(fs *flag.FlagSet, lookup func(string) (string, bool)) []error {
+	set := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+	var errs []error
+	fs.VisitAll(func(f *flag.Flag) {
+		if set[f.Name] {
+			return
+		}
+		value, ok := lookup(envName(f.Name))
+		if !ok {
+			return
+		}
+		if err := fs.Set(f.Name, value); err != nil {
+			errs = append(errs, fmt.Errorf("invalid value %q for %s: %v", value, envName(f.Name), err))
+		}
+	})
+	return errs
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEnvName(t *testing.T) {
+	for name, want := range map[string]string{
+		"apikey":                    "PSI_EXPORTER_APIKEY",
+		"fetch.max-retries":         "PSI_EXPORTER_FETCH_MAX_RETRIES",
+		"web.listen-address":        "PSI_EXPORTER_WEB_LISTEN_ADDRESS",
+		"check-config.verify-key":   "PSI_EXPORTER_CHECK_CONFIG_VERIFY_KEY",
+		"execute.client-rate-limit": "PSI_EXPORTER_EXECUTE_CLIENT_RATE_LIMIT",
+	} {
+		if got := envName(name); got != want {
+			t.Errorf("envName(%q) = %q, want %q", name, got, want)
+		}
+	}
+}
+
+// parseWithEnv parses args with the exporter's flags, then applies env.
+func parseWithEnv(t *testing.T, args []string, env map[string]string) (*config, *flag.FlagSet, []error) {
+	t.Helper()
+	fs := flag.NewFlagSet("psi-exporter", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	c := registerFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	errs := applyEnv(fs, func(name string) (string, bool) {
+		v, ok := env[name]
+		return v, ok
+	})
+	return c, fs, errs
+}
+
+func TestApplyEnv(t *testing.T) {
+	c, fs, errs := parseWithEnv(t, []string{"--fetch.max-retries=3"}, map[string]string{
+		"PSI_EXPORTER_FETCH_MAX_RETRIES": "5",
+		"PSI_EXPORTER_FETCH_TIMEOUT":     "2m",
+		"PSI_EXPORTER_METRICS_PREFIX":    "",
+		"PSI_EXPORTER_DRY_RUN":           "true",
+		// Variables of no flag are ignored.
+		"PSI_EXPORTER_NO_SUCH_FLAG": "1",
+		"FETCH_TIMEOUT":             "3m",
+	})
+	if len(errs) > 0 {
+		t.Fatal(errs)
+	}
+	// The flags keep precedence over the environment.
+	if c.fetchMaxRetries != 3 {
+		t.Errorf("fetch.max-retries %d, want 3 from the flag", c.fetchMaxRetries)
+	}
+	if c.fetchTimeout != 2*time.Minute {
+		t.Errorf("fetch.timeout %s, want 2m from the environment", c.fetchTimeout)
+	}
+	if !c.dryRun {
+		t.Error("dry-run not set from the environment")
+	}
+	// An empty variable still sets its flag.
+	if f := fs.Lookup("metrics.prefix"); f.Value.String() != "" {
+		t.Errorf("metrics.prefix %q, want it empty", f.Value)
+	}
+	// The flags set from the environment count as set.
+	var set []string
+	fs.Visit(func(f *flag.Flag) { set = append(set, f.Name) })
+	if want := "dry-run fetch.max-retries fetch.timeout metrics.prefix"; strings.Join(set, " ") != want {
+		t.Errorf("set flags %q, want %q", set, want)
+	}
+
+	_, _, errs = parseWithEnv(t, nil, map[string]string{
+		"PSI_EXPORTER_FETCH_MAX_RETRIES": "many",
+		"PSI_EXPORTER_FETCH_TIMEOUT":     "2",
+	})
+	want := []string{
+		`invalid value "many" for PSI_EXPORTER_FETCH_MAX_RETRIES: parse error`,
+		`invalid value "2" for PSI_EXPORTER_FETCH_TIMEOUT: parse error`,
+	}
+	if len(errs) != len(want) {
+		t.Fatalf("got errors %v, want %q", errs, want)
+	}
+	for i, err := range errs {
+		if err.Error() != want[i] {
+			t.Errorf("got error %v, want %q", err, want[i])
+		}
+	}
+}
+
+func TestEnvPrecedence(t *testing.T) {
+	t.Setenv(apiKeyEnv, "")
+	configFile := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(configFile, []byte(`
+api_keys: [file-key]
+fetch:
+  timeout: 90s
+  max_retries: 1
+  runs: 3
+targets:
+  - url: https://example.com/
+`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	// max-retries is set by all three, timeout by the environment and the
+	// file, runs by the file only.
+	c, fs, errs := parseWithEnv(t, []string{"--config.file=" + configFile, "--fetch.max-retries=4"}, map[string]string{
+		"PSI_EXPORTER_FETCH_MAX_RETRIES": "2",
+		"PSI_EXPORTER_FETCH_TIMEOUT":     "2m",
+	})
+	if len(errs) > 0 {
+		t.Fatal(errs)
+	}
+	s, errs := c.resolve(fs)
+	if len(errs) > 0 {
+		t.Fatal(errs)
+	}
+	if got := s.fetchDefaults.MaxRetries; got != 4 {
+		t.Errorf("max retries %d, want 4 from the flag", got)
+	}
+	if got := s.fetchDefaults.Timeout; got != 2*time.Minute {
+		t.Errorf("timeout %s, want 2m from the environment", got)
+	}
+	if s.runs != 3 {
+		t.Errorf("runs %d, want 3 from the file", s.runs)
+	}
+	if len(s.keys) != 1 || s.keys[0] != "file-key" {
+		t.Errorf("got keys %q, want the key of the file", s.keys)
+	}
+
+	// The API key of the environment overrides the file's.
+	c, fs, errs = parseWithEnv(t, []string{"--config.file=" + configFile}, map[string]string{"PSI_EXPORTER_APIKEY": "env-key"})
+	if len(errs) > 0 {
+		t.Fatal(errs)
+	}
+	if s, errs = c.resolve(fs); len(errs) > 0 {
+		t.Fatal(errs)
+	}
+	if len(s.keys) != 1 || s.keys[0] != "env-key" {
+		t.Errorf("got keys %q, want the key of the environment", s.keys)
+	}
+}
@@ -0,0 +1,347 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+)
+
+// maxExecuteBodyBytes limits the size of a POST /execute request body.
+const maxExecuteBodyBytes = 1 << 20
+
+// errQueueFull is returned when the worker pool has no room for a job.
+var errQueueFull = errors.New("fetch queue is full, try again later")
+
+// parseExecuteTarget validates the URL, strategy and scope of a manual fetch
+// request and normalizes the URL. An empty scope defaults to page.
+func parseExecuteTarget(rawURL, strategy, scope string) (target, error) {
+	if scope == "" {
+		scope = scopePage
+	}
+	if rawURL == "" || strategy == "" {
+		return target{}, errors.New("Missing URL or strategy")
+	}
+	rawURL, err := normalizeTargetURL(rawURL)
+	if err != nil {
+		return target{}, err
+	}
+	if err := validateStrategy(strategy); err != nil {
+		return target{}, err
+	}
+	if scope != scopePage && scope != scopeOrigin {
+		return target{}, fmt.Errorf("invalid scope %q: must be page or origin", scope)
+	}
+	return target{URL: rawURL, Strategy: strategy, Scope: scope}, nil
+}
+
+// executeLabelPrefix prefixes the query parameters setting the labels of a
+// manual fetch, e.g. label_deploy_sha=abc123.
+const executeLabelPrefix = "label_"
+
+// parseExecuteLabelNames parses the comma-separated label names of
+// --execute.labels.
+func parseExecuteLabelNames(raw string) ([]string, error) {
+	var names []string
+	for _, name := range strings.Split(raw, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if err := validateTargetLabels(map[string]string{name: ""}); err != nil {
+			return nil, err
+		}
+		if !slices.Contains(names, name) {
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
+
+// parseExecuteLabels returns the labels set by the label_<name> parameters
+// of q, which must be allowed by --execute.labels.
+func (e *exporter) parseExecuteLabels(q url.Values) (map[string]string, error) {
+	var labels map[string]string
+	for param, values := range q {
+		name, ok := strings.CutPrefix(param, executeLabelPrefix)
+		if !ok {
+			continue
+		}
+		if !slices.Contains(e.executeLabels, name) {
+			return nil, fmt.Errorf("label %q is not allowed, see --execute.labels", name)
+		}
+		if len(values) > 1 {
+			return nil, fmt.Errorf("label %q is set more than once", name)
+		}
+		if labels == nil {
+			labels = map[string]string{}
+		}
+		labels[name] = values[0]
+	}
+	return labels, nil
+}
+
+// enqueue answers t from the result cache when possible, and otherwise queues
+// a fetch job for it on the worker pool.
+func (e *exporter) enqueue(t target, refresh bool) (*job, error) {
+	t = e.monitoredTarget(t)
+	if e.cache != nil && !refresh {
+		if result, fetchedAt, ok := e.cache.get(t); ok {
+			e.metrics.cacheHits.Inc()
+			return e.jobs.createCached(t, result, fetchedAt), nil
+		}
+	}
+	e.metrics.cacheMisses.Inc()
+
+	j := e.jobs.create(t)
+	if !e.pool.trySubmit(func() { e.runJob(j) }) {
+		e.logger.Warn("Rejected /execute request, fetch queue is full", "site", t.URL, "strategy", t.Strategy)
+		e.jobs.finish(j.ID, nil, errQueueFull)
+		return nil, errQueueFull
+	}
+	return j, nil
+}
+
+// monitoredTarget returns the configured target of the URL, strategy and
+// scope of the manual fetch t, with the labels of t added, so the fetch
+// updates the target's series with its site, labels and options. Other URLs
+// are fetched with the default options.
+func (e *exporter) monitoredTarget(t target) target {
+	for _, monitored := range e.currentTargets() {
+		if monitored.key() != t.key() {
+			continue
+		}
+		if len(t.Labels) > 0 {
+			labels := maps.Clone(monitored.Labels)
+			if labels == nil {
+				labels = map[string]string{}
+			}
+			maps.Copy(labels, t.Labels)
+			monitored.Labels = labels
+		}
+		return monitored
+	}
+	t.Options = e.fetchDefaults
+	return t
+}
+
+// executePSI enqueues a PSI fetch for a given URL and strategy and returns the
+// job ID. With ?wait=true it blocks until the job completes instead. A fresh
+// cached result is returned right away unless ?refresh=true is passed.
+func (e *exporter) executePSI(w http.ResponseWriter, r *http.Request) {
+	if !e.guard.authorize(w, r) {
+		return
+	}
+	query := r.URL.Query()
+	t, err := parseExecuteTarget(query.Get("url"), query.Get("strategy"), query.Get("scope"))
+	if err == nil {
+		t.Labels, err = e.parseExecuteLabels(query)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := e.guard.allowURL(t.URL); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	j, err := e.enqueue(t, query.Get("refresh") == "true")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	status := http.StatusAccepted
+	if query.Get("wait") == "true" || !j.cachedAt.IsZero() {
+		select {
+		case <-j.done:
+			status = http.StatusOK
+		case <-r.Context().Done():
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", "/jobs/"+j.ID)
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(e.jobs.snapshot(j.ID))
+}
+
+// runRequest is the body of POST /api/v1/runs.
+type runRequest struct {
+	URL      string `json:"url"`
+	Strategy string `json:"strategy"`
+	Scope    string `json:"scope"`
+	// Refresh bypasses the result cache.
+	Refresh bool `json:"refresh"`
+}
+
+// createRun handles POST /api/v1/runs, enqueueing a fetch of the target in
+// the JSON body and answering 202 Accepted with the job right away, for
+// clients that poll GET /api/v1/runs/{id} rather than hold a connection
+// open for the whole fetch. A fresh cached result is answered with 200 OK.
+func (e *exporter) createRun(w http.ResponseWriter, r *http.Request) {
+	if !e.guard.authorize(w, r) {
+		return
+	}
+	var req runRequest
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxExecuteBodyBytes))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid request body: %v", err), http.StatusBadRequest)
+		return
+	}
+	t, err := parseExecuteTarget(req.URL, req.Strategy, req.Scope)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := e.guard.allowURL(t.URL); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	j, err := e.enqueue(t, req.Refresh)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	status := http.StatusAccepted
+	if !j.cachedAt.IsZero() {
+		status = http.StatusOK
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", "/api/v1/runs/"+j.ID)
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(e.jobs.snapshot(j.ID))
+}
+
+// executeRequest is the body of POST /execute.
+type executeRequest struct {
+	Targets []struct {
+		URL string `json:"url"`
+		// Strategy defaults to every strategy when empty.
+		Strategy string `json:"strategy"`
+		Scope    string `json:"scope"`
+	} `json:"targets"`
+}
+
+// executeItem is the outcome of one target of a POST /execute request.
+type executeItem struct {
+	URL      string   `json:"url"`
+	Strategy string   `json:"strategy,omitempty"`
+	Status   int      `json:"status"`
+	Job      *jobView `json:"job,omitempty"`
+	Error    string   `json:"error,omitempty"`
+}
+
+// executeBatch handles POST /execute, enqueueing a fetch for each target in
+// the JSON body. Every target is reported individually, so one invalid entry
+// doesn't fail the whole request; mixed outcomes are answered with 207
+// Multi-Status.
+func (e *exporter) executeBatch(w http.ResponseWriter, r *http.Request) {
+	if !e.guard.authorize(w, r) {
+		return
+	}
+	var req executeRequest
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxExecuteBodyBytes))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid request body: %v", err), http.StatusBadRequest)
+		return
+	}
+	if len(req.Targets) == 0 {
+		http.Error(w, "Request body lists no targets", http.StatusBadRequest)
+		return
+	}
+	// The labels of the query string apply to every target of the batch.
+	labels, err := e.parseExecuteLabels(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var items []executeItem
+	var jobs []*job
+	for _, rt := range req.Targets {
+		strats := []string{rt.Strategy}
+		if rt.Strategy == "" {
+			strats = e.strategies
+		}
+		for _, strategy := range strats {
+			items = append(items, executeItem{URL: rt.URL, Strategy: strategy})
+		}
+	}
+	if len(items) > e.maxExecuteTargets {
+		http.Error(w, fmt.Sprintf("Too many targets: %d URL/strategy pairs requested, at most %d allowed", len(items), e.maxExecuteTargets), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	refresh := r.URL.Query().Get("refresh") == "true"
+	i := 0
+	for _, rt := range req.Targets {
+		n := 1
+		if rt.Strategy == "" {
+			n = len(e.strategies)
+		}
+		for ; n > 0; n, i = n-1, i+1 {
+			item := &items[i]
+			t, err := parseExecuteTarget(item.URL, item.Strategy, rt.Scope)
+			if err != nil {
+				item.Status, item.Error = http.StatusBadRequest, err.Error()
+				jobs = append(jobs, nil)
+				continue
+			}
+			t.Labels = labels
+			if err := e.guard.allowURL(t.URL); err != nil {
+				item.Status, item.Error = http.StatusForbidden, err.Error()
+				jobs = append(jobs, nil)
+				continue
+			}
+			j, err := e.enqueue(t, refresh)
+			if err != nil {
+				item.Status, item.Error = http.StatusServiceUnavailable, err.Error()
+				jobs = append(jobs, nil)
+				continue
+			}
+			jobs = append(jobs, j)
+		}
+	}
+
+	wait := r.URL.Query().Get("wait") == "true"
+	for i, j := range jobs {
+		if j == nil {
+			continue
+		}
+		items[i].Status = http.StatusAccepted
+		if wait || !j.cachedAt.IsZero() {
+			select {
+			case <-j.done:
+				items[i].Status = http.StatusOK
+			case <-r.Context().Done():
+				return
+			}
+		}
+		view := e.jobs.snapshot(j.ID)
+		if view.Status == jobFailed {
+			items[i].Status, items[i].Error = http.StatusBadGateway, view.Error
+		}
+		items[i].Job = &view
+	}
+
+	status := items[0].Status
+	for _, item := range items[1:] {
+		if item.Status != status {
+			status = http.StatusMultiStatus
+			break
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(items)
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestExecuteBatch(t *testing.T) {
+	// targetsBody returns a body listing n URLs without a strategy.
+	targetsBody := func(n int) string {
+		var targets []string
+		for i := range n {
+			targets = append(targets, fmt.Sprintf(`{"url": "https://example.com/%d"}`, i))
+		}
+		return `{"targets": [` + strings.Join(targets, ", ") + `]}`
+	}
+	tests := []struct {
+		name, query, body string
+		// allowedHosts is the allowlist of the guard.
+		allowedHosts []string
+		queueFull    bool
+		status       int
+		// items are the URL, strategy and status of the items answered, in
+		// order, and errBody a part of the body of a request failing as a
+		// whole.
+		items   []string
+		errBody string
+	}{
+		{
+			name:   "every strategy",
+			query:  "?wait=true",
+			body:   `{"targets": [{"url": "https://example.com/"}]}`,
+			status: http.StatusOK,
+			items:  []string{"https://example.com/ mobile 200", "https://example.com/ desktop 200"},
+		},
+		{
+			name:   "accepted",
+			body:   `{"targets": [{"url": "https://example.com/", "strategy": "mobile"}, {"url": "https://example.com/", "strategy": "desktop", "scope": "origin"}]}`,
+			status: http.StatusAccepted,
+			items:  []string{"https://example.com/ mobile 202", "https://example.com/ desktop 202"},
+		},
+		{
+			name:   "invalid entries",
+			query:  "?wait=true",
+			body:   `{"targets": [{"url": "example.com", "strategy": "mobile"}, {"url": "https://example.com/", "strategy": "tablet"}, {"url": "https://example.com/", "strategy": "mobile", "scope": "domain"}, {"url": "https://example.com/", "strategy": "mobile"}]}`,
+			status: http.StatusMultiStatus,
+			items:  []string{"example.com mobile 400", "https://example.com/ tablet 400", "https://example.com/ mobile 400", "https://example.com/ mobile 200"},
+		},
+		{
+			name:   "only invalid entries",
+			body:   `{"targets": [{"url": "", "strategy": "mobile"}, {"url": "ftp://example.com/"}]}`,
+			status: http.StatusBadRequest,
+			items:  []string{" mobile 400", "ftp://example.com/ mobile 400", "ftp://example.com/ desktop 400"},
+		},
+		{
+			name:         "URLs not allowed",
+			query:        "?wait=true",
+			body:         `{"targets": [{"url": "https://evil-example.com/", "strategy": "mobile"}, {"url": "https://www.example.com/", "strategy": "mobile"}]}`,
+			allowedHosts: []string{"example.com"},
+			status:       http.StatusMultiStatus,
+			items:        []string{"https://evil-example.com/ mobile 403", "https://www.example.com/ mobile 200"},
+		},
+		{
+			name:      "queue full",
+			body:      `{"targets": [{"url": "https://example.com/"}]}`,
+			queueFull: true,
+			status:    http.StatusServiceUnavailable,
+			items:     []string{"https://example.com/ mobile 503", "https://example.com/ desktop 503"},
+		},
+		{
+			name:   "failed fetches",
+			query:  "?wait=true",
+			body:   `{"targets": [{"url": "https://example.com/down", "strategy": "mobile"}, {"url": "https://example.com/", "strategy": "mobile"}, {"url": "example.com", "strategy": "mobile"}]}`,
+			status: http.StatusMultiStatus,
+			items:  []string{"https://example.com/down mobile 502", "https://example.com/ mobile 200", "example.com mobile 400"},
+		},
+		{
+			name:   "as many targets as allowed",
+			body:   targetsBody(5),
+			status: http.StatusAccepted,
+			items: []string{
+				"https://example.com/0 mobile 202", "https://example.com/0 desktop 202",
+				"https://example.com/1 mobile 202", "https://example.com/1 desktop 202",
+				"https://example.com/2 mobile 202", "https://example.com/2 desktop 202",
+				"https://example.com/3 mobile 202", "https://example.com/3 desktop 202",
+				"https://example.com/4 mobile 202", "https://example.com/4 desktop 202",
+			},
+		},
+		{
+			name:    "too many targets",
+			body:    targetsBody(6),
+			status:  http.StatusRequestEntityTooLarge,
+			errBody: "Too many targets: 12 URL/strategy pairs requested, at most 10 allowed",
+		},
+		{name: "no targets", body: `{"targets": []}`, status: http.StatusBadRequest, errBody: "Request body lists no targets"},
+		{name: "unknown field", body: `{"targets": [{"url": "https://example.com/", "device": "mobile"}]}`, status: http.StatusBadRequest, errBody: `unknown field "device"`},
+		{name: "label not allowed", query: "?label_team=web", body: `{"targets": [{"url": "https://example.com/"}]}`, status: http.StatusBadRequest, errBody: `label "team" is not allowed`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newTestExporter(t, func(w http.ResponseWriter, r *http.Request) {
+				if strings.HasSuffix(r.URL.Query().Get("url"), "/down") {
+					http.Error(w, `{"error": {"code": 500, "message": "Lighthouse returned error: Something went wrong."}}`, http.StatusInternalServerError)
+					return
+				}
+				answerRun(w, r)
+			})
+			e.guard.hosts = tt.allowedHosts
+			if tt.queueFull {
+				e.pool = &workerPool{queue: make(chan func())}
+			}
+			rec := serve(e.executeBatch, http.MethodPost, "/execute"+tt.query, tt.body)
+			if rec.Code != tt.status {
+				t.Errorf("status %d, want %d", rec.Code, tt.status)
+			}
+			if tt.errBody != "" {
+				if !strings.Contains(rec.Body.String(), tt.errBody) {
+					t.Errorf("body %q lacks %q", rec.Body, tt.errBody)
+				}
+				return
+			}
+			var items []executeItem
+			decode(t, rec, &items)
+			var got []string
+			for _, item := range items {
+				got = append(got, fmt.Sprintf("%s %s %d", item.URL, item.Strategy, item.Status))
+				// Failed fetches have both a job and an error.
+				if (item.Error != "") != (item.Status >= 400) {
+					t.Errorf("item %+v has error %q", item, item.Error)
+				}
+				if (item.Job != nil) != (item.Status < 400 || item.Status == http.StatusBadGateway) {
+					t.Errorf("item %+v has job %v", item, item.Job)
+				}
+			}
+			if !slices.Equal(got, tt.items) {
+				t.Errorf("got items %q, want %q", got, tt.items)
+			}
+		})
+	}
+}
@@ -0,0 +1,39 @@
+package main
+
+// gapMetrics are the lab metrics compared between the strategies by
+// psi_strategy_metric_gap, by audit and value of the metric label.
+var gapMetrics = []struct{ audit, name string }{
+	{"largest-contentful-paint", "largest_contentful_paint"},
+	{"total-blocking-time", "total_blocking_time"},
+}
+
+// updateStrategyGaps exports the differences between the latest desktop and
+// mobile results of every site fetched with both strategies. The gaps of
+// sites without a successful result of either strategy are removed.
+func (e *exporter) updateStrategyGaps() {
+	states := map[string]targetState{}
+	for _, st := range e.status.list() {
+		id := target{URL: st.URL, Strategy: st.Strategy, Scope: st.Scope, Backend: st.Backend, Profile: st.Profile}
+		states[id.key()] = st
+	}
+	e.metrics.strategyScoreGap.Reset()
+	e.metrics.strategyMetricGap.Reset()
+	for _, t := range e.currentTargets() {
+		if t.Strategy != "mobile" {
+			continue
+		}
+		desktop := t
+		desktop.Strategy = "desktop"
+		m, d := states[t.key()], states[desktop.key()]
+		if m.PerformanceScore != nil && d.PerformanceScore != nil {
+			e.metrics.strategyScoreGap.WithLabelValues(e.metrics.siteValues(t)...).Set(*d.PerformanceScore - *m.PerformanceScore)
+		}
+		for _, g := range gapMetrics {
+			mv, ok := m.Metrics[g.audit]
+			dv, dok := d.Metrics[g.audit]
+			if ok && dok {
+				e.metrics.strategyMetricGap.WithLabelValues(e.metrics.siteValues(t, g.name)...).Set(dv - mv)
+			}
+		}
+	}
+}
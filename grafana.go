@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// grafanaPanel describes a time series panel of the dashboard.
+type grafanaPanel struct {
+	title string
+	// metric is the metric name without the namespace.
+	metric string
+	unit   string
+	// extra selects the series of metrics with more labels than the site
+	// and strategy.
+	extra string
+	// thresholds are the upper bounds of the green and yellow ranges, or
+	// the lower bounds with ascending.
+	thresholds [2]float64
+	ascending  bool
+}
+
+// grafanaPanels are the panels of the dashboard, two per row.
+var grafanaPanels = []grafanaPanel{
+	{title: "Performance score", metric: "performance_score", unit: "percentunit", thresholds: [2]float64{0.5, 0.9}, ascending: true},
+	{title: "Fetch success", metric: "scrape_success", unit: "bool"},
+	{title: "Largest Contentful Paint (lab)", metric: "largest_contentful_paint", unit: "ms", thresholds: [2]float64{2500, 4000}},
+	{title: "Largest Contentful Paint (field p75)", metric: "field_largest_contentful_paint", unit: "ms", thresholds: [2]float64{2500, 4000}},
+	{title: "Cumulative Layout Shift (lab)", metric: "cumulative_layout_shift", unit: "none", thresholds: [2]float64{0.1, 0.25}},
+	{title: "Cumulative Layout Shift (field p75)", metric: "field_cumulative_layout_shift", unit: "none", thresholds: [2]float64{0.1, 0.25}},
+	{title: "Total Blocking Time (lab)", metric: "total_blocking_time", unit: "ms", thresholds: [2]float64{200, 600}},
+	{title: "Interaction to Next Paint (field p75)", metric: "interaction_to_next_paint", unit: "ms", extra: `source="field"`, thresholds: [2]float64{200, 500}},
+	{title: "First Contentful Paint (lab)", metric: "first_contentful_paint", unit: "ms", thresholds: [2]float64{1800, 3000}},
+	{title: "Speed Index (lab)", metric: "speed_index", unit: "ms", thresholds: [2]float64{3400, 5800}},
+}
+
+// grafanaDashboard returns a Grafana dashboard of the exporter's metrics named
+// with namespace, with a site variable listing sites and a strategy variable.
+func grafanaDashboard(namespace string, sites []string) map[string]any {
+	var panels []map[string]any
+	for i, p := range grafanaPanels {
+		// Sites are regex-escaped, as URLs contain dots and question marks.
+		selector := `site=~"${site:regex}",strategy=~"$strategy"`
+		if p.extra != "" {
+			selector += "," + p.extra
+		}
+		field := map[string]any{"unit": p.unit}
+		if p.thresholds != [2]float64{} {
+			colors := []string{"green", "yellow", "red"}
+			if p.ascending {
+				colors = []string{"red", "yellow", "green"}
+			}
+			field["thresholds"] = map[string]any{
+				"mode": "absolute",
+				"steps": []map[string]any{
+					{"color": colors[0], "value": nil},
+					{"color": colors[1], "value": p.thresholds[0]},
+					{"color": colors[2], "value": p.thresholds[1]},
+				},
+			}
+			field["custom"] = map[string]any{"thresholdsStyle": map[string]any{"mode": "line"}}
+		}
+		panels = append(panels, map[string]any{
+			"id":         i + 1,
+			"type":       "timeseries",
+			"title":      p.title,
+			"datasource": map[string]any{"type": "prometheus", "uid": "${datasource}"},
+			"gridPos":    map[string]any{"h": 8, "w": 12, "x": (i % 2) * 12, "y": (i / 2) * 8},
+			"fieldConfig": map[string]any{
+				"defaults":  field,
+				"overrides": []any{},
+			},
+			"targets": []map[string]any{{
+				"refId":        "A",
+				"expr":         fmt.Sprintf("%s{%s}", prometheus.BuildFQName(namespace, "", p.metric), selector),
+				"legendFormat": "{{site}} {{strategy}}",
+			}},
+		})
+	}
+
+	options := []map[string]any{{"text": "All", "value": "$__all", "selected": true}}
+	values := make([]string, len(sites))
+	for i, s := range sites {
+		options = append(options, map[string]any{"text": s, "value": s, "selected": false})
+		// Custom variables separate their values with commas.
+		values[i] = strings.ReplaceAll(s, ",", `\,`)
+	}
+	return map[string]any{
+		"title":         "PageSpeed Insights",
+		"uid":           namespace + "-pagespeed-insights",
+		"tags":          []string{"pagespeed", "web-vitals"},
+		"schemaVersion": 39,
+		"editable":      true,
+		"time":          map[string]any{"from": "now-7d", "to": "now"},
+		"refresh":       "30m",
+		"panels":        panels,
+		"templating": map[string]any{"list": []map[string]any{
+			{
+				"name":  "datasource",
+				"label": "Data source",
+				"type":  "datasource",
+				"query": "prometheus",
+			},
+			{
+				"name":       "site",
+				"label":      "Site",
+				"type":       "custom",
+				"query":      strings.Join(values, ","),
+				"options":    options,
+				"current":    map[string]any{"text": "All", "value": "$__all"},
+				"includeAll": true,
+				"allValue":   ".*",
+				"multi":      true,
+			},
+			{
+				"name":       "strategy",
+				"label":      "Strategy",
+				"type":       "custom",
+				"query":      strings.Join(strategies, ","),
+				"current":    map[string]any{"text": "All", "value": "$__all"},
+				"includeAll": true,
+				"allValue":   ".*",
+				"multi":      true,
+			},
+		}},
+	}
+}
+
+// grafanaDashboardJSON serves /grafana/dashboard.json, a dashboard of the
+// metrics of the current targets ready to import into Grafana.
+func (e *exporter) grafanaDashboardJSON(w http.ResponseWriter, r *http.Request) {
+	var sites []string
+	for _, t := range e.currentTargets() {
+		if !slices.Contains(sites, t.site()) {
+			sites = append(sites, t.site())
+		}
+	}
+	slices.Sort(sites)
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(grafanaDashboard(e.namespace, sites))
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// maxGuardClients bounds the rate limit state kept per client; idle clients
+// are dropped beyond it.
+const maxGuardClients = 1024
+
+// errURLNotAllowed is returned for manual fetches of URLs outside the
+// allowlist of --execute.allowed-hosts and --execute.targets-only.
+var errURLNotAllowed = errors.New("URL is not allowed for manual fetches")
+
+// executeGuard protects the endpoints fetching URLs on demand, /execute,
+// /api/v1/runs and /probe, so reaching the exporter isn't enough to spend
+// its quota. The zero value lets every request through.
+type executeGuard struct {
+	// token is the bearer token requests must carry, empty for none.
+	token string
+	// hosts are the allowed hosts, which allow their subdomains too.
+	hosts []string
+	// targets returns the configured targets, whose URLs are allowed
+	// when set.
+	targets func() []target
+	// perMinute is the number of requests a client may make per minute, 0
+	// for no limit.
+	perMinute float64
+	rejected  *prometheus.CounterVec
+
+	mu      sync.Mutex
+	clients map[string]*clientBucket
+}
+
+// clientBucket is the token bucket of a client, in requests.
+type clientBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// parseAllowedHosts parses the comma-separated hosts of
+// --execute.allowed-hosts.
+func parseAllowedHosts(raw string) ([]string, error) {
+	var hosts []string
+	for _, h := range strings.Split(raw, ",") {
+		h = strings.ToLower(strings.TrimSpace(h))
+		if h == "" {
+			continue
+		}
+		if strings.ContainsAny(h, "/:*") {
+			return nil, fmt.Errorf("%q must be a host name like example.com, without scheme, port or wildcard", h)
+		}
+		hosts = append(hosts, h)
+	}
+	return hosts, nil
+}
+
+// authorize reports whether the request carries the token and is within its
+// client's rate limit, answering 401 or 429 otherwise.
+func (g *executeGuard) authorize(w http.ResponseWriter, r *http.Request) bool {
+	if g.token != "" {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(g.token)) != 1 {
+			g.reject("unauthorized")
+			w.Header().Set("WWW-Authenticate", `Bearer realm="psi-exporter"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return false
+		}
+	}
+	return g.limit(w, r)
+}
+
+// limit reports whether the request is within its client's rate limit,
+// answering 429 otherwise.
+func (g *executeGuard) limit(w http.ResponseWriter, r *http.Request) bool {
+	if wait := g.take(clientAddr(r)); wait > 0 {
+		g.reject("rate_limited")
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		http.Error(w, "Too many requests, try again later", http.StatusTooManyRequests)
+		return false
+	}
+	return true
+}
+
+// allowURL returns errURLNotAllowed unless the allowlist is empty, u's host
+// is one of the allowed hosts or a subdomain of one, or u is the URL of a
+// configured target.
+func (g *executeGuard) allowURL(u string) error {
+	if len(g.hosts) == 0 && g.targets == nil {
+		return nil
+	}
+	if parsed, err := url.Parse(u); err == nil {
+		host := strings.ToLower(parsed.Hostname())
+		if slices.ContainsFunc(g.hosts, func(h string) bool { return host == h || strings.HasSuffix(host, "."+h) }) {
+			return nil
+		}
+	}
+	if g.targets != nil && slices.ContainsFunc(g.targets(), func(t target) bool { return t.URL == u }) {
+		return nil
+	}
+	g.reject("url_not_allowed")
+	return errURLNotAllowed
+}
+
+func (g *executeGuard) reject(reason string) {
+	if g.rejected != nil {
+		g.rejected.WithLabelValues(reason).Inc()
+	}
+}
+
+// take takes a request from the bucket of client, which holds a minute of
+// requests, and returns how long the client has to wait when it's empty.
+func (g *executeGuard) take(client string) time.Duration {
+	if g.perMinute <= 0 {
+		return 0
+	}
+	interval := time.Duration(float64(time.Minute) / g.perMinute)
+	burst := max(1, math.Floor(g.perMinute))
+	now := time.Now()
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.clients == nil {
+		g.clients = map[string]*clientBucket{}
+	}
+	b, ok := g.clients[client]
+	if !ok {
+		if len(g.clients) >= maxGuardClients {
+			g.dropIdle(now, interval, burst)
+		}
+		b = &clientBucket{tokens: burst, last: now}
+		g.clients[client] = b
+	}
+	b.tokens = min(burst, b.tokens+float64(now.Sub(b.last))/float64(interval))
+	b.last = now
+	if b.tokens < 1 {
+		return time.Duration((1 - b.tokens) * float64(interval))
+	}
+	b.tokens--
+	return 0
+}
+
+// dropIdle removes the buckets that have refilled completely, which are
+// no different from new ones.
+func (g *executeGuard) dropIdle(now time.Time, interval time.Duration, burst float64) {
+	for client, b := range g.clients {
+		if b.tokens+float64(now.Sub(b.last))/float64(interval) >= burst {
+			delete(g.clients, client)
+		}
+	}
+}
+
+// clientAddr returns the IP address of the client of r. Behind a reverse
+// proxy all requests share the proxy's address.
+func clientAddr(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// guardedExecute returns the response of e to GET /execute of u from the
+// client at addr, with the Authorization header auth unless empty.
+func guardedExecute(e *exporter, u, addr, auth string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodGet, "/execute?strategy=mobile&url="+url.QueryEscape(u), nil)
+	r.RemoteAddr = addr
+	if auth != "" {
+		r.Header.Set("Authorization", auth)
+	}
+	rec := httptest.NewRecorder()
+	e.executePSI(rec, r)
+	return rec
+}
+
+func TestExecuteGuard(t *testing.T) {
+	tests := []struct {
+		name, token string
+		hosts       []string
+		// targetsOnly allows the URLs of the configured targets.
+		targetsOnly bool
+		url, auth   string
+		status      int
+		reason      string
+	}{
+		{name: "open", url: "https://example.com/", status: http.StatusAccepted},
+		{name: "token", token: "s3cret", url: "https://example.com/", auth: "Bearer s3cret", status: http.StatusAccepted},
+		{name: "missing token", token: "s3cret", url: "https://example.com/", status: http.StatusUnauthorized, reason: "unauthorized"},
+		{name: "wrong token", token: "s3cret", url: "https://example.com/", auth: "Bearer s3cre", status: http.StatusUnauthorized, reason: "unauthorized"},
+		{name: "token of another scheme", token: "s3cret", url: "https://example.com/", auth: "Basic s3cret", status: http.StatusUnauthorized, reason: "unauthorized"},
+
+		{name: "allowed host", hosts: []string{"example.com"}, url: "https://Example.com/shop", status: http.StatusAccepted},
+		{name: "allowed subdomain", hosts: []string{"example.com"}, url: "https://www.example.com/", status: http.StatusAccepted},
+		{name: "allowed host with a port", hosts: []string{"example.com"}, url: "https://example.com:8443/", status: http.StatusAccepted},
+		{name: "host ending like an allowed one", hosts: []string{"example.com"}, url: "https://evil-example.com/", status: http.StatusForbidden, reason: "url_not_allowed"},
+		{name: "allowed host as a subdomain", hosts: []string{"example.com"}, url: "https://example.com.evil.example/", status: http.StatusForbidden, reason: "url_not_allowed"},
+		{name: "allowed host in the path", hosts: []string{"example.com"}, url: "https://evil.example/example.com", status: http.StatusForbidden, reason: "url_not_allowed"},
+
+		{name: "monitored URL", targetsOnly: true, url: "https://example.com/", status: http.StatusAccepted},
+		{name: "monitored URL spelled otherwise", targetsOnly: true, url: "HTTPS://EXAMPLE.COM:443", status: http.StatusAccepted},
+		{name: "unmonitored URL", targetsOnly: true, url: "https://example.com/other", status: http.StatusForbidden, reason: "url_not_allowed"},
+		{name: "unmonitored URL of an allowed host", hosts: []string{"example.com"}, targetsOnly: true, url: "https://example.com/other", status: http.StatusAccepted},
+
+		// The token is checked before the URL.
+		{name: "missing token for a URL not allowed", token: "s3cret", hosts: []string{"example.com"}, url: "https://evil.example/", status: http.StatusUnauthorized, reason: "unauthorized"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newTestExporter(t, answerRun)
+			e.targets = []target{{URL: "https://example.com", Strategy: "mobile", Scope: scopePage}}
+			e.guard = &executeGuard{token: tt.token, hosts: tt.hosts, rejected: e.metrics.executeRejected}
+			if tt.targetsOnly {
+				e.guard.targets = e.currentTargets
+			}
+			rec := guardedExecute(e, tt.url, "192.0.2.1:1234", tt.auth)
+			if rec.Code != tt.status {
+				t.Errorf("status %d %q, want %d", rec.Code, rec.Body, tt.status)
+			}
+			if want := `Bearer realm="psi-exporter"`; tt.status == http.StatusUnauthorized && rec.Header().Get("WWW-Authenticate") != want {
+				t.Errorf("WWW-Authenticate %q, want %q", rec.Header().Get("WWW-Authenticate"), want)
+			}
+			if tt.status == http.StatusForbidden && !strings.Contains(rec.Body.String(), errURLNotAllowed.Error()) {
+				t.Errorf("body %q lacks %q", rec.Body, errURLNotAllowed)
+			}
+			for _, reason := range []string{"unauthorized", "url_not_allowed", "rate_limited"} {
+				want := 0.0
+				if reason == tt.reason {
+					want = 1
+				}
+				if got := testutil.ToFloat64(e.metrics.executeRejected.WithLabelValues(reason)); got != want {
+					t.Errorf("rejected %g requests as %s, want %g", got, reason, want)
+				}
+			}
+		})
+	}
+}
+
+func TestExecuteGuardRateLimit(t *testing.T) {
+	e := newTestExporter(t, answerRun)
+	e.guard = &executeGuard{token: "s3cret", perMinute: 2, rejected: e.metrics.executeRejected}
+
+	// Unauthorized requests don't take from the bucket.
+	if rec := guardedExecute(e, "https://example.com/", "192.0.2.1:1234", ""); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("status %d, want 401", rec.Code)
+	}
+	for range 2 {
+		if rec := guardedExecute(e, "https://example.com/", "192.0.2.1:1234", "Bearer s3cret"); rec.Code != http.StatusAccepted {
+			t.Fatalf("status %d %q, want 202", rec.Code, rec.Body)
+		}
+	}
+	// The bucket, of the IP address whatever the port, refills a request every
+	// 30s.
+	rec := guardedExecute(e, "https://example.com/", "192.0.2.1:5678", "Bearer s3cret")
+	if rec.Code != http.StatusTooManyRequests {
+		t.Errorf("status %d, want 429", rec.Code)
+	}
+	if got := rec.Header().Get("Retry-After"); got != "30" {
+		t.Errorf("Retry-After %q, want 30", got)
+	}
+	// Other clients have buckets of their own.
+	if rec := guardedExecute(e, "https://example.com/", "198.51.100.7:1234", "Bearer s3cret"); rec.Code != http.StatusAccepted {
+		t.Errorf("status %d for another client, want 202", rec.Code)
+	}
+	if got := testutil.ToFloat64(e.metrics.executeRejected.WithLabelValues("rate_limited")); got != 1 {
+		t.Errorf("rejected %g requests as rate limited, want 1", got)
+	}
+}
+
+func TestParseAllowedHosts(t *testing.T) {
+	hosts, err := parseAllowedHosts(" Example.com, ,shop.example.org,")
+	if want := []string{"example.com", "shop.example.org"}; err != nil || !slices.Equal(hosts, want) {
+		t.Errorf("got %q, %v, want %q", hosts, err, want)
+	}
+	for _, raw := range []string{"https://example.com", "example.com:443", "*.example.com", "example.com/shop"} {
+		if _, err := parseAllowedHosts(raw); err == nil || !strings.Contains(err.Error(), "must be a host name like example.com") {
+			t.Errorf("parseAllowedHosts(%q) got error %v", raw, err)
+		}
+	}
+}
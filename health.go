@@ -0,0 +1,22 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// healthz serves /healthz, which reports that the process is alive.
+func (e *exporter) healthz(w http.ResponseWriter, _ *http.Request) {
+	fmt.Fprintln(w, "OK")
+}
+
+// readyz serves /readyz, which reports ready once the configuration is
+// loaded, with --web.ready-after-initial-fetch once the initial fetch is done
+// too, and not ready again while shutting down.
+func (e *exporter) readyz(w http.ResponseWriter, _ *http.Request) {
+	if !e.ready.Load() {
+		http.Error(w, "Not ready", http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintln(w, "Ready")
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/yahyasahaja/prometheus-exporter-pagespeed-insight/pkg/psi"
+)
+
+// Modes of --metrics.lab-histograms.
+const (
+	histogramsClassic = "classic"
+	histogramsNative  = "native"
+	histogramsBoth    = "both"
+)
+
+// validateHistogramMode checks the value of --metrics.lab-histograms, empty
+// when the histograms are disabled.
+func validateHistogramMode(mode string) error {
+	switch mode {
+	case "", histogramsClassic, histogramsNative, histogramsBoth:
+		return nil
+	}
+	return fmt.Errorf("invalid --metrics.lab-histograms %q: must be %s, %s or %s", mode, histogramsClassic, histogramsNative, histogramsBoth)
+}
+
+// labHistogram is a lab metric observed in a histogram on every run.
+type labHistogram struct {
+	audit string
+	vec   *prometheus.HistogramVec
+}
+
+// labHistograms records the lab metrics of every Lighthouse run, so their
+// percentiles over a time window can be queried rather than only the value
+// of the latest run.
+type labHistograms []labHistogram
+
+// newLabHistograms returns the histograms of mode, with the per-target
+// labels targetLabels.
+func newLabHistograms(namespace, mode string, targetLabels []string) labHistograms {
+	histogram := func(audit, name, help string, buckets []float64) labHistogram {
+		opts := prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      name,
+			Help:      help,
+		}
+		if mode != histogramsNative {
+			opts.Buckets = buckets
+		}
+		if mode != histogramsClassic {
+			opts.NativeHistogramBucketFactor = 1.1
+			opts.NativeHistogramMaxBucketNumber = 100
+		}
+		return labHistogram{audit: audit, vec: prometheus.NewHistogramVec(opts, targetLabels)}
+	}
+	// The buckets bracket the thresholds of Lighthouse's scoring.
+	paint := []float64{500, 1000, 1500, 1800, 2000, 2500, 3000, 4000, 5000, 7500, 10000, 20000}
+	return labHistograms{
+		histogram("first-contentful-paint", "first_contentful_paint_observations", "First Contentful Paint of every Lighthouse run in milliseconds", paint),
+		histogram("largest-contentful-paint", "largest_contentful_paint_observations", "Largest Contentful Paint of every Lighthouse run in milliseconds", paint),
+		histogram("total-blocking-time", "total_blocking_time_observations", "Total Blocking Time of every Lighthouse run in milliseconds", []float64{50, 100, 200, 300, 450, 600, 1000, 2000, 5000}),
+	}
+}
+
+func (h labHistograms) collectors() []prometheus.Collector {
+	var cs []prometheus.Collector
+	for _, l := range h {
+		cs = append(cs, l.vec)
+	}
+	return cs
+}
+
+// observe records the lab metrics res has a value for.
+func (h labHistograms) observe(values []string, res *psi.Result) {
+	for _, l := range h {
+		if v := res.Audits[l.audit].NumericValue; v != nil {
+			l.vec.WithLabelValues(values...).Observe(*v)
+		}
+	}
+}
+
+// delete removes the series of the target with the label values values.
+func (h labHistograms) delete(values []string) {
+	for _, l := range h {
+		l.vec.DeleteLabelValues(values...)
+	}
+}
@@ -0,0 +1,401 @@
+package main
+
+import (
+	"bufio"
+	"cmp"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/yahyasahaja/prometheus-exporter-pagespeed-insight/pkg/collector"
+)
+
+// historyMetrics are the lab metrics kept in the history: the Core Web
+// Vitals and the other metrics of the performance score.
+var historyMetrics = []string{
+	"first-contentful-paint",
+	"largest-contentful-paint",
+	"cumulative-layout-shift",
+	"total-blocking-time",
+	"speed-index",
+	"interaction-to-next-paint",
+	"server-response-time",
+}
+
+// historyCompactInterval is how often expired points are removed from the
+// history file.
+const historyCompactInterval = time.Hour
+
+// historyPoint is the outcome of one successful fetch of a target.
+type historyPoint struct {
+	Time             time.Time          `json:"time"`
+	URL              string             `json:"url"`
+	Strategy         string             `json:"strategy"`
+	Backend          string             `json:"backend,omitempty"`
+	Profile          string             `json:"profile,omitempty"`
+	PerformanceScore *float64           `json:"performance_score,omitempty"`
+	CategoryScores   map[string]float64 `json:"category_scores,omitempty"`
+	Metrics          map[string]float64 `json:"metrics,omitempty"`
+	FieldData        map[string]float64 `json:"field_data,omitempty"`
+	// Source is sourceCrUXHistory for the field data of a CrUX collection
+	// period, empty for a fetch.
+	Source string `json:"source,omitempty"`
+}
+
+// historySeries are the points of one target, oldest first.
+type historySeries struct {
+	URL      string         `json:"url"`
+	Strategy string         `json:"strategy"`
+	Backend  string         `json:"backend,omitempty"`
+	Profile  string         `json:"profile,omitempty"`
+	Points   []historyPoint `json:"points"`
+}
+
+// historyStore keeps the results of the fetches of the last retention in
+// memory and in a file of JSON lines at path, one point per line, so they
+// survive restarts. Points are appended as they are recorded, and the
+// expired ones are dropped from the file every historyCompactInterval.
+type historyStore struct {
+	path      string
+	retention time.Duration
+
+	mu     sync.RWMutex
+	file   *os.File
+	points []historyPoint
+}
+
+// openHistory loads the points of the history file at path that are within
+// retention and compacts the file.
+func openHistory(path string, retention time.Duration) (*historyStore, error) {
+	h := &historyStore{path: path, retention: retention}
+	f, err := os.Open(path)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("reading --history.file: %v", err)
+	}
+	if err == nil {
+		cutoff := time.Now().Add(-retention)
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(nil, 1<<20)
+		for line := 1; scanner.Scan(); line++ {
+			var p historyPoint
+			if err := json.Unmarshal(scanner.Bytes(), &p); err != nil {
+				f.Close()
+				return nil, fmt.Errorf("parsing --history.file %s, line %d: %v", path, line, err)
+			}
+			if p.Time.After(cutoff) {
+				h.points = append(h.points, p)
+			}
+		}
+		f.Close()
+		if err := scanner.Err(); err != nil {
+			return nil, fmt.Errorf("reading --history.file: %v", err)
+		}
+	}
+	// Points are appended in the order of the fetches finishing, which a
+	// clock step may have disturbed.
+	slices.SortStableFunc(h.points, func(a, b historyPoint) int { return a.Time.Compare(b.Time) })
+	if err := h.rewrite(); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// add records a successful fetch of t.
+func (h *historyStore) add(t target, at time.Time, r *collector.Result) error {
+	p := historyPoint{
+		Time:             at,
+		URL:              t.URL,
+		Strategy:         t.Strategy,
+		Backend:          t.Backend,
+		Profile:          t.Profile,
+		PerformanceScore: r.PerformanceScore,
+		CategoryScores:   r.CategoryScores,
+		FieldData:        r.FieldData,
+	}
+	for _, id := range historyMetrics {
+		if v, ok := r.Metrics[id]; ok {
+			if p.Metrics == nil {
+				p.Metrics = map[string]float64{}
+			}
+			p.Metrics[id] = v
+		}
+	}
+	raw, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.points = append(h.points, p)
+	if _, err := h.file.Write(append(raw, '\n')); err != nil {
+		return fmt.Errorf("appending to --history.file: %v", err)
+	}
+	return nil
+}
+
+// backfill adds the points of ps that aren't in the history yet, those with
+// the time, target and source of a stored one, and returns how many it
+// added. Points older than the retention are skipped.
+func (h *historyStore) backfill(ps []historyPoint) (int, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	type key struct {
+		time                                    int64
+		url, strategy, backend, profile, source string
+	}
+	stored := map[key]bool{}
+	for _, p := range h.points {
+		stored[key{p.Time.UnixNano(), p.URL, p.Strategy, p.Backend, p.Profile, p.Source}] = true
+	}
+	cutoff := time.Now().Add(-h.retention)
+	added := 0
+	for _, p := range ps {
+		k := key{p.Time.UnixNano(), p.URL, p.Strategy, p.Backend, p.Profile, p.Source}
+		if stored[k] || !p.Time.After(cutoff) {
+			continue
+		}
+		stored[k] = true
+		h.points = append(h.points, p)
+		added++
+	}
+	if added == 0 {
+		return 0, nil
+	}
+	slices.SortStableFunc(h.points, func(a, b historyPoint) int { return a.Time.Compare(b.Time) })
+	return added, h.rewrite()
+}
+
+// historyCategories and historyFieldData are the category scores and field
+// metrics exported as CSV columns, in column order.
+var (
+	historyCategories = []string{"accessibility", "best-practices", "seo", "pwa"}
+	historyFieldData  = []string{"FIRST_CONTENTFUL_PAINT_MS", "LARGEST_CONTENTFUL_PAINT_MS", "CUMULATIVE_LAYOUT_SHIFT_SCORE", "INTERACTION_TO_NEXT_PAINT"}
+)
+
+// selectPoints returns the points between from and to, oldest first. An empty
+// site or strategy matches every one.
+func (h *historyStore) selectPoints(site, strategy string, from, to time.Time) []historyPoint {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	var points []historyPoint
+	for _, p := range h.points {
+		if site != "" && p.URL != site || strategy != "" && p.Strategy != strategy || p.Time.Before(from) || p.Time.After(to) {
+			continue
+		}
+		points = append(points, p)
+	}
+	return points
+}
+
+// targetPoints returns the points of t between from and to, oldest first.
+func (h *historyStore) targetPoints(t target, from, to time.Time) []historyPoint {
+	points := h.selectPoints(t.URL, t.Strategy, from, to)
+	return slices.DeleteFunc(points, func(p historyPoint) bool { return p.Backend != t.Backend || p.Profile != t.Profile })
+}
+
+// recentScores returns the performance scores of the last n points of t,
+// oldest first.
+func (h *historyStore) recentScores(t target, n int) []float64 {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	var scores []float64
+	for i := len(h.points) - 1; i >= 0 && len(scores) < n; i-- {
+		if p := h.points[i]; p.URL == t.URL && p.Strategy == t.Strategy && p.Backend == t.Backend && p.Profile == t.Profile && p.PerformanceScore != nil {
+			scores = append(scores, *p.PerformanceScore)
+		}
+	}
+	slices.Reverse(scores)
+	return scores
+}
+
+// query returns the points of site between from and to, grouped by
+// strategy, backend and profile. An empty strategy matches both.
+func (h *historyStore) query(site, strategy string, from, to time.Time) []historySeries {
+	var series []historySeries
+	for _, p := range h.selectPoints(site, strategy, from, to) {
+		i := slices.IndexFunc(series, func(s historySeries) bool {
+			return s.Strategy == p.Strategy && s.Backend == p.Backend && s.Profile == p.Profile
+		})
+		if i < 0 {
+			series = append(series, historySeries{URL: p.URL, Strategy: p.Strategy, Backend: p.Backend, Profile: p.Profile})
+			i = len(series) - 1
+		}
+		series[i].Points = append(series[i].Points, p)
+	}
+	return series
+}
+
+// compact drops the expired points every historyCompactInterval.
+func (h *historyStore) compact(logger *slog.Logger) {
+	for range time.Tick(historyCompactInterval) {
+		h.mu.Lock()
+		cutoff := time.Now().Add(-h.retention)
+		i := slices.IndexFunc(h.points, func(p historyPoint) bool { return p.Time.After(cutoff) })
+		if i < 0 {
+			i = len(h.points)
+		}
+		var err error
+		if i > 0 {
+			h.points = slices.Delete(h.points, 0, i)
+			err = h.rewrite()
+		}
+		h.mu.Unlock()
+		if err != nil {
+			logger.Error("Failed to compact the history", "err", err)
+		}
+	}
+}
+
+// rewrite replaces the history file with the points in memory and reopens
+// it for appending.
+func (h *historyStore) rewrite() error {
+	var buf []byte
+	for _, p := range h.points {
+		raw, err := json.Marshal(p)
+		if err != nil {
+			return err
+		}
+		buf = append(append(buf, raw...), '\n')
+	}
+	if h.file != nil {
+		h.file.Close()
+	}
+	if err := writeFileAtomic(h.path, buf); err != nil {
+		return fmt.Errorf("writing --history.file: %v", err)
+	}
+	f, err := os.OpenFile(h.path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		return fmt.Errorf("opening --history.file: %v", err)
+	}
+	h.file = f
+	return nil
+}
+
+// historyQuery parses the site, strategy, from and to parameters of a
+// history request. from defaults to the start of the retention and to to
+// now. Without requireSite, a missing site selects every site.
+func (h *historyStore) historyQuery(r *http.Request, requireSite bool) (site, strategy string, from, to time.Time, err error) {
+	q := r.URL.Query()
+	if q.Get("site") != "" || requireSite {
+		if site, err = normalizeTargetURL(q.Get("site")); err != nil {
+			return "", "", time.Time{}, time.Time{}, err
+		}
+	}
+	if strategy = q.Get("strategy"); strategy != "" {
+		if err = validateStrategy(strategy); err != nil {
+			return "", "", time.Time{}, time.Time{}, err
+		}
+	}
+	to = time.Now()
+	from = to.Add(-h.retention)
+	for name, t := range map[string]*time.Time{"from": &from, "to": &to} {
+		if v := q.Get(name); v != "" {
+			if *t, err = time.Parse(time.RFC3339, v); err != nil {
+				return "", "", time.Time{}, time.Time{}, fmt.Errorf("invalid %s %q: must be an RFC 3339 time like 2024-01-31T00:00:00Z", name, v)
+			}
+		}
+	}
+	return site, strategy, from, to, nil
+}
+
+// serveHistory serves GET /api/v1/history?site=&strategy=&from=&to= with the
+// stored results of a site, one series per strategy.
+func (h *historyStore) serveHistory(w http.ResponseWriter, r *http.Request) {
+	site, strategy, from, to, err := h.historyQuery(r, true)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	series := h.query(site, strategy, from, to)
+	if series == nil {
+		series = []historySeries{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(series)
+}
+
+// serveExport serves GET /api/v1/history/export?format=csv|json with the
+// stored results of every site, or of the one given by site, as a download
+// for spreadsheets. The strategy, from and to parameters are those of
+// /api/v1/history.
+func (h *historyStore) serveExport(w http.ResponseWriter, r *http.Request) {
+	site, strategy, from, to, err := h.historyQuery(r, false)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "csv"
+	}
+	points := h.selectPoints(site, strategy, from, to)
+	switch format {
+	case "csv":
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		w.Header().Set("Content-Disposition", `attachment; filename="psi-history.csv"`)
+		writeHistoryCSV(w, points)
+	case "json":
+		if points == nil {
+			points = []historyPoint{}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Disposition", `attachment; filename="psi-history.json"`)
+		json.NewEncoder(w).Encode(points)
+	default:
+		http.Error(w, fmt.Sprintf("invalid format %q: must be csv or json", format), http.StatusBadRequest)
+	}
+}
+
+// writeHistoryCSV writes points as CSV with a header row. Values a point
+// lacks are left empty.
+func writeHistoryCSV(w io.Writer, points []historyPoint) error {
+	header := []string{"time", "url", "strategy", "performance_score"}
+	header = append(header, historyCategories...)
+	header = append(header, historyMetrics...)
+	for _, name := range historyFieldData {
+		header = append(header, "field_"+strings.ToLower(name))
+	}
+	header = append(header, "backend", "profile", "source")
+	cw := csv.NewWriter(w)
+	cw.Write(header)
+	value := func(v float64, ok bool) string {
+		if !ok {
+			return ""
+		}
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	}
+	for _, p := range points {
+		row := []string{p.Time.UTC().Format(time.RFC3339), p.URL, p.Strategy, ""}
+		if p.PerformanceScore != nil {
+			row[3] = value(*p.PerformanceScore, true)
+		}
+		for _, c := range historyCategories {
+			v, ok := p.CategoryScores[c]
+			row = append(row, value(v, ok))
+		}
+		for _, m := range historyMetrics {
+			v, ok := p.Metrics[m]
+			row = append(row, value(v, ok))
+		}
+		for _, f := range historyFieldData {
+			v, ok := p.FieldData[f]
+			row = append(row, value(v, ok))
+		}
+		row = append(row, cmp.Or(p.Backend, backendPSI), p.Profile, cmp.Or(p.Source, "fetch"))
+		cw.Write(row)
+	}
+	cw.Flush()
+	return cw.Error()
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// httpDiscoveryTimeout bounds a single request to --targets.http-url.
+const httpDiscoveryTimeout = 30 * time.Second
+
+// targetDiscovery periodically fetches target groups from a discovery source.
+// The last list fetched successfully is kept when a refresh fails, so an
+// outage of the source doesn't drop the monitored targets.
+type targetDiscovery struct {
+	// source names the flag configuring the discovery, for messages.
+	source   string
+	fetch    func() ([]targetGroup, error)
+	interval time.Duration
+	// labelNames are custom labels always set on the discovered targets.
+	labelNames []string
+
+	mu     sync.Mutex
+	groups []targetGroup
+
+	failures    prometheus.Counter
+	lastSuccess prometheus.Gauge
+}
+
+// newTargetDiscovery returns a discovery refreshed every interval whose
+// metrics are named after kind.
+func newTargetDiscovery(namespace, kind, source string, interval time.Duration, fetch func() ([]targetGroup, error)) *targetDiscovery {
+	return &targetDiscovery{
+		source:   source,
+		fetch:    fetch,
+		interval: interval,
+		failures: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "targets_" + kind + "_refresh_failures_total",
+			Help:      "Number of failed refreshes of the targets from " + source,
+		}),
+		lastSuccess: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "targets_" + kind + "_last_refresh_success_timestamp_seconds",
+			Help:      "Time of the last successful refresh of the targets from " + source + ", as a Unix timestamp",
+		}),
+	}
+}
+
+// newHTTPDiscovery returns a discovery of the target groups served by url in
+// the format of Prometheus http_sd.
+func newHTTPDiscovery(namespace, url string, interval time.Duration) *targetDiscovery {
+	client := &http.Client{Timeout: httpDiscoveryTimeout}
+	return newTargetDiscovery(namespace, "http", "--targets.http-url", interval, func() ([]targetGroup, error) {
+		resp, err := client.Get(url)
+		if err != nil {
+			return nil, fmt.Errorf("fetching --targets.http-url: %v", err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("fetching --targets.http-url: unexpected status %s", resp.Status)
+		}
+		var groups []targetGroup
+		if err := json.NewDecoder(resp.Body).Decode(&groups); err != nil {
+			return nil, fmt.Errorf("decoding --targets.http-url response: %v", err)
+		}
+		return groups, nil
+	})
+}
+
+// refresh fetches the target groups and, when the response is valid, makes
+// them the current list. It reports whether the list changed.
+func (d *targetDiscovery) refresh() (bool, error) {
+	groups, err := d.fetch()
+	if err != nil {
+		d.failures.Inc()
+		return false, err
+	}
+	d.lastSuccess.SetToCurrentTime()
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	changed := !sameGroups(d.groups, groups)
+	d.groups = groups
+	return changed, nil
+}
+
+// current returns the last target groups fetched successfully.
+func (d *targetDiscovery) current() []targetGroup {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.groups
+}
+
+// run refreshes the target groups every interval and calls reload when they
+// changed. Failed refreshes are logged and counted.
+func (d *targetDiscovery) run(logger *slog.Logger, reload func()) {
+	for range time.Tick(d.interval) {
+		changed, err := d.refresh()
+		if err != nil {
+			logger.Warn("Failed to refresh targets, keeping the last good list", "source", d.source, "err", err)
+			continue
+		}
+		if changed {
+			logger.Info("Discovered targets changed, reloading", "source", d.source)
+			reload()
+		}
+	}
+}
+
+func (d *targetDiscovery) collectors() []prometheus.Collector {
+	return []prometheus.Collector{d.failures, d.lastSuccess}
+}
+
+// sameGroups reports whether a and b list the same URLs with the same labels
+// in the same order.
+func sameGroups(a, b []targetGroup) bool {
+	ja, _ := json.Marshal(a)
+	jb, _ := json.Marshal(b)
+	return string(ja) == string(jb)
+}
+
+// serveSD serves GET /sd with the targets in the format of Prometheus
+// http_sd, one group per target labeled with its site, strategy and custom
+// labels, so other scrapers, e.g. blackbox exporter probes, can use the same
+// list. ?strategy= restricts it to the targets of one strategy.
+func (e *exporter) serveSD(w http.ResponseWriter, r *http.Request) {
+	strategy := r.URL.Query().Get("strategy")
+	groups := []targetGroup{}
+	for _, t := range e.currentTargets() {
+		if strategy != "" && t.Strategy != strategy {
+			continue
+		}
+		labels := map[string]string{"site": t.site(), "strategy": t.Strategy}
+		for name, value := range t.Labels {
+			if value != "" {
+				labels[name] = value
+			}
+		}
+		groups = append(groups, targetGroup{Targets: []string{t.URL}, Labels: labels})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(groups)
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestHTTPDiscovery(t *testing.T) {
+	var mu sync.Mutex
+	status, body := http.StatusOK, ""
+	sd := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		w.WriteHeader(status)
+		io.WriteString(w, body)
+	}))
+	defer sd.Close()
+	d := newHTTPDiscovery("psi", sd.URL, time.Minute)
+	both := `[{"targets": ["https://a.example", "https://b.example"], "labels": {"team": "web"}}]`
+
+	tests := []struct {
+		name   string
+		status int
+		body   string
+		// err is a part of the expected error.
+		err     string
+		changed bool
+		// want are the URLs of the current groups.
+		want string
+	}{
+		{name: "first list", status: http.StatusOK, body: both, changed: true, want: "https://a.example https://b.example"},
+		{name: "same list", status: http.StatusOK, body: both, want: "https://a.example https://b.example"},
+		{name: "target removed", status: http.StatusOK, body: `[{"targets": ["https://a.example"], "labels": {"team": "web"}}]`, changed: true, want: "https://a.example"},
+		// Failed refreshes keep the last good list.
+		{name: "error status", status: http.StatusInternalServerError, body: both, err: "unexpected status 500 Internal Server Error", want: "https://a.example"},
+		{name: "malformed", status: http.StatusOK, body: `[{"targets": [`, err: "decoding --targets.http-url response", want: "https://a.example"},
+		{name: "target added back", status: http.StatusOK, body: both, changed: true, want: "https://a.example https://b.example"},
+		{name: "labels changed", status: http.StatusOK, body: `[{"targets": ["https://a.example", "https://b.example"], "labels": {"team": "shop"}}]`, changed: true, want: "https://a.example https://b.example"},
+		{name: "no targets", status: http.StatusOK, body: `[]`, changed: true},
+	}
+	failures := 0.0
+	for _, tt := range tests {
+		mu.Lock()
+		status, body = tt.status, tt.body
+		mu.Unlock()
+		changed, err := d.refresh()
+		switch {
+		case tt.err == "" && err != nil:
+			t.Errorf("%s: got error %v", tt.name, err)
+		case tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)):
+			t.Errorf("%s: got error %v, want %q", tt.name, err, tt.err)
+		}
+		if tt.err != "" {
+			failures++
+		}
+		if changed != tt.changed {
+			t.Errorf("%s: got changed %v, want %v", tt.name, changed, tt.changed)
+		}
+		var urls []string
+		for _, g := range d.current() {
+			urls = append(urls, g.Targets...)
+		}
+		if got := strings.Join(urls, " "); got != tt.want {
+			t.Errorf("%s: got targets %q, want %q", tt.name, got, tt.want)
+		}
+		if got := testutil.ToFloat64(d.failures); got != failures {
+			t.Errorf("%s: counted %v failures, want %v", tt.name, got, failures)
+		}
+	}
+	if testutil.ToFloat64(d.lastSuccess) == 0 {
+		t.Error("didn't record the last successful refresh")
+	}
+
+	sd.Close()
+	if _, err := d.refresh(); err == nil || !strings.Contains(err.Error(), "fetching --targets.http-url") {
+		t.Errorf("got error %v for an unreachable endpoint", err)
+	}
+}
+
+func TestServeSD(t *testing.T) {
+	e := &exporter{targets: []target{
+		{URL: "https://example.com", Strategy: "mobile", Scope: scopePage, Labels: map[string]string{"team": "web", "tier": ""}},
+		{URL: "https://example.com", Strategy: "desktop", Scope: scopePage, Site: "home"},
+	}}
+	tests := []struct {
+		query, want string
+	}{
+		{"", `[{"targets":["https://example.com"],"labels":{"site":"https://example.com","strategy":"mobile","team":"web"}},{"targets":["https://example.com"],"labels":{"site":"home","strategy":"desktop"}}]`},
+		{"?strategy=desktop", `[{"targets":["https://example.com"],"labels":{"site":"home","strategy":"desktop"}}]`},
+		{"?strategy=tablet", `[]`},
+	}
+	for _, tt := range tests {
+		rec := serve(e.serveSD, http.MethodGet, "/sd"+tt.query, "")
+		if got := strings.TrimSpace(rec.Body.String()); got != tt.want {
+			t.Errorf("/sd%s served %s, want %s", tt.query, got, tt.want)
+		}
+		if got := rec.Header().Get("Content-Type"); got != "application/json" {
+			t.Errorf("/sd%s served Content-Type %q", tt.query, got)
+		}
+	}
+}
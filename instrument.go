@@ -0,0 +1,74 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// instrument wraps next, the handler of the exporter's own endpoints, with
+// the HTTP server metrics, labelled by the pattern mux routes each request
+// to. With accessLog, every request is also logged once it's answered.
+func (m *metrics) instrument(mux *http.ServeMux, next http.Handler, accessLog bool, logger *slog.Logger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, pattern := mux.Handler(r)
+		labels := prometheus.Labels{"handler": routeLabel(pattern)}
+		h := promhttp.InstrumentHandlerInFlight(m.httpInFlight,
+			promhttp.InstrumentHandlerDuration(m.httpDuration.MustCurryWith(labels),
+				promhttp.InstrumentHandlerCounter(m.httpRequests.MustCurryWith(labels), next)))
+		if !accessLog {
+			h.ServeHTTP(w, r)
+			return
+		}
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		start := time.Now()
+		h.ServeHTTP(rec, r)
+		logger.Info("HTTP request", "method", r.Method, "path", r.URL.Path, "status", rec.status, "bytes", rec.bytes,
+			"duration", time.Since(start), "remote", clientAddr(r), "user_agent", r.UserAgent())
+	})
+}
+
+// routeLabel returns the handler label of a ServeMux pattern: its path
+// without the method, or "none" for requests no pattern matches.
+func routeLabel(pattern string) string {
+	if pattern == "" {
+		return "none"
+	}
+	if _, path, ok := strings.Cut(pattern, " "); ok {
+		return path
+	}
+	return pattern
+}
+
+// statusRecorder records the status code and size of a response for the
+// access log.
+type statusRecorder struct {
+	http.ResponseWriter
+	status      int
+	bytes       int
+	wroteHeader bool
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if !r.wroteHeader {
+		r.status, r.wroteHeader = status, true
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	r.wroteHeader = true
+	n, err := r.ResponseWriter.Write(b)
+	r.bytes += n
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer, e.g. to
+// flush a streamed profile.
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+	"time"
+
+	"github.com/yahyasahaja/prometheus-exporter-pagespeed-insight/pkg/collector"
+)
+
+// fetchQueueSize bounds the number of fetches waiting for a worker.
+const fetchQueueSize = 256
+
+// flightGroup coalesces concurrent fetches of the same target into one, so a
+// target requested through /execute while the scheduler is fetching it
+// doesn't spend quota twice. The zero value is ready to use.
+type flightGroup struct {
+	mu      sync.Mutex
+	flights map[string]*flight
+}
+
+type flight struct {
+	done   chan struct{}
+	result *collector.Result
+	err    error
+}
+
+// do runs fn unless a call for key is in flight, in which case it waits for
+// that call and returns its outcome instead. shared reports whether it did.
+func (g *flightGroup) do(key string, fn func() (*collector.Result, error)) (result *collector.Result, shared bool, err error) {
+	g.mu.Lock()
+	if f, ok := g.flights[key]; ok {
+		g.mu.Unlock()
+		<-f.done
+		return f.result, true, f.err
+	}
+	if g.flights == nil {
+		g.flights = map[string]*flight{}
+	}
+	f := &flight{done: make(chan struct{})}
+	g.flights[key] = f
+	g.mu.Unlock()
+
+	f.result, f.err = fn()
+	g.mu.Lock()
+	delete(g.flights, key)
+	g.mu.Unlock()
+	close(f.done)
+	return f.result, false, f.err
+}
+
+// inFlight counts the fetches or report uploads in progress, so shutdown can
+// wait for them.
+type inFlight struct {
+	mu sync.Mutex
+	n  int
+	// idle is closed when n drops to zero, nil while nobody waits.
+	idle chan struct{}
+}
+
+func (f *inFlight) add(delta int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.n += delta
+	if f.n == 0 && f.idle != nil {
+		close(f.idle)
+		f.idle = nil
+	}
+}
+
+func (f *inFlight) count() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.n
+}
+
+// wait returns once nothing is in progress, or false when ctx is done
+// first.
+func (f *inFlight) wait(ctx context.Context) bool {
+	f.mu.Lock()
+	if f.n == 0 {
+		f.mu.Unlock()
+		return true
+	}
+	if f.idle == nil {
+		f.idle = make(chan struct{})
+	}
+	idle := f.idle
+	f.mu.Unlock()
+	select {
+	case <-idle:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// workerPool runs submitted functions on a fixed number of goroutines.
+type workerPool struct {
+	queue chan func()
+}
+
+func newWorkerPool(workers, queueSize int) *workerPool {
+	p := &workerPool{queue: make(chan func(), queueSize)}
+	for i := 0; i < workers; i++ {
+		go func() {
+			for fn := range p.queue {
+				fn()
+			}
+		}()
+	}
+	return p
+}
+
+// submit queues fn, blocking while the queue is full.
+func (p *workerPool) submit(fn func()) {
+	p.queue <- fn
+}
+
+// trySubmit queues fn and reports whether there was room for it.
+func (p *workerPool) trySubmit(fn func()) bool {
+	select {
+	case p.queue <- fn:
+		return true
+	default:
+		return false
+	}
+}
+
+type jobState string
+
+const (
+	jobPending jobState = "pending"
+	jobRunning jobState = "running"
+	jobDone    jobState = "done"
+	jobFailed  jobState = "failed"
+)
+
+// job is a fetch requested through /execute.
+type job struct {
+	ID         string
+	target     target
+	state      jobState
+	result     *collector.Result
+	err        error
+	createdAt  time.Time
+	startedAt  time.Time
+	finishedAt time.Time
+	// cachedAt is set when the job was answered from the result cache and
+	// holds the time the cached result was fetched.
+	cachedAt time.Time
+	// done is closed once the job has finished.
+	done chan struct{}
+}
+
+// jobView is the JSON representation of a job.
+type jobView struct {
+	ID         string            `json:"id"`
+	URL        string            `json:"url"`
+	Strategy   string            `json:"strategy"`
+	Status     jobState          `json:"status"`
+	Result     *collector.Result `json:"result,omitempty"`
+	Error      string            `json:"error,omitempty"`
+	Cached     bool              `json:"cached"`
+	AgeSeconds *float64          `json:"age_seconds,omitempty"`
+	CreatedAt  time.Time         `json:"created_at"`
+	StartedAt  *time.Time        `json:"started_at,omitempty"`
+	FinishedAt *time.Time        `json:"finished_at,omitempty"`
+	// DurationSeconds is how long the fetch took, retries included.
+	DurationSeconds *float64 `json:"duration_seconds,omitempty"`
+}
+
+// jobStore tracks /execute jobs until ttl after they finish.
+type jobStore struct {
+	mu   sync.Mutex
+	jobs map[string]*job
+	ttl  time.Duration
+}
+
+func newJobStore(ttl time.Duration) *jobStore {
+	return &jobStore{jobs: map[string]*job{}, ttl: ttl}
+}
+
+func newJobID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func (s *jobStore) create(t target) *job {
+	j := &job{
+		ID:        newJobID(),
+		target:    t,
+		state:     jobPending,
+		createdAt: time.Now(),
+		done:      make(chan struct{}),
+	}
+	s.mu.Lock()
+	s.jobs[j.ID] = j
+	s.mu.Unlock()
+	return j
+}
+
+// createCached records a job answered from the result cache, already done.
+func (s *jobStore) createCached(t target, result *collector.Result, fetchedAt time.Time) *job {
+	now := time.Now()
+	j := &job{
+		ID:         newJobID(),
+		target:     t,
+		state:      jobDone,
+		result:     result,
+		createdAt:  now,
+		finishedAt: now,
+		cachedAt:   fetchedAt,
+		done:       make(chan struct{}),
+	}
+	close(j.done)
+	s.mu.Lock()
+	s.jobs[j.ID] = j
+	s.mu.Unlock()
+	return j
+}
+
+func (s *jobStore) start(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if j, ok := s.jobs[id]; ok {
+		j.state, j.startedAt = jobRunning, time.Now()
+	}
+}
+
+func (s *jobStore) finish(id string, result *collector.Result, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	j, ok := s.jobs[id]
+	if !ok {
+		return
+	}
+	j.state, j.result, j.err = jobDone, result, err
+	if err != nil {
+		j.state = jobFailed
+	}
+	j.finishedAt = time.Now()
+	close(j.done)
+}
+
+// get returns a snapshot of the job with the given ID.
+func (s *jobStore) get(id string) (jobView, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	j, ok := s.jobs[id]
+	if !ok {
+		return jobView{}, false
+	}
+	return j.view(), true
+}
+
+// snapshot is like get for a job known to exist.
+func (s *jobStore) snapshot(id string) jobView {
+	view, _ := s.get(id)
+	return view
+}
+
+func (j *job) view() jobView {
+	v := jobView{
+		ID:        j.ID,
+		URL:       j.target.URL,
+		Strategy:  j.target.Strategy,
+		Status:    j.state,
+		Result:    j.result,
+		CreatedAt: j.createdAt,
+	}
+	if j.err != nil {
+		v.Error = j.err.Error()
+	}
+	if !j.startedAt.IsZero() {
+		started := j.startedAt
+		v.StartedAt = &started
+	}
+	if !j.finishedAt.IsZero() {
+		finished := j.finishedAt
+		v.FinishedAt = &finished
+		if !j.startedAt.IsZero() {
+			duration := j.finishedAt.Sub(j.startedAt).Seconds()
+			v.DurationSeconds = &duration
+		}
+	}
+	if !j.cachedAt.IsZero() {
+		age := j.createdAt.Sub(j.cachedAt).Seconds()
+		v.Cached, v.AgeSeconds = true, &age
+	}
+	return v
+}
+
+// collectGarbage removes finished jobs older than the TTL every interval.
+func (s *jobStore) collectGarbage(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		s.sweep(now)
+	}
+}
+
+// sweep removes the jobs that finished more than the TTL before now.
+func (s *jobStore) sweep(now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, j := range s.jobs {
+		if !j.finishedAt.IsZero() && now.Sub(j.finishedAt) > s.ttl {
+			delete(s.jobs, id)
+		}
+	}
+}
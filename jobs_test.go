@@ -0,0 +1,136 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// waitJob waits for the job id of e to finish.
+func waitJob(t *testing.T, e *exporter, id string) {
+	t.Helper()
+	e.jobs.mu.Lock()
+	j := e.jobs.jobs[id]
+	e.jobs.mu.Unlock()
+	select {
+	case <-j.done:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("job %s didn't finish", id)
+	}
+}
+
+func TestExecuteJobs(t *testing.T) {
+	started := make(chan string, 2)
+	release := make(chan struct{})
+	e := newTestExporter(t, func(w http.ResponseWriter, r *http.Request) {
+		started <- r.URL.Query().Get("url")
+		<-release
+		if strings.HasSuffix(r.URL.Query().Get("url"), "/down") {
+			http.Error(w, `{"error": {"code": 500, "message": "Lighthouse returned error: Something went wrong."}}`, http.StatusInternalServerError)
+			return
+		}
+		answerRun(w, r)
+	})
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /execute", e.executePSI)
+	mux.HandleFunc("GET /jobs/{id}", e.jobStatus)
+	execute := func(url string) jobView {
+		t.Helper()
+		rec := serve(mux.ServeHTTP, http.MethodGet, "/execute?strategy=mobile&url="+url, "")
+		if rec.Code != http.StatusAccepted {
+			t.Fatalf("status %d %q, want 202", rec.Code, rec.Body)
+		}
+		var view jobView
+		decode(t, rec, &view)
+		if want := "/jobs/" + view.ID; rec.Header().Get("Location") != want {
+			t.Errorf("Location %q, want %q", rec.Header().Get("Location"), want)
+		}
+		return view
+	}
+	status := func(id string) jobView {
+		t.Helper()
+		rec := serve(mux.ServeHTTP, http.MethodGet, "/jobs/"+id, "")
+		if rec.Code != http.StatusOK {
+			t.Fatalf("status %d %q, want 200", rec.Code, rec.Body)
+		}
+		var view jobView
+		decode(t, rec, &view)
+		return view
+	}
+
+	up := execute("https://example.com/")
+	<-started
+	if view := status(up.ID); view.Status != jobRunning || view.StartedAt == nil {
+		t.Errorf("got job %+v, want it running", view)
+	}
+	// The only worker is busy, so the next job waits for it.
+	down := execute("https://example.com/down")
+	if down.Status != jobPending || down.StartedAt != nil {
+		t.Errorf("got job %+v, want it pending", down)
+	}
+
+	close(release)
+	waitJob(t, e, up.ID)
+	waitJob(t, e, down.ID)
+	view := status(up.ID)
+	if view.Status != jobDone || view.Error != "" || view.FinishedAt == nil || view.DurationSeconds == nil {
+		t.Errorf("got job %+v, want it done", view)
+	}
+	if view.Result == nil || view.Result.PerformanceScore == nil || *view.Result.PerformanceScore != 0.5 {
+		t.Errorf("got result %+v, want a performance score of 0.5", view.Result)
+	}
+	view = status(down.ID)
+	if view.Status != jobFailed || !strings.Contains(view.Error, "Something went wrong") || view.Result != nil {
+		t.Errorf("got job %+v, want it failed", view)
+	}
+
+	if rec := serve(mux.ServeHTTP, http.MethodGet, "/jobs/unknown", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("status %d for an unknown job, want 404", rec.Code)
+	}
+}
+
+func TestExecuteWait(t *testing.T) {
+	e := newTestExporter(t, answerRun)
+	rec := serve(e.executePSI, http.MethodGet, "/execute?url=https://example.com/&strategy=desktop&wait=true", "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d %q, want 200", rec.Code, rec.Body)
+	}
+	var view jobView
+	decode(t, rec, &view)
+	if view.Status != jobDone || view.URL != "https://example.com" || view.Strategy != "desktop" || view.Result == nil {
+		t.Errorf("got job %+v, want it done", view)
+	}
+}
+
+func TestExecuteQueueFull(t *testing.T) {
+	e := newTestExporter(t, answerRun)
+	// A pool without workers or queue has no room for any job.
+	e.pool = &workerPool{queue: make(chan func())}
+	rec := serve(e.executePSI, http.MethodGet, "/execute?url=https://example.com/&strategy=mobile", "")
+	if rec.Code != http.StatusServiceUnavailable || !strings.Contains(rec.Body.String(), errQueueFull.Error()) {
+		t.Errorf("got %d %q, want 503 %q", rec.Code, rec.Body, errQueueFull)
+	}
+}
+
+func TestJobStoreSweep(t *testing.T) {
+	s := newJobStore(time.Minute)
+	finished := s.create(target{URL: "https://example.com", Strategy: "mobile"})
+	s.finish(finished.ID, nil, nil)
+	running := s.create(target{URL: "https://example.com", Strategy: "desktop"})
+	s.start(running.ID)
+
+	now := time.Now()
+	s.sweep(now.Add(30 * time.Second))
+	if _, ok := s.get(finished.ID); !ok {
+		t.Error("swept a job finished within the TTL")
+	}
+	s.sweep(now.Add(2 * time.Minute))
+	if _, ok := s.get(finished.ID); ok {
+		t.Error("kept a job finished more than the TTL ago")
+	}
+	// Unfinished jobs are kept however old they are.
+	if view, ok := s.get(running.ID); !ok || view.Status != jobRunning {
+		t.Errorf("got job %+v, %v, want the running job", view, ok)
+	}
+}
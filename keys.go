@@ -0,0 +1,45 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// apiKeyEnv is the environment variable read when --apikey isn't set, which
+// keeps the key out of the process list.
+const apiKeyEnv = "PSI_API_KEY"
+
+// loadAPIKeys combines the comma-separated --apikey value with the keys in
+// --apikey-file, one per line. Blank lines and lines starting with # are
+// ignored.
+func loadAPIKeys(list, file string) ([]string, error) {
+	var keys []string
+	for _, k := range strings.Split(list, ",") {
+		if k = strings.TrimSpace(k); k != "" {
+			keys = append(keys, k)
+		}
+	}
+	if file == "" {
+		return keys, nil
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, fmt.Errorf("reading --apikey-file: %v", err)
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		keys = append(keys, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("reading --apikey-file: %v", err)
+	}
+	return keys, nil
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Annotations read from Kubernetes Ingresses by --kubernetes.ingress-discovery.
+const (
+	annotationScrape     = "psi.exporter/scrape"
+	annotationStrategies = "psi.exporter/strategy"
+	annotationPath       = "psi.exporter/path"
+)
+
+// kubeServiceAccountDir holds the credentials mounted into every pod.
+const kubeServiceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// kubeIngressLabels are the labels added to the targets discovered from
+// Ingresses. They are always part of the metrics' label set, so Ingresses
+// annotated after startup don't change it.
+var kubeIngressLabels = []string{"kubernetes_ingress", "kubernetes_namespace"}
+
+// ingressList is the subset of a networking.k8s.io/v1 IngressList read by the
+// exporter.
+type ingressList struct {
+	Metadata struct {
+		Continue string `json:"continue"`
+	} `json:"metadata"`
+	Items []struct {
+		Metadata struct {
+			Name        string            `json:"name"`
+			Namespace   string            `json:"namespace"`
+			Annotations map[string]string `json:"annotations"`
+		} `json:"metadata"`
+		Spec struct {
+			Rules []struct {
+				Host string `json:"host"`
+			} `json:"rules"`
+			TLS []struct {
+				Hosts []string `json:"hosts"`
+			} `json:"tls"`
+		} `json:"spec"`
+	} `json:"items"`
+}
+
+// kubeClient lists Ingresses from the Kubernetes API, either at apiURL
+// without credentials (e.g. through kubectl proxy) or, when apiURL is empty,
+// from inside the cluster with the pod's service account.
+type kubeClient struct {
+	apiURL    string
+	tokenFile string
+	client    *http.Client
+}
+
+func newKubeClient(apiURL string) (*kubeClient, error) {
+	if apiURL != "" {
+		return &kubeClient{
+			apiURL: strings.TrimSuffix(apiURL, "/"),
+			client: &http.Client{Timeout: httpDiscoveryTimeout},
+		}, nil
+	}
+
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, fmt.Errorf("not running in a Kubernetes cluster, set --kubernetes.api-url")
+	}
+	ca, err := os.ReadFile(path.Join(kubeServiceAccountDir, "ca.crt"))
+	if err != nil {
+		return nil, fmt.Errorf("reading the service account CA: %v", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, fmt.Errorf("no certificate found in the service account CA")
+	}
+	return &kubeClient{
+		apiURL:    "https://" + net.JoinHostPort(host, port),
+		tokenFile: path.Join(kubeServiceAccountDir, "token"),
+		client: &http.Client{
+			Timeout:   httpDiscoveryTimeout,
+			Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}},
+		},
+	}, nil
+}
+
+// get decodes the JSON response to a GET of the API path into v.
+func (k *kubeClient) get(apiPath string, v any) error {
+	req, err := http.NewRequest(http.MethodGet, k.apiURL+apiPath, nil)
+	if err != nil {
+		return err
+	}
+	if k.tokenFile != "" {
+		// The token is read on every request, as the kubelet rotates it.
+		token, err := os.ReadFile(k.tokenFile)
+		if err != nil {
+			return fmt.Errorf("reading the service account token: %v", err)
+		}
+		req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	}
+	resp, err := k.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// newKubeDiscovery returns a discovery of the hosts of the Ingresses in
+// namespace, or all namespaces when empty, annotated with
+// psi.exporter/scrape: "true".
+func newKubeDiscovery(namespace, ingressNamespace, apiURL string, interval time.Duration) (*targetDiscovery, error) {
+	k, err := newKubeClient(apiURL)
+	if err != nil {
+		return nil, fmt.Errorf("--kubernetes.ingress-discovery: %v", err)
+	}
+	listPath := "/apis/networking.k8s.io/v1/ingresses"
+	if ingressNamespace != "" {
+		listPath = "/apis/networking.k8s.io/v1/namespaces/" + url.PathEscape(ingressNamespace) + "/ingresses"
+	}
+
+	d := newTargetDiscovery(namespace, "kubernetes", "--kubernetes.ingress-discovery", interval, func() ([]targetGroup, error) {
+		var groups []targetGroup
+		next := ""
+		for {
+			query := url.Values{"limit": {"500"}}
+			if next != "" {
+				query.Set("continue", next)
+			}
+			var list ingressList
+			if err := k.get(listPath+"?"+query.Encode(), &list); err != nil {
+				return nil, fmt.Errorf("listing Kubernetes Ingresses: %v", err)
+			}
+			groups = append(groups, ingressGroups(list)...)
+			if next = list.Metadata.Continue; next == "" {
+				return groups, nil
+			}
+		}
+	})
+	d.labelNames = kubeIngressLabels
+	return d, nil
+}
+
+// ingressGroups returns one target group per annotated Ingress, with a URL
+// for each of its hosts. Hosts listed in the Ingress's TLS section are
+// fetched over HTTPS; wildcard hosts are skipped.
+func ingressGroups(list ingressList) []targetGroup {
+	var groups []targetGroup
+	for _, ing := range list.Items {
+		annotations := ing.Metadata.Annotations
+		if annotations[annotationScrape] != "true" {
+			continue
+		}
+		urlPath := annotations[annotationPath]
+		if !strings.HasPrefix(urlPath, "/") {
+			urlPath = "/" + urlPath
+		}
+		var tlsHosts []string
+		for _, t := range ing.Spec.TLS {
+			tlsHosts = append(tlsHosts, t.Hosts...)
+		}
+
+		g := targetGroup{
+			Labels: map[string]string{
+				"kubernetes_namespace": ing.Metadata.Namespace,
+				"kubernetes_ingress":   ing.Metadata.Name,
+			},
+		}
+		for _, rule := range ing.Spec.Rules {
+			if rule.Host == "" || strings.HasPrefix(rule.Host, "*") {
+				continue
+			}
+			scheme := "http"
+			if slices.Contains(tlsHosts, rule.Host) {
+				scheme = "https"
+			}
+			if u := scheme + "://" + rule.Host + urlPath; !slices.Contains(g.Targets, u) {
+				g.Targets = append(g.Targets, u)
+			}
+		}
+		for _, s := range strings.Split(annotations[annotationStrategies], ",") {
+			if s = strings.TrimSpace(s); s != "" {
+				g.Strategies = append(g.Strategies, s)
+			}
+		}
+		if len(g.Targets) > 0 {
+			groups = append(groups, g)
+		}
+	}
+	return groups
+}
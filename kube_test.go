@@ -0,0 +1,177 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// ingress returns an Ingress of the web namespace as listed by the
+// Kubernetes API.
+func ingress(name string, annotations map[string]string, hosts []string, tlsHosts ...string) map[string]any {
+	var rules []map[string]string
+	for _, h := range hosts {
+		rules = append(rules, map[string]string{"host": h})
+	}
+	return map[string]any{
+		"metadata": map[string]any{"name": name, "namespace": "web", "annotations": annotations},
+		"spec":     map[string]any{"rules": rules, "tls": []map[string]any{{"hosts": tlsHosts}}},
+	}
+}
+
+func TestKubeDiscovery(t *testing.T) {
+	scrape := map[string]string{annotationScrape: "true"}
+	shop := ingress("shop", map[string]string{annotationScrape: "true", annotationPath: "shop", annotationStrategies: "mobile, "},
+		[]string{"shop.example", "*.shop.example", "", "shop.example"}, "shop.example")
+	blog := ingress("blog", scrape, []string{"blog.example"})
+	var mu sync.Mutex
+	// pages are the pages of the Ingress list, served one per request.
+	var pages [][]map[string]any
+	var requests []*http.Request
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		requests = append(requests, r)
+		if r.URL.Path != "/apis/networking.k8s.io/v1/namespaces/web/ingresses" {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		page := 0
+		if c := r.URL.Query().Get("continue"); c != "" {
+			page = int(c[0] - '0')
+		}
+		list := map[string]any{"items": pages[page], "metadata": map[string]string{}}
+		if page+1 < len(pages) {
+			list["metadata"] = map[string]string{"continue": string(rune('0' + page + 1))}
+		}
+		json.NewEncoder(w).Encode(list)
+	}))
+	defer api.Close()
+	// A trailing slash of the API URL is dropped.
+	d, err := newKubeDiscovery("psi", "web", api.URL+"/", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	shopGroup := targetGroup{
+		Targets:    []string{"https://shop.example/shop"},
+		Labels:     map[string]string{"kubernetes_namespace": "web", "kubernetes_ingress": "shop"},
+		Strategies: []string{"mobile"},
+	}
+	blogGroup := targetGroup{
+		Targets: []string{"http://blog.example/"},
+		Labels:  map[string]string{"kubernetes_namespace": "web", "kubernetes_ingress": "blog"},
+	}
+
+	tests := []struct {
+		name    string
+		pages   [][]map[string]any
+		changed bool
+		want    []targetGroup
+	}{
+		{
+			name: "annotated Ingresses",
+			pages: [][]map[string]any{{
+				shop,
+				ingress("internal", nil, []string{"internal.example"}),
+				ingress("disabled", map[string]string{annotationScrape: "false"}, []string{"disabled.example"}),
+				ingress("wildcard", scrape, []string{"*.example"}),
+			}, {blog}},
+			changed: true,
+			want:    []targetGroup{shopGroup, blogGroup},
+		},
+		{
+			name:  "unchanged",
+			pages: [][]map[string]any{{shop}, {blog}},
+			want:  []targetGroup{shopGroup, blogGroup},
+		},
+		{
+			name:    "Ingress removed",
+			pages:   [][]map[string]any{{shop}},
+			changed: true,
+			want:    []targetGroup{shopGroup},
+		},
+		{
+			name:    "Ingress added back",
+			pages:   [][]map[string]any{{blog, shop}},
+			changed: true,
+			want:    []targetGroup{blogGroup, shopGroup},
+		},
+	}
+	for _, tt := range tests {
+		mu.Lock()
+		pages, requests = tt.pages, nil
+		mu.Unlock()
+		changed, err := d.refresh()
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if changed != tt.changed {
+			t.Errorf("%s: got changed %v, want %v", tt.name, changed, tt.changed)
+		}
+		if got := d.current(); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got groups %+v, want %+v", tt.name, got, tt.want)
+		}
+		if len(requests) != len(tt.pages) {
+			t.Errorf("%s: listed %d pages, want %d", tt.name, len(requests), len(tt.pages))
+		}
+		for _, r := range requests {
+			if r.URL.Query().Get("limit") != "500" || r.Header.Get("Authorization") != "" {
+				t.Errorf("%s: got request %s with Authorization %q", tt.name, r.URL, r.Header.Get("Authorization"))
+			}
+		}
+	}
+
+	// Listing a namespace the exporter may not read fails.
+	d, err = newKubeDiscovery("psi", "other", api.URL, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.refresh(); err == nil || !strings.Contains(err.Error(), "listing Kubernetes Ingresses: unexpected status 403 Forbidden") {
+		t.Errorf("got error %v, want 403", err)
+	}
+}
+
+func TestKubeClientToken(t *testing.T) {
+	var auth []string
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth = append(auth, r.Header.Get("Authorization"))
+		w.Write([]byte(`{"items": []}`))
+	}))
+	defer api.Close()
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	k := &kubeClient{apiURL: api.URL, tokenFile: tokenFile, client: api.Client()}
+
+	// The token is read again for every request, as the kubelet rotates
+	// it.
+	for _, token := range []string{"first\n", "second"} {
+		if err := os.WriteFile(tokenFile, []byte(token), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		var list ingressList
+		if err := k.get("/apis/networking.k8s.io/v1/ingresses", &list); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if want := []string{"Bearer first", "Bearer second"}; !reflect.DeepEqual(auth, want) {
+		t.Errorf("sent Authorization %q, want %q", auth, want)
+	}
+
+	os.Remove(tokenFile)
+	if err := k.get("/", &ingressList{}); err == nil || !strings.Contains(err.Error(), "reading the service account token") {
+		t.Errorf("got error %v without a token", err)
+	}
+}
+
+func TestNewKubeClientOutsideCluster(t *testing.T) {
+	t.Setenv("KUBERNETES_SERVICE_HOST", "")
+	if _, err := newKubeDiscovery("psi", "", "", time.Minute); err == nil || !strings.Contains(err.Error(), "set --kubernetes.api-url") {
+		t.Errorf("got error %v outside a cluster", err)
+	}
+}
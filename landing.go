@@ -0,0 +1,48 @@
+package main
+
+import (
+	"html/template"
+	"net/http"
+
+	"github.com/yahyasahaja/prometheus-exporter-pagespeed-insight/pkg/scheduler"
+)
+
+var landingTemplate = template.Must(template.New("landing").Parse(`<!DOCTYPE html>
+<html>
+<head><title>PSI Exporter</title></head>
+<body>
+<h1>PSI Exporter</h1>
+<p>Version {{.Version}} (revision {{.Revision}}) - <a href="/version">build information</a></p>
+<p>Monitoring {{.Targets}} targets. Schedule: {{.Schedule}}.</p>
+<ul>
+<li><a href="/metrics">/metrics</a> - Prometheus metrics</li>
+<li><a href="/ui">/ui</a> - latest scores of every target against their thresholds</li>
+<li><a href="/targets">/targets</a> - fetch state of every target</li>
+<li><a href="/sd">/sd</a> - targets in the format of Prometheus HTTP service discovery</li>
+<li><a href="/grafana/dashboard.json">/grafana/dashboard.json</a> - Grafana dashboard of the targets</li>
+<li>/probe?target=&lt;url&gt;&amp;strategy=&lt;strategy&gt; - fetch a target during the scrape</li>
+<li>/api/v1/history?site=&lt;url&gt; - stored results of a site with --history.file, as CSV from /api/v1/history/export</li>
+<li>/execute?url=&lt;url&gt;&amp;strategy=mobile|desktop - queue a PSI fetch for a URL, then poll /jobs/&lt;id&gt; (<a href="https://github.com/yahyasahaja/prometheus-exporter-pagespeed-insight#execute">documentation</a>)</li>
+<li><a href="/healthz">/healthz</a> and <a href="/readyz">/readyz</a> - liveness and readiness</li>
+</ul>
+</body>
+</html>
+`))
+
+// landingPage serves the exporter's landing page at / and a 404 for every
+// path that isn't handled elsewhere.
+func (e *exporter) landingPage(sched scheduler.Schedule) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		// The schedule describes the current targets' own schedules too.
+		schedule := sched.String()
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		landingTemplate.Execute(w, struct {
+			Version, Revision, Schedule string
+			Targets                     int
+		}{version, revision, schedule, len(e.currentTargets())})
+	}
+}
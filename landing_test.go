@@ -0,0 +1,69 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/yahyasahaja/prometheus-exporter-pagespeed-insight/pkg/scheduler"
+)
+
+func TestLandingPage(t *testing.T) {
+	e := &exporter{targets: []target{
+		{URL: "https://example.com", Strategy: "mobile", Scope: scopePage},
+		{URL: "https://example.com", Strategy: "desktop", Scope: scopePage},
+	}}
+	handler := e.landingPage(scheduler.NewMinutes([]int{0, 30}))
+
+	tests := []struct {
+		method, path string
+		status       int
+		contentType  string
+		// body are parts of the expected body.
+		body []string
+	}{
+		{
+			method: http.MethodGet, path: "/", status: http.StatusOK, contentType: "text/html; charset=utf-8",
+			body: []string{
+				"<title>PSI Exporter</title>",
+				"Version " + version + " (revision " + revision + ")",
+				"Monitoring 2 targets. Schedule: minutes [0 30] of every hour.",
+				`<a href="/metrics">/metrics</a>`,
+				`<a href="/targets">/targets</a>`,
+				"/execute?url=&lt;url&gt;&amp;strategy=mobile|desktop",
+				"/probe?target=&lt;url&gt;&amp;strategy=&lt;strategy&gt;",
+			},
+		},
+		{method: http.MethodHead, path: "/", status: http.StatusOK, contentType: "text/html; charset=utf-8"},
+		{method: http.MethodGet, path: "/?foo=bar", status: http.StatusOK, contentType: "text/html; charset=utf-8", body: []string{"Monitoring 2 targets."}},
+		{method: http.MethodGet, path: "/favicon.ico", status: http.StatusNotFound, contentType: "text/plain; charset=utf-8", body: []string{"404 page not found"}},
+		{method: http.MethodGet, path: "/metrics/", status: http.StatusNotFound, contentType: "text/plain; charset=utf-8", body: []string{"404 page not found"}},
+		{method: http.MethodGet, path: "/index.html", status: http.StatusNotFound, contentType: "text/plain; charset=utf-8", body: []string{"404 page not found"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.method+" "+tt.path, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			handler(rec, httptest.NewRequest(tt.method, tt.path, nil))
+			if rec.Code != tt.status {
+				t.Errorf("status %d, want %d", rec.Code, tt.status)
+			}
+			if got := rec.Header().Get("Content-Type"); got != tt.contentType {
+				t.Errorf("Content-Type %q, want %q", got, tt.contentType)
+			}
+			for _, want := range tt.body {
+				if !strings.Contains(rec.Body.String(), want) {
+					t.Errorf("body %q lacks %q", rec.Body, want)
+				}
+			}
+		})
+	}
+
+	// Without a schedule, the page says so.
+	e = &exporter{}
+	rec := httptest.NewRecorder()
+	e.landingPage(runSchedule{e: e})(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	if want := "Monitoring 0 targets. Schedule: no scheduled fetches."; !strings.Contains(rec.Body.String(), want) {
+		t.Errorf("body %q lacks %q", rec.Body, want)
+	}
+}
@@ -1,244 +1,1141 @@
 package main
 
 import (
+	"cmp"
+	"context"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"regexp"
+	"runtime"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
+	"unicode/utf8"
 
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/exporter-toolkit/web"
+	"github.com/yahyasahaja/prometheus-exporter-pagespeed-insight/pkg/collector"
+	"github.com/yahyasahaja/prometheus-exporter-pagespeed-insight/pkg/crux"
+	"github.com/yahyasahaja/prometheus-exporter-pagespeed-insight/pkg/lighthouse"
+	"github.com/yahyasahaja/prometheus-exporter-pagespeed-insight/pkg/psi"
+	"github.com/yahyasahaja/prometheus-exporter-pagespeed-insight/pkg/scheduler"
+	"github.com/yahyasahaja/prometheus-exporter-pagespeed-insight/pkg/webpagetest"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"golang.org/x/net/idna"
 )
 
+// Build information, injected at build time via -ldflags.
+var (
+	version   = "dev"
+	revision  = "unknown"
+	branch    = "unknown"
+	buildDate = "unknown"
+)
+
+// strategies are the strategies of the PSI API, the default of --strategies.
+var strategies = []string{"mobile", "desktop"}
+
+// metricNamespaceRE matches valid metric name prefixes, including none.
+var metricNamespaceRE = regexp.MustCompile(`^([a-zA-Z_][a-zA-Z0-9_]*)?$`)
+
+// Scopes of the CrUX field data exported for a target.
+const (
+	scopePage   = collector.ScopePage
+	scopeOrigin = collector.ScopeOrigin
+)
+
+// originPrefix marks a --urls entry whose field data is read at origin level.
+const originPrefix = "origin:"
+
 type target struct {
 	URL      string
 	Strategy string
+	// Scope selects whether field data comes from loadingExperience (page)
+	// or originLoadingExperience (origin).
+	Scope string
+	// Labels are custom labels added to every series of the target.
+	Labels map[string]string
+	// Options are the request deadline and retry policy of the target.
+	Options psi.RetryPolicy
+	// Runs is the number of Lighthouse runs per fetch, of which the median
+	// is exported, that of --fetch.runs when zero.
+	Runs int
+	// Categories are the Lighthouse categories requested for the target,
+	// those of --categories when empty.
+	Categories []string
+	// Locale is the locale of the target's reports, also exported as the
+	// locale label, that of --locale when empty.
+	Locale string
+	// QueryParams are added to the URL of every run, and CacheBust, if set,
+	// is a parameter set to a new random value on every run. Neither
+	// changes the site label.
+	QueryParams map[string]string
+	CacheBust   string
+	// APIKey is the key of the target's requests, which rotate between the
+	// global keys when empty.
+	APIKey string
+	// Priority orders the fetches of a run, the highest first.
+	Priority int
+	// Schedule replaces the global schedule for the target when set.
+	Schedule scheduler.Schedule
+	// Baseline enables regression detection for the target when set.
+	Baseline *baselinePolicy
+	// Budgets limit metrics of the target, sorted by metric.
+	Budgets []budget
+	// SLOs are the objectives of the config file, shared by every target.
+	SLOs []slo
+	// Site is the site label after the site_relabel rules of the config
+	// file, if they changed URL.
+	Site string
+	// Backend is the source of the target's results if it isn't PSI, e.g.
+	// backendWebPageTest or backendLighthouse. Targets differing only by
+	// backend are distinct.
+	Backend string
+	// Profile is the scan profile of the target, if any. Targets differing
+	// only by profile are distinct.
+	Profile string
+	// DetailedAudits exports the Lighthouse diagnostics of the target even
+	// without --detailed-audits, and AllAudits every audit without
+	// --export.all-audits.
+	DetailedAudits bool
+	AllAudits      bool
 }
 
-var (
-	perfScore = prometheus.NewGaugeVec(prometheus.GaugeOpts{
-		Name: "psi_performance_score",
-		Help: "Performance score from PSI (0-1 scale)",
-	}, []string{"site", "strategy"})
-
-	fcp = prometheus.NewGaugeVec(prometheus.GaugeOpts{
-		Name: "psi_first_contentful_paint",
-		Help: "First Contentful Paint in milliseconds",
-	}, []string{"site", "strategy"})
-
-	lcp = prometheus.NewGaugeVec(prometheus.GaugeOpts{
-		Name: "psi_largest_contentful_paint",
-		Help: "Largest Contentful Paint in milliseconds",
-	}, []string{"site", "strategy"})
-
-	cls = prometheus.NewGaugeVec(prometheus.GaugeOpts{
-		Name: "psi_cumulative_layout_shift",
-		Help: "Cumulative Layout Shift score",
-	}, []string{"site", "strategy"})
-
-	tbt = prometheus.NewGaugeVec(prometheus.GaugeOpts{
-		Name: "psi_total_blocking_time",
-		Help: "Total Blocking Time in milliseconds",
-	}, []string{"site", "strategy"})
-)
+// series returns the identity of t's series in the collector.
+func (t target) series() collector.Target {
+	return collector.Target{URL: t.URL, Strategy: t.Strategy, Site: t.Site, Scope: t.Scope, Labels: t.Labels, Backend: t.Backend, Profile: t.Profile, AllAudits: t.AllAudits}
+}
 
-func fetchPSIData(apiKey string, target target) {
-	log.Printf("Fetching PSI data for %s (%s)...", target.URL, target.Strategy)
-	url := fmt.Sprintf("https://www.googleapis.com/pagespeedonline/v5/runPagespeed?url=%s&strategy=%s&key=%s", target.URL, target.Strategy, apiKey)
+// site returns the value of the site label of t.
+func (t target) site() string {
+	if t.Site != "" {
+		return t.Site
+	}
+	return t.URL
+}
 
-	// Exponential backoff parameters
-	maxRetries := 5
-	delay := 2 * time.Second
+// validateRetryPolicy checks that a target's retry policy is within the
+// supported ranges.
+func validateRetryPolicy(p psi.RetryPolicy) error {
+	if p.Timeout < 5*time.Second || p.Timeout > 5*time.Minute {
+		return fmt.Errorf("timeout %s must be between 5s and 5m", p.Timeout)
+	}
+	if p.MaxRetries < 0 || p.MaxRetries > 10 {
+		return fmt.Errorf("max retries %d must be between 0 and 10", p.MaxRetries)
+	}
+	if p.InitialBackoff < 0 {
+		return fmt.Errorf("initial backoff %s must not be negative", p.InitialBackoff)
+	}
+	if p.MaxBackoff < 0 {
+		return fmt.Errorf("max backoff %s must not be negative", p.MaxBackoff)
+	}
+	if p.Jitter < 0 || p.Jitter > 1 {
+		return fmt.Errorf("jitter %g must be between 0 and 1", p.Jitter)
+	}
+	return nil
+}
 
-	for retries := 0; retries < maxRetries; retries++ {
-		resp, err := http.Get(url)
+// validateRuns checks the number of runs per fetch of a target.
+func validateRuns(runs int) error {
+	if runs < 1 || runs > 10 {
+		return fmt.Errorf("runs %d must be between 1 and 10", runs)
+	}
+	return nil
+}
+
+// key identifies a target independently of its labels.
+func (t target) key() string {
+	key := t.URL + "|" + t.Strategy + "|" + t.Scope
+	if t.Backend != "" {
+		key += "|" + t.Backend
+	}
+	if t.Profile != "" {
+		key += "|profile=" + t.Profile
+	}
+	return key
+}
+
+// validateTargetURL checks that raw is an absolute http(s) URL with a host.
+func validateTargetURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return fmt.Errorf("invalid URL %q: %v", raw, err)
+	}
+	if !strings.Contains(raw, "://") {
+		return fmt.Errorf("invalid URL %q: missing scheme, e.g. https://%s", raw, raw)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("invalid URL %q: scheme must be http or https", raw)
+	}
+	if u.Host == "" {
+		return fmt.Errorf("invalid URL %q: missing host", raw)
+	}
+	// A doubled or a leading dot is a typo the API only rejects with a 400
+	// on every run.
+	if host := strings.TrimSuffix(u.Hostname(), "."); slices.Contains(strings.Split(host, "."), "") {
+		return fmt.Errorf("invalid URL %q: invalid host %q", raw, u.Hostname())
+	}
+	return nil
+}
+
+// normalizeTargetURL validates raw like validateTargetURL and returns its
+// canonical form, so that spellings of the same page share one set of series:
+// the scheme and host are lowercased, an internationalized host is converted
+// to its ASCII (punycode) form, default and empty ports and the fragment are
+// dropped, and a trailing slash is removed from the path.
+func normalizeTargetURL(raw string) (string, error) {
+	if err := validateTargetURL(raw); err != nil {
+		return "", err
+	}
+	u, _ := url.Parse(raw)
+	u.Scheme = strings.ToLower(u.Scheme)
+	host, port := strings.ToLower(u.Hostname()), u.Port()
+	// url.URL.String would percent-encode the host instead.
+	if strings.ContainsFunc(host, func(r rune) bool { return r >= utf8.RuneSelf }) {
+		ascii, err := idna.Lookup.ToASCII(host)
 		if err != nil {
-			log.Printf("Error fetching PSI: %v", err)
-			time.Sleep(delay)
-			delay *= 2 // Increase delay for next retry
-			continue
+			return "", fmt.Errorf("invalid URL %q: invalid host %q: %v", raw, u.Hostname(), err)
 		}
-		defer resp.Body.Close()
+		host = ascii
+	}
+	if (u.Scheme == "http" && port == "80") || (u.Scheme == "https" && port == "443") {
+		port = ""
+	}
+	if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+	if port != "" {
+		host += ":" + port
+	}
+	u.Host = host
+	u.Fragment, u.RawFragment = "", ""
+	u.Path = strings.TrimRight(u.Path, "/")
+	u.RawPath = strings.TrimRight(u.RawPath, "/")
+	return u.String(), nil
+}
 
-		var data map[string]interface{}
-		if err := json.NewDecoder(resp.Body).Decode(&data); err != nil {
-			log.Printf("Error decoding PSI response: %v", err)
-			time.Sleep(delay)
-			delay *= 2
-			continue
+// validateStrategy checks that s is a strategy supported by the PSI API.
+func validateStrategy(s string) error {
+	for _, known := range strategies {
+		if s == known {
+			return nil
 		}
+	}
+	return fmt.Errorf("invalid strategy %q: must be one of %s", s, strings.Join(strategies, ", "))
+}
 
-		// Check if the expected fields are available in the response
-		result, ok := data["lighthouseResult"].(map[string]interface{})
-		if !ok {
-			log.Println("Invalid response structure: missing 'lighthouseResult'", data)
-			time.Sleep(delay)
-			delay *= 2
-			continue
+// validateCategory checks that c is a Lighthouse category scored by the PSI
+// API.
+func validateCategory(c string) error {
+	for _, known := range psi.Categories {
+		if c == known {
+			return nil
 		}
+	}
+	return fmt.Errorf("invalid category %q: must be one of %s", c, strings.Join(psi.Categories, ", "))
+}
 
-		categories, ok := result["categories"].(map[string]interface{})
-		if !ok {
-			log.Println("Invalid response structure: missing 'categories'")
-			time.Sleep(delay)
-			delay *= 2
-			continue
-		}
+// localeRE matches BCP 47 language tags such as "de" or "pt-BR".
+var localeRE = regexp.MustCompile(`^[a-zA-Z]{2,3}(-[a-zA-Z0-9]{2,8})*$`)
 
-		performance, ok := categories["performance"].(map[string]interface{})
-		if !ok {
-			log.Println("Invalid response structure: missing 'performance' category")
-			time.Sleep(delay)
-			delay *= 2
-			continue
-		}
+// validateLocale checks that locale looks like a locale of the PSI API.
+func validateLocale(locale string) error {
+	if !localeRE.MatchString(locale) {
+		return fmt.Errorf("invalid locale %q: must be a language tag such as de or pt-BR", locale)
+	}
+	return nil
+}
+
+// fetchPSIData fetches target, or waits for the fetch of target already in
+// flight and shares its outcome.
+func (e *exporter) fetchPSIData(target target) (*collector.Result, error) {
+	result, shared, err := e.flights.do(target.key(), func() (*collector.Result, error) {
+		return e.fetch(target)
+	})
+	if shared {
+		e.logger.Debug("Joined the fetch already in flight", "site", target.URL, "strategy", target.Strategy)
+	}
+	return result, err
+}
 
-		// Extract performance score and other data
-		labels := prometheus.Labels{"site": target.URL, "strategy": target.Strategy}
+// fetch runs PSI for target and records the outcome in the metrics, the
+// status and the result cache.
+func (e *exporter) fetch(target target) (*collector.Result, error) {
+	if err := e.ctx.Err(); err != nil {
+		return nil, err
+	}
+	e.inFlight.add(1)
+	defer e.inFlight.add(-1)
+	logger := e.logger.With("site", target.URL, "strategy", target.Strategy)
+	logger.Info("Fetching PSI data")
+	e.status.attempted(target, time.Now())
 
-		if score, ok := performance["score"].(float64); ok {
-			perfScore.With(labels).Set(score)
+	client := e.client.WithRetryPolicy(target.Options).WithOnRetry(func(string, string) {
+		e.metrics.fetchRetries.WithLabelValues(e.metrics.targetValues(target)...).Inc()
+	}).WithOnError(func(_, _, reason string) {
+		e.metrics.apiErrors.WithLabelValues(e.metrics.targetValues(target, reason)...).Inc()
+	})
+	runner := e.lighthouse
+	if len(target.Categories) > 0 || target.Locale != "" {
+		request := psi.RequestOptions{Categories: target.Categories, Locale: cmp.Or(target.Locale, e.locale)}
+		if len(request.Categories) == 0 {
+			request.Categories = e.categories
 		}
-
-		audits, ok := result["audits"].(map[string]interface{})
-		if ok {
-			// Extract FCP, LCP, CLS, TBT
-			if v, ok := audits["first-contentful-paint"].(map[string]interface{})["numericValue"].(float64); ok {
-				fcp.With(labels).Set(v)
+		client = client.WithRequestOptions(request)
+		runner = runner.WithRequestOptions(request)
+	}
+	if target.APIKey != "" {
+		client = client.WithKey(target.APIKey)
+	}
+	start := time.Now()
+	runs := target.Runs
+	if runs == 0 {
+		runs = e.runs
+	}
+	// Each run is a request of its own, subject to the rate limit and the
+	// retries. A fetch fails only if every run failed.
+	var results []*psi.Result
+	// reportIDs are the IDs of the archived reports of results.
+	reportIDs := map[*psi.Result]string{}
+	var err error
+	var b backend = client
+	switch target.Backend {
+	case backendWebPageTest:
+		b = e.webpagetest
+	case backendLighthouse:
+		b = runner
+	}
+	for i := range runs {
+		res, runErr := b.Run(e.requests, target.requestURL(), target.Strategy)
+		if runErr != nil {
+			err = runErr
+			if e.requests.Err() != nil {
+				break
 			}
-			if v, ok := audits["largest-contentful-paint"].(map[string]interface{})["numericValue"].(float64); ok {
-				lcp.With(labels).Set(v)
+			if runs > 1 {
+				logger.Warn("Lighthouse run failed", "run", i+1, "runs", runs, "err", runErr)
 			}
-			if v, ok := audits["cumulative-layout-shift"].(map[string]interface{})["numericValue"].(float64); ok {
-				cls.With(labels).Set(v)
+			continue
+		}
+		res.RequestedURL = target.stripQueryParams(res.RequestedURL)
+		res.FinalURL = target.stripQueryParams(res.FinalURL)
+		results = append(results, res)
+		e.metrics.labHistograms.observe(e.metrics.targetValues(target), res)
+		// The archive only holds Lighthouse reports.
+		if e.reports != nil && target.Backend != backendWebPageTest {
+			id, err := e.reports.archive(logger, target, time.Now(), res)
+			if err != nil {
+				logger.Error("Failed to archive the Lighthouse report", "err", err)
 			}
-			if v, ok := audits["total-blocking-time"].(map[string]interface{})["numericValue"].(float64); ok {
-				tbt.With(labels).Set(v)
+			if id != "" {
+				reportIDs[res] = id
 			}
 		}
+	}
+	if err != nil && e.requests.Err() != nil {
+		// Interrupted by shutdown, which says nothing about the target.
+		logger.Info("Fetch cancelled by shutdown")
+		return nil, err
+	}
+	if len(results) > 0 {
+		err = nil
+	}
+	e.metrics.fetchDuration.WithLabelValues(e.metrics.targetValues(target)...).Observe(time.Since(start).Seconds())
+	if err != nil {
+		e.metrics.fetchFailures.WithLabelValues(e.metrics.targetValues(target)...).Inc()
+		logger.Error("Failed to fetch PSI data", "attempts", target.Options.MaxRetries+1, "err", err)
+		failures := e.status.failed(target, time.Now(), err)
+		e.metrics.results.Failed(target.series())
+		e.metrics.runtimeError.DeletePartialMatch(e.metrics.targetLabels(target))
+		var runtimeErr *psi.RuntimeError
+		if errors.As(err, &runtimeErr) {
+			e.metrics.runtimeError.WithLabelValues(e.metrics.targetValues(target, runtimeErr.Code)...).Set(1)
+		}
+		// Quota errors say nothing about the target itself.
+		var quotaErr *psi.QuotaError
+		if e.quarantineAfter > 0 && failures >= e.quarantineAfter && !errors.As(err, &quotaErr) {
+			until := time.Now().Add(e.quarantineFor)
+			e.status.quarantine(target, until)
+			e.metrics.quarantined.WithLabelValues(e.metrics.targetValues(target)...).Set(1)
+			logger.Warn("Quarantining failing target", "consecutive_failures", failures, "until", until)
+		}
+		return nil, err
+	}
+	e.metrics.quarantined.WithLabelValues(e.metrics.targetValues(target)...).Set(0)
+	e.metrics.runtimeError.DeletePartialMatch(e.metrics.targetLabels(target))
 
-		// If we reached here, the response was valid and processed successfully
-		return
+	extracted := e.metrics.results.SetRuns(logger, target.series(), results, e.detailedAudits || target.DetailedAudits)
+	if e.reports != nil && target.Backend != backendWebPageTest {
+		// Only the report of the exported run is linked, per profile.
+		stale := prometheus.Labels{"site": target.site(), "strategy": target.Strategy}
+		if target.Profile != "" {
+			stale[profileLabel] = target.Profile
+		}
+		e.metrics.reportInfo.DeletePartialMatch(stale)
+		median, _ := collector.MedianRun(results)
+		if id, ok := reportIDs[median]; ok {
+			e.metrics.reportInfo.WithLabelValues(e.metrics.targetValues(target, id)...).Set(1)
+		}
 	}
+	if e.cache != nil {
+		e.cache.put(target, extracted)
+	}
+	now := time.Now()
+	e.status.succeeded(target, now, extracted)
+	if target.Baseline != nil && extracted.PerformanceScore != nil {
+		e.checkRegression(target, *extracted.PerformanceScore, logger)
+	}
+	e.checkBudgets(target, extracted, logger)
+	if e.history != nil {
+		if err := e.history.add(target, now, extracted); err != nil {
+			logger.Error("Failed to record the result in the history", "err", err)
+		}
+	}
+	return extracted, nil
+}
+
+// exporter holds the state shared by the scheduler and the HTTP handlers.
+type exporter struct {
+	// ctx is cancelled on shutdown, after which no fetch starts.
+	ctx context.Context
+	// requests is cancelled once the fetches in flight at shutdown had
+	// their grace period, aborting those still running.
+	requests context.Context
+	inFlight inFlight
+	// ready is reported by /readyz.
+	ready   atomic.Bool
+	client  *psi.Client
+	logger  *slog.Logger
+	metrics *metrics
+	// namespace prefixes the names of the metrics built for /probe, which
+	// carry constLabels like every other metric.
+	namespace   string
+	constLabels map[string]string
+	// probeModules are the modules selectable with /probe?module=.
+	probeModules map[string]probeModule
+	// detailedAudits enables the export of Lighthouse diagnostics.
+	detailedAudits bool
+	// allAudits enables the export of every audit.
+	allAudits bool
+	// quarantineAfter consecutive failures make scheduled runs skip a target
+	// for quarantineFor. Zero disables the quarantine.
+	quarantineAfter int
+	quarantineFor   time.Duration
+	// spread is how the fetches of a scheduled run are spread until the
+	// next run, one of the spread* modes.
+	spread string
+	// maintenance are the windows during which runs fetch nothing.
+	maintenance []maintenanceWindow
+	// history is nil unless --history.file is set.
+	history *historyStore
+	// reports is nil unless --reports.url is set.
+	reports     *reportArchive
+	regressions regressions
+	// store is nil unless --persist.file is set.
+	store *resultStore
+	// pusher is nil unless push mode is enabled.
+	pusher *pusher
+	// notifier is nil unless --notify.webhook-url or
+	// --notify.slack-webhook-url is set.
+	notifier *notifier
+	// cache is nil when the /execute cache is disabled.
+	cache *resultCache
+	// fetchDefaults is the retry policy of targets requested via /execute.
+	fetchDefaults psi.RetryPolicy
+	// webpagetest runs the targets of the webpagetest backend.
+	webpagetest *webpagetest.Client
+	// lighthouse runs the targets of the lighthouse backend.
+	lighthouse *lighthouse.Runner
+	// crux is nil unless the history is enabled and a CrUX API key is
+	// available, and cruxPeriods the number of periods it backfills.
+	crux        *crux.Client
+	cruxPeriods int
+	// strategies are those of --strategies, fetched for targets and
+	// /execute requests that don't name theirs.
+	strategies []string
+	// runs is the number of runs per fetch of targets without their own.
+	runs int
+	// categories and locale are the Lighthouse categories and locale
+	// requested by probes without a module and by /execute.
+	categories []string
+	locale     string
+	// maxExecuteTargets caps the URL/strategy pairs of a POST /execute.
+	maxExecuteTargets int
+	// executeLabels are the label names /execute and /probe requests may set.
+	executeLabels []string
+	// guard authenticates and rate limits the manual fetches of /execute,
+	// /api/v1/runs and /probe.
+	guard  *executeGuard
+	pool   *workerPool
+	jobs   *jobStore
+	status *targetStatus
 
-	// After all retries, log the failure
-	log.Printf("Failed to fetch data for %s after %d retries.", target.URL, maxRetries)
+	// targets are the targets of scheduled runs, replaced on reload.
+	targetsMu sync.RWMutex
+	targets   []target
+	// tenants are the tenants of the config file by name, replaced with
+	// the targets.
+	tenants map[string]tenant
+	// config is the configuration served by /api/v1/config.
+	config configView
+
+	// pauses are the pauses of scheduled fetches set through /api/v1/pause.
+	pauses *pauseState
+	// quotaPause holds back scheduled fetches while every key is over quota.
+	quotaPause quotaPause
+	// flights coalesces concurrent fetches of the same target.
+	flights flightGroup
 }
 
-// New endpoint to execute PSI for a given URL and strategy
-func executePSI(w http.ResponseWriter, r *http.Request, apiKey string) {
-	url := r.URL.Query().Get("url")
-	strategy := r.URL.Query().Get("strategy")
+// quotaPause postpones the fetches of scheduled runs until the PSI API
+// accepts requests again.
+type quotaPause struct {
+	mu    sync.Mutex
+	until time.Time
+}
 
-	if url == "" || strategy == "" {
-		http.Error(w, "Missing URL or strategy", http.StatusBadRequest)
+// extend postpones fetches until at least until, and reports whether this
+// moved the end of the pause.
+func (p *quotaPause) extend(until time.Time) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !until.After(p.until) {
+		return false
+	}
+	p.until = until
+	return true
+}
+
+// wait blocks until the pause is over or ctx is done.
+func (p *quotaPause) wait(ctx context.Context) {
+	p.mu.Lock()
+	d := time.Until(p.until)
+	p.mu.Unlock()
+	if d <= 0 {
 		return
 	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+}
+
+// shutdownTimeout bounds how long shutdown waits for the HTTP handlers, the
+// cancelled fetches and the final OTLP export.
+const shutdownTimeout = 10 * time.Second
+
+// runTargets queues a fetch for every target on the worker pool, waits for
+// all of them to complete and logs a summary of the run. With a spread mode,
+// the fetches are queued at offsets across window instead of all at once.
+// When every API key is over its quota, the remaining fetches are postponed
+// until the API accepts requests again, and the target that hit the quota is
+// fetched again. It returns the number of fetches that failed.
+func (e *exporter) runTargets(targets []target, window time.Duration) int {
+	start := time.Now()
+	var (
+		wg     sync.WaitGroup
+		mu     sync.Mutex
+		failed int
+	)
+	due := make([]target, 0, len(targets))
+	paused := 0
+	for _, t := range targets {
+		if e.pauses.paused(t) {
+			e.logger.Debug("Skipping paused target", "site", t.URL, "strategy", t.Strategy)
+			paused++
+			continue
+		}
+		if e.status.quarantined(t, start) {
+			e.logger.Debug("Skipping quarantined target", "site", t.URL, "strategy", t.Strategy)
+			continue
+		}
+		due = append(due, t)
+	}
+	// Whatever cuts a run short or holds it back, a maintenance window, the
+	// shutdown or the quota, hits its last fetches, so the important ones go
+	// first.
+	slices.SortStableFunc(due, func(a, b target) int { return b.Priority - a.Priority })
+	skipped := len(targets) - len(due) - paused
+	offsets := spreadOffsets(e.spread, len(due), window)
+	queued := 0
+	for i, t := range due {
+		// The fetches not queued yet when shutting down are dropped.
+		if !e.sleepUntil(start.Add(offsets[i])) {
+			break
+		}
+		if until := e.inMaintenance(time.Now()); !until.IsZero() {
+			e.logger.Info("Skipping fetches during maintenance window", "targets", len(due)-i, "until", until)
+			break
+		}
+		if e.pauses.pausedAll() {
+			e.logger.Info("Skipping fetches while paused", "targets", len(due)-i)
+			break
+		}
+		queued++
+		wg.Add(1)
+		e.pool.submit(func() {
+			defer wg.Done()
+			e.quotaPause.wait(e.ctx)
+			_, err := e.fetchPSIData(t)
+			if e.postponeOnQuota(err) {
+				e.quotaPause.wait(e.ctx)
+				_, err = e.fetchPSIData(t)
+				e.postponeOnQuota(err)
+			}
+			if err != nil {
+				mu.Lock()
+				failed++
+				mu.Unlock()
+			}
+		})
+	}
+	wg.Wait()
+	duration := time.Since(start)
+	e.metrics.cycleDuration.Set(duration.Seconds())
+	// The window of a scheduled run ends with the next run.
+	if window > 0 && duration > window {
+		e.metrics.cycleOverruns.Inc()
+	}
+	e.updateStrategyGaps()
+	e.logger.Info("Fetch run finished", "targets", len(targets), "succeeded", queued-failed, "failed", failed, "quarantined", skipped, "paused", paused, "duration", duration)
+	if e.pusher != nil {
+		e.pusher.push(time.Now())
+	}
+	e.saveResults()
+	return failed
+}
 
-	// Call fetchPSIData for the provided URL and strategy
-	target := target{URL: url, Strategy: strategy}
-	fetchPSIData(apiKey, target)
+// sleepUntil waits until t, and reports false if the exporter shuts down
+// first.
+func (e *exporter) sleepUntil(t time.Time) bool {
+	d := time.Until(t)
+	if d <= 0 {
+		return e.ctx.Err() == nil
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-e.ctx.Done():
+		return false
+	}
+}
 
-	// Prepare the response
-	response := map[string]interface{}{
-		"performance_score": perfScore,
-		"cls":               cls,
-		"fcp":               fcp,
-		"lcp":               lcp,
-		"tbt":               tbt,
-		"rawData":           r,
+// postponeOnQuota extends the quota pause if err reports that every API key
+// is over its quota, and reports whether it did. The own key of a target
+// being over its quota holds back only that target's fetches, as the other
+// targets bill other keys.
+func (e *exporter) postponeOnQuota(err error) bool {
+	var quotaErr *psi.QuotaError
+	if !errors.As(err, &quotaErr) || quotaErr.Pinned {
+		return false
 	}
+	if e.quotaPause.extend(quotaErr.Until) {
+		e.logger.Warn("Every API key is over its quota, postponing fetches", "until", quotaErr.Until)
+	}
+	return true
+}
+
+// runJob executes a queued job and records its outcome.
+func (e *exporter) runJob(j *job) {
+	e.jobs.start(j.ID)
+	result, err := e.fetchPSIData(j.target)
+	e.jobs.finish(j.ID, result, err)
+}
 
-	// Return JSON response
+// jobStatus reports the state of a job created by /execute or
+// /api/v1/runs.
+func (e *exporter) jobStatus(w http.ResponseWriter, r *http.Request) {
+	view, ok := e.jobs.get(r.PathValue("id"))
+	if !ok {
+		http.Error(w, "Job not found", http.StatusNotFound)
+		return
+	}
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(response)
+	json.NewEncoder(w).Encode(view)
 }
 
-func expandTargets(urls []string) []target {
-	strategies := []string{"mobile", "desktop"}
-	targets := []target{}
-	for _, u := range urls {
-		u = strings.TrimSpace(u)
-		if u == "" {
-			continue
-		}
-		for _, s := range strategies {
-			targets = append(targets, target{URL: u, Strategy: s})
-		}
+// webFlags returns the exporter-toolkit settings serving server on its
+// address with the TLS and basic auth settings of webConfigFile.
+func webFlags(server *http.Server, webConfigFile string) *web.FlagConfig {
+	systemdSocket := false
+	return &web.FlagConfig{
+		WebListenAddresses: &[]string{server.Addr},
+		WebSystemdSocket:   &systemdSocket,
+		WebConfigFile:      &webConfigFile,
 	}
-	return targets
 }
 
-func parseMinutes(minArg string) []int {
-	parts := strings.Split(minArg, ",")
-	minutes := []int{}
-	if len(parts) == 0 {
-		log.Println("Warning: No minutes specified, no fetch will occur.")
+// readTokenFile returns the bearer token in path, which must not be empty.
+func readTokenFile(path string) (string, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
 	}
-	for _, p := range parts {
-		if val, err := strconv.Atoi(strings.TrimSpace(p)); err == nil && val >= 0 && val < 60 {
-			minutes = append(minutes, val)
-		}
+	token := strings.TrimSpace(string(raw))
+	if token == "" {
+		return "", errors.New("file is empty")
 	}
-	return minutes
+	return token, nil
 }
 
 func main() {
-	apiKey := flag.String("apikey", "", "Google PageSpeed Insights API key")
-	urlsArg := flag.String("urls", "", "Comma-separated list of URLs to monitor")
-	minutesArg := flag.String("minutes", "0,30", "Comma-separated list of minutes in an hour to run fetch")
-	port := flag.String("port", "2112", "Port to run the exporter on")
-	withInitialFetch := flag.Bool("initial", false, "Fetch initial data")
-	flag.Parse()
+	command, args := splitCommand(os.Args[1:])
+	cfg := registerFlags(flag.CommandLine)
+	flag.Usage = usage(flag.CommandLine)
+	flag.CommandLine.Parse(args)
+	if errs := applyEnv(flag.CommandLine, os.LookupEnv); len(errs) > 0 {
+		for _, err := range errs {
+			fmt.Fprintln(os.Stderr, err)
+		}
+		os.Exit(1)
+	}
+	if cfg.dryRun {
+		cfg.checkConfig, cfg.verifyKey = true, true
+	}
+	switch command {
+	case cmdValidate:
+		cfg.checkConfig = true
+	case cmdFetch:
+		if flag.NArg() == 0 {
+			fmt.Fprintln(os.Stderr, "fetch requires at least one URL")
+			os.Exit(1)
+		}
+		// Only the URLs given are fetched, with the settings of the other
+		// flags and the config file, so targets aren't discovered.
+		cfg.urls, cfg.once = strings.Join(flag.Args(), ","), false
+		cfg.targetsFile, cfg.targetsHTTPURL, cfg.kubeIngressDiscovery, cfg.adminTokenFile = "", "", false, ""
+	}
+
+	logger, err := newLogger(os.Stderr, cfg.logLevel, cfg.logFormat)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	if cfg.targetsHTTPURL != "" {
+		cfg.discoveries = append(cfg.discoveries, newHTTPDiscovery(cfg.metricNamespace, cfg.targetsHTTPURL, cfg.targetsHTTPRefresh))
+	}
+	if cfg.kubeIngressDiscovery {
+		d, err := newKubeDiscovery(cfg.metricNamespace, cfg.kubeNamespace, cfg.kubeAPIURL, cfg.kubeRefresh)
+		if err != nil {
+			logger.Error("Invalid configuration", "err", err)
+			os.Exit(1)
+		}
+		cfg.discoveries = append(cfg.discoveries, d)
+	}
+	var adminToken string
+	if cfg.adminTokenFile != "" {
+		if adminToken, err = readTokenFile(cfg.adminTokenFile); err != nil {
+			logger.Error("Invalid configuration", "err", fmt.Errorf("--admin.token-file: %v", err))
+			os.Exit(1)
+		}
+		if cfg.runtimeTargets, err = loadRuntimeTargets(cfg.adminTargetsFile); err != nil {
+			logger.Error("Invalid configuration", "err", err)
+			os.Exit(1)
+		}
+	}
+	var executeToken string
+	if cfg.executeTokenFile != "" {
+		if executeToken, err = readTokenFile(cfg.executeTokenFile); err != nil {
+			logger.Error("Invalid configuration", "err", fmt.Errorf("--execute.token-file: %v", err))
+			os.Exit(1)
+		}
+	}
+	var discoveryErrs []error
+	for _, d := range cfg.discoveries {
+		if _, err := d.refresh(); err != nil {
+			discoveryErrs = append(discoveryErrs, err)
+		}
+	}
+
+	// base is kept for reloads, as resolve applies the config file to cfg.
+	base := *cfg
+	s, errs := cfg.resolve(flag.CommandLine)
+	if cfg.checkConfig {
+		errs = append(errs, discoveryErrs...)
+		if len(errs) == 0 {
+			errs = checkConfig(os.Stdout, s, cfg.verifyKey)
+		}
+		for _, err := range errs {
+			fmt.Fprintln(os.Stderr, "error:", err)
+		}
+		if len(errs) > 0 {
+			os.Exit(1)
+		}
+		fmt.Println("Configuration OK")
+		return
+	}
+	if len(errs) > 0 {
+		for _, err := range errs {
+			logger.Error("Invalid configuration", "err", err)
+		}
+		os.Exit(1)
+	}
+	rules := ruleGenerator{namespace: cfg.metricNamespace, global: s.schedule, cycles: cfg.rulesCycles}
+	if command == cmdRules {
+		if err := rules.writeRules(os.Stdout, s.targets); err != nil {
+			logger.Error("Failed to write the alerting rules", "err", err)
+			os.Exit(1)
+		}
+		return
+	}
+	for _, t := range s.duplicates {
+		logger.Warn("Ignoring duplicate target", "site", t.URL, "strategy", t.Strategy)
+	}
+	for _, err := range discoveryErrs {
+		logger.Warn("Failed to fetch the initial discovered targets, retrying on the next refresh", "err", err)
+	}
+
+	m := newMetrics(collector.Opts{
+		Namespace:    cfg.metricNamespace,
+		TargetLabels: s.labelNames,
+		Timestamps:   cfg.metricsTimestamps,
+		AllAudits:    cfg.exportAllAudits,
+		MaxAge:       cfg.metricsMaxAge,
+	}, cfg.labHistograms)
+	registry := prometheus.NewRegistry()
+	// Everything registered with reg carries the --metrics.const-labels.
+	reg := prometheus.WrapRegistererWith(s.constLabels, registry)
+	reg.MustRegister(m.collectors()...)
+	for _, d := range cfg.discoveries {
+		reg.MustRegister(d.collectors()...)
+	}
+	var quota *quotaTracker
+	if cfg.apiKeyDailyQuota > 0 {
+		quota = newQuotaTracker(cfg.metricNamespace, len(s.keys), cfg.apiKeyDailyQuota)
+		reg.MustRegister(quota)
+	}
+	// The runtime metrics of a --once run would clash with those of the
+	// node exporter reading its output.
+	if !cfg.disableExporterMetrics && !cfg.once {
+		reg.MustRegister(
+			collectors.NewGoCollector(),
+			collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		)
+	}
+	m.buildInfo.WithLabelValues(version, revision, branch, buildDate, runtime.Version()).Set(1)
+	m.reloadSuccess.Set(1)
+	m.reloadTime.SetToCurrentTime()
+
+	psiConfig := s.psiConfig()
+	psiConfig.KeyCooldown = cfg.apiKeyCooldown
+	psiConfig.Request = psi.RequestOptions{Categories: s.categories, Locale: s.locale}
+	psiConfig.RateLimit = cfg.fetchRateLimit
+	psiConfig.RateBurst = cfg.fetchRateBurst
+	psiConfig.Logger = logger
+	psiConfig.OnQuotaError = func(keyIndex int) {
+		m.apiKeyErrors.WithLabelValues(strconv.Itoa(keyIndex)).Inc()
+	}
+	psiConfig.OnRequest = func(keyIndex int, outcome string) {
+		m.apiRequests.WithLabelValues(outcome).Inc()
+		if quota != nil {
+			quota.record(keyIndex, outcome)
+		}
+	}
+	client, err := psi.New(psiConfig)
+	if err != nil {
+		logger.Error("Failed to create PSI client", "err", err)
+		os.Exit(1)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	requests, cancelRequests := context.WithCancel(context.Background())
+	defer cancelRequests()
+
+	e := &exporter{
+		ctx:      ctx,
+		requests: requests,
+		client:   client,
+		logger:   logger,
+		metrics:  m,
+		pool:     newWorkerPool(cfg.maxConcurrency, fetchQueueSize),
+		jobs:     newJobStore(cfg.jobsTTL),
+		status:   newTargetStatus(s.targets, s.schedule),
+		pauses:   &pauseState{targets: map[pausedTarget]bool{}},
 
-	if *apiKey == "" || *urlsArg == "" {
-		log.Fatal("Both --apikey and --urls must be provided")
+		namespace:         cfg.metricNamespace,
+		constLabels:       s.constLabels,
+		probeModules:      s.probeModules,
+		fetchDefaults:     s.fetchDefaults,
+		strategies:        s.strategies,
+		webpagetest:       webpagetest.New(s.webpagetest),
+		lighthouse:        lighthouse.New(s.lighthouse),
+		runs:              s.runs,
+		categories:        s.categories,
+		locale:            s.locale,
+		detailedAudits:    cfg.detailedAudits,
+		allAudits:         cfg.exportAllAudits,
+		quarantineAfter:   cfg.quarantineAfter,
+		quarantineFor:     cfg.quarantineDuration,
+		spread:            s.spread,
+		maintenance:       s.maintenance,
+		maxExecuteTargets: cfg.executeMaxTargets,
+		executeLabels:     s.executeLabels,
 	}
+	if cfg.pushGatewayURL != "" || cfg.pushRemoteWriteURL != "" {
+		e.pusher = newPusher(registry, cfg.pushGatewayURL, cfg.pushRemoteWriteURL, cfg.pushJob, cfg.pushInstance, m.pushFailures, logger)
+	}
+	if cfg.notifyWebhookURL != "" || cfg.notifySlackURL != "" {
+		e.notifier = newNotifier(cfg.notifyWebhookURL, cfg.notifySlackURL, cfg.notifyDebounce, m.notificationFailures, logger)
+	}
+	if cfg.executeCacheTTL > 0 {
+		e.cache = newResultCache(cfg.executeCacheTTL, cfg.executeCacheSize)
+	}
+	e.guard = &executeGuard{token: executeToken, hosts: s.executeHosts, perMinute: cfg.executeClientRateLimit, rejected: m.executeRejected}
+	if cfg.executeTargetsOnly {
+		e.guard.targets = e.currentTargets
+	}
+	go e.jobs.collectGarbage(time.Minute)
 
-	urls := strings.Split(*urlsArg, ",")
-	targets := expandTargets(urls)
-	fetchMinutes := parseMinutes(*minutesArg)
+	var meterProvider *sdkmetric.MeterProvider
+	if cfg.otlpEndpoint != "" {
+		var err error
+		// The headers were validated with the rest of the configuration.
+		headers, _ := parseOTLPHeaders(cfg.otlpHeaders)
+		if meterProvider, err = newMeterProvider(cfg.otlpEndpoint, cfg.otlpInsecure, headers, cfg.otlpInterval, registry, m.pushFailures, logger); err != nil {
+			logger.Error("Failed to set up OTLP export", "err", err)
+			os.Exit(1)
+		}
+	}
 
-	prometheus.MustRegister(perfScore, fcp, lcp, cls, tbt)
+	e.setTargets(s.targets)
+	e.setTenants(s.tenants)
+	e.setConfig(newConfigView(cfg, s))
+	if cfg.historyFile != "" {
+		if e.history, err = openHistory(cfg.historyFile, cfg.historyRetention); err != nil {
+			logger.Error("Failed to open the history", "err", err)
+			os.Exit(1)
+		}
+		go e.history.compact(logger)
+		reg.MustRegister(newSLOCollector(e, cfg.metricNamespace))
+		e.seedRegressions()
+		if s.cruxAPIKey != "" {
+			cruxConfig := crux.Config{APIKey: s.cruxAPIKey, BaseURL: cfg.cruxAPIURL}
+			if s.client != nil {
+				cruxConfig.HTTPClient = &http.Client{Transport: s.client.Transport, Timeout: time.Minute}
+			}
+			e.crux = crux.New(cruxConfig)
+			e.cruxPeriods = cfg.cruxPeriods
+		}
+	}
+	if s.reports != nil {
+		e.reports = newReportArchive(s.reports, cfg.reportsRetention, cfg.reportsScreenshots, m.reportFailures)
+		go e.reports.pruneExpired(logger)
+	}
+	if cfg.persistFile != "" {
+		e.store = &resultStore{path: cfg.persistFile}
+		// A snapshot that can't be read only costs the restored values.
+		if restored, err := e.restoreResults(); err != nil {
+			logger.Warn("Failed to restore persisted results", "err", err)
+		} else {
+			logger.Info("Restored persisted results", "targets", restored, "file", cfg.persistFile)
+		}
+	}
+	if cfg.once || command == cmdFetch {
+		var code int
+		if command == cmdFetch {
+			code = e.runFetch(fetchTargets(e.currentTargets(), flag.Args()))
+		} else {
+			code = e.runOnce(registry, cfg.onceOutput)
+		}
+		if meterProvider != nil {
+			if err := meterProvider.Shutdown(context.Background()); err != nil {
+				logger.Warn("Failed to flush OTLP metrics", "err", err)
+			}
+		}
+		os.Exit(code)
+	}
+	r := &reloader{base: base, fs: flag.CommandLine, e: e, keys: s.keys}
+	go r.watchSignals()
+	for _, d := range cfg.discoveries {
+		go d.run(logger, func() {
+			if err := r.reload(); err != nil {
+				logger.Error("Failed to reload configuration", "err", err)
+			}
+		})
+	}
+	if cfg.targetsFile != "" {
+		err := watchTargetsFile(cfg.targetsFile, logger, func() {
+			if err := r.reload(); err != nil {
+				logger.Error("Failed to reload configuration", "err", err)
+			}
+		})
+		if err != nil {
+			logger.Error("Failed to watch --targets.file", "err", err)
+			os.Exit(1)
+		}
+	}
 
 	// Initial fetch
 	go func() {
-		if *withInitialFetch {
-			for _, t := range targets {
-				fetchPSIData(*apiKey, t)
-				time.Sleep(2 * time.Second)
-			}
+		// The backfilled samples are older than those of any run, which
+		// remote_write endpoints may reject once newer ones arrived.
+		if cfg.cruxBackfill {
+			e.backfillCrUX(ctx)
+		}
+		if cfg.pushBackfill {
+			e.backfillRemoteWrite()
+		}
+		if cfg.initialFetch {
+			e.runTargets(e.currentTargets(), 0)
+		}
+		if cfg.readyAfterInitialFetch {
+			e.ready.Store(true)
 		}
 	}()
+	if !cfg.readyAfterInitialFetch {
+		e.ready.Store(true)
+	}
 
-	go func() {
-		ticker := time.NewTicker(1 * time.Minute)
-		defer ticker.Stop()
-		for now := range ticker.C {
-			minute := now.Minute()
-			for _, m := range fetchMinutes {
-				if minute == m {
-					log.Printf("Minute match %d: fetching...", m)
-					for _, t := range targets {
-						fetchPSIData(*apiKey, t)
-						time.Sleep(2 * time.Second)
-					}
-					break
-				}
+	if s.schedule == nil {
+		logger.Warn("No global schedule, only targets with their own schedule are fetched", "minutes", cfg.minutes)
+	}
+	sched := runSchedule{e: e, global: s.schedule}
+	go scheduler.Run(ctx, scheduler.RealClock, logger, sched, cfg.scheduleOverlap, m.overlappedRuns, m.nextRun, func(due time.Time) {
+		targets := sched.due(due)
+		if len(targets) == 0 {
+			return
+		}
+		// The fetches may be spread until the next run of any target.
+		var window time.Duration
+		if next := sched.Next(due); !next.IsZero() {
+			window = next.Sub(due)
+		}
+		logger.Info("Starting scheduled fetch run", "targets", len(targets), "spread", s.spread, "window", window)
+		e.runTargets(targets, window)
+	})
+
+	// Add /execute endpoint for manual fetch
+	cors := &corsPolicy{origins: s.corsOrigins}
+	cors.handle("GET /execute", e.executePSI)
+	cors.handle("POST /execute", e.executeBatch)
+	cors.handle("GET /jobs/{id}", e.jobStatus)
+	cors.handle("POST /api/v1/runs", e.createRun)
+	cors.handle("GET /api/v1/runs/{id}", e.jobStatus)
+	cors.handle("GET /targets", e.targetsStatus)
+	cors.handle("GET /api/v1/config", e.serveConfig)
+	http.HandleFunc("GET /sd", e.serveSD)
+	http.HandleFunc("GET /ui", e.ui)
+	http.HandleFunc("GET /grafana/dashboard.json", e.grafanaDashboardJSON)
+	http.HandleFunc("GET /rules", e.serveRules(rules))
+	http.HandleFunc("POST /ui/run", e.uiRun)
+	http.HandleFunc("GET /probe", e.probe)
+	http.HandleFunc("POST /-/reload", r.handleReload)
+	cors.handle("GET /api/v1/pause", e.servePause(false))
+	cors.handle("POST /api/v1/pause", e.servePause(false))
+	cors.handle("POST /api/v1/resume", e.servePause(true))
+	http.HandleFunc("GET /healthz", e.healthz)
+	http.HandleFunc("GET /version", serveVersion)
+	http.HandleFunc("GET /readyz", e.readyz)
+	if e.reports != nil {
+		cors.handle("GET /api/v1/reports", e.reports.serveList)
+		cors.handle("GET /api/v1/reports/{id}", e.reports.serveReport)
+		cors.handle("GET /api/v1/reports/{id}/screenshots", e.reports.serveScreenshots)
+		cors.handle("GET /api/v1/reports/{id}/screenshots/{name}", e.reports.serveScreenshot)
+	}
+	if e.history != nil {
+		cors.handle("GET /api/v1/history", e.history.serveHistory)
+		cors.handle("GET /api/v1/history/export", e.history.serveExport)
+		if e.crux != nil {
+			cors.handle("POST /api/v1/history/backfill", e.serveCrUXBackfill)
+		}
+	}
+	if adminToken != "" {
+		a := &adminAPI{token: adminToken, targets: cfg.runtimeTargets, r: r}
+		http.HandleFunc("GET /api/v1/targets", a.list)
+		http.HandleFunc("POST /api/v1/targets", a.add)
+		http.HandleFunc("DELETE /api/v1/targets", a.remove)
+	}
+	http.HandleFunc("/", e.landingPage(sched))
+
+	http.Handle("/metrics", promhttp.HandlerFor(registry, promhttp.HandlerOpts{Registry: registry}))
+	http.HandleFunc("GET /metrics/{tenant}", e.tenantMetrics(registry))
+	// Connection errors of net/http, e.g. failed TLS handshakes, are logged
+	// like everything else rather than by the standard logger.
+	serverLog := slog.NewLogLogger(logger.Handler(), slog.LevelWarn)
+	server := &http.Server{Addr: fmt.Sprintf(":%s", cfg.port), ErrorLog: serverLog}
+	handler := withoutPprof(http.DefaultServeMux)
+	var debugServer *http.Server
+	switch {
+	case cfg.enablePprof && cfg.debugPort != "":
+		debugServer = &http.Server{Addr: fmt.Sprintf(":%s", cfg.debugPort), Handler: pprofHandler(), ErrorLog: serverLog}
+		go func() {
+			logger.Info("Profiling endpoints listening", "address", debugServer.Addr)
+			if err := web.ListenAndServe(debugServer, webFlags(debugServer, cfg.webConfigFile), logger); err != nil && err != http.ErrServerClosed {
+				logger.Error("Debug HTTP server failed", "err", err)
+				os.Exit(1)
 			}
+		}()
+	case cfg.enablePprof:
+		handler = http.DefaultServeMux
+		http.Handle(pprofPrefix, pprofHandler())
+		logger.Warn("Profiling endpoints are served on the main port, consider --debug.port")
+	}
+	server.Handler = m.instrument(http.DefaultServeMux, handler, cfg.webAccessLog, logger)
+	go func() {
+		logger.Info("PSI Exporter listening", "address", server.Addr, "version", version, "revision", revision)
+		if err := web.ListenAndServe(server, webFlags(server, cfg.webConfigFile), logger); err != nil && err != http.ErrServerClosed {
+			logger.Error("HTTP server failed", "err", err)
+			os.Exit(1)
 		}
 	}()
 
-	// Add /execute endpoint for manual fetch
-	http.HandleFunc("/execute", func(w http.ResponseWriter, r *http.Request) {
-		executePSI(w, r, *apiKey)
-	})
+	<-ctx.Done()
+	stop()
+	e.ready.Store(false)
+	logger.Info("Shutting down", "grace_period", cfg.shutdownGracePeriod)
+
+	// The scheduler has stopped and no fetch starts anymore. Those in flight
+	// may finish within the grace period; the rest are cancelled.
+	if cfg.shutdownGracePeriod > 0 {
+		graceCtx, cancel := context.WithTimeout(context.Background(), cfg.shutdownGracePeriod)
+		if !e.inFlight.wait(graceCtx) {
+			logger.Warn("Cancelling the fetches still in flight after the grace period", "fetches", e.inFlight.count())
+		}
+		cancel()
+	}
+	cancelRequests()
 
-	http.Handle("/metrics", promhttp.Handler())
-	log.Printf("PSI Exporter listening on :%s", *port)
-	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%s", *port), nil))
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if !e.inFlight.wait(shutdownCtx) {
+		logger.Warn("Cancelled fetches didn't return in time", "fetches", e.inFlight.count())
+	}
+	if e.reports != nil && !e.reports.pending.wait(shutdownCtx) {
+		logger.Warn("Dropping the reports not archived in time", "reports", e.reports.pending.count())
+	}
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		logger.Warn("HTTP server shutdown failed", "err", err)
+	}
+	if debugServer != nil {
+		// A running CPU profile or trace isn't worth waiting for.
+		debugServer.Close()
+	}
+	// Saved last, so it includes the results of the drained fetches and
+	// /execute jobs.
+	e.saveResults()
+	if meterProvider != nil {
+		// Shutdown flushes the metrics collected since the last export.
+		if err := meterProvider.Shutdown(shutdownCtx); err != nil {
+			logger.Warn("OTLP meter provider shutdown failed", "err", err)
+		}
+	}
 }
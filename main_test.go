@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/yahyasahaja/prometheus-exporter-pagespeed-insight/pkg/collector"
+	"github.com/yahyasahaja/prometheus-exporter-pagespeed-insight/pkg/psi"
+)
+
+var discard = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+// psiRun is a successful response of the PSI API.
+const psiRun = `{"lighthouseResult": {"categories": {"performance": {"score": 0.5}}}}`
+
+// answerRun is a fake PSI API answering every run with psiRun.
+func answerRun(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	io.WriteString(w, psiRun)
+}
+
+// newTestExporter returns an exporter without targets fetching from the
+// fake PSI API api, with one worker and the mobile and desktop strategies.
+func newTestExporter(t *testing.T, api http.HandlerFunc) *exporter {
+	t.Helper()
+	server := httptest.NewServer(api)
+	t.Cleanup(server.Close)
+	client, err := psi.New(psi.Config{Keys: []string{"test"}, BaseURL: server.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &exporter{
+		ctx:      context.Background(),
+		requests: context.Background(),
+		client:   client,
+		logger:   discard,
+		metrics:  newMetrics(collector.Opts{Namespace: "psi"}, ""),
+		pool:     newWorkerPool(1, fetchQueueSize),
+		jobs:     newJobStore(time.Minute),
+		status:   newTargetStatus(nil, nil),
+		pauses:   &pauseState{targets: map[pausedTarget]bool{}},
+		guard:    &executeGuard{},
+
+		fetchDefaults:     psi.RetryPolicy{Timeout: time.Minute},
+		strategies:        []string{"mobile", "desktop"},
+		runs:              1,
+		maxExecuteTargets: 10,
+	}
+}
+
+// serve returns the response of handler to a request of method for target
+// with body.
+func serve(handler http.HandlerFunc, method, target, body string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	handler(rec, httptest.NewRequest(method, target, strings.NewReader(body)))
+	return rec
+}
+
+// decode decodes the JSON body of rec into v.
+func decode(t *testing.T, rec *httptest.ResponseRecorder, v any) {
+	t.Helper()
+	if err := json.Unmarshal(rec.Body.Bytes(), v); err != nil {
+		t.Fatalf("decoding %q: %v", rec.Body, err)
+	}
+}
+
+func TestValidateTargetURL(t *testing.T) {
+	tests := []struct {
+		url string
+		// err is a part of the expected error, empty for a valid URL.
+		err string
+	}{
+		{"https://example.com/", ""},
+		{"http://example.com", ""},
+		{"https://example.com:8443/shop", ""},
+		{"https://example.com/search?q=shoes&page=2", ""},
+		{"https://example.com/search?q=caf%C3%A9&tags=a,b", ""},
+		{"https://example.com/?q=ü", ""},
+		{"https://example.com/#reviews", ""},
+		{"https://example.com/app#/route?tab=1", ""},
+		{"https://example.com/caf%C3%A9", ""},
+		{"https://example.com/café", ""},
+		{"https://bücher.example/", ""},
+		{"https://b%C3%BCcher.example/", ""},
+		{"https://xn--bcher-kva.example/", ""},
+		{"https://example.com./", ""},
+		{"https://[::1]:8443/", ""},
+
+		{"example.com", "missing scheme, e.g. https://example.com"},
+		{"example.com/path?next=https://other.example", "scheme must be http or https"},
+		{"ftp://example.com/", "scheme must be http or https"},
+		{"https://", "missing host"},
+		{"https:///path", "missing host"},
+		{"https://example..com/", `invalid host "example..com"`},
+		{"https://.example.com/", `invalid host ".example.com"`},
+		{"https://exa mple.com/", "invalid character"},
+		{"https://ex%41mple.com/", "invalid URL escape"},
+		{"https://example.com/%zz", "invalid URL escape"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.url, func(t *testing.T) {
+			err := validateTargetURL(tt.url)
+			switch {
+			case tt.err == "" && err != nil:
+				t.Errorf("got error %v, want none", err)
+			case tt.err != "" && err == nil:
+				t.Errorf("got no error, want %q", tt.err)
+			case tt.err != "" && !strings.Contains(err.Error(), tt.err):
+				t.Errorf("got error %v, want %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestNormalizeTargetURL(t *testing.T) {
+	tests := []struct {
+		url, want string
+		// err is a part of the expected error.
+		err string
+	}{
+		{url: "https://example.com/", want: "https://example.com"},
+		{url: "HTTPS://Example.COM/Path/", want: "https://example.com/Path"},
+		{url: "https://example.com:443/", want: "https://example.com"},
+		{url: "http://example.com:80/a", want: "http://example.com/a"},
+		{url: "https://example.com:80/", want: "https://example.com:80"},
+		{url: "https://example.com:8443/a/", want: "https://example.com:8443/a"},
+		{url: "https://example.com:/", want: "https://example.com"},
+		{url: "https://[::1]:443/", want: "https://[::1]"},
+		{url: "https://[::1]:8443/", want: "https://[::1]:8443"},
+
+		// The query string is kept as is, only the path loses its slash.
+		{url: "https://example.com/shop/?b=2&a=1", want: "https://example.com/shop?b=2&a=1"},
+		{url: "https://example.com/?q=a%20b", want: "https://example.com?q=a%20b"},
+		{url: "https://example.com/search?q=a+b&q=c", want: "https://example.com/search?q=a+b&q=c"},
+		{url: "https://example.com/search?q=caf%C3%A9", want: "https://example.com/search?q=caf%C3%A9"},
+		{url: "https://example.com/?Q=X", want: "https://example.com?Q=X"},
+
+		// Fragments are dropped, even when they look like a path or query.
+		{url: "https://example.com/#reviews", want: "https://example.com"},
+		{url: "https://example.com/app#/route?tab=1", want: "https://example.com/app"},
+		{url: "https://example.com/?q=1#top", want: "https://example.com?q=1"},
+
+		// Paths are percent-encoded, and keep their escaped slashes.
+		{url: "https://example.com/café/", want: "https://example.com/caf%C3%A9"},
+		{url: "https://example.com/caf%C3%A9/", want: "https://example.com/caf%C3%A9"},
+		{url: "https://example.com/a%2Fb/", want: "https://example.com/a%2Fb"},
+		{url: "https://example.com/a%20b", want: "https://example.com/a%20b"},
+
+		// Internationalized hosts are converted to punycode, whichever way
+		// they are spelled.
+		{url: "https://bücher.example/", want: "https://xn--bcher-kva.example"},
+		{url: "https://Bücher.Example/", want: "https://xn--bcher-kva.example"},
+		{url: "https://b%C3%BCcher.example/", want: "https://xn--bcher-kva.example"},
+		{url: "https://XN--BCHER-KVA.example/", want: "https://xn--bcher-kva.example"},
+		{url: "https://münchen.de/straße?stadt=münchen#oben", want: "https://xn--mnchen-3ya.de/stra%C3%9Fe?stadt=münchen"},
+		{url: "https://a\u200db.example/", err: "invalid label"},
+		{url: "https://⒈.example/", err: "disallowed rune"},
+
+		{url: "example.com", err: "missing scheme"},
+		{url: "https://example..com/", err: "invalid host"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.url, func(t *testing.T) {
+			got, err := normalizeTargetURL(tt.url)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Errorf("got %q, error %v, want error %q", got, err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+			// Normalizing is idempotent.
+			if again, err := normalizeTargetURL(got); err != nil || again != got {
+				t.Errorf("normalizing %q again got %q, %v", got, again, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,369 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/yahyasahaja/prometheus-exporter-pagespeed-insight/pkg/collector"
+)
+
+// metrics is the set of metrics exported by the exporter.
+type metrics struct {
+	// results holds the per-target metrics set from PSI results.
+	results      *collector.Collector
+	apiKeyErrors *prometheus.CounterVec
+	pushFailures *prometheus.CounterVec
+	// notificationFailures counts notifications that failed after all
+	// retries, by destination.
+	notificationFailures *prometheus.CounterVec
+	overlappedRuns       *prometheus.CounterVec
+	// targetsConfigured, nextRun, cycleDuration and cycleOverruns report
+	// whether the fetch runs keep up with the schedule.
+	targetsConfigured prometheus.Gauge
+	nextRun           prometheus.Gauge
+	cycleDuration     prometheus.Gauge
+	cycleOverruns     prometheus.Counter
+	reloadSuccess     prometheus.Gauge
+	// schedulerPaused and targetPaused report the pauses of
+	// /api/v1/pause.
+	schedulerPaused prometheus.Gauge
+	targetPaused    *prometheus.GaugeVec
+	reloadTime      prometheus.Gauge
+	cacheHits       prometheus.Counter
+	cacheMisses     prometheus.Counter
+	reportFailures  prometheus.Counter
+	// reportInfo links the latest result of every target to its archived
+	// report.
+	reportInfo *prometheus.GaugeVec
+	// executeRejected counts manual fetch requests refused by the
+	// executeGuard, by reason.
+	executeRejected *prometheus.CounterVec
+	buildInfo       *prometheus.GaugeVec
+	fetchDuration   *prometheus.HistogramVec
+	fetchRetries    *prometheus.CounterVec
+	fetchFailures   *prometheus.CounterVec
+	quarantined     *prometheus.GaugeVec
+	// scoreBaseline, scoreDelta and scoreRegression compare the latest
+	// performance score of targets with a baseline to it.
+	scoreBaseline   *prometheus.GaugeVec
+	scoreDelta      *prometheus.GaugeVec
+	scoreRegression *prometheus.GaugeVec
+	// strategyScoreGap and strategyMetricGap compare the latest desktop
+	// and mobile results of each site.
+	strategyScoreGap  *prometheus.GaugeVec
+	strategyMetricGap *prometheus.GaugeVec
+	// budgetExceeded and budgetMargin report the budgets of targets.
+	budgetExceeded *prometheus.GaugeVec
+	budgetMargin   *prometheus.GaugeVec
+	apiRequests    *prometheus.CounterVec
+	// apiErrors counts the failed PSI requests of every target by reason.
+	apiErrors *prometheus.CounterVec
+	// runtimeError reports the Lighthouse runtime error of the targets
+	// whose last fetch failed with one.
+	runtimeError *prometheus.GaugeVec
+	// httpRequests, httpDuration and httpInFlight instrument the
+	// exporter's own HTTP endpoints.
+	httpRequests *prometheus.CounterVec
+	httpDuration *prometheus.HistogramVec
+	httpInFlight prometheus.Gauge
+	// labHistograms is empty unless --metrics.lab-histograms is set.
+	labHistograms labHistograms
+}
+
+// newMetrics creates the exporter's metrics with every name prefixed by
+// opts.Namespace. The per-target metrics are exported as configured by opts,
+// and the lab histograms in histogramMode unless it is empty.
+func newMetrics(opts collector.Opts, histogramMode string) *metrics {
+	namespace := opts.Namespace
+	// The per-target metrics carry the custom labels of the targets, like
+	// those of the collector.
+	targetLabels := append([]string{"site", "strategy"}, opts.TargetLabels...)
+	budgetLabels := append([]string{"site", "strategy", "metric"}, opts.TargetLabels...)
+	reportLabels := append([]string{"site", "strategy", "report_id"}, opts.TargetLabels...)
+	siteLabels := append([]string{"site"}, opts.TargetLabels...)
+	gapLabels := append([]string{"site", "metric"}, opts.TargetLabels...)
+	errorLabels := append([]string{"site", "strategy", "reason"}, opts.TargetLabels...)
+	runtimeErrorLabels := append([]string{"site", "strategy", "code"}, opts.TargetLabels...)
+	m := &metrics{
+		results: collector.New(opts),
+
+		apiKeyErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "api_key_errors_total",
+			Help:      "Number of quota errors returned by the PSI API per configured API key",
+		}, []string{"key_index"}),
+
+		notificationFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "notification_failures_total",
+			Help:      "Number of budget and regression notifications that failed after all retries",
+		}, []string{"destination"}),
+
+		pushFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "push_failures_total",
+			Help:      "Number of metric pushes that failed after all retries",
+		}, []string{"destination"}),
+
+		overlappedRuns: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "scheduled_runs_overlapped_total",
+			Help:      "Number of scheduled fetch runs that were due while the previous run was still in progress, by the action taken",
+		}, []string{"action"}),
+
+		targetsConfigured: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "targets_configured",
+			Help:      "Number of configured targets, one per URL and strategy",
+		}),
+
+		nextRun: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "scheduler_next_run_timestamp_seconds",
+			Help:      "Time of the next scheduled fetch run, as a Unix timestamp, 0 while none is planned",
+		}),
+
+		cycleDuration: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "fetch_cycle_duration_seconds",
+			Help:      "Duration of the last fetch run, from its start until its last fetch finished",
+		}),
+
+		cycleOverruns: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "fetch_cycle_overruns_total",
+			Help:      "Number of scheduled fetch runs that were still in progress when the next run was due",
+		}),
+
+		schedulerPaused: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "scheduler_paused",
+			Help:      "Whether scheduled fetches are paused through /api/v1/pause (1) or not (0)",
+		}),
+
+		reloadSuccess: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "config_last_reload_successful",
+			Help:      "Whether the last configuration reload succeeded (1) or failed (0)",
+		}),
+
+		reloadTime: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "config_last_reload_success_timestamp_seconds",
+			Help:      "Time of the last successful configuration reload, as a Unix timestamp",
+		}),
+
+		cacheHits: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "execute_cache_hits_total",
+			Help:      "Number of /execute and /probe requests answered from the result cache",
+		}),
+
+		cacheMisses: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "execute_cache_misses_total",
+			Help:      "Number of /execute and /probe requests that required a PSI API call",
+		}),
+
+		reportFailures: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "report_archive_failures_total",
+			Help:      "Number of Lighthouse reports that couldn't be archived to --reports.url",
+		}),
+
+		reportInfo: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "report_info",
+			Help:      "ID of the archived report of the exported result of the target, for /api/v1/reports/{id}, always 1",
+		}, reportLabels),
+
+		executeRejected: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "execute_rejected_total",
+			Help:      "Number of /execute, /api/v1/runs and /probe requests refused by reason: unauthorized, rate_limited or url_not_allowed",
+		}, []string{"reason"}),
+
+		buildInfo: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "exporter_build_info",
+			Help:      "Version information of the running exporter, always 1",
+		}, []string{"version", "revision", "branch", "builddate", "goversion"}),
+
+		fetchDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "fetch_duration_seconds",
+			Help:      "Duration of the scheduled and /execute PSI runs, including retries",
+			// A single PSI call usually takes 10s to 60s.
+			Buckets: []float64{5, 10, 20, 30, 45, 60, 90, 120, 180, 300, 600},
+		}, targetLabels),
+
+		fetchRetries: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "fetch_retries_total",
+			Help:      "Number of retried PSI requests",
+		}, targetLabels),
+
+		fetchFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "fetch_failures_total",
+			Help:      "Number of PSI runs that failed after all retries",
+		}, targetLabels),
+
+		targetPaused: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "target_paused",
+			Help:      "Whether scheduled runs skip the target because it is paused through /api/v1/pause, always 1",
+		}, targetLabels),
+
+		quarantined: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "target_quarantined",
+			Help:      "Whether scheduled runs skip the target after too many consecutive failures (1) or not (0)",
+		}, targetLabels),
+
+		scoreBaseline: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "score_baseline",
+			Help:      "Baseline performance score of the target (0-1 scale), static or the average of its last runs",
+		}, targetLabels),
+
+		scoreDelta: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "score_regression_delta",
+			Help:      "Latest performance score of the target minus its baseline, negative when it dropped",
+		}, targetLabels),
+
+		strategyScoreGap: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "strategy_score_gap",
+			Help:      "Latest desktop performance score of the site minus its mobile score, growing as mobile falls behind",
+		}, siteLabels),
+
+		strategyMetricGap: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "strategy_metric_gap_ms",
+			Help:      "Latest desktop value of a lab metric of the site minus its mobile value in milliseconds, by metric",
+		}, gapLabels),
+
+		scoreRegression: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "score_regression",
+			Help:      "Whether the latest performance score of the target is below its baseline by more than the margin (1) or not (0)",
+		}, targetLabels),
+
+		budgetExceeded: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "budget_exceeded",
+			Help:      "Whether the latest value of the metric of the target is outside its budget (1) or not (0)",
+		}, budgetLabels),
+
+		budgetMargin: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "budget_margin",
+			Help:      "How far the latest value of the metric of the target is within its budget, negative when it exceeds it",
+		}, budgetLabels),
+
+		apiRequests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "api_requests_total",
+			Help:      "Number of PSI API requests by outcome: success, quota_exceeded or error",
+		}, []string{"outcome"}),
+
+		apiErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "api_errors_total",
+			Help:      "Number of failed PSI API requests of the target by reason: network, timeout, invalid_url, auth, quota, client_error, server_error or decode",
+		}, errorLabels),
+
+		runtimeError: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "lighthouse_runtime_error",
+			Help:      "Lighthouse runtime error of the last fetch of the target, always 1, e.g. code NO_FCP; absent after a successful fetch",
+		}, runtimeErrorLabels),
+
+		httpRequests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "http_requests_total",
+			Help:      "Number of requests to the exporter's HTTP endpoints by handler, status code and method",
+		}, []string{"handler", "code", "method"}),
+
+		httpDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "http_request_duration_seconds",
+			Help:      "Duration of requests to the exporter's HTTP endpoints by handler",
+			// /execute?wait=true and /probe last as long as a PSI run.
+			Buckets: []float64{0.005, 0.025, 0.1, 0.5, 1, 5, 15, 30, 60, 120},
+		}, []string{"handler"}),
+
+		httpInFlight: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "http_requests_in_flight",
+			Help:      "Number of requests to the exporter's HTTP endpoints being served",
+		}),
+	}
+	if histogramMode != "" {
+		m.labHistograms = newLabHistograms(namespace, histogramMode, targetLabels)
+	}
+	return m
+}
+
+// collectors returns every metric for registration.
+func (m *metrics) collectors() []prometheus.Collector {
+	return append([]prometheus.Collector{
+		m.results, m.apiKeyErrors, m.pushFailures, m.overlappedRuns,
+		m.targetsConfigured, m.nextRun, m.cycleDuration, m.cycleOverruns,
+		m.schedulerPaused, m.targetPaused, m.reloadSuccess, m.reloadTime, m.cacheHits, m.cacheMisses, m.reportFailures, m.reportInfo, m.executeRejected, m.buildInfo,
+		m.fetchDuration, m.fetchRetries, m.fetchFailures, m.quarantined, m.apiRequests, m.apiErrors, m.runtimeError,
+		m.scoreBaseline, m.scoreDelta, m.scoreRegression, m.strategyScoreGap, m.strategyMetricGap,
+		m.budgetExceeded, m.budgetMargin, m.notificationFailures,
+		m.httpRequests, m.httpDuration, m.httpInFlight,
+	}, m.labHistograms.collectors()...)
+}
+
+// deleteTarget removes the series of the fetch metrics of t.
+func (m *metrics) deleteTarget(t target) {
+	values := m.targetValues(t)
+	m.fetchDuration.DeleteLabelValues(values...)
+	m.fetchRetries.DeleteLabelValues(values...)
+	m.fetchFailures.DeleteLabelValues(values...)
+	m.quarantined.DeleteLabelValues(values...)
+	m.targetPaused.DeleteLabelValues(values...)
+	m.scoreBaseline.DeleteLabelValues(values...)
+	m.scoreDelta.DeleteLabelValues(values...)
+	m.scoreRegression.DeleteLabelValues(values...)
+	m.labHistograms.delete(values)
+	series := prometheus.Labels{"site": t.site(), "strategy": t.Strategy}
+	m.budgetExceeded.DeletePartialMatch(series)
+	m.budgetMargin.DeletePartialMatch(series)
+	m.reportInfo.DeletePartialMatch(series)
+	m.apiErrors.DeletePartialMatch(series)
+	m.runtimeError.DeletePartialMatch(series)
+}
+
+// targetValues returns the label values of t's series of the per-target
+// metrics: the site, the strategy, extra and the custom labels.
+func (m *metrics) targetValues(t target, extra ...string) []string {
+	values := append([]string{t.site(), t.Strategy}, extra...)
+	for _, name := range m.results.TargetLabelNames() {
+		values = append(values, t.Labels[name])
+	}
+	return values
+}
+
+// targetLabels returns the labels of t's series of the per-target metrics
+// without their own labels, to delete them by partial match.
+func (m *metrics) targetLabels(t target) prometheus.Labels {
+	labels := prometheus.Labels{"site": t.site(), "strategy": t.Strategy}
+	for _, name := range m.results.TargetLabelNames() {
+		labels[name] = t.Labels[name]
+	}
+	return labels
+}
+
+// siteValues returns the label values of t's series of the per-site
+// metrics: the site, extra and the custom labels.
+func (m *metrics) siteValues(t target, extra ...string) []string {
+	values := append([]string{t.site()}, extra...)
+	for _, name := range m.results.TargetLabelNames() {
+		values = append(values, t.Labels[name])
+	}
+	return values
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	notifyAttempts = 3
+	notifyTimeout  = 10 * time.Second
+)
+
+// notification reports that a budget of a target started or stopped being
+// exceeded, or that its score started or stopped regressing.
+type notification struct {
+	Status   string `json:"status"` // "firing" or "resolved"
+	Kind     string `json:"kind"`   // "budget" or "regression"
+	Site     string `json:"site"`
+	Strategy string `json:"strategy"`
+	// Metric is the budget's metric, or performance_score for regressions.
+	Metric string  `json:"metric"`
+	Value  float64 `json:"value"`
+	// Threshold is the budget, or the baseline minus the margin.
+	Threshold float64           `json:"threshold"`
+	Labels    map[string]string `json:"labels,omitempty"`
+	Time      time.Time         `json:"time"`
+}
+
+// text describes n for chat messages.
+func (n notification) text() string {
+	value := strconv.FormatFloat(n.Value, 'g', 4, 64)
+	threshold := strconv.FormatFloat(n.Threshold, 'g', 4, 64)
+	switch {
+	case n.Kind == "budget" && n.Status == "firing":
+		return fmt.Sprintf(":red_circle: %s (%s) exceeds its %s budget: %s, budget %s", n.Site, n.Strategy, n.Metric, value, threshold)
+	case n.Kind == "budget":
+		return fmt.Sprintf(":large_green_circle: %s (%s) is within its %s budget again: %s, budget %s", n.Site, n.Strategy, n.Metric, value, threshold)
+	case n.Status == "firing":
+		return fmt.Sprintf(":red_circle: The performance score of %s (%s) regressed to %s, below %s", n.Site, n.Strategy, value, threshold)
+	default:
+		return fmt.Sprintf(":large_green_circle: The performance score of %s (%s) recovered to %s", n.Site, n.Strategy, value)
+	}
+}
+
+// alertState is what the notifier remembers of a budget or regression of a
+// target.
+type alertState struct {
+	firing bool
+	// notified is set while a firing notification awaits its resolution.
+	notified     bool
+	lastNotified time.Time
+}
+
+// notifier posts notifications to a generic webhook, as JSON, and/or to a
+// Slack incoming webhook. A budget or regression is notified when it starts
+// firing, unless it was already notified within debounce, and when it
+// resolves after a notification, so flapping runs don't spam.
+type notifier struct {
+	client     *http.Client
+	webhookURL string
+	slackURL   string
+	debounce   time.Duration
+	failures   *prometheus.CounterVec
+	logger     *slog.Logger
+
+	mu     sync.Mutex
+	alerts map[string]*alertState
+}
+
+func newNotifier(webhookURL, slackURL string, debounce time.Duration, failures *prometheus.CounterVec, logger *slog.Logger) *notifier {
+	return &notifier{
+		client:     &http.Client{Timeout: notifyTimeout},
+		webhookURL: webhookURL,
+		slackURL:   slackURL,
+		debounce:   debounce,
+		failures:   failures,
+		logger:     logger,
+		alerts:     map[string]*alertState{},
+	}
+}
+
+// update records whether the budget or regression of n is firing and sends
+// n in the background if that warrants a notification.
+func (n *notifier) update(note notification, firing bool) {
+	key := note.Site + "|" + note.Strategy + "|" + note.Kind + "|" + note.Metric
+	n.mu.Lock()
+	state, ok := n.alerts[key]
+	if !ok {
+		state = &alertState{}
+		n.alerts[key] = state
+	}
+	send := false
+	switch {
+	case firing && !state.firing:
+		state.firing = true
+		if note.Time.Sub(state.lastNotified) >= n.debounce {
+			state.notified, state.lastNotified, send = true, note.Time, true
+		}
+	case !firing && state.firing:
+		state.firing = false
+		send, state.notified = state.notified, false
+	}
+	n.mu.Unlock()
+	if !send {
+		return
+	}
+	note.Status = "resolved"
+	if firing {
+		note.Status = "firing"
+	}
+	go n.send(note)
+}
+
+// forget drops the state of the budgets and regression of t, so it doesn't
+// outlive a removed target.
+func (n *notifier) forget(t target) {
+	prefix := t.URL + "|" + t.Strategy + "|"
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for key := range n.alerts {
+		if strings.HasPrefix(key, prefix) {
+			delete(n.alerts, key)
+		}
+	}
+}
+
+// send posts note to every configured destination.
+func (n *notifier) send(note notification) {
+	if n.webhookURL != "" {
+		n.withRetry("webhook", n.webhookURL, note)
+	}
+	if n.slackURL != "" {
+		n.withRetry("slack", n.slackURL, map[string]string{"text": note.text()})
+	}
+}
+
+// withRetry posts body as JSON to rawURL with exponential backoff, counting
+// a failure when every attempt failed.
+func (n *notifier) withRetry(destination, rawURL string, body any) {
+	logger := n.logger.With("destination", destination)
+	raw, err := json.Marshal(body)
+	if err != nil {
+		logger.Error("Failed to encode notification", "err", err)
+		return
+	}
+	delay := time.Second
+	for attempt := 1; attempt <= notifyAttempts; attempt++ {
+		if err = n.post(rawURL, raw); err == nil {
+			logger.Debug("Sent notification")
+			return
+		}
+		logger.Debug("Error sending notification", "attempt", attempt, "err", err)
+		if attempt < notifyAttempts {
+			time.Sleep(delay)
+			delay *= 2
+		}
+	}
+	n.failures.WithLabelValues(destination).Inc()
+	logger.Error("Failed to send notification", "attempts", notifyAttempts, "err", err)
+}
+
+func (n *notifier) post(rawURL string, body []byte) error {
+	resp, err := n.client.Post(rawURL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		// Webhook URLs embed their secret, so keep them out of the logs.
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			err = urlErr.Err
+		}
+		return err
+	}
+	drainBody(resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("webhook returned HTTP %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,388 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/yahyasahaja/prometheus-exporter-pagespeed-insight/pkg/psi"
+)
+
+// gcsBaseURL is the endpoint of the Google Cloud Storage JSON API.
+const gcsBaseURL = "https://storage.googleapis.com"
+
+// objectError returns the error of a failed object storage response,
+// errReportNotFound for a 404.
+func objectError(resp *http.Response) error {
+	if resp.StatusCode == http.StatusNotFound {
+		return errReportNotFound
+	}
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	return fmt.Errorf("unexpected status %s: %s", resp.Status, strings.TrimSpace(string(body)))
+}
+
+// s3ReportStore keeps the reports as objects of an S3 bucket, or of any
+// store with an S3-compatible API such as MinIO or the interoperability API
+// of Google Cloud Storage. Requests are path-style and signed with AWS
+// Signature Version 4.
+type s3ReportStore struct {
+	endpoint, bucket, prefix string
+	region                   string
+	accessKey, secretKey     string
+	sessionToken             string
+	client                   *http.Client
+}
+
+// newS3ReportStore returns the store of bucket, with the credentials and the
+// region of the AWS_* environment variables. The endpoint defaults to that
+// of AWS S3 in the region.
+func newS3ReportStore(bucket, prefix, endpoint string, client *http.Client) (*s3ReportStore, error) {
+	s := &s3ReportStore{
+		bucket:       bucket,
+		prefix:       prefix,
+		region:       os.Getenv("AWS_REGION"),
+		accessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+		secretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		sessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+		client:       client,
+	}
+	if s.region == "" {
+		s.region = os.Getenv("AWS_DEFAULT_REGION")
+	}
+	if s.region == "" {
+		s.region = "us-east-1"
+	}
+	if s.accessKey == "" || s.secretKey == "" {
+		return nil, errors.New("--reports.url: s3:// requires AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY")
+	}
+	s.endpoint = strings.TrimSuffix(endpoint, "/")
+	if s.endpoint == "" {
+		s.endpoint = "https://s3." + s.region + ".amazonaws.com"
+	}
+	return s, nil
+}
+
+func (s *s3ReportStore) String() string {
+	return "s3://" + joinKey(s.bucket, s.prefix)
+}
+
+// joinKey joins the non-empty parts of an object key with slashes.
+func joinKey(parts ...string) string {
+	var nonEmpty []string
+	for _, p := range parts {
+		if p != "" {
+			nonEmpty = append(nonEmpty, p)
+		}
+	}
+	return strings.Join(nonEmpty, "/")
+}
+
+// objectKey returns the object key of a report key.
+func (s *s3ReportStore) objectKey(key string) string {
+	return joinKey(s.prefix, key)
+}
+
+func (s *s3ReportStore) put(ctx context.Context, key string, body []byte) error {
+	resp, err := s.do(ctx, http.MethodPut, s.objectKey(key), nil, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return objectError(resp)
+	}
+	return nil
+}
+
+func (s *s3ReportStore) get(ctx context.Context, key string) ([]byte, error) {
+	resp, err := s.do(ctx, http.MethodGet, s.objectKey(key), nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, objectError(resp)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+func (s *s3ReportStore) delete(ctx context.Context, key string) error {
+	resp, err := s.do(ctx, http.MethodDelete, s.objectKey(key), nil, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNotFound {
+		return objectError(resp)
+	}
+	return nil
+}
+
+// s3ListResult is the response of ListObjectsV2.
+type s3ListResult struct {
+	Contents []struct {
+		Key string `xml:"Key"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+func (s *s3ReportStore) list(ctx context.Context, prefix string) ([]string, error) {
+	base := ""
+	if s.prefix != "" {
+		base = s.prefix + "/"
+	}
+	query := url.Values{"list-type": {"2"}, "prefix": {base + prefix}}
+	var keys []string
+	for {
+		resp, err := s.do(ctx, http.MethodGet, "", query, nil)
+		if err != nil {
+			return nil, err
+		}
+		var result s3ListResult
+		if resp.StatusCode != http.StatusOK {
+			err = objectError(resp)
+		} else {
+			err = xml.NewDecoder(resp.Body).Decode(&result)
+		}
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range result.Contents {
+			keys = append(keys, strings.TrimPrefix(c.Key, base))
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return keys, nil
+		}
+		query.Set("continuation-token", result.NextContinuationToken)
+	}
+}
+
+// do sends a signed request for the object key, or for the bucket if key is
+// empty.
+func (s *s3ReportStore) do(ctx context.Context, method, key string, query url.Values, body []byte) (*http.Response, error) {
+	uri := "/" + awsEscape(s.bucket, false)
+	if key != "" {
+		uri += "/" + awsEscape(key, false)
+	}
+	rawQuery := awsQuery(query)
+	target := s.endpoint + uri
+	if rawQuery != "" {
+		target += "?" + rawQuery
+	}
+	req, err := http.NewRequestWithContext(ctx, method, target, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	s.sign(req, uri, rawQuery, body, time.Now().UTC())
+	return s.client.Do(req)
+}
+
+// sign adds the AWS Signature Version 4 of the request to its headers.
+func (s *s3ReportStore) sign(req *http.Request, uri, rawQuery string, body []byte, now time.Time) {
+	payloadHash := sha256Hex(body)
+	amzDate := now.Format("20060102T150405Z")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if s.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", s.sessionToken)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name := range req.Header {
+		lower := strings.ToLower(name)
+		if lower == "content-type" || strings.HasPrefix(lower, "x-amz-") {
+			headers[lower] = strings.TrimSpace(req.Header.Get(name))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{req.Method, uri, rawQuery, canonicalHeaders.String(), signedHeaders, payloadHash}, "\n")
+	scope := now.Format("20060102") + "/" + s.region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(canonicalRequest))
+
+	key := hmacSHA256([]byte("AWS4"+s.secretKey), now.Format("20060102"))
+	key = hmacSHA256(key, s.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", s.accessKey, scope, signedHeaders, signature))
+}
+
+func sha256Hex(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// awsEscape percent-encodes s as Signature Version 4 requires: everything
+// but the unreserved characters, and slashes unless escapeSlash is false.
+func awsEscape(s string, escapeSlash bool) string {
+	var b strings.Builder
+	for _, c := range []byte(s) {
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9', c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !escapeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// awsQuery returns the canonical query string of query, sorted by name.
+func awsQuery(query url.Values) string {
+	names := make([]string, 0, len(query))
+	for name := range query {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var pairs []string
+	for _, name := range names {
+		for _, v := range query[name] {
+			pairs = append(pairs, awsEscape(name, true)+"="+awsEscape(v, true))
+		}
+	}
+	return strings.Join(pairs, "&")
+}
+
+// gcsReportStore keeps the reports as objects of a Google Cloud Storage
+// bucket, using the JSON API with OAuth 2.0 tokens.
+type gcsReportStore struct {
+	bucket, prefix string
+	tokens         psi.TokenSource
+	client         *http.Client
+	baseURL        string
+}
+
+func (s *gcsReportStore) String() string {
+	return "gs://" + joinKey(s.bucket, s.prefix)
+}
+
+func (s *gcsReportStore) do(ctx context.Context, method, target string, body []byte) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, target, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	token, err := s.tokens.Token(ctx)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	return s.client.Do(req)
+}
+
+// objectURL returns the URL of the object of key, with the query query.
+func (s *gcsReportStore) objectURL(key, query string) string {
+	return s.baseURL + "/storage/v1/b/" + url.PathEscape(s.bucket) + "/o/" + url.PathEscape(joinKey(s.prefix, key)) + query
+}
+
+func (s *gcsReportStore) put(ctx context.Context, key string, body []byte) error {
+	target := s.baseURL + "/upload/storage/v1/b/" + url.PathEscape(s.bucket) + "/o?" + url.Values{"uploadType": {"media"}, "name": {joinKey(s.prefix, key)}}.Encode()
+	resp, err := s.do(ctx, http.MethodPost, target, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return objectError(resp)
+	}
+	return nil
+}
+
+func (s *gcsReportStore) get(ctx context.Context, key string) ([]byte, error) {
+	resp, err := s.do(ctx, http.MethodGet, s.objectURL(key, "?alt=media"), nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, objectError(resp)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+func (s *gcsReportStore) delete(ctx context.Context, key string) error {
+	resp, err := s.do(ctx, http.MethodDelete, s.objectURL(key, ""), nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNotFound {
+		return objectError(resp)
+	}
+	return nil
+}
+
+func (s *gcsReportStore) list(ctx context.Context, prefix string) ([]string, error) {
+	base := ""
+	if s.prefix != "" {
+		base = s.prefix + "/"
+	}
+	query := url.Values{"prefix": {base + prefix}, "fields": {"items(name),nextPageToken"}}
+	var keys []string
+	for {
+		resp, err := s.do(ctx, http.MethodGet, s.baseURL+"/storage/v1/b/"+url.PathEscape(s.bucket)+"/o?"+query.Encode(), nil)
+		if err != nil {
+			return nil, err
+		}
+		var result struct {
+			Items []struct {
+				Name string `json:"name"`
+			} `json:"items"`
+			NextPageToken string `json:"nextPageToken"`
+		}
+		if resp.StatusCode != http.StatusOK {
+			err = objectError(resp)
+		} else {
+			err = json.NewDecoder(resp.Body).Decode(&result)
+		}
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range result.Items {
+			keys = append(keys, strings.TrimPrefix(item.Name, base))
+		}
+		if result.NextPageToken == "" {
+			return keys, nil
+		}
+		query.Set("pageToken", result.NextPageToken)
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"os"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/expfmt"
+)
+
+// Exit codes of --once besides 0, every fetch succeeded, and 1, an invalid
+// configuration.
+const (
+	onceFetchFailed = 2
+	onceWriteFailed = 3
+)
+
+// runOnce fetches every target a single time and writes the metrics of
+// gatherer in the text exposition format to output, or to stdout when it's
+// empty. It returns the exit code of the process.
+func (e *exporter) runOnce(gatherer prometheus.Gatherer, output string) int {
+	failed := e.runTargets(e.currentTargets(), 0)
+	if output != "" {
+		// WriteToTextfile renames a temporary file into place, so the
+		// node exporter never reads a partial file.
+		if err := prometheus.WriteToTextfile(output, gatherer); err != nil {
+			e.logger.Error("Failed to write the metrics", "file", output, "err", err)
+			return onceWriteFailed
+		}
+	} else {
+		families, err := gatherer.Gather()
+		if err == nil {
+			for _, mf := range families {
+				if _, err = expfmt.MetricFamilyToText(os.Stdout, mf); err != nil {
+					break
+				}
+			}
+		}
+		if err != nil {
+			e.logger.Error("Failed to write the metrics", "err", err)
+			return onceWriteFailed
+		}
+	}
+	if failed > 0 {
+		return onceFetchFailed
+	}
+	return 0
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	prometheusbridge "go.opentelemetry.io/contrib/bridges/prometheus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetrichttp"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+	"go.opentelemetry.io/otel/sdk/resource"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+)
+
+// newMeterProvider returns a meter provider that periodically exports every
+// metric of gatherer to the OTLP/HTTP endpoint, with the Prometheus labels
+// as attributes. Exports run in the background, so a slow or unavailable
+// collector never delays a fetch; failed exports are logged and counted in
+// failures.
+func newMeterProvider(endpoint string, insecure bool, headers map[string]string, interval time.Duration, gatherer prometheus.Gatherer, failures *prometheus.CounterVec, logger *slog.Logger) (*sdkmetric.MeterProvider, error) {
+	opts := []otlpmetrichttp.Option{}
+	if len(headers) > 0 {
+		opts = append(opts, otlpmetrichttp.WithHeaders(headers))
+	}
+	if strings.Contains(endpoint, "://") {
+		opts = append(opts, otlpmetrichttp.WithEndpointURL(endpoint))
+	} else {
+		opts = append(opts, otlpmetrichttp.WithEndpoint(endpoint))
+	}
+	if insecure {
+		opts = append(opts, otlpmetrichttp.WithInsecure())
+	}
+	exp, err := otlpmetrichttp.New(context.Background(), opts...)
+	if err != nil {
+		return nil, fmt.Errorf("creating OTLP exporter: %v", err)
+	}
+
+	// Export errors are already logged by countingExporter.
+	otel.SetErrorHandler(otel.ErrorHandlerFunc(func(err error) {
+		logger.Debug("OpenTelemetry error", "err", err)
+	}))
+
+	reader := sdkmetric.NewPeriodicReader(
+		&countingExporter{Exporter: exp, failures: failures.WithLabelValues("otlp"), logger: logger},
+		sdkmetric.WithInterval(interval),
+		sdkmetric.WithProducer(prometheusbridge.NewMetricProducer(prometheusbridge.WithGatherer(gatherer))),
+	)
+	res := resource.NewWithAttributes(semconv.SchemaURL,
+		semconv.ServiceName(pushJobName),
+		semconv.ServiceVersion(version),
+	)
+	return sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader), sdkmetric.WithResource(res)), nil
+}
+
+// countingExporter wraps an OTLP exporter to log and count failed exports.
+type countingExporter struct {
+	sdkmetric.Exporter
+	failures prometheus.Counter
+	logger   *slog.Logger
+}
+
+func (c *countingExporter) Export(ctx context.Context, rm *metricdata.ResourceMetrics) error {
+	err := c.Exporter.Export(ctx, rm)
+	if err != nil {
+		c.failures.Inc()
+		c.logger.Warn("OTLP export failed", "err", err)
+	}
+	return err
+}
+
+// parseOTLPHeaders parses the comma-separated name=value pairs of
+// --otlp.headers.
+func parseOTLPHeaders(raw string) (map[string]string, error) {
+	headers := map[string]string{}
+	for _, pair := range strings.Split(raw, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(pair, "=")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" {
+			return nil, fmt.Errorf("%q must be name=value", pair)
+		}
+		headers[name] = strings.TrimSpace(value)
+	}
+	return headers, nil
+}
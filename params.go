@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// requestURL returns the URL requested by a run of t: its URL with the
+// query parameters of the target, and the cache-busting one set to a new
+// random value.
+func (t target) requestURL() string {
+	if len(t.QueryParams) == 0 && t.CacheBust == "" {
+		return t.URL
+	}
+	u, err := url.Parse(t.URL)
+	if err != nil {
+		return t.URL
+	}
+	q := u.Query()
+	for name, value := range t.QueryParams {
+		q.Set(name, value)
+	}
+	if t.CacheBust != "" {
+		q.Set(t.CacheBust, fmt.Sprintf("%016x", rand.Uint64()))
+	}
+	u.RawQuery = q.Encode()
+	return u.String()
+}
+
+// stripQueryParams removes the parameters added by requestURL from u, e.g.
+// the final URL of a run, so that it matches the target's URL again and the
+// random cache-busting value doesn't end up in a label.
+func (t target) stripQueryParams(u string) string {
+	if u == "" || len(t.QueryParams) == 0 && t.CacheBust == "" {
+		return u
+	}
+	parsed, err := url.Parse(u)
+	if err != nil {
+		return u
+	}
+	q := parsed.Query()
+	for name := range t.QueryParams {
+		q.Del(name)
+	}
+	q.Del(t.CacheBust)
+	// Re-encoding would reorder the target's own parameters.
+	if len(q) == 0 {
+		parsed.RawQuery = ""
+		return parsed.String()
+	}
+	original, err := url.Parse(t.URL)
+	if err == nil && original.Query().Encode() == q.Encode() {
+		parsed.RawQuery = original.RawQuery
+		return parsed.String()
+	}
+	parsed.RawQuery = q.Encode()
+	return parsed.String()
+}
+
+// validateQueryParams checks the query parameters and the cache-busting
+// parameter of a target.
+func validateQueryParams(params map[string]string, cacheBust string) error {
+	for name := range params {
+		if strings.TrimSpace(name) == "" {
+			return fmt.Errorf("query_params: empty parameter name")
+		}
+	}
+	if _, ok := params[cacheBust]; ok && cacheBust != "" {
+		return fmt.Errorf("cache_bust %q is also one of query_params", cacheBust)
+	}
+	return nil
+}
+
+// queryParamsString describes the parameters added to the URL of t for
+// --check-config, with the cache-busting one as name=<random>.
+func (t target) queryParamsString() string {
+	var params []string
+	for name, value := range t.QueryParams {
+		params = append(params, name+"="+value)
+	}
+	sort.Strings(params)
+	if t.CacheBust != "" {
+		params = append(params, t.CacheBust+"=<random>")
+	}
+	return strings.Join(params, "&")
+}
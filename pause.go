@@ -0,0 +1,154 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// pauseState holds the pauses of scheduled fetches set through
+// /api/v1/pause. It isn't persisted: a restart resumes everything.
+type pauseState struct {
+	mu  sync.Mutex
+	all bool
+	// targets are the paused URL and strategy pairs.
+	targets map[pausedTarget]bool
+}
+
+// pausedTarget is a paused URL and strategy.
+type pausedTarget struct {
+	URL      string `json:"url"`
+	Strategy string `json:"strategy"`
+}
+
+// paused reports whether scheduled runs skip t.
+func (p *pauseState) paused(t target) bool {
+	return p.pausedAll() || p.targetPaused(t)
+}
+
+// pausedAll reports whether every scheduled fetch is paused.
+func (p *pauseState) pausedAll() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.all
+}
+
+// targetPaused reports whether t itself is paused, regardless of a global
+// pause.
+func (p *pauseState) targetPaused(t target) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.targets[pausedTarget{URL: t.URL, Strategy: t.Strategy}]
+}
+
+// pause pauses targets, or everything when there are none.
+func (p *pauseState) pause(targets []target) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if targets == nil {
+		p.all = true
+	}
+	for _, t := range targets {
+		p.targets[pausedTarget{URL: t.URL, Strategy: t.Strategy}] = true
+	}
+}
+
+// resume resumes targets, or everything, including the paused targets, when
+// there are none.
+func (p *pauseState) resume(targets []target) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if targets == nil {
+		p.all = false
+		clear(p.targets)
+	}
+	for _, t := range targets {
+		delete(p.targets, pausedTarget{URL: t.URL, Strategy: t.Strategy})
+	}
+}
+
+// pauseView is the JSON state of the pauses.
+type pauseView struct {
+	Paused  bool           `json:"paused"`
+	Targets []pausedTarget `json:"targets"`
+}
+
+func (p *pauseState) view() pauseView {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	v := pauseView{Paused: p.all, Targets: []pausedTarget{}}
+	for t := range p.targets {
+		v.Targets = append(v.Targets, t)
+	}
+	slices.SortFunc(v.Targets, func(a, b pausedTarget) int {
+		return cmp.Or(strings.Compare(a.URL, b.URL), strings.Compare(a.Strategy, b.Strategy))
+	})
+	return v
+}
+
+// updatePauseMetrics sets psi_scheduler_paused and psi_target_paused from
+// the pauses.
+func (e *exporter) updatePauseMetrics() {
+	if e.pauses.pausedAll() {
+		e.metrics.schedulerPaused.Set(1)
+	} else {
+		e.metrics.schedulerPaused.Set(0)
+	}
+	for _, t := range e.currentTargets() {
+		if e.pauses.targetPaused(t) {
+			e.metrics.targetPaused.WithLabelValues(e.metrics.targetValues(t)...).Set(1)
+		} else {
+			e.metrics.targetPaused.DeleteLabelValues(e.metrics.targetValues(t)...)
+		}
+	}
+}
+
+// servePause serves GET /api/v1/pause with the pauses, and POST
+// /api/v1/pause and /api/v1/resume, which pause or resume the scheduled
+// fetches of the targets of ?url= and ?strategy=, or all of them without
+// a URL.
+func (e *exporter) servePause(resume bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !e.guard.authorize(w, r) {
+			return
+		}
+		if r.Method == http.MethodPost {
+			u, strategy := r.URL.Query().Get("url"), r.URL.Query().Get("strategy")
+			if u == "" && strategy != "" {
+				http.Error(w, "strategy requires url", http.StatusBadRequest)
+				return
+			}
+			// Without a URL, every scheduled fetch is paused or resumed.
+			var targets []target
+			if u != "" {
+				var err error
+				if u, err = normalizeTargetURL(u); err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+				for _, t := range e.currentTargets() {
+					if t.URL == u && (strategy == "" || t.Strategy == strategy) {
+						targets = append(targets, t)
+					}
+				}
+				if len(targets) == 0 {
+					http.Error(w, "No target with this URL and strategy", http.StatusNotFound)
+					return
+				}
+			}
+			if resume {
+				e.pauses.resume(targets)
+				e.logger.Info("Resumed scheduled fetches", "site", u, "strategy", strategy)
+			} else {
+				e.pauses.pause(targets)
+				e.logger.Info("Paused scheduled fetches", "site", u, "strategy", strategy)
+			}
+			e.updatePauseMetrics()
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(e.pauses.view())
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/yahyasahaja/prometheus-exporter-pagespeed-insight/pkg/collector"
+)
+
+// resultsSnapshot is the format of --persist.file.
+type resultsSnapshot struct {
+	SavedAt time.Time         `json:"saved_at"`
+	Results []collector.Saved `json:"results"`
+}
+
+// resultStore keeps the latest result of every target in a JSON snapshot at
+// path, so a restart doesn't blank the series until the next run.
+type resultStore struct {
+	path string
+	// mu serializes saves, which replace the whole file.
+	mu sync.Mutex
+}
+
+// save writes the results of the exporter's collector to the store.
+func (s *resultStore) save(results *collector.Collector) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	raw, err := json.Marshal(resultsSnapshot{SavedAt: time.Now(), Results: results.Save()})
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(s.path, raw); err != nil {
+		return fmt.Errorf("persisting results: %v", err)
+	}
+	return nil
+}
+
+// load returns the saved results, none if the file doesn't exist yet.
+func (s *resultStore) load() ([]collector.Saved, error) {
+	raw, err := os.ReadFile(s.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading --persist.file: %v", err)
+	}
+	var snapshot resultsSnapshot
+	if err := json.Unmarshal(raw, &snapshot); err != nil {
+		return nil, fmt.Errorf("parsing --persist.file %s: %v", s.path, err)
+	}
+	return snapshot.Results, nil
+}
+
+// restoreResults exports the saved results of the current targets again and
+// returns how many were restored. Results of targets no longer monitored are
+// dropped.
+func (e *exporter) restoreResults() (int, error) {
+	saved, err := e.store.load()
+	if err != nil {
+		return 0, err
+	}
+	byKey := map[string]collector.Saved{}
+	for _, r := range saved {
+		// Snapshots of older versions have no scope.
+		byKey[r.URL+"|"+r.Strategy+"|"+cmp.Or(r.Scope, scopePage)+"|"+r.Backend+"|"+r.Profile] = r
+	}
+	restored := 0
+	for _, t := range e.currentTargets() {
+		r, ok := byKey[t.URL+"|"+t.Strategy+"|"+t.Scope+"|"+t.Backend+"|"+t.Profile]
+		if !ok {
+			continue
+		}
+		e.metrics.results.Restore(t.series(), r)
+		if r.Result != nil && !r.LastSuccess.IsZero() {
+			e.status.succeeded(t, r.LastSuccess, r.Result)
+		}
+		restored++
+	}
+	return restored, nil
+}
+
+// saveResults persists the latest results if --persist.file is set.
+func (e *exporter) saveResults() {
+	if e.store == nil {
+		return
+	}
+	if err := e.store.save(e.metrics.results); err != nil {
+		e.logger.Error("Failed to persist results", "err", err)
+	}
+}
+
+// writeFileAtomic replaces the file at path with data, so readers never see
+// a partially written file.
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,982 @@
+// Package collector exports the results of PSI runs as Prometheus metrics.
+// A Collector keeps the latest result of every target and turns it into
+// metrics at scrape time, so a target's series disappear as soon as it is
+// deleted. It is registered like any other prometheus.Collector.
+package collector
+
+import (
+	"cmp"
+	"encoding/json"
+	"log/slog"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/yahyasahaja/prometheus-exporter-pagespeed-insight/pkg/psi"
+)
+
+// Scopes of the field data exported for a target.
+const (
+	// ScopePage exports the field data of the page itself.
+	ScopePage = "page"
+	// ScopeOrigin exports the field data aggregated over the page's origin.
+	ScopeOrigin = "origin"
+)
+
+// Target identifies the series of a monitored page.
+type Target struct {
+	URL      string
+	Strategy string
+	// Site is the value of the site label, URL when empty.
+	Site string
+	// Scope is ScopePage or ScopeOrigin.
+	Scope string
+	// Labels are custom labels added to every series of the target.
+	Labels map[string]string
+	// Backend is the source of the results if it isn't PSI, e.g.
+	// "webpagetest". Targets of different backends are stored apart.
+	Backend string
+	// Profile is the scan profile of the target, if any. Targets of
+	// different profiles are stored apart.
+	Profile string
+	// AllAudits exports every audit of the target like Opts.AllAudits.
+	AllAudits bool
+}
+
+// site returns the value of the site label of t.
+func (t Target) site() string {
+	if t.Site != "" {
+		return t.Site
+	}
+	return t.URL
+}
+
+// key identifies the stored result of t.
+func (t Target) key() string {
+	return t.labKey() + "|" + t.Scope
+}
+
+// labKey identifies the lab series of t, which targets differing only by
+// scope share.
+func (t Target) labKey() string {
+	key := t.URL + "|" + t.Strategy
+	if t.Backend != "" {
+		key += "|" + t.Backend
+	}
+	if t.Profile != "" {
+		key += "|profile=" + t.Profile
+	}
+	return key
+}
+
+// Result holds the values extracted from a successful PSI run.
+type Result struct {
+	PerformanceScore *float64 `json:"performance_score,omitempty"`
+	// CategoryScores are the scores of the other requested categories.
+	CategoryScores    map[string]float64 `json:"category_scores,omitempty"`
+	Metrics           map[string]float64 `json:"metrics"`
+	AuditScores       map[string]float64 `json:"audit_scores"`
+	LighthouseVersion string             `json:"lighthouse_version,omitempty"`
+	FinalURL          string             `json:"final_url,omitempty"`
+	// RedirectHops is the number of redirects Lighthouse followed to reach
+	// FinalURL, when the result reports the redirect chain.
+	RedirectHops *int `json:"redirect_hops,omitempty"`
+	// AnalysisTime is when PSI ran the analysis, if the response says.
+	AnalysisTime *time.Time         `json:"analysis_time,omitempty"`
+	FieldData    map[string]float64 `json:"field_data,omitempty"`
+	// FieldDistribution holds the proportions of real users in the good,
+	// needs improvement and poor ranges of each metric of FieldData.
+	FieldDistribution map[string][]float64 `json:"field_distribution,omitempty"`
+	// FieldCategory is the overall verdict of the field data: "FAST",
+	// "AVERAGE" or "SLOW".
+	FieldCategory string `json:"field_category,omitempty"`
+	// OriginFallback reports that the page-level field data is the origin's.
+	OriginFallback bool               `json:"origin_fallback,omitempty"`
+	MainThreadWork map[string]float64 `json:"mainthread_work_ms,omitempty"`
+	BootupTime     *float64           `json:"bootup_time_ms,omitempty"`
+	// ThirdPartyBlockingTime and ThirdPartyTransferSize are the main-thread
+	// blocking time and the transfer size of each third-party entity.
+	ThirdPartyBlockingTime map[string]float64 `json:"third_party_blocking_time_ms,omitempty"`
+	ThirdPartyTransferSize map[string]float64 `json:"third_party_transfer_size_bytes,omitempty"`
+	// SavingsMs and SavingsBytes are the estimated savings of each
+	// opportunity audit.
+	SavingsMs    map[string]float64 `json:"opportunity_savings_ms,omitempty"`
+	SavingsBytes map[string]float64 `json:"opportunity_savings_bytes,omitempty"`
+	// MissingAudits lists the expected audits the response had no value for.
+	MissingAudits []string `json:"missing_audits,omitempty"`
+	// ResourceRequests and ResourceTransferSize are the number of requests
+	// and the transfer size of each resource type of the resource-summary
+	// audit, such as "script" or "image", including "total" and
+	// "third-party".
+	ResourceRequests     map[string]float64 `json:"resource_requests,omitempty"`
+	ResourceTransferSize map[string]float64 `json:"resource_transfer_size_bytes,omitempty"`
+	// AccessibilityAudits are the scores of the audits of the accessibility
+	// category, when it was requested.
+	AccessibilityAudits map[string]float64 `json:"accessibility_audit_scores,omitempty"`
+	// RunScores are the performance scores of every run, sorted, when the
+	// result is the median of several runs.
+	RunScores []float64 `json:"run_scores,omitempty"`
+}
+
+// Opts configures a Collector.
+type Opts struct {
+	// Namespace prefixes every metric name.
+	Namespace string
+	// TargetLabels are the custom label names of the targets, added after
+	// the site and strategy labels of every metric.
+	TargetLabels []string
+	// Timestamps attaches the time Lighthouse fetched the page to every
+	// sample of a target, instead of leaving it to the scrape time.
+	Timestamps bool
+	// AllAudits exports the numericValue and score of every audit of a
+	// result, not only those with a dedicated metric.
+	AllAudits bool
+	// MaxAge stops exporting the values of a result once it is older than
+	// MaxAge without a successful run replacing it. Zero keeps results
+	// exported until the target is deleted.
+	MaxAge time.Duration
+}
+
+// labAudit maps a Lighthouse audit to the metric receiving its numericValue.
+// Optional audits are missing from some Lighthouse versions, so their absence
+// isn't reported.
+type labAudit struct {
+	audit    string
+	desc     *prometheus.Desc
+	optional bool
+}
+
+// categoryScore maps a Lighthouse category other than performance to the
+// metric receiving its score.
+type categoryScore struct {
+	category string
+	desc     *prometheus.Desc
+}
+
+// fieldMetric maps a CrUX metric of loadingExperience to the metric receiving
+// its 75th percentile. CrUX reports some metrics in scaled units, so the
+// percentile is multiplied by scale.
+type fieldMetric struct {
+	metric string
+	desc   *prometheus.Desc
+	scale  float64
+	// labAudit is the lab audit of the same metric, compared by
+	// psi_lab_field_delta, if any. name is the value of the metric label of
+	// psi_lab_field_delta and psi_field_distribution.
+	labAudit, name string
+}
+
+// fieldCategories are the overall verdicts of the field data, exported by
+// psi_field_overall_category in lower case.
+var fieldCategories = []string{"FAST", "AVERAGE", "SLOW"}
+
+// fieldBuckets are the values of the bucket label of psi_field_distribution,
+// in the order of the distributions of CrUX.
+var fieldBuckets = []string{"good", "needs_improvement", "poor"}
+
+// redirectHop is a row of the redirects audit, one per URL of the chain
+// including the final one.
+type redirectHop struct {
+	URL string `json:"url"`
+}
+
+// labINPAudits are the ids of the lab INP audit, which only Lighthouse
+// versions measuring interactions report, newest first.
+var labINPAudits = []string{"interaction-to-next-paint", "experimental-interaction-to-next-paint"}
+
+// resourceType is a row of the resource-summary audit.
+type resourceType struct {
+	ResourceType string   `json:"resourceType"`
+	RequestCount *float64 `json:"requestCount"`
+	TransferSize *float64 `json:"transferSize"`
+}
+
+// thirdPartyEntity is a row of the third-party-summary audit. Entity is the
+// name of the entity, or a link with the name as its text before Lighthouse
+// 10.
+type thirdPartyEntity struct {
+	Entity       json.RawMessage `json:"entity"`
+	TransferSize *float64        `json:"transferSize"`
+	BlockingTime *float64        `json:"blockingTime"`
+}
+
+// name returns the name of the entity, empty if there is none.
+func (e thirdPartyEntity) name() string {
+	var name string
+	if json.Unmarshal(e.Entity, &name) == nil {
+		return name
+	}
+	var link struct {
+		Text string `json:"text"`
+	}
+	json.Unmarshal(e.Entity, &link)
+	return link.Text
+}
+
+// mainThreadTask is a row of the mainthread-work-breakdown audit.
+type mainThreadTask struct {
+	Group    string   `json:"group"`
+	Duration *float64 `json:"duration"`
+}
+
+// entry is the latest result stored for a target.
+type entry struct {
+	// labelValues are the values of the site, strategy and custom labels.
+	labelValues []string
+	url         string
+	scope       string
+	// labKey is the labKey of the target, see Collect.
+	labKey     string
+	backend    string
+	profile    string
+	formFactor string
+	// allAudits exports every audit of the result, see Target.AllAudits.
+	allAudits bool
+	// fetchTime is zero when the result had no parsable fetchTime.
+	fetchTime  time.Time
+	redirected bool
+	// result is nil until the first successful run.
+	result *Result
+	// success reports whether the last run succeeded, lastSuccess is the
+	// time of the last successful one.
+	success     bool
+	lastSuccess time.Time
+}
+
+// Collector exports the results of PSI runs. It is safe for concurrent use.
+type Collector struct {
+	perfScore           *prometheus.Desc
+	perfScoreMin        *prometheus.Desc
+	perfScoreMax        *prometheus.Desc
+	runs                *prometheus.Desc
+	auditScore          *prometheus.Desc
+	auditNumeric        *prometheus.Desc
+	a11yAuditScore      *prometheus.Desc
+	resourceRequests    *prometheus.Desc
+	resourceTransfer    *prometheus.Desc
+	lighthouseInfo      *prometheus.Desc
+	lighthouseFetchTime *prometheus.Desc
+	analysisTime        *prometheus.Desc
+	finalURLInfo        *prometheus.Desc
+	redirected          *prometheus.Desc
+	redirectHops        *prometheus.Desc
+	originFallback      *prometheus.Desc
+	labFieldDelta       *prometheus.Desc
+	fieldDistribution   *prometheus.Desc
+	fieldCategory       *prometheus.Desc
+	inp                 *prometheus.Desc
+	savingsMs           *prometheus.Desc
+	savingsBytes        *prometheus.Desc
+	mainThreadWork      *prometheus.Desc
+	bootupTime          *prometheus.Desc
+	thirdPartyBlocking  *prometheus.Desc
+	thirdPartyTransfer  *prometheus.Desc
+	scrapeSuccess       *prometheus.Desc
+	lastSuccess         *prometheus.Desc
+	auditMissing        *prometheus.CounterVec
+
+	// targetLabelNames are the custom label names attached to every
+	// per-target series.
+	targetLabelNames []string
+	timestamps       bool
+	allAudits        bool
+	maxAge           time.Duration
+
+	// labAudits lists the Lighthouse audits read from each result.
+	labAudits []labAudit
+	// categoryScores lists the categories exported besides performance.
+	categoryScores []categoryScore
+	// fieldMetrics lists the CrUX metrics read from each result.
+	fieldMetrics []fieldMetric
+
+	mu      sync.RWMutex
+	entries map[string]*entry
+
+	// fetchTimeErrors records the targets for which an unparsable fetchTime
+	// has already been logged, so a persistent format change doesn't flood
+	// the log.
+	fetchTimeErrors sync.Map
+}
+
+// New returns a Collector configured by opts.
+func New(opts Opts) *Collector {
+	base := labelNames([]string{"site", "strategy"}, opts.TargetLabels...)
+	desc := func(name, help string, extra ...string) *prometheus.Desc {
+		return prometheus.NewDesc(prometheus.BuildFQName(opts.Namespace, "", name), help, labelNames(base, extra...), nil)
+	}
+	c := &Collector{
+		targetLabelNames: opts.TargetLabels,
+		timestamps:       opts.Timestamps,
+		allAudits:        opts.AllAudits,
+		maxAge:           opts.MaxAge,
+		entries:          map[string]*entry{},
+
+		perfScore:           desc("performance_score", "Performance score from PSI (0-1 scale)"),
+		perfScoreMin:        desc("performance_score_min", "Lowest performance score of the runs the exported result is the median of"),
+		perfScoreMax:        desc("performance_score_max", "Highest performance score of the runs the exported result is the median of"),
+		runs:                desc("lighthouse_runs", "Number of successful Lighthouse runs the exported result is the median of"),
+		auditScore:          desc("audit_score", "Lighthouse audit score (0-1 scale)", "audit"),
+		auditNumeric:        desc("audit_numeric_value", "numericValue of a Lighthouse audit, in the audit's unit", "audit"),
+		resourceRequests:    desc("resource_requests", "Number of requests the page made for a resource type, from the resource-summary audit", "resource_type"),
+		resourceTransfer:    desc("resource_transfer_size_bytes", "Transfer size of the resources of a type the page loaded in bytes, from the resource-summary audit", "resource_type"),
+		a11yAuditScore:      desc("accessibility_audit_score", "Score of an audit of the accessibility category, 1 passed and 0 failed", "audit"),
+		lighthouseInfo:      desc("lighthouse_info", "Lighthouse version and form factor used for the last PSI run, always 1", "lighthouse_version", "form_factor"),
+		lighthouseFetchTime: desc("lighthouse_fetch_time_seconds", "Time at which Lighthouse fetched the page, as a Unix timestamp"),
+		analysisTime:        desc("analysis_timestamp_seconds", "Time at which PSI ran the analysis, older than the fetch when PSI served a cached analysis, as a Unix timestamp"),
+		finalURLInfo:        desc("final_url_info", "URL Lighthouse analyzed after following redirects, always 1", "final_url"),
+		redirected:          desc("redirected", "Whether the requested URL redirected to a different final URL (1) or not (0)"),
+		redirectHops:        desc("redirect_hops", "Number of redirects followed from the requested URL to the final URL"),
+		originFallback:      desc("field_origin_fallback", "Whether PSI fell back to the origin's field data because the page had too few CrUX samples (1) or not (0)"),
+		fieldDistribution:   desc("field_distribution", "Proportion of real users (CrUX) in the good, needs improvement or poor range of a metric (0-1 scale)", "metric", "bucket", "scope"),
+		fieldCategory:       desc("field_overall_category", "Whether the overall verdict of the field data (CrUX) of the target is the category (1) or not (0)", "category", "scope"),
+		labFieldDelta:       desc("lab_field_delta", "Lab value of a metric minus the 75th percentile of real users (CrUX), in the metric's unit", "metric", "scope"),
+		inp:                 desc("interaction_to_next_paint", "Interaction to Next Paint in milliseconds, from the field data or the lab audit", "source"),
+		savingsMs:           desc("opportunity_savings_ms", "Estimated load time savings of a Lighthouse opportunity in milliseconds", "audit"),
+		savingsBytes:        desc("opportunity_savings_bytes", "Estimated transfer size savings of a Lighthouse opportunity in bytes", "audit"),
+		mainThreadWork:      desc("mainthread_work_ms", "Main-thread time spent per Lighthouse task group in milliseconds", "group"),
+		bootupTime:          desc("bootup_time_ms", "Total JavaScript execution time reported by the bootup-time audit in milliseconds"),
+		thirdPartyBlocking:  desc("third_party_blocking_time_ms", "Main-thread blocking time of the scripts of a third-party entity in milliseconds", "entity"),
+		thirdPartyTransfer:  desc("third_party_transfer_size_bytes", "Transfer size of the resources of a third-party entity in bytes", "entity"),
+
+		scrapeSuccess: desc("scrape_success", "Whether the last PSI run of the target succeeded (1) or failed (0)"),
+		lastSuccess:   desc("last_successful_fetch_timestamp_seconds", "Time of the last successful PSI run of the target, as a Unix timestamp"),
+
+		auditMissing: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: opts.Namespace,
+			Name:      "audit_missing_total",
+			Help:      "Number of otherwise successful PSI responses that lacked an expected audit",
+		}, labelNames(base, "audit")),
+	}
+	c.labAudits = []labAudit{
+		{"first-contentful-paint", desc("first_contentful_paint", "First Contentful Paint in milliseconds"), false},
+		{"largest-contentful-paint", desc("largest_contentful_paint", "Largest Contentful Paint in milliseconds"), false},
+		{"cumulative-layout-shift", desc("cumulative_layout_shift", "Cumulative Layout Shift score"), false},
+		{"total-blocking-time", desc("total_blocking_time", "Total Blocking Time in milliseconds"), false},
+		{"speed-index", desc("speed_index", "Speed Index in milliseconds"), false},
+		{"server-response-time", desc("server_response_time", "Time the server took to respond to the main document request in milliseconds"), false},
+		// Lighthouse 10 removed Time to Interactive from the report.
+		{"interactive", desc("time_to_interactive", "Time to Interactive in milliseconds"), true},
+		{"total-byte-weight", desc("total_byte_weight_bytes", "Total size of the resources the page loaded in bytes"), true},
+		{"dom-size", desc("dom_size_elements", "Number of DOM elements of the page"), true},
+		{"network-requests", desc("network_requests", "Number of network requests the page made"), true},
+	}
+	c.categoryScores = []categoryScore{
+		{"accessibility", desc("accessibility_score", "Accessibility score from PSI (0-1 scale)")},
+		{"best-practices", desc("best_practices_score", "Best practices score from PSI (0-1 scale)")},
+		{"seo", desc("seo_score", "SEO score from PSI (0-1 scale)")},
+		{"pwa", desc("pwa_score", "Progressive Web App score from PSI (0-1 scale)")},
+	}
+	c.fieldMetrics = []fieldMetric{
+		{"FIRST_CONTENTFUL_PAINT_MS", desc("field_first_contentful_paint", "75th percentile First Contentful Paint of real users (CrUX) in milliseconds", "scope"), 1, "first-contentful-paint", "fcp"},
+		{"LARGEST_CONTENTFUL_PAINT_MS", desc("field_largest_contentful_paint", "75th percentile Largest Contentful Paint of real users (CrUX) in milliseconds", "scope"), 1, "largest-contentful-paint", "lcp"},
+		// CrUX reports CLS multiplied by 100.
+		{"CUMULATIVE_LAYOUT_SHIFT_SCORE", desc("field_cumulative_layout_shift", "75th percentile Cumulative Layout Shift of real users (CrUX)", "scope"), 0.01, "cumulative-layout-shift", "cls"},
+		// A page load has no interactions, so the lab has no INP.
+		{"INTERACTION_TO_NEXT_PAINT", desc("field_interaction_to_next_paint", "75th percentile Interaction to Next Paint of real users (CrUX) in milliseconds", "scope"), 1, "", "inp"},
+	}
+	return c
+}
+
+// TargetLabelNames returns the custom label names of the Collector.
+func (c *Collector) TargetLabelNames() []string {
+	return c.targetLabelNames
+}
+
+// Describe implements prometheus.Collector.
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	for _, d := range []*prometheus.Desc{
+		c.perfScore, c.perfScoreMin, c.perfScoreMax, c.runs,
+		c.auditScore, c.auditNumeric, c.a11yAuditScore, c.resourceRequests, c.resourceTransfer,
+		c.lighthouseInfo, c.lighthouseFetchTime, c.analysisTime,
+		c.finalURLInfo, c.redirected, c.redirectHops,
+		c.originFallback, c.labFieldDelta, c.fieldDistribution, c.fieldCategory, c.inp, c.savingsMs, c.savingsBytes,
+		c.mainThreadWork, c.bootupTime, c.thirdPartyBlocking, c.thirdPartyTransfer,
+		c.scrapeSuccess, c.lastSuccess,
+	} {
+		ch <- d
+	}
+	for _, a := range c.labAudits {
+		ch <- a.desc
+	}
+	for _, s := range c.categoryScores {
+		ch <- s.desc
+	}
+	for _, f := range c.fieldMetrics {
+		ch <- f.desc
+	}
+	c.auditMissing.Describe(ch)
+}
+
+// Collect implements prometheus.Collector, turning the stored results into
+// metrics. Values a result lacks, such as audits missing from the response,
+// aren't exported for that target rather than keeping an earlier value.
+// Results older than MaxAge only export the run metrics, so their last
+// successful fetch time still tells how stale they are.
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	c.auditMissing.Collect(ch)
+
+	now := time.Now()
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	// The origin twin of a page target writes the same series as the page
+	// except for the field data, so it only exports that.
+	pages := map[string]bool{}
+	for _, e := range c.entries {
+		if e.scope != ScopeOrigin {
+			pages[e.labKey] = true
+		}
+	}
+	for _, e := range c.entries {
+		fieldOnly := e.scope == ScopeOrigin && pages[e.labKey]
+		// The run metrics describe the run itself, so they never carry the
+		// fetch time.
+		if !fieldOnly {
+			ch <- prometheus.MustNewConstMetric(c.scrapeSuccess, prometheus.GaugeValue, boolValue(e.success), e.labelValues...)
+			if !e.lastSuccess.IsZero() {
+				ch <- prometheus.MustNewConstMetric(c.lastSuccess, prometheus.GaugeValue, float64(e.lastSuccess.UnixNano())/1e9, e.labelValues...)
+			}
+		}
+		r := e.result
+		if r == nil || c.maxAge > 0 && now.Sub(e.lastSuccess) > c.maxAge {
+			continue
+		}
+
+		emit := func(desc *prometheus.Desc, value float64, extra ...string) {
+			m := prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, value, labelNames(e.labelValues, extra...)...)
+			if c.timestamps && !e.fetchTime.IsZero() {
+				m = prometheus.NewMetricWithTimestamp(e.fetchTime, m)
+			}
+			ch <- m
+		}
+
+		for _, f := range c.fieldMetrics {
+			v, ok := r.FieldData[f.metric]
+			if !ok {
+				continue
+			}
+			emit(f.desc, v, e.scope)
+			if lab, ok := r.Metrics[f.labAudit]; ok && f.labAudit != "" {
+				emit(c.labFieldDelta, lab-v, f.name, e.scope)
+			}
+			for i, proportion := range r.FieldDistribution[f.metric] {
+				emit(c.fieldDistribution, proportion, f.name, fieldBuckets[i], e.scope)
+			}
+		}
+		// Verdicts unknown to the exporter set every category to 0.
+		if r.FieldCategory != "" {
+			for _, category := range fieldCategories {
+				emit(c.fieldCategory, boolValue(r.FieldCategory == category), strings.ToLower(category), e.scope)
+			}
+		}
+		if fieldOnly {
+			continue
+		}
+		if r.PerformanceScore != nil {
+			emit(c.perfScore, *r.PerformanceScore)
+		}
+		if len(r.RunScores) > 0 {
+			emit(c.perfScoreMin, r.RunScores[0])
+			emit(c.perfScoreMax, r.RunScores[len(r.RunScores)-1])
+			emit(c.runs, float64(len(r.RunScores)))
+		}
+		for _, s := range c.categoryScores {
+			if v, ok := r.CategoryScores[s.category]; ok {
+				emit(s.desc, v)
+			}
+		}
+		for _, a := range c.labAudits {
+			if v, ok := r.Metrics[a.audit]; ok {
+				emit(a.desc, v)
+			}
+		}
+		for audit, v := range r.AuditScores {
+			emit(c.auditScore, v, audit)
+		}
+		if c.allAudits || e.allAudits {
+			for audit, v := range r.Metrics {
+				emit(c.auditNumeric, v, audit)
+			}
+		}
+		for resourceType, v := range r.ResourceRequests {
+			emit(c.resourceRequests, v, resourceType)
+		}
+		for resourceType, v := range r.ResourceTransferSize {
+			emit(c.resourceTransfer, v, resourceType)
+		}
+		for audit, v := range r.AccessibilityAudits {
+			emit(c.a11yAuditScore, v, audit)
+		}
+		if r.LighthouseVersion != "" {
+			emit(c.lighthouseInfo, 1, r.LighthouseVersion, e.formFactor)
+		}
+		if !e.fetchTime.IsZero() {
+			emit(c.lighthouseFetchTime, float64(e.fetchTime.UnixNano())/1e9)
+		}
+		if r.FinalURL != "" {
+			emit(c.finalURLInfo, 1, r.FinalURL)
+			emit(c.redirected, boolValue(e.redirected))
+		}
+		if r.RedirectHops != nil {
+			emit(c.redirectHops, float64(*r.RedirectHops))
+		}
+		if r.AnalysisTime != nil {
+			emit(c.analysisTime, float64(r.AnalysisTime.UnixNano())/1e9)
+		}
+		if v, ok := r.FieldData["INTERACTION_TO_NEXT_PAINT"]; ok {
+			emit(c.inp, v, "field")
+		}
+		if v, ok := r.Metrics[labINPAudits[0]]; ok {
+			emit(c.inp, v, "lab")
+		}
+		// Origin-scoped targets read the origin's data in any case.
+		if e.scope == ScopePage && len(r.FieldData) > 0 {
+			emit(c.originFallback, boolValue(r.OriginFallback))
+		}
+		for audit, v := range r.SavingsMs {
+			emit(c.savingsMs, v, audit)
+		}
+		for audit, v := range r.SavingsBytes {
+			emit(c.savingsBytes, v, audit)
+		}
+		for group, duration := range r.MainThreadWork {
+			emit(c.mainThreadWork, duration, group)
+		}
+		if r.BootupTime != nil {
+			emit(c.bootupTime, *r.BootupTime)
+		}
+		for entity, v := range r.ThirdPartyBlockingTime {
+			emit(c.thirdPartyBlocking, v, entity)
+		}
+		for entity, v := range r.ThirdPartyTransferSize {
+			emit(c.thirdPartyTransfer, v, entity)
+		}
+	}
+}
+
+// Failed records a failed PSI run of target. The values of its last
+// successful run stay exported.
+func (c *Collector) Failed(target Target) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[target.key()]
+	if !ok {
+		e = &entry{labelValues: c.labelValues(target), url: target.URL, scope: target.Scope, labKey: target.labKey(), backend: target.Backend, profile: target.Profile, allAudits: target.AllAudits}
+		c.entries[target.key()] = e
+	}
+	e.success = false
+}
+
+// Delete removes every series of t.
+func (c *Collector) Delete(t Target) {
+	c.mu.Lock()
+	delete(c.entries, t.key())
+	c.mu.Unlock()
+	// The counters of t are those with every label of t, whatever their
+	// audit.
+	labels := prometheus.Labels{"site": t.site(), "strategy": t.Strategy}
+	for _, name := range c.targetLabelNames {
+		labels[name] = t.Labels[name]
+	}
+	c.auditMissing.DeletePartialMatch(labels)
+}
+
+// Saved is the stored state of a target, as returned by Save, which Restore
+// exports again, e.g. after a restart.
+type Saved struct {
+	URL      string `json:"url"`
+	Strategy string `json:"strategy"`
+	Scope    string `json:"scope,omitempty"`
+	Backend  string `json:"backend,omitempty"`
+	Profile  string `json:"profile,omitempty"`
+	// Result is nil if the target never had a successful run.
+	Result      *Result   `json:"result,omitempty"`
+	FormFactor  string    `json:"form_factor,omitempty"`
+	FetchTime   time.Time `json:"fetch_time"`
+	Redirected  bool      `json:"redirected,omitempty"`
+	Success     bool      `json:"success"`
+	LastSuccess time.Time `json:"last_success"`
+}
+
+// Save returns the stored state of every target.
+func (c *Collector) Save() []Saved {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	saved := make([]Saved, 0, len(c.entries))
+	for _, e := range c.entries {
+		saved = append(saved, Saved{
+			URL:         e.url,
+			Strategy:    e.labelValues[1],
+			Scope:       e.scope,
+			Backend:     e.backend,
+			Profile:     e.profile,
+			Result:      e.result,
+			FormFactor:  e.formFactor,
+			FetchTime:   e.fetchTime,
+			Redirected:  e.redirected,
+			Success:     e.success,
+			LastSuccess: e.lastSuccess,
+		})
+	}
+	return saved
+}
+
+// Restore stores the saved state of target, with target's current labels and
+// scope, unless a run of target was recorded since the Collector was created.
+func (c *Collector) Restore(target Target, saved Saved) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.entries[target.key()]; ok {
+		return
+	}
+	c.entries[target.key()] = &entry{
+		labelValues: c.labelValues(target),
+		url:         target.URL,
+		scope:       target.Scope,
+		labKey:      target.labKey(),
+		backend:     target.Backend,
+		profile:     target.Profile,
+		allAudits:   target.AllAudits,
+		formFactor:  saved.FormFactor,
+		fetchTime:   saved.FetchTime,
+		redirected:  saved.Redirected,
+		result:      saved.Result,
+		success:     saved.Success,
+		lastSuccess: saved.LastSuccess,
+	}
+}
+
+// labelNames returns a copy of names with extra appended.
+func labelNames(names []string, extra ...string) []string {
+	return append(append([]string{}, names...), extra...)
+}
+
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// labelValues returns the values of the site, strategy and custom labels of
+// t. Custom labels t doesn't define are set to the empty string.
+func (c *Collector) labelValues(t Target) []string {
+	values := []string{t.site(), t.Strategy}
+	for _, name := range c.targetLabelNames {
+		values = append(values, t.Labels[name])
+	}
+	return values
+}
+
+// Set stores the values of a successful PSI run of target, replacing its
+// previous result, and returns them. Lighthouse diagnostics are exported only
+// with detailedAudits.
+func (c *Collector) Set(logger *slog.Logger, target Target, res *psi.Result, detailedAudits bool) *Result {
+	return c.SetRuns(logger, target, []*psi.Result{res}, detailedAudits)
+}
+
+// SetRuns is like Set for several successful runs of target. It stores the
+// run with the median performance score, rather than the median of each
+// metric, so the exported values stay those of one consistent run. Of an
+// even number of runs, the lower of the two middle ones is the median. Runs
+// without a performance score only count when every run lacks one.
+func (c *Collector) SetRuns(logger *slog.Logger, target Target, runs []*psi.Result, detailedAudits bool) *Result {
+	res, scores := MedianRun(runs)
+	extracted := &Result{
+		Metrics:           map[string]float64{},
+		AuditScores:       map[string]float64{},
+		LighthouseVersion: res.LighthouseVersion,
+		FinalURL:          res.FinalURL,
+	}
+	if len(runs) > 1 {
+		extracted.RunScores = scores
+	}
+	e := &entry{
+		labelValues: c.labelValues(target),
+		url:         target.URL,
+		scope:       target.Scope,
+		labKey:      target.labKey(),
+		backend:     target.Backend,
+		profile:     target.Profile,
+		allAudits:   target.AllAudits,
+		formFactor:  res.FormFactor,
+		fetchTime:   c.fetchTime(logger, target, res),
+		result:      extracted,
+		success:     true,
+		lastSuccess: time.Now(),
+	}
+
+	if score, ok := res.Categories["performance"]; ok {
+		extracted.PerformanceScore = &score
+	}
+	for _, s := range c.categoryScores {
+		if score, ok := res.Categories[s.category]; ok {
+			if extracted.CategoryScores == nil {
+				extracted.CategoryScores = map[string]float64{}
+			}
+			extracted.CategoryScores[s.category] = score
+		}
+	}
+	if res.FinalURL != "" {
+		requestedURL := res.RequestedURL
+		if requestedURL == "" {
+			requestedURL = target.URL
+		}
+		e.redirected = res.FinalURL != requestedURL
+	}
+	// The redirects audit lists no chain when the page didn't redirect.
+	if audit, ok := res.Audits["redirects"]; ok {
+		hops := max(len(psi.Items[redirectHop](audit))-1, 0)
+		extracted.RedirectHops = &hops
+	}
+	if analysisTime, err := time.Parse(time.RFC3339, res.AnalysisTime); err == nil {
+		extracted.AnalysisTime = &analysisTime
+	}
+	extracted.FieldData = c.fieldData(target.Scope, res)
+	extracted.FieldDistribution = c.fieldDistributions(target.Scope, res)
+	extracted.FieldCategory = res.OverallCategory
+	if target.Scope == ScopeOrigin {
+		extracted.FieldCategory = res.OriginOverallCategory
+	}
+	extracted.OriginFallback = target.Scope == ScopePage && res.OriginFallback
+
+	// Navigation runs don't measure interactions, so the lab INP is optional
+	// and not reported as missing.
+	for _, id := range labINPAudits {
+		if v := res.Audits[id].NumericValue; v != nil {
+			extracted.Metrics[labINPAudits[0]] = *v
+			break
+		}
+	}
+	extracted.MissingAudits = c.labValues(target, res, extracted)
+	// Some Lighthouse versions report network-requests only as a table of
+	// the requests.
+	if audit, ok := res.Audits["network-requests"]; ok && audit.NumericValue == nil && audit.Details.Items != nil {
+		extracted.Metrics["network-requests"] = float64(len(audit.Details.Items))
+	}
+	if len(extracted.MissingAudits) > 0 {
+		logger.Warn("Audits missing from PSI response", "audits", strings.Join(extracted.MissingAudits, ","))
+	}
+	if c.allAudits || target.AllAudits {
+		allAudits(res, extracted)
+	}
+	opportunities(res, extracted)
+	resourceSummary(res, extracted)
+	accessibilityAudits(res, extracted)
+	if detailedAudits {
+		diagnostics(res, extracted)
+	}
+
+	c.mu.Lock()
+	c.entries[target.key()] = e
+	c.mu.Unlock()
+	return extracted
+}
+
+// MedianRun returns the run of runs with the median performance score, the
+// one SetRuns stores, and the sorted scores of the runs that have one.
+func MedianRun(runs []*psi.Result) (*psi.Result, []float64) {
+	scored := slices.DeleteFunc(slices.Clone(runs), func(r *psi.Result) bool {
+		_, ok := r.Categories["performance"]
+		return !ok
+	})
+	if len(scored) == 0 {
+		return runs[0], nil
+	}
+	slices.SortStableFunc(scored, func(a, b *psi.Result) int {
+		return cmp.Compare(a.Categories["performance"], b.Categories["performance"])
+	})
+	scores := make([]float64, len(scored))
+	for i, r := range scored {
+		scores[i] = r.Categories["performance"]
+	}
+	return scored[(len(scored)-1)/2], scores
+}
+
+// fetchTime parses the time Lighthouse fetched the page. It is zero when the
+// result has none or it doesn't parse, which is logged once per target until
+// a later result parses again.
+func (c *Collector) fetchTime(logger *slog.Logger, target Target, res *psi.Result) time.Time {
+	if res.FetchTime == "" {
+		return time.Time{}
+	}
+	fetchTime, err := time.Parse(time.RFC3339, res.FetchTime)
+	if err != nil {
+		if _, logged := c.fetchTimeErrors.LoadOrStore(target.key(), true); !logged {
+			logger.Warn("Error parsing fetchTime", "fetch_time", res.FetchTime, "err", err)
+		}
+		return time.Time{}
+	}
+	c.fetchTimeErrors.Delete(target.key())
+	return fetchTime
+}
+
+// labValues records the numericValue and score of every audit in labAudits
+// in extracted, and returns the required audits the result has no
+// numericValue for. A missing audit is counted and not exported rather than left at its
+// previous value, which would look like healthy flat data.
+func (c *Collector) labValues(target Target, res *psi.Result, extracted *Result) []string {
+	var missing []string
+	for _, a := range c.labAudits {
+		audit := res.Audits[a.audit]
+		if audit.NumericValue == nil {
+			if !a.optional {
+				c.auditMissing.WithLabelValues(append(c.labelValues(target), a.audit)...).Inc()
+				missing = append(missing, a.audit)
+			}
+			continue
+		}
+		extracted.Metrics[a.audit] = *audit.NumericValue
+		// Informative audits have a null score and are skipped.
+		if audit.Score != nil {
+			extracted.AuditScores[a.audit] = *audit.Score
+		}
+	}
+	return missing
+}
+
+// allAudits records the numericValue and score of every audit in extracted.
+func allAudits(res *psi.Result, extracted *Result) {
+	for id, audit := range res.Audits {
+		if audit.NumericValue != nil {
+			extracted.Metrics[id] = *audit.NumericValue
+		}
+		if audit.Score != nil {
+			extracted.AuditScores[id] = *audit.Score
+		}
+	}
+}
+
+// opportunities records the estimated savings of every opportunity audit in
+// extracted. Savings the audit doesn't estimate, such as bytes for
+// render-blocking-resources, are absent.
+func opportunities(res *psi.Result, extracted *Result) {
+	for id, audit := range res.Audits {
+		if audit.Details.Type != "opportunity" {
+			continue
+		}
+		if v := audit.Details.OverallSavingsMs; v != nil {
+			if extracted.SavingsMs == nil {
+				extracted.SavingsMs = map[string]float64{}
+			}
+			extracted.SavingsMs[id] = *v
+		}
+		if v := audit.Details.OverallSavingsBytes; v != nil {
+			if extracted.SavingsBytes == nil {
+				extracted.SavingsBytes = map[string]float64{}
+			}
+			extracted.SavingsBytes[id] = *v
+		}
+	}
+}
+
+// resourceSummary records the requests and the transfer size of every
+// resource type of the resource-summary audit in extracted.
+func resourceSummary(res *psi.Result, extracted *Result) {
+	for _, item := range psi.Items[resourceType](res.Audits["resource-summary"]) {
+		if item.ResourceType == "" {
+			continue
+		}
+		if item.RequestCount != nil {
+			if extracted.ResourceRequests == nil {
+				extracted.ResourceRequests = map[string]float64{}
+			}
+			extracted.ResourceRequests[item.ResourceType] = *item.RequestCount
+		}
+		if item.TransferSize != nil {
+			if extracted.ResourceTransferSize == nil {
+				extracted.ResourceTransferSize = map[string]float64{}
+			}
+			extracted.ResourceTransferSize[item.ResourceType] = *item.TransferSize
+		}
+	}
+}
+
+// accessibilityAudits records the score of every audit of the accessibility
+// category in extracted. Manual and not applicable audits have no score and
+// are absent.
+func accessibilityAudits(res *psi.Result, extracted *Result) {
+	for _, id := range res.CategoryAudits["accessibility"] {
+		if score := res.Audits[id].Score; score != nil {
+			if extracted.AccessibilityAudits == nil {
+				extracted.AccessibilityAudits = map[string]float64{}
+			}
+			extracted.AccessibilityAudits[id] = *score
+		}
+	}
+}
+
+// diagnostics records the main-thread work breakdown per task group, the
+// bootup-time total and the impact of every third-party entity in extracted.
+// Group and entity names are passed through unchanged.
+func diagnostics(res *psi.Result, extracted *Result) {
+	work := map[string]float64{}
+	for _, item := range psi.Items[mainThreadTask](res.Audits["mainthread-work-breakdown"]) {
+		if item.Group == "" || item.Duration == nil {
+			continue
+		}
+		work[item.Group] += *item.Duration
+	}
+	if len(work) > 0 {
+		extracted.MainThreadWork = work
+	}
+	extracted.BootupTime = res.Audits["bootup-time"].NumericValue
+
+	blocking, transfer := map[string]float64{}, map[string]float64{}
+	for _, item := range psi.Items[thirdPartyEntity](res.Audits["third-party-summary"]) {
+		name := item.name()
+		if name == "" {
+			continue
+		}
+		if item.BlockingTime != nil {
+			blocking[name] += *item.BlockingTime
+		}
+		if item.TransferSize != nil {
+			transfer[name] += *item.TransferSize
+		}
+	}
+	if len(blocking) > 0 {
+		extracted.ThirdPartyBlockingTime = blocking
+	}
+	if len(transfer) > 0 {
+		extracted.ThirdPartyTransferSize = transfer
+	}
+}
+
+// fieldData returns the CrUX field data of a result. Page-scoped targets read
+// the page's loading experience and origin-scoped ones the origin's. Metrics
+// the result has no data for are absent, since small pages often lack field
+// data.
+func (c *Collector) fieldData(scope string, res *psi.Result) map[string]float64 {
+	percentiles := res.LoadingExperience
+	if scope == ScopeOrigin {
+		percentiles = res.OriginLoadingExperience
+	}
+	values := map[string]float64{}
+	for _, f := range c.fieldMetrics {
+		if percentile, ok := percentiles[f.metric]; ok {
+			values[f.metric] = percentile * f.scale
+		}
+	}
+	return values
+}
+
+// fieldDistributions returns the distributions of the field data of a result,
+// of the page or of the origin like fieldData.
+func (c *Collector) fieldDistributions(scope string, res *psi.Result) map[string][]float64 {
+	distributions := res.Distributions
+	if scope == ScopeOrigin {
+		distributions = res.OriginDistributions
+	}
+	var values map[string][]float64
+	for _, f := range c.fieldMetrics {
+		if d, ok := distributions[f.metric]; ok {
+			if values == nil {
+				values = map[string][]float64{}
+			}
+			values[f.metric] = d
+		}
+	}
+	return values
+}
@@ -0,0 +1,235 @@
+package collector
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"github.com/yahyasahaja/prometheus-exporter-pagespeed-insight/pkg/psi"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files of testdata")
+
+// fetch returns the result of a PSI run answered with the recorded response
+// testdata/name.
+func fetch(t *testing.T, name string) *psi.Result {
+	t.Helper()
+	body, err := os.ReadFile("testdata/" + name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(body)
+	}))
+	defer api.Close()
+	client, err := psi.New(psi.Config{Keys: []string{"test"}, BaseURL: api.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := client.Run(context.Background(), "https://example.com/", "mobile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res
+}
+
+// withoutRunTimes gathers g without the families holding the time of the
+// test run.
+func withoutRunTimes(g prometheus.Gatherer) prometheus.Gatherer {
+	return prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		families, err := g.Gather()
+		return slices.DeleteFunc(families, func(f *dto.MetricFamily) bool {
+			return f.GetName() == "psi_last_successful_fetch_timestamp_seconds"
+		}), err
+	})
+}
+
+var discard = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+func TestCollectGolden(t *testing.T) {
+	c := New(Opts{Namespace: "psi", TargetLabels: []string{"team"}})
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(c)
+
+	res := fetch(t, "runpagespeed.json")
+	page := Target{URL: "https://example.com/", Strategy: "mobile", Scope: ScopePage, Labels: map[string]string{"team": "web"}}
+	c.Set(discard, page, res, true)
+	origin := page
+	origin.Scope = ScopeOrigin
+	c.Set(discard, origin, res, true)
+	failed := Target{URL: "https://example.com/down", Strategy: "desktop", Scope: ScopePage}
+	c.Failed(failed)
+
+	golden := "testdata/metrics.golden"
+	if *update {
+		families, err := withoutRunTimes(reg).Gather()
+		if err != nil {
+			t.Fatal(err)
+		}
+		f, err := os.Create(golden)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, family := range families {
+			if _, err := expfmt.MetricFamilyToText(f, family); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := f.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want, err := os.Open(golden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer want.Close()
+	if err := testutil.GatherAndCompare(withoutRunTimes(reg), want); err != nil {
+		t.Error(err)
+	}
+	// The run times are still exported, though not compared.
+	if n, err := testutil.GatherAndCount(reg, "psi_last_successful_fetch_timestamp_seconds"); err != nil || n != 1 {
+		t.Errorf("exported %d last successful fetch times (%v), want 1", n, err)
+	}
+}
+
+func TestSetMissingAudits(t *testing.T) {
+	c := New(Opts{Namespace: "psi", TargetLabels: []string{"profile"}})
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(c)
+	var logs bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&logs, nil))
+	target := Target{URL: "https://example.com/", Strategy: "mobile", Scope: ScopePage}
+
+	c.Set(logger, target, fetch(t, "runpagespeed.json"), false)
+	if logs.Len() > 0 {
+		t.Errorf("logged %q for a complete response", logs.String())
+	}
+	for range 2 {
+		res := c.Set(logger, target, fetch(t, "runpagespeed_missing_audits.json"), false)
+		if want := []string{"total-blocking-time", "speed-index"}; !slices.Equal(res.MissingAudits, want) {
+			t.Errorf("got missing audits %q, want %q", res.MissingAudits, want)
+		}
+	}
+
+	// Optional audits such as interactive aren't counted.
+	want := `
+# HELP psi_audit_missing_total Number of otherwise successful PSI responses that lacked an expected audit
+# TYPE psi_audit_missing_total counter
+psi_audit_missing_total{audit="speed-index",profile="",site="https://example.com/",strategy="mobile"} 2
+psi_audit_missing_total{audit="total-blocking-time",profile="",site="https://example.com/",strategy="mobile"} 2
+`
+	if err := testutil.GatherAndCompare(reg, strings.NewReader(want), "psi_audit_missing_total"); err != nil {
+		t.Error(err)
+	}
+	// The series of the missing audits are deleted rather than left at
+	// their previous values.
+	for _, name := range []string{"psi_speed_index", "psi_total_blocking_time"} {
+		if n, err := testutil.GatherAndCount(reg, name); err != nil || n != 0 {
+			t.Errorf("exported %d %s series (%v), want none", n, name, err)
+		}
+	}
+	scores := `
+# HELP psi_audit_score Lighthouse audit score (0-1 scale)
+# TYPE psi_audit_score gauge
+psi_audit_score{audit="cumulative-layout-shift",profile="",site="https://example.com/",strategy="mobile"} 0.95
+psi_audit_score{audit="first-contentful-paint",profile="",site="https://example.com/",strategy="mobile"} 0.9
+psi_audit_score{audit="largest-contentful-paint",profile="",site="https://example.com/",strategy="mobile"} 0.8
+psi_audit_score{audit="server-response-time",profile="",site="https://example.com/",strategy="mobile"} 1
+`
+	if err := testutil.GatherAndCompare(reg, strings.NewReader(scores), "psi_audit_score"); err != nil {
+		t.Error(err)
+	}
+	if n, err := testutil.GatherAndCount(reg, "psi_largest_contentful_paint"); err != nil || n != 1 {
+		t.Errorf("exported %d LCP series (%v), want 1", n, err)
+	}
+	if got := strings.Count(logs.String(), `level=WARN msg="Audits missing from PSI response" audits=total-blocking-time,speed-index`); got != 2 {
+		t.Errorf("logged %q, want 2 warnings about the missing audits", logs.String())
+	}
+
+	// Deleting the target deletes its counters, but not those of the same
+	// page scanned with another profile.
+	light := Target{URL: "https://example.com/", Strategy: "mobile", Scope: ScopePage, Profile: "light", Labels: map[string]string{"profile": "light"}}
+	c.Set(discard, light, fetch(t, "runpagespeed_missing_audits.json"), false)
+	c.Delete(target)
+	want = `
+# HELP psi_audit_missing_total Number of otherwise successful PSI responses that lacked an expected audit
+# TYPE psi_audit_missing_total counter
+psi_audit_missing_total{audit="speed-index",profile="light",site="https://example.com/",strategy="mobile"} 1
+psi_audit_missing_total{audit="total-blocking-time",profile="light",site="https://example.com/",strategy="mobile"} 1
+`
+	if err := testutil.GatherAndCompare(reg, strings.NewReader(want), "psi_audit_missing_total"); err != nil {
+		t.Errorf("after deleting the target: %v", err)
+	}
+}
+
+func TestTargetAllAudits(t *testing.T) {
+	// numericAudits returns the number of psi_audit_numeric_value series of
+	// each profile gathered from g.
+	numericAudits := func(g prometheus.Gatherer) map[string]int {
+		families, err := g.Gather()
+		if err != nil {
+			t.Fatal(err)
+		}
+		counts := map[string]int{}
+		for _, f := range families {
+			if f.GetName() != "psi_audit_numeric_value" {
+				continue
+			}
+			for _, m := range f.Metric {
+				for _, l := range m.Label {
+					if l.GetName() == "profile" {
+						counts[l.GetValue()]++
+					}
+				}
+			}
+		}
+		return counts
+	}
+
+	c := New(Opts{Namespace: "psi", TargetLabels: []string{"profile"}})
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(c)
+	light := Target{URL: "https://example.com/", Strategy: "mobile", Scope: ScopePage, Profile: "light", Labels: map[string]string{"profile": "light"}}
+	full := light
+	full.Profile, full.Labels, full.AllAudits = "full", map[string]string{"profile": "full"}, true
+	c.Set(discard, light, fetch(t, "runpagespeed.json"), false)
+	c.Set(discard, full, fetch(t, "runpagespeed.json"), false)
+
+	// Only the profile with all_audits exports every audit.
+	counts := numericAudits(reg)
+	if counts["full"] == 0 || counts["light"] != 0 {
+		t.Fatalf("exported %v numeric audits by profile, want those of the full profile only", counts)
+	}
+	// Its audits stay exported after a failed run and once restored.
+	c.Failed(full)
+	if got := numericAudits(reg); got["full"] != counts["full"] {
+		t.Errorf("exported %d numeric audits after a failed run, want %d", got["full"], counts["full"])
+	}
+	restored := New(Opts{Namespace: "psi", TargetLabels: []string{"profile"}})
+	reg = prometheus.NewPedanticRegistry()
+	reg.MustRegister(restored)
+	for _, s := range c.Save() {
+		if s.Profile == "full" {
+			restored.Restore(full, s)
+		} else {
+			restored.Restore(light, s)
+		}
+	}
+	if got := numericAudits(reg); got["full"] != counts["full"] || got["light"] != 0 {
+		t.Errorf("exported %v numeric audits by profile once restored, want %v", got, counts)
+	}
+}
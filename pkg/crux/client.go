@@ -0,0 +1,199 @@
+// Package crux is a client for the history of the Chrome UX Report API: the
+// 75th percentiles of the Core Web Vitals of real users of a page or an
+// origin over the last weeks, one 28-day collection period per week.
+package crux
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// DefaultEndpoint is the queryHistoryRecord method of the CrUX API.
+const DefaultEndpoint = "https://chromeuxreport.googleapis.com/v1/records:queryHistoryRecord"
+
+// DefaultPeriods is the number of collection periods the API returns by
+// default, 25 weeks.
+const DefaultPeriods = 25
+
+// Metrics are the ids of the metrics of a History.
+var Metrics = []string{
+	"first_contentful_paint",
+	"largest_contentful_paint",
+	"cumulative_layout_shift",
+	"interaction_to_next_paint",
+}
+
+// ErrNotFound is returned for a page or an origin with too few users to have
+// CrUX data.
+var ErrNotFound = errors.New("crux: no data for the page or origin")
+
+// Config configures a Client.
+type Config struct {
+	APIKey string
+	// BaseURL is the queryHistoryRecord endpoint, DefaultEndpoint when
+	// empty.
+	BaseURL string
+	// HTTPClient makes the API requests, http.DefaultClient when nil.
+	HTTPClient *http.Client
+}
+
+// Client queries the CrUX History API. It is safe for concurrent use.
+type Client struct {
+	apiKey     string
+	baseURL    string
+	httpClient *http.Client
+}
+
+// New returns a Client for cfg.
+func New(cfg Config) *Client {
+	c := &Client{apiKey: cfg.APIKey, baseURL: cfg.BaseURL, httpClient: cfg.HTTPClient}
+	if c.baseURL == "" {
+		c.baseURL = DefaultEndpoint
+	}
+	if c.httpClient == nil {
+		c.httpClient = http.DefaultClient
+	}
+	return c
+}
+
+// Query selects the record of a History.
+type Query struct {
+	// URL is the page, unless Origin is set.
+	URL    string
+	Origin string
+	// FormFactor is "PHONE", "DESKTOP" or "TABLET", every device when empty.
+	FormFactor string
+	// Periods is the number of collection periods, DefaultPeriods when zero.
+	Periods int
+}
+
+// Period is a collection period of a History.
+type Period struct {
+	// FirstDate and LastDate are the first and the last day of the period,
+	// at midnight UTC.
+	FirstDate, LastDate time.Time
+	// P75 maps the ids of Metrics to their 75th percentile in the period.
+	// Metrics without enough data in the period are absent.
+	P75 map[string]float64
+}
+
+// date is a day of a collection period.
+type date struct {
+	Year  int `json:"year"`
+	Month int `json:"month"`
+	Day   int `json:"day"`
+}
+
+func (d date) time() time.Time {
+	return time.Date(d.Year, time.Month(d.Month), d.Day, 0, 0, 0, 0, time.UTC)
+}
+
+// History returns the collection periods of the record of q, oldest first.
+func (c *Client) History(ctx context.Context, q Query) ([]Period, error) {
+	body := map[string]any{"metrics": Metrics}
+	if q.Origin != "" {
+		body["origin"] = q.Origin
+	} else {
+		body["url"] = q.URL
+	}
+	if q.FormFactor != "" {
+		body["formFactor"] = q.FormFactor
+	}
+	if q.Periods > 0 {
+		body["collectionPeriodCount"] = q.Periods
+	}
+	raw, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.baseURL+"?"+url.Values{"key": {c.apiKey}}.Encode(), bytes.NewReader(raw))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			urlErr.URL = c.baseURL
+		}
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("reading CrUX response: %v", err)
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, ErrNotFound
+	}
+
+	var res struct {
+		Record struct {
+			Metrics map[string]struct {
+				PercentilesTimeseries struct {
+					// P75s are numbers, or strings for the layout shift,
+					// and null for periods without enough data.
+					P75s []json.RawMessage `json:"p75s"`
+				} `json:"percentilesTimeseries"`
+			} `json:"metrics"`
+			CollectionPeriods []struct {
+				FirstDate date `json:"firstDate"`
+				LastDate  date `json:"lastDate"`
+			} `json:"collectionPeriods"`
+		} `json:"record"`
+		Error *struct {
+			Code    int    `json:"code"`
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	if err := json.Unmarshal(data, &res); err != nil {
+		return nil, fmt.Errorf("decoding CrUX response: %v", err)
+	}
+	if res.Error != nil {
+		return nil, fmt.Errorf("CrUX API error %d: %s", res.Error.Code, res.Error.Message)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("CrUX API returned HTTP %d", resp.StatusCode)
+	}
+
+	periods := make([]Period, len(res.Record.CollectionPeriods))
+	for i, p := range res.Record.CollectionPeriods {
+		periods[i] = Period{FirstDate: p.FirstDate.time(), LastDate: p.LastDate.time(), P75: map[string]float64{}}
+	}
+	for id, m := range res.Record.Metrics {
+		for i, raw := range m.PercentilesTimeseries.P75s {
+			if i >= len(periods) {
+				break
+			}
+			if v, ok := parseP75(raw); ok {
+				periods[i].P75[id] = v
+			}
+		}
+	}
+	return periods, nil
+}
+
+// parseP75 returns the value of a percentile, false for null.
+func parseP75(raw json.RawMessage) (float64, bool) {
+	var v any
+	if err := json.Unmarshal(raw, &v); err != nil {
+		return 0, false
+	}
+	switch v := v.(type) {
+	case float64:
+		return v, true
+	case string:
+		f, err := strconv.ParseFloat(v, 64)
+		return f, err == nil
+	}
+	return 0, false
+}
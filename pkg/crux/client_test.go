@@ -0,0 +1,136 @@
+package crux
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+// fixture returns the recorded API response testdata/name.
+func fixture(t *testing.T, name string) []byte {
+	t.Helper()
+	body, err := os.ReadFile("testdata/" + name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return body
+}
+
+// newFakeAPI returns a client of a CrUX API answering every request with
+// status and body, and the request bodies it decoded.
+func newFakeAPI(t *testing.T, status int, body []byte) (*Client, *[]map[string]any) {
+	var requests []map[string]any
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			t.Errorf("request method %s", r.Method)
+		}
+		if got := r.URL.Query().Get("key"); got != "test-key" {
+			t.Errorf("requested with key %q", got)
+		}
+		if got := r.Header.Get("Content-Type"); got != "application/json" {
+			t.Errorf("request content type %q", got)
+		}
+		var req map[string]any
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Errorf("decoding request: %v", err)
+		}
+		requests = append(requests, req)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		w.Write(body)
+	}))
+	t.Cleanup(api.Close)
+	return New(Config{APIKey: "test-key", BaseURL: api.URL}), &requests
+}
+
+func TestHistory(t *testing.T) {
+	c, requests := newFakeAPI(t, http.StatusOK, fixture(t, "history.json"))
+	periods, err := c.History(context.Background(), Query{URL: "https://example.com/", FormFactor: "PHONE", Periods: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := (*requests)[0]
+	if req["url"] != "https://example.com/" || req["formFactor"] != "PHONE" || req["collectionPeriodCount"] != 3.0 {
+		t.Errorf("requested %v", req)
+	}
+	if _, ok := req["origin"]; ok {
+		t.Errorf("requested %v with an origin", req)
+	}
+	if metrics, _ := req["metrics"].([]any); len(metrics) != len(Metrics) {
+		t.Errorf("requested metrics %v, want %v", req["metrics"], Metrics)
+	}
+
+	day := func(month time.Month, day int) time.Time { return time.Date(2026, month, day, 0, 0, 0, 0, time.UTC) }
+	want := []Period{
+		{
+			FirstDate: day(time.January, 18), LastDate: day(time.February, 14),
+			// The period without enough interactions has no INP.
+			P75: map[string]float64{"first_contentful_paint": 1850, "largest_contentful_paint": 2650, "cumulative_layout_shift": 0.08},
+		},
+		{
+			FirstDate: day(time.January, 25), LastDate: day(time.February, 21),
+			P75: map[string]float64{"first_contentful_paint": 1790, "largest_contentful_paint": 2540, "cumulative_layout_shift": 0.07, "interaction_to_next_paint": 190},
+		},
+		{
+			FirstDate: day(time.February, 1), LastDate: day(time.February, 28),
+			P75: map[string]float64{"first_contentful_paint": 1720, "largest_contentful_paint": 2390, "cumulative_layout_shift": 0.05, "interaction_to_next_paint": 180},
+		},
+	}
+	if len(periods) != len(want) {
+		t.Fatalf("got %d periods, want %d", len(periods), len(want))
+	}
+	for i, p := range periods {
+		if !p.FirstDate.Equal(want[i].FirstDate) || !p.LastDate.Equal(want[i].LastDate) {
+			t.Errorf("period %d from %s to %s, want %s to %s", i, p.FirstDate, p.LastDate, want[i].FirstDate, want[i].LastDate)
+		}
+		if !maps.Equal(p.P75, want[i].P75) {
+			t.Errorf("period %d has p75s %v, want %v", i, p.P75, want[i].P75)
+		}
+	}
+}
+
+func TestHistoryOrigin(t *testing.T) {
+	c, requests := newFakeAPI(t, http.StatusOK, fixture(t, "history.json"))
+	if _, err := c.History(context.Background(), Query{URL: "https://example.com/", Origin: "https://example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	// The origin takes precedence over the URL, and the API defaults apply.
+	req := (*requests)[0]
+	if req["origin"] != "https://example.com" || len(req) != 2 {
+		t.Errorf("requested %v, want the origin and the metrics only", req)
+	}
+}
+
+func TestHistoryErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		body   []byte
+		want   string
+	}{
+		{name: "invalid key", status: http.StatusBadRequest, body: fixture(t, "invalid_key.json"), want: "CrUX API error 400: API key not valid. Please pass a valid API key."},
+		{name: "no error", status: http.StatusBadGateway, body: []byte(`{}`), want: "CrUX API returned HTTP 502"},
+		{name: "not JSON", status: http.StatusServiceUnavailable, body: []byte(`<html>Service Unavailable</html>`), want: "decoding CrUX response: invalid character '<' looking for beginning of value"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, _ := newFakeAPI(t, tt.status, tt.body)
+			if _, err := c.History(context.Background(), Query{URL: "https://example.com/"}); err == nil || err.Error() != tt.want {
+				t.Errorf("got error %v, want %q", err, tt.want)
+			}
+		})
+	}
+
+	// Pages without enough users are not found rather than failing.
+	c, _ := newFakeAPI(t, http.StatusNotFound, fixture(t, "not_found.json"))
+	if _, err := c.History(context.Background(), Query{URL: "https://example.com/"}); !errors.Is(err, ErrNotFound) {
+		t.Errorf("got error %v, want ErrNotFound", err)
+	}
+}
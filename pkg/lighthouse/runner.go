@@ -0,0 +1,140 @@
+// Package lighthouse runs a local installation of the Lighthouse CLI and
+// converts its reports into psi.Result, so that pages Google's servers can't
+// reach, such as internal or staging sites, are exported like those of a PSI
+// run.
+package lighthouse
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/yahyasahaja/prometheus-exporter-pagespeed-insight/pkg/psi"
+)
+
+// DefaultCommand is the Lighthouse CLI looked up in the PATH.
+const DefaultCommand = "lighthouse"
+
+// DefaultChromeFlags run Chrome without a window.
+const DefaultChromeFlags = "--headless=new"
+
+// Config configures a Runner.
+type Config struct {
+	// Command is the Lighthouse CLI, DefaultCommand when empty.
+	Command string
+	// ChromeFlags are passed to the Chrome Lighthouse launches,
+	// DefaultChromeFlags when empty.
+	ChromeFlags string
+	// Timeout bounds a run. Zero means no timeout.
+	Timeout time.Duration
+	// Concurrency caps the runs of the Runner and the Runners derived from
+	// it, since every run launches a Chrome. Zero means one at a time.
+	Concurrency int
+	// Request are the request options of Run.
+	Request psi.RequestOptions
+}
+
+// Runner runs the Lighthouse CLI. It is safe for concurrent use.
+type Runner struct {
+	command     string
+	chromeFlags string
+	timeout     time.Duration
+	options     psi.RequestOptions
+	// slots holds a token for every run in progress.
+	slots chan struct{}
+}
+
+// New returns a Runner for cfg.
+func New(cfg Config) *Runner {
+	r := &Runner{
+		command:     cfg.Command,
+		chromeFlags: cfg.ChromeFlags,
+		timeout:     cfg.Timeout,
+		options:     cfg.Request,
+		slots:       make(chan struct{}, max(cfg.Concurrency, 1)),
+	}
+	if r.command == "" {
+		r.command = DefaultCommand
+	}
+	if r.chromeFlags == "" {
+		r.chromeFlags = DefaultChromeFlags
+	}
+	return r
+}
+
+// WithRequestOptions returns a Runner that shares r's settings and
+// concurrency limit but runs with o.
+func (r *Runner) WithRequestOptions(o psi.RequestOptions) *Runner {
+	clone := *r
+	clone.options = o
+	return &clone
+}
+
+// args returns the arguments of the command of a run.
+func (r *Runner) args(pageURL, strategy string) []string {
+	categories := []string{"performance"}
+	for _, c := range r.options.Categories {
+		if c != "performance" {
+			categories = append(categories, c)
+		}
+	}
+	args := []string{
+		pageURL,
+		"--output=json",
+		"--output-path=stdout",
+		"--quiet",
+		"--chrome-flags=" + r.chromeFlags,
+		"--only-categories=" + strings.Join(categories, ","),
+	}
+	// Lighthouse emulates a phone by default.
+	if strategy == "desktop" {
+		args = append(args, "--preset=desktop")
+	}
+	if r.options.Locale != "" {
+		args = append(args, "--locale="+r.options.Locale)
+	}
+	return args
+}
+
+// Run runs Lighthouse on pageURL with the strategy's preset, waiting for a
+// free slot first, and returns its report.
+func (r *Runner) Run(ctx context.Context, pageURL, strategy string) (*psi.Result, error) {
+	select {
+	case r.slots <- struct{}{}:
+		defer func() { <-r.slots }()
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	if r.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, r.timeout)
+		defer cancel()
+	}
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, r.command, r.args(pageURL, strategy)...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() != nil {
+			return nil, fmt.Errorf("running %s: %w", r.command, ctx.Err())
+		}
+		if msg := lastLine(stderr.String()); msg != "" {
+			return nil, fmt.Errorf("running %s: %v: %s", r.command, err, msg)
+		}
+		return nil, fmt.Errorf("running %s: %v", r.command, err)
+	}
+	// A page that fails to load still gets a report, with a
+	// *psi.RuntimeError.
+	return psi.ParseLighthouseResult(stdout.Bytes())
+}
+
+// lastLine returns the last non-empty line of s, which is where the CLI
+// reports why it failed.
+func lastLine(s string) string {
+	lines := strings.Split(strings.TrimSpace(s), "\n")
+	return strings.TrimSpace(lines[len(lines)-1])
+}
@@ -0,0 +1,267 @@
+package psi
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Scope is the OAuth 2.0 scope of the access tokens requested for the API.
+const Scope = "https://www.googleapis.com/auth/cloud-platform"
+
+// defaultTokenURI is Google's OAuth 2.0 token endpoint.
+const defaultTokenURI = "https://oauth2.googleapis.com/token"
+
+// tokenRefreshMargin is how long before its expiry a token is replaced, so
+// it doesn't expire during a run.
+const tokenRefreshMargin = 5 * time.Minute
+
+// TokenSource supplies the OAuth 2.0 access tokens of requests authenticated
+// without an API key.
+type TokenSource interface {
+	// Token returns a valid access token.
+	Token(ctx context.Context) (string, error)
+}
+
+// Credentials are Google Application Default Credentials. They implement
+// TokenSource, caching each token until shortly before it expires.
+type Credentials struct {
+	// Source describes where the credentials were found.
+	Source string
+	// QuotaProject is the project billed for requests made with user
+	// credentials, from the credentials file's quota_project_id.
+	QuotaProject string
+
+	client *http.Client
+	fetch  func(ctx context.Context) (*tokenResponse, error)
+
+	mu     sync.Mutex
+	token  string
+	expiry time.Time
+}
+
+// credentialsFile is a service account key or the user credentials written
+// by gcloud auth application-default login.
+type credentialsFile struct {
+	Type string `json:"type"`
+	// Service account keys.
+	ClientEmail  string `json:"client_email"`
+	PrivateKey   string `json:"private_key"`
+	PrivateKeyID string `json:"private_key_id"`
+	TokenURI     string `json:"token_uri"`
+	// User credentials.
+	ClientID       string `json:"client_id"`
+	ClientSecret   string `json:"client_secret"`
+	RefreshToken   string `json:"refresh_token"`
+	QuotaProjectID string `json:"quota_project_id"`
+}
+
+type tokenResponse struct {
+	AccessToken      string `json:"access_token"`
+	ExpiresIn        int    `json:"expires_in"`
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+}
+
+// FindDefaultCredentials looks up the Application Default Credentials like
+// Google's client libraries: the file named by GOOGLE_APPLICATION_CREDENTIALS,
+// then the file written by gcloud auth application-default login, then the
+// service account of the GCE or GKE metadata server, which is how workload
+// identity provides credentials. Tokens are requested with client.
+func FindDefaultCredentials(client *http.Client) (*Credentials, error) {
+	if path := os.Getenv("GOOGLE_APPLICATION_CREDENTIALS"); path != "" {
+		return credentialsFromFile(client, path)
+	}
+	if path := wellKnownCredentialsFile(); path != "" {
+		if _, err := os.Stat(path); err == nil {
+			return credentialsFromFile(client, path)
+		} else if !errors.Is(err, fs.ErrNotExist) {
+			return nil, fmt.Errorf("psi: reading default credentials: %v", err)
+		}
+	}
+	host := os.Getenv("GCE_METADATA_HOST")
+	if host == "" {
+		host = "metadata.google.internal"
+	}
+	c := &Credentials{Source: "metadata server " + host, client: client}
+	c.fetch = func(ctx context.Context) (*tokenResponse, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://"+host+"/computeMetadata/v1/instance/service-accounts/default/token", nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Metadata-Flavor", "Google")
+		return c.do(req)
+	}
+	return c, nil
+}
+
+// wellKnownCredentialsFile returns the path of the user credentials written
+// by gcloud, or "" if the home directory is unknown.
+func wellKnownCredentialsFile() string {
+	const name = "application_default_credentials.json"
+	if dir := os.Getenv("CLOUDSDK_CONFIG"); dir != "" {
+		return filepath.Join(dir, name)
+	}
+	if runtime.GOOS == "windows" {
+		if dir := os.Getenv("APPDATA"); dir != "" {
+			return filepath.Join(dir, "gcloud", name)
+		}
+		return ""
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".config", "gcloud", name)
+}
+
+func credentialsFromFile(client *http.Client, path string) (*Credentials, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("psi: reading credentials: %v", err)
+	}
+	var f credentialsFile
+	if err := json.Unmarshal(raw, &f); err != nil {
+		return nil, fmt.Errorf("psi: parsing credentials %s: %v", path, err)
+	}
+	tokenURI := f.TokenURI
+	if tokenURI == "" {
+		tokenURI = defaultTokenURI
+	}
+
+	c := &Credentials{Source: path, QuotaProject: f.QuotaProjectID, client: client}
+	switch f.Type {
+	case "service_account":
+		key, err := parsePrivateKey(f.PrivateKey)
+		if err != nil {
+			return nil, fmt.Errorf("psi: credentials %s: %v", path, err)
+		}
+		c.Source = fmt.Sprintf("service account %s (%s)", f.ClientEmail, path)
+		c.fetch = func(ctx context.Context) (*tokenResponse, error) {
+			assertion, err := signJWT(key, f.PrivateKeyID, f.ClientEmail, tokenURI, time.Now())
+			if err != nil {
+				return nil, err
+			}
+			return c.post(ctx, tokenURI, url.Values{
+				"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+				"assertion":  {assertion},
+			})
+		}
+	case "authorized_user":
+		c.Source = "user credentials (" + path + ")"
+		c.fetch = func(ctx context.Context) (*tokenResponse, error) {
+			return c.post(ctx, tokenURI, url.Values{
+				"grant_type":    {"refresh_token"},
+				"client_id":     {f.ClientID},
+				"client_secret": {f.ClientSecret},
+				"refresh_token": {f.RefreshToken},
+			})
+		}
+	default:
+		return nil, fmt.Errorf("psi: credentials %s: unsupported type %q", path, f.Type)
+	}
+	return c, nil
+}
+
+// Token implements TokenSource.
+func (c *Credentials) Token(ctx context.Context) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.token != "" && time.Now().Before(c.expiry) {
+		return c.token, nil
+	}
+	resp, err := c.fetch(ctx)
+	if err != nil {
+		return "", fmt.Errorf("fetching an access token from %s: %v", c.Source, err)
+	}
+	c.token = resp.AccessToken
+	c.expiry = time.Now().Add(time.Duration(resp.ExpiresIn)*time.Second - tokenRefreshMargin)
+	return c.token, nil
+}
+
+func (c *Credentials) post(ctx context.Context, tokenURI string, form url.Values) (*tokenResponse, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, tokenURI, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return c.do(req)
+}
+
+// do makes a token request and decodes its response.
+func (c *Credentials) do(req *http.Request) (*tokenResponse, error) {
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var data tokenResponse
+	if err := json.NewDecoder(resp.Body).Decode(&data); err != nil {
+		return nil, fmt.Errorf("unexpected response (HTTP %d): %v", resp.StatusCode, err)
+	}
+	if data.Error != "" {
+		return nil, fmt.Errorf("%s: %s", data.Error, data.ErrorDescription)
+	}
+	if resp.StatusCode != http.StatusOK || data.AccessToken == "" {
+		return nil, fmt.Errorf("no access token in the response (HTTP %d)", resp.StatusCode)
+	}
+	return &data, nil
+}
+
+func parsePrivateKey(key string) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode([]byte(key))
+	if block == nil {
+		return nil, errors.New("no PEM private key found")
+	}
+	if parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes); err == nil {
+		if rsaKey, ok := parsed.(*rsa.PrivateKey); ok {
+			return rsaKey, nil
+		}
+		return nil, errors.New("private key is not an RSA key")
+	}
+	return x509.ParsePKCS1PrivateKey(block.Bytes)
+}
+
+// signJWT returns the assertion a service account exchanges for an access
+// token, valid for an hour from now.
+func signJWT(key *rsa.PrivateKey, keyID, email, audience string, now time.Time) (string, error) {
+	header, err := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT", "kid": keyID})
+	if err != nil {
+		return "", err
+	}
+	claims, err := json.Marshal(map[string]any{
+		"iss":   email,
+		"scope": Scope,
+		"aud":   audience,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+	enc := base64.RawURLEncoding
+	unsigned := enc.EncodeToString(header) + "." + enc.EncodeToString(claims)
+	sum := sha256.Sum256([]byte(unsigned))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, sum[:])
+	if err != nil {
+		return "", err
+	}
+	return unsigned + "." + enc.EncodeToString(sig), nil
+}
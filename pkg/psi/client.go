@@ -0,0 +1,573 @@
+// Package psi is a client for the Google PageSpeed Insights API. It rotates
+// between API keys, retries failed runs with exponential backoff and decodes
+// the Lighthouse and Chrome UX Report data of a run into a Result.
+package psi
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// DefaultEndpoint is the Google PageSpeed Insights API.
+const DefaultEndpoint = "https://www.googleapis.com/pagespeedonline/v5/runPagespeed"
+
+// RetryPolicy controls the deadline and retries of a run.
+type RetryPolicy struct {
+	// Timeout bounds each attempt, including reading the response. Zero
+	// means no timeout.
+	Timeout time.Duration
+	// MaxRetries is the number of attempts made after the first one fails.
+	MaxRetries int
+	// InitialBackoff is the delay before the first retry, doubled for each
+	// further retry up to MaxBackoff, if set.
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	// Jitter randomizes each delay by up to this fraction in either
+	// direction, so that runs failing together don't retry in lockstep.
+	Jitter float64
+}
+
+// DefaultRetryPolicy retries a run 4 times, starting with a 2 second delay.
+var DefaultRetryPolicy = RetryPolicy{
+	Timeout:        time.Minute,
+	MaxRetries:     4,
+	InitialBackoff: 2 * time.Second,
+}
+
+// RequestOptions are optional parameters of the runs of a Client.
+type RequestOptions struct {
+	// Categories are the Lighthouse categories to score, by their ids in
+	// the result such as "performance" or "best-practices". The
+	// performance category is always scored, and is the only one when
+	// Categories is empty.
+	Categories []string
+	// Locale is the locale of the result's text, such as "de". The API
+	// picks one when empty.
+	Locale string
+}
+
+// Categories are the ids of the Lighthouse categories the API can score.
+var Categories = []string{"performance", "accessibility", "best-practices", "seo", "pwa"}
+
+// Config configures a Client.
+type Config struct {
+	// Keys are the API keys to rotate between. At least one is required
+	// unless TokenSource is set.
+	Keys []string
+	// TokenSource, if set, authenticates every request with an OAuth 2.0
+	// access token, e.g. from FindDefaultCredentials.
+	TokenSource TokenSource
+	// QuotaProject, if set, is the project billed for the requests, sent
+	// as X-Goog-User-Project.
+	QuotaProject string
+	// KeyCooldown is how long a key is skipped after hitting its quota.
+	KeyCooldown time.Duration
+	// BaseURL is the API endpoint, DefaultEndpoint when empty.
+	BaseURL string
+	// HTTPClient makes the API requests, http.DefaultClient when nil.
+	HTTPClient *http.Client
+	// Retry is the retry policy of Run.
+	Retry RetryPolicy
+	// Request are the request options of Run.
+	Request RequestOptions
+	// RateLimit caps the API requests of the Client and the Clients derived
+	// from it, in requests per minute, with bursts of up to RateBurst
+	// requests. Zero disables the limit.
+	RateLimit float64
+	RateBurst int
+	// Logger receives a debug entry for every failed attempt. Nothing is
+	// logged when nil.
+	Logger *slog.Logger
+	// OnQuotaError, if set, is called with the index of a key whenever the
+	// API reports that the key has exhausted its quota.
+	OnQuotaError func(keyIndex int)
+	// OnRequest, if set, is called after every API request of a run with
+	// the index of its key and its outcome: OutcomeSuccess,
+	// OutcomeQuotaExceeded or OutcomeError.
+	OnRequest func(keyIndex int, outcome string)
+}
+
+// Outcomes of an API request reported to Config.OnRequest.
+const (
+	OutcomeSuccess       = "success"
+	OutcomeQuotaExceeded = "quota_exceeded"
+	OutcomeError         = "error"
+)
+
+// Client runs PSI analyses. It is safe for concurrent use.
+type Client struct {
+	keys         *keyRotator
+	tokens       TokenSource
+	quotaProject string
+	limiter      *rateLimiter
+	baseURL      string
+	httpClient   *http.Client
+	retry        RetryPolicy
+	options      RequestOptions
+	logger       *slog.Logger
+	onQuotaError func(int)
+	onRequest    func(int, string)
+	onRetry      func(string, string)
+	onError      func(string, string, string)
+	// pinned is the key every run uses, empty to rotate.
+	pinned string
+}
+
+// New returns a Client for cfg.
+func New(cfg Config) (*Client, error) {
+	keys := cfg.Keys
+	if len(keys) == 0 {
+		if cfg.TokenSource == nil {
+			return nil, errors.New("psi: at least one API key or a token source is required")
+		}
+		// Requests authenticated by token alone are made with an empty
+		// key, index 0.
+		keys = []string{""}
+	}
+	c := &Client{
+		keys:         newKeyRotator(keys, cfg.KeyCooldown),
+		tokens:       cfg.TokenSource,
+		quotaProject: cfg.QuotaProject,
+		limiter:      newRateLimiter(cfg.RateLimit, cfg.RateBurst),
+		baseURL:      cfg.BaseURL,
+		httpClient:   cfg.HTTPClient,
+		retry:        cfg.Retry,
+		options:      cfg.Request,
+		logger:       cfg.Logger,
+		onQuotaError: cfg.OnQuotaError,
+		onRequest:    cfg.OnRequest,
+	}
+	if c.baseURL == "" {
+		c.baseURL = DefaultEndpoint
+	}
+	if c.httpClient == nil {
+		c.httpClient = http.DefaultClient
+	}
+	if c.logger == nil {
+		c.logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	}
+	if c.onQuotaError == nil {
+		c.onQuotaError = func(int) {}
+	}
+	if c.onRequest == nil {
+		c.onRequest = func(int, string) {}
+	}
+
+	return c, nil
+}
+
+// WithRetryPolicy returns a Client that shares c's keys and settings but
+// retries with p.
+func (c *Client) WithRetryPolicy(p RetryPolicy) *Client {
+	clone := *c
+	clone.retry = p
+	return &clone
+}
+
+// WithRequestOptions returns a Client that shares c's keys and settings but
+// runs with o.
+func (c *Client) WithRequestOptions(o RequestOptions) *Client {
+	clone := *c
+	clone.options = o
+	return &clone
+}
+
+// WithOnError returns a Client that shares c's keys and settings but calls
+// f after every failed attempt of a run with the reason of the failure, one
+// of the Reason constants. Attempts interrupted by the cancellation of the
+// run aren't reported.
+func (c *Client) WithOnError(f func(pageURL, strategy, reason string)) *Client {
+	clone := *c
+	clone.onError = f
+	return &clone
+}
+
+// WithOnRetry returns a Client that shares c's keys and settings but calls
+// f before every retry of a run.
+func (c *Client) WithOnRetry(f func(pageURL, strategy string)) *Client {
+	clone := *c
+	clone.onRetry = f
+	return &clone
+}
+
+// WithKey returns a Client that shares c's settings but makes every request
+// with key instead of rotating between the configured keys. A key that isn't
+// among them is added outside the rotation, with the next key index, and is
+// quarantined on its own when it hits its quota.
+func (c *Client) WithKey(key string) *Client {
+	clone := *c
+	clone.pinned = key
+	return &clone
+}
+
+// SetKeys replaces the keys rotated by c and the Clients derived from it.
+// Keys that are kept stay quarantined; the indexes of the keys pinned with
+// WithKey move after the new keys.
+func (c *Client) SetKeys(keys []string) error {
+	if len(keys) == 0 {
+		return errors.New("psi: at least one API key is required")
+	}
+	c.keys.replace(keys)
+	return nil
+}
+
+// Run analyzes pageURL with the given strategy ("mobile" or "desktop"). Failed
+// attempts are retried according to the retry policy, except for client errors
+// such as an invalid URL and permanent Lighthouse runtime errors, which end the
+// run right away; a run whose Lighthouse run failed returns a *RuntimeError,
+// possibly wrapped. An attempt that hits a key's quota is retried right away
+// with another key when one is available, and otherwise ends the run with a
+// *QuotaError. A Client pinned to a key by WithKey never rotates; a run whose
+// key is over its quota fails right away.
+func (c *Client) Run(ctx context.Context, pageURL, strategy string) (*Result, error) {
+	logger := c.logger.With("site", pageURL, "strategy", strategy)
+	attempts := c.retry.MaxRetries + 1
+	delay := c.retry.InitialBackoff
+
+	var lastErr error
+	// rotated is set when the previous attempt hit a key's quota and another
+	// key is available, in which case the next attempt is made right away.
+	rotated := false
+	for retries := 0; retries < attempts; retries++ {
+		if retries > 0 && !rotated {
+			select {
+			case <-time.After(c.retry.jittered(delay)):
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+			delay *= 2 // Increase delay for next retry
+			if c.retry.MaxBackoff > 0 {
+				delay = min(delay, c.retry.MaxBackoff)
+			}
+		}
+		if retries > 0 && c.onRetry != nil {
+			c.onRetry(pageURL, strategy)
+		}
+		rotated = false
+
+		if err := c.limiter.wait(ctx); err != nil {
+			return nil, err
+		}
+		var keyIndex int
+		apiKey := c.pinned
+		if apiKey != "" {
+			var until time.Time
+			keyIndex, until = c.keys.pin(apiKey)
+			if time.Now().Before(until) {
+				return nil, &QuotaError{Until: until, Pinned: true, KeyIndex: keyIndex}
+			}
+		} else {
+			keyIndex, apiKey = c.keys.pick()
+		}
+		attemptLogger := logger.With("attempt", retries+1, "key_index", keyIndex)
+		statusCode, resp, err := c.request(ctx, c.runURL(apiKey, pageURL, strategy))
+		if err != nil {
+			attemptLogger.Debug("Error fetching PSI", "err", err)
+			c.onRequest(keyIndex, OutcomeError)
+			if ctx.Err() == nil {
+				c.reportError(pageURL, strategy, requestErrorReason(statusCode, err))
+			}
+			lastErr = err
+			continue
+		}
+		attemptLogger = attemptLogger.With("status_code", statusCode)
+
+		if isQuotaError(statusCode, resp.Error) {
+			c.onRequest(keyIndex, OutcomeQuotaExceeded)
+			c.reportError(pageURL, strategy, ReasonQuota)
+			c.onQuotaError(keyIndex)
+			lastErr = fmt.Errorf("quota exceeded for API key %d", keyIndex)
+			retryAfter := resp.retryAfter
+			if isDailyQuotaError(resp.Error) {
+				retryAfter = time.Until(nextQuotaReset(time.Now()))
+			}
+			rotated = c.keys.quarantine(keyIndex, retryAfter) && c.pinned == ""
+			attemptLogger.Debug("API key quota exceeded", "retry_with_other_key", rotated, "retry_after", retryAfter)
+			if c.pinned != "" {
+				_, until := c.keys.pin(c.pinned)
+				return nil, &QuotaError{Until: until, Pinned: true, KeyIndex: keyIndex}
+			}
+			if !rotated {
+				// Retrying before a key recovers would only burn attempts.
+				return nil, &QuotaError{Until: c.keys.resumeAt()}
+			}
+			continue
+		}
+
+		if statusCode != http.StatusOK {
+			c.onRequest(keyIndex, OutcomeError)
+			reason := statusReason(statusCode)
+			if isKeyError(statusCode, resp.Error) {
+				reason = ReasonAuth
+			}
+			c.reportError(pageURL, strategy, reason)
+			lastErr = resp.Error.err(statusCode)
+			attemptLogger.Debug("PSI API error", "err", lastErr)
+			if isPermanentError(statusCode) {
+				// The same request would fail again, e.g. for an invalid
+				// URL or a rejected key.
+				return nil, lastErr
+			}
+			continue
+		}
+
+		result, err := resp.result()
+		var runtimeErr *RuntimeError
+		if errors.As(err, &runtimeErr) {
+			attemptLogger.Debug("Lighthouse runtime error", "code", runtimeErr.Code, "err", err)
+			c.onRequest(keyIndex, OutcomeError)
+			c.reportError(pageURL, strategy, ReasonRuntimeError)
+			if runtimeErr.Permanent() {
+				return nil, err
+			}
+			lastErr = err
+			continue
+		}
+		if err != nil {
+			attemptLogger.Debug("Invalid PSI response", "err", err)
+			c.onRequest(keyIndex, OutcomeError)
+			c.reportError(pageURL, strategy, ReasonDecode)
+			lastErr = err
+			continue
+		}
+		c.onRequest(keyIndex, OutcomeSuccess)
+		attemptLogger.Debug("Fetched PSI data")
+		return result, nil
+	}
+	return nil, fmt.Errorf("failed to fetch data for %s after %d attempts: %w", pageURL, attempts, lastErr)
+}
+
+// Reasons of the failed attempts of a run, see WithOnError.
+const (
+	// ReasonNetwork is a connection or transport error.
+	ReasonNetwork = "network"
+	// ReasonTimeout is an attempt that exceeded the retry policy's Timeout,
+	// or an HTTP 408 or 504.
+	ReasonTimeout = "timeout"
+	// ReasonInvalidURL is an HTTP 400, which the API returns for URLs it
+	// can't analyze.
+	ReasonInvalidURL = "invalid_url"
+	// ReasonAuth is a rejected key or token: an HTTP 401, a 403 other than
+	// a quota error, or a 400 for an invalid key.
+	ReasonAuth = "auth"
+	// ReasonQuota is a quota error, an HTTP 429 or a 403 with a quota
+	// reason.
+	ReasonQuota = "quota"
+	// ReasonClientError is any other HTTP 4xx.
+	ReasonClientError = "client_error"
+	// ReasonServerError is an HTTP 5xx, e.g. Lighthouse failing to load the
+	// page.
+	ReasonServerError = "server_error"
+	// ReasonDecode is a response that isn't valid JSON or lacks the
+	// Lighthouse result.
+	ReasonDecode = "decode"
+	// ReasonRuntimeError is a response whose Lighthouse run failed, see
+	// RuntimeError.
+	ReasonRuntimeError = "runtime_error"
+)
+
+// reportError calls the onError callback, if any.
+func (c *Client) reportError(pageURL, strategy, reason string) {
+	if c.onError != nil {
+		c.onError(pageURL, strategy, reason)
+	}
+}
+
+// requestErrorReason returns the reason of an attempt that got no HTTP
+// response, statusCode 0, or an unreadable one.
+func requestErrorReason(statusCode int, err error) string {
+	// An error page that isn't JSON, e.g. of a proxy.
+	if statusCode != 0 && statusCode != http.StatusOK {
+		return statusReason(statusCode)
+	}
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || errors.As(err, &netErr) && netErr.Timeout() {
+		return ReasonTimeout
+	}
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &syntaxErr) || errors.As(err, &typeErr) {
+		return ReasonDecode
+	}
+	return ReasonNetwork
+}
+
+// statusReason returns the reason of an attempt answered with statusCode,
+// other than a quota error.
+func statusReason(statusCode int) string {
+	switch {
+	case statusCode == http.StatusBadRequest:
+		return ReasonInvalidURL
+	case statusCode == http.StatusUnauthorized || statusCode == http.StatusForbidden:
+		return ReasonAuth
+	case statusCode == http.StatusRequestTimeout || statusCode == http.StatusGatewayTimeout:
+		return ReasonTimeout
+	case statusCode >= 500:
+		return ReasonServerError
+	}
+	return ReasonClientError
+}
+
+// jittered returns d randomized by the policy's jitter.
+func (p RetryPolicy) jittered(d time.Duration) time.Duration {
+	if p.Jitter <= 0 {
+		return d
+	}
+	return time.Duration(float64(d) * (1 + p.Jitter*(2*rand.Float64()-1)))
+}
+
+// isPermanentError reports whether a request that failed with statusCode
+// would fail the same way if retried: client errors other than timeouts and
+// rate limiting.
+func isPermanentError(statusCode int) bool {
+	return statusCode >= 400 && statusCode < 500 && statusCode != http.StatusRequestTimeout && statusCode != http.StatusTooManyRequests
+}
+
+// QuotaError is returned by Run when every API key has exhausted its quota,
+// or the key the Client is pinned to has.
+type QuotaError struct {
+	// Until is when the first key is expected to accept requests again,
+	// from the API's Retry-After or the key cool-down.
+	Until time.Time
+	// Pinned is set when the error is that of the key the Client is pinned
+	// to, KeyIndex, rather than of every key.
+	Pinned   bool
+	KeyIndex int
+}
+
+func (e *QuotaError) Error() string {
+	if e.Pinned {
+		return fmt.Sprintf("quota exceeded for API key %d until %s", e.KeyIndex, e.Until.Format(time.RFC3339))
+	}
+	return fmt.Sprintf("quota exceeded for every API key until %s", e.Until.Format(time.RFC3339))
+}
+
+// VerifyKey checks that the API accepts key by making a request that is
+// rejected for its missing URL before any analysis is run, so it is cheap and
+// doesn't count against the key's quota. A key over its quota is considered
+// valid. With a TokenSource, an empty key checks the access token alone.
+func (c *Client) VerifyKey(ctx context.Context, key string) error {
+	statusCode, resp, err := c.request(ctx, BuildURL(c.baseURL, key, "", ""))
+	if err != nil {
+		return err
+	}
+	if !isQuotaError(statusCode, resp.Error) && isKeyError(statusCode, resp.Error) {
+		return fmt.Errorf("rejected by the PSI API (HTTP %d)", statusCode)
+	}
+	return nil
+}
+
+// request makes a single API request bounded by the retry policy's timeout
+// and decodes its JSON body.
+func (c *Client) request(ctx context.Context, requestURL string) (int, *response, error) {
+	if c.retry.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.retry.Timeout)
+		defer cancel()
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, requestURL, nil)
+	if err != nil {
+		return 0, nil, err
+	}
+	if c.tokens != nil {
+		token, err := c.tokens.Token(ctx)
+		if err != nil {
+			return 0, nil, err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	if c.quotaProject != "" {
+		req.Header.Set("X-Goog-User-Project", c.quotaProject)
+	}
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		// Transport errors quote the request URL, which holds the key.
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			urlErr.URL = RedactURL(urlErr.URL)
+		}
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return resp.StatusCode, nil, fmt.Errorf("reading PSI response: %v", err)
+	}
+	var data response
+	if err := json.Unmarshal(body, &data); err != nil {
+		return resp.StatusCode, nil, fmt.Errorf("decoding PSI response: %w", err)
+	}
+	data.raw = body
+	data.retryAfter = parseRetryAfter(resp.Header.Get("Retry-After"))
+	return resp.StatusCode, &data, nil
+}
+
+// runURL returns the request URL of a run, with the client's request options.
+func (c *Client) runURL(apiKey, pageURL, strategy string) string {
+	requestURL := BuildURL(c.baseURL, apiKey, pageURL, strategy)
+	params := url.Values{}
+	if len(c.options.Categories) > 0 {
+		params.Add("category", categoryParam("performance"))
+		for _, category := range c.options.Categories {
+			if category != "performance" {
+				params.Add("category", categoryParam(category))
+			}
+		}
+	}
+	if c.options.Locale != "" {
+		params.Set("locale", c.options.Locale)
+	}
+	if len(params) == 0 {
+		return requestURL
+	}
+	return requestURL + "&" + params.Encode()
+}
+
+// categoryParam returns the API's name of a Lighthouse category id, e.g.
+// BEST_PRACTICES for best-practices.
+func categoryParam(id string) string {
+	return strings.ToUpper(strings.ReplaceAll(id, "-", "_"))
+}
+
+// RedactURL returns requestURL with the value of its key parameter replaced,
+// so it can be logged or shown in errors.
+func RedactURL(requestURL string) string {
+	u, err := url.Parse(requestURL)
+	if err != nil {
+		return requestURL
+	}
+	params := u.Query()
+	if !params.Has("key") {
+		return requestURL
+	}
+	params.Set("key", "REDACTED")
+	u.RawQuery = params.Encode()
+	return u.String()
+}
+
+// BuildURL returns the request URL analyzing pageURL with strategy against
+// the API at baseURL. Empty values are omitted except for the URL. The page
+// URL is passed as a percent-encoded query value so that its own query string
+// and fragment are not mistaken for parameters of the API call.
+func BuildURL(baseURL, apiKey, pageURL, strategy string) string {
+	params := url.Values{}
+	params.Set("url", pageURL)
+	if strategy != "" {
+		params.Set("strategy", strategy)
+	}
+	if apiKey != "" {
+		params.Set("key", apiKey)
+	}
+	return baseURL + "?" + params.Encode()
+}
@@ -0,0 +1,325 @@
+package psi
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fixture returns the recorded API response testdata/name.
+func fixture(t *testing.T, name string) []byte {
+	t.Helper()
+	body, err := os.ReadFile("testdata/" + name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return body
+}
+
+// reply is a recorded response of the fake API.
+type reply struct {
+	status int
+	body   []byte
+}
+
+// fakeAPI is a PSI API answering the requests made with each key with its
+// replies in turn, repeating the last one, and recording the keys used.
+type fakeAPI struct {
+	*httptest.Server
+	mu      sync.Mutex
+	replies map[string][]reply
+	keys    []string
+}
+
+func newFakeAPI(t *testing.T, replies map[string][]reply) *fakeAPI {
+	api := &fakeAPI{replies: replies}
+	api.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if got := r.URL.Query().Get("url"); got != testPage {
+			t.Errorf("requested url %q", got)
+		}
+		if got := r.URL.Query().Get("strategy"); got != "mobile" {
+			t.Errorf("requested strategy %q", got)
+		}
+		key := r.URL.Query().Get("key")
+		api.mu.Lock()
+		api.keys = append(api.keys, key)
+		rs := api.replies[key]
+		if len(rs) == 0 {
+			api.mu.Unlock()
+			t.Errorf("request with unexpected key %q", key)
+			http.Error(w, "{}", http.StatusForbidden)
+			return
+		}
+		rep := rs[0]
+		if len(rs) > 1 {
+			api.replies[key] = rs[1:]
+		}
+		api.mu.Unlock()
+		if rep.status == http.StatusTooManyRequests {
+			w.Header().Set("Retry-After", "60")
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(rep.status)
+		w.Write(rep.body)
+	}))
+	t.Cleanup(api.Close)
+	return api
+}
+
+// requested returns the keys of the requests made so far.
+func (api *fakeAPI) requested() []string {
+	api.mu.Lock()
+	defer api.mu.Unlock()
+	return slices.Clone(api.keys)
+}
+
+// outcomes records the calls of the callbacks of a Client.
+type outcomes struct {
+	mu       sync.Mutex
+	requests []string
+	quota    []int
+	errors   []string
+	retries  int
+}
+
+func newTestClient(t *testing.T, api *fakeAPI, keys []string, maxRetries int) (*Client, *outcomes) {
+	t.Helper()
+	o := &outcomes{}
+	c, err := New(Config{
+		Keys:        keys,
+		KeyCooldown: 30 * time.Second,
+		BaseURL:     api.URL,
+		Retry:       RetryPolicy{Timeout: 5 * time.Second, MaxRetries: maxRetries, InitialBackoff: time.Millisecond},
+		OnQuotaError: func(keyIndex int) {
+			o.mu.Lock()
+			defer o.mu.Unlock()
+			o.quota = append(o.quota, keyIndex)
+		},
+		OnRequest: func(keyIndex int, outcome string) {
+			o.mu.Lock()
+			defer o.mu.Unlock()
+			o.requests = append(o.requests, outcome)
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c = c.WithOnError(func(_, _, reason string) {
+		o.mu.Lock()
+		defer o.mu.Unlock()
+		o.errors = append(o.errors, reason)
+	}).WithOnRetry(func(string, string) {
+		o.mu.Lock()
+		defer o.mu.Unlock()
+		o.retries++
+	})
+	return c, o
+}
+
+const testPage = "https://example.com/?q=1#top"
+
+func TestRun(t *testing.T) {
+	api := newFakeAPI(t, map[string][]reply{"key-a": {{http.StatusOK, fixture(t, "runpagespeed.json")}}})
+	c, o := newTestClient(t, api, []string{"key-a"}, 0)
+
+	res, err := c.Run(context.Background(), testPage, "mobile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := res.Categories["performance"]; got != 0.85 {
+		t.Errorf("performance score %v, want 0.85", got)
+	}
+	if got := res.Categories["accessibility"]; got != 0.9 {
+		t.Errorf("accessibility score %v, want 0.9", got)
+	}
+	if lcp := res.Audits["largest-contentful-paint"].NumericValue; lcp == nil || *lcp != 2400 {
+		t.Errorf("LCP audit %v, want 2400", lcp)
+	}
+	if got := res.LoadingExperience["LARGEST_CONTENTFUL_PAINT_MS"]; got != 2600 {
+		t.Errorf("field LCP %v, want 2600", got)
+	}
+	if got, want := res.Distributions["LARGEST_CONTENTFUL_PAINT_MS"], []float64{0.7, 0.2, 0.1}; !slices.Equal(got, want) {
+		t.Errorf("field LCP distribution %v, want %v", got, want)
+	}
+	if res.LighthouseVersion != "12.0.0" || res.FormFactor != "mobile" || res.FinalURL != "https://example.com/" {
+		t.Errorf("run metadata %q, %q, %q", res.LighthouseVersion, res.FormFactor, res.FinalURL)
+	}
+	// The raw response is kept for the report archive.
+	if len(res.Raw) == 0 {
+		t.Error("raw response missing")
+	}
+	if !slices.Equal(o.requests, []string{OutcomeSuccess}) || len(o.errors) != 0 {
+		t.Errorf("outcomes %v, errors %v", o.requests, o.errors)
+	}
+}
+
+func TestRunRotatesKeyOverQuota(t *testing.T) {
+	api := newFakeAPI(t, map[string][]reply{
+		"key-a": {{http.StatusTooManyRequests, fixture(t, "quota_exceeded.json")}},
+		"key-b": {{http.StatusOK, fixture(t, "runpagespeed.json")}},
+	})
+	c, o := newTestClient(t, api, []string{"key-a", "key-b"}, 1)
+
+	// The retry with key-b is made right away, without backoff.
+	start := time.Now()
+	if _, err := c.Run(context.Background(), testPage, "mobile"); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("run took %s", elapsed)
+	}
+	// key-a stays quarantined for the next run.
+	if _, err := c.Run(context.Background(), testPage, "mobile"); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := api.requested(), []string{"key-a", "key-b", "key-b"}; !slices.Equal(got, want) {
+		t.Errorf("requested keys %v, want %v", got, want)
+	}
+	if !slices.Equal(o.quota, []int{0}) {
+		t.Errorf("quota errors of keys %v, want [0]", o.quota)
+	}
+	if want := []string{OutcomeQuotaExceeded, OutcomeSuccess, OutcomeSuccess}; !slices.Equal(o.requests, want) {
+		t.Errorf("outcomes %v, want %v", o.requests, want)
+	}
+	if !slices.Equal(o.errors, []string{ReasonQuota}) {
+		t.Errorf("errors %v, want [%s]", o.errors, ReasonQuota)
+	}
+}
+
+func TestRunEveryKeyOverQuota(t *testing.T) {
+	quota := []reply{{http.StatusTooManyRequests, fixture(t, "quota_exceeded.json")}}
+	api := newFakeAPI(t, map[string][]reply{"key-a": quota, "key-b": quota})
+	c, _ := newTestClient(t, api, []string{"key-a", "key-b"}, 3)
+
+	start := time.Now()
+	_, err := c.Run(context.Background(), testPage, "mobile")
+	var quotaErr *QuotaError
+	if !errors.As(err, &quotaErr) {
+		t.Fatalf("got error %v, want a QuotaError", err)
+	}
+	if quotaErr.Pinned {
+		t.Error("QuotaError of the rotated keys is pinned")
+	}
+	// Retry-After asks for longer than the cool-down.
+	if quotaErr.Until.Before(start.Add(59*time.Second)) || quotaErr.Until.After(time.Now().Add(60*time.Second)) {
+		t.Errorf("quota exceeded until %s, want a minute after %s", quotaErr.Until, start)
+	}
+	// The retries aren't spent once no key is left.
+	if got, want := api.requested(), []string{"key-a", "key-b"}; !slices.Equal(got, want) {
+		t.Errorf("requested keys %v, want %v", got, want)
+	}
+}
+
+func TestRunRetriesServerErrors(t *testing.T) {
+	serverError := reply{http.StatusInternalServerError, fixture(t, "server_error.json")}
+	api := newFakeAPI(t, map[string][]reply{
+		"key-a": {serverError, serverError, {http.StatusOK, fixture(t, "runpagespeed.json")}},
+	})
+	c, o := newTestClient(t, api, []string{"key-a"}, 3)
+
+	if _, err := c.Run(context.Background(), testPage, "mobile"); err != nil {
+		t.Fatal(err)
+	}
+	if got := len(api.requested()); got != 3 {
+		t.Errorf("made %d requests, want 3", got)
+	}
+	if o.retries != 2 {
+		t.Errorf("retried %d times, want 2", o.retries)
+	}
+	if want := []string{ReasonServerError, ReasonServerError}; !slices.Equal(o.errors, want) {
+		t.Errorf("errors %v, want %v", o.errors, want)
+	}
+}
+
+func TestRunGivesUpOnServerErrors(t *testing.T) {
+	api := newFakeAPI(t, map[string][]reply{"key-a": {{http.StatusInternalServerError, fixture(t, "server_error.json")}}})
+	c, _ := newTestClient(t, api, []string{"key-a"}, 2)
+
+	_, err := c.Run(context.Background(), testPage, "mobile")
+	if err == nil {
+		t.Fatal("run succeeded")
+	}
+	if want := "failed to fetch data for https://example.com/?q=1#top after 3 attempts: PSI API error (HTTP 500): Lighthouse returned error: Something went wrong."; err.Error() != want {
+		t.Errorf("got error %q, want %q", err, want)
+	}
+}
+
+func TestRunPinnedKey(t *testing.T) {
+	api := newFakeAPI(t, map[string][]reply{
+		"key-a":    {{http.StatusOK, fixture(t, "runpagespeed.json")}},
+		"key-team": {{http.StatusTooManyRequests, fixture(t, "quota_exceeded.json")}},
+	})
+	c, o := newTestClient(t, api, []string{"key-a"}, 3)
+	pinned := c.WithKey("key-team")
+
+	for i := range 2 {
+		_, err := pinned.Run(context.Background(), testPage, "mobile")
+		var quotaErr *QuotaError
+		if !errors.As(err, &quotaErr) {
+			t.Fatalf("run %d: got error %v, want a QuotaError", i, err)
+		}
+		if !quotaErr.Pinned || quotaErr.KeyIndex != 1 {
+			t.Errorf("run %d: QuotaError pinned %v of key %d, want pinned of key 1", i, quotaErr.Pinned, quotaErr.KeyIndex)
+		}
+		if time.Until(quotaErr.Until) < 50*time.Second {
+			t.Errorf("run %d: quota exceeded until %s, want in a minute", i, quotaErr.Until)
+		}
+	}
+	// The pinned key never rotates to key-a, and isn't requested again
+	// while over its quota.
+	if got, want := api.requested(), []string{"key-team"}; !slices.Equal(got, want) {
+		t.Errorf("requested keys %v, want %v", got, want)
+	}
+	if !slices.Equal(o.quota, []int{1}) {
+		t.Errorf("quota errors of keys %v, want [1]", o.quota)
+	}
+
+	// The rotated keys are unaffected.
+	if _, err := c.Run(context.Background(), testPage, "mobile"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBuildURL(t *testing.T) {
+	tests := []string{
+		"https://example.com/",
+		"https://shop.example.com/search?q=shoes&sort=price",
+		"https://example.com/search?q=caf%C3%A9&tags=a,b",
+		"https://example.com/?next=https://other.example/?a=1&b=2",
+		"https://example.com/#reviews",
+		"https://example.com/app#/route?tab=1&key=x",
+		"https://example.com/café/?q=ü",
+		"https://example.com/caf%C3%A9",
+		"https://bücher.example/",
+	}
+	for _, raw := range tests {
+		t.Run(raw, func(t *testing.T) {
+			got := BuildURL(DefaultEndpoint, "s3cret&x=1", raw, "desktop")
+			if !strings.HasPrefix(got, DefaultEndpoint+"?") {
+				t.Fatalf("got %q, want a request to %s", got, DefaultEndpoint)
+			}
+			u, err := url.Parse(got)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if u.Fragment != "" {
+				t.Errorf("got request %q with fragment %q", got, u.Fragment)
+			}
+			q := u.Query()
+			if len(q) != 3 {
+				t.Errorf("got parameters %q, want url, strategy and key only", q)
+			}
+			if q.Get("url") != raw || q.Get("strategy") != "desktop" || q.Get("key") != "s3cret&x=1" {
+				t.Errorf("got parameters %q", q)
+			}
+		})
+	}
+}
@@ -0,0 +1,239 @@
+package psi
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// keyRotator hands out API keys round-robin, skipping keys that have been
+// quarantined after hitting their quota. Only the first rotated keys take
+// part in the rotation; the keys added by pin are used only by the Clients
+// pinned to them.
+type keyRotator struct {
+	mu          sync.Mutex
+	keys        []string
+	rotated     int
+	next        int
+	quarantined []time.Time
+	cooldown    time.Duration
+}
+
+func newKeyRotator(keys []string, cooldown time.Duration) *keyRotator {
+	return &keyRotator{
+		keys:        slices.Clone(keys),
+		rotated:     len(keys),
+		quarantined: make([]time.Time, len(keys)),
+		cooldown:    cooldown,
+	}
+}
+
+// pin returns the index of key, adding it after the known keys, outside the
+// rotation, if it is new, and when it leaves quarantine, which is in the past
+// for a healthy key.
+func (r *keyRotator) pin(key string) (int, time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if i := slices.Index(r.keys, key); i >= 0 {
+		return i, r.quarantined[i]
+	}
+	r.keys = append(r.keys, key)
+	r.quarantined = append(r.quarantined, time.Time{})
+	return len(r.keys) - 1, time.Time{}
+}
+
+// replace swaps the rotated keys for keys. Pinned keys follow them, and keys
+// that are kept stay quarantined.
+func (r *keyRotator) replace(keys []string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	until := map[string]time.Time{}
+	for i, k := range r.keys {
+		until[k] = r.quarantined[i]
+	}
+	all := slices.Clone(keys)
+	for _, k := range r.keys[r.rotated:] {
+		if !slices.Contains(all, k) {
+			all = append(all, k)
+		}
+	}
+	r.keys = all
+	r.rotated = len(keys)
+	r.next = 0
+	r.quarantined = make([]time.Time, len(all))
+	for i, k := range all {
+		r.quarantined[i] = until[k]
+	}
+}
+
+// pick returns the next healthy key and its index. When every key is
+// quarantined the one whose cool-down ends first is returned, so a fetch is
+// never refused outright.
+func (r *keyRotator) pick() (int, string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	soonest := -1
+	for i := 0; i < r.rotated; i++ {
+		idx := (r.next + i) % r.rotated
+		if !now.Before(r.quarantined[idx]) {
+			r.next = idx + 1
+			return idx, r.keys[idx]
+		}
+		if soonest < 0 || r.quarantined[idx].Before(r.quarantined[soonest]) {
+			soonest = idx
+		}
+	}
+	r.next = soonest + 1
+	return soonest, r.keys[soonest]
+}
+
+// quarantine takes the key at index out of rotation for the cool-down period,
+// or for retryAfter when the API asked for longer, and reports whether
+// another healthy rotated key is still available.
+func (r *keyRotator) quarantine(index int, retryAfter time.Duration) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	r.quarantined[index] = now.Add(max(r.cooldown, retryAfter))
+	for i, until := range r.quarantined[:r.rotated] {
+		if i != index && !now.Before(until) {
+			return true
+		}
+	}
+	return false
+}
+
+// resumeAt returns when the first quarantined key returns to rotation, or
+// now if a key is healthy.
+func (r *keyRotator) resumeAt() time.Time {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	soonest := r.quarantined[0]
+	for _, until := range r.quarantined[1:r.rotated] {
+		if until.Before(soonest) {
+			soonest = until
+		}
+	}
+	if soonest.Before(now) {
+		return now
+	}
+	return soonest
+}
+
+// QuotaResetZone is the time zone at whose midnight the daily quota of the
+// PSI API resets.
+const QuotaResetZone = "America/Los_Angeles"
+
+// nextQuotaReset returns the first midnight in QuotaResetZone after now. The
+// zone's standard offset is used when the time zone database is missing.
+func nextQuotaReset(now time.Time) time.Time {
+	loc, err := time.LoadLocation(QuotaResetZone)
+	if err != nil {
+		loc = time.FixedZone("PST", -8*60*60)
+	}
+	local := now.In(loc)
+	return time.Date(local.Year(), local.Month(), local.Day()+1, 0, 0, 0, 0, loc)
+}
+
+// parseRetryAfter returns the delay of a Retry-After header, given either as
+// seconds or as an HTTP date, or zero when it is absent or invalid.
+func parseRetryAfter(h string) time.Duration {
+	if h == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(h); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if at, err := http.ParseTime(h); err == nil {
+		return max(time.Until(at), 0)
+	}
+	return 0
+}
+
+// apiError is the error object of a Google API error response.
+type apiError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+	Status  string `json:"status"`
+	Errors  []struct {
+		Reason string `json:"reason"`
+	} `json:"errors"`
+	Details []struct {
+		Reason string `json:"reason"`
+	} `json:"details"`
+}
+
+// err returns the error of a request answered with statusCode and e, which
+// may be nil when the body had no error object.
+func (e *apiError) err(statusCode int) error {
+	if e == nil || e.Message == "" {
+		return fmt.Errorf("PSI API error (HTTP %d)", statusCode)
+	}
+	return fmt.Errorf("PSI API error (HTTP %d): %s", statusCode, e.Message)
+}
+
+// reasons returns the machine-readable reasons of the error, from both the
+// legacy errors list and the ErrorInfo details.
+func (e *apiError) reasons() []string {
+	if e == nil {
+		return nil
+	}
+	var reasons []string
+	if e.Status != "" {
+		reasons = append(reasons, e.Status)
+	}
+	for _, entry := range e.Errors {
+		if entry.Reason != "" {
+			reasons = append(reasons, entry.Reason)
+		}
+	}
+	for _, entry := range e.Details {
+		if entry.Reason != "" {
+			reasons = append(reasons, entry.Reason)
+		}
+	}
+	return reasons
+}
+
+// isQuotaError reports whether a PSI API response signals that the API key
+// has exhausted its quota.
+func isQuotaError(statusCode int, apiErr *apiError) bool {
+	if statusCode == http.StatusTooManyRequests {
+		return true
+	}
+	for _, reason := range apiErr.reasons() {
+		switch reason {
+		case "RESOURCE_EXHAUSTED", "RATE_LIMIT_EXCEEDED", "rateLimitExceeded", "userRateLimitExceeded", "dailyLimitExceeded", "quotaExceeded":
+			return true
+		}
+	}
+	return false
+}
+
+// isDailyQuotaError reports whether a quota error is about the key's daily
+// quota, which only resets at midnight Pacific Time, rather than a
+// per-minute one.
+func isDailyQuotaError(apiErr *apiError) bool {
+	if slices.Contains(apiErr.reasons(), "dailyLimitExceeded") {
+		return true
+	}
+	return apiErr != nil && strings.Contains(strings.ToLower(apiErr.Message), "per day")
+}
+
+// isKeyError reports whether a PSI API response rejects the API key itself
+// as invalid, disabled or not permitted to call the API.
+func isKeyError(statusCode int, apiErr *apiError) bool {
+	for _, reason := range apiErr.reasons() {
+		switch reason {
+		case "API_KEY_INVALID", "API_KEY_SERVICE_BLOCKED", "SERVICE_DISABLED", "keyInvalid", "accessNotConfigured":
+			return true
+		}
+	}
+	return statusCode == http.StatusForbidden || statusCode == http.StatusUnauthorized
+}
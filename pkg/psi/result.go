@@ -0,0 +1,261 @@
+package psi
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+)
+
+// Result is the outcome of a successful PSI run.
+type Result struct {
+	// Categories maps each Lighthouse category that was scored, such as
+	// "performance", to its score between 0 and 1.
+	Categories map[string]float64
+	// CategoryAudits maps each category of the run to the IDs of the audits
+	// it is scored from.
+	CategoryAudits    map[string][]string
+	LighthouseVersion string
+	// FormFactor is the device Lighthouse emulated, "mobile" or "desktop".
+	FormFactor string
+	// FetchTime is the time Lighthouse fetched the page, as reported by the
+	// API (RFC 3339).
+	FetchTime string
+	// AnalysisTime is the time PSI ran the analysis (RFC 3339), which is
+	// older than the request when PSI answered from its cache. Lighthouse
+	// reports have none.
+	AnalysisTime string
+	RequestedURL string
+	// FinalURL is the URL Lighthouse analyzed after following redirects.
+	FinalURL string
+	// Audits are the Lighthouse audits of the run by audit ID.
+	Audits map[string]Audit
+	// LoadingExperience and OriginLoadingExperience map each Chrome UX
+	// Report metric, such as "LARGEST_CONTENTFUL_PAINT_MS", to the 75th
+	// percentile of real users of the page and of its whole origin. Metrics
+	// without field data are absent.
+	LoadingExperience       map[string]float64
+	OriginLoadingExperience map[string]float64
+	// Distributions and OriginDistributions map each Chrome UX Report metric
+	// to the proportions of real users of the page and of its origin in the
+	// metric's good, needs improvement and poor ranges, in this order.
+	Distributions       map[string][]float64
+	OriginDistributions map[string][]float64
+	// OverallCategory and OriginOverallCategory are the verdicts of the field
+	// data of the page and of its origin: "FAST", "AVERAGE" or "SLOW", empty
+	// without field data.
+	OverallCategory       string
+	OriginOverallCategory string
+	// OriginFallback reports that the page had too little traffic for field
+	// data, and LoadingExperience holds the data of its origin instead.
+	OriginFallback bool
+	// Raw is the complete JSON response of the API, e.g. for archiving the
+	// Lighthouse report.
+	Raw json.RawMessage
+}
+
+// Audit is a single Lighthouse audit.
+type Audit struct {
+	// Score is nil for informative audits.
+	Score        *float64 `json:"score"`
+	NumericValue *float64 `json:"numericValue"`
+	Details      struct {
+		// Type is the kind of details, e.g. "table" or "opportunity".
+		Type  string            `json:"type"`
+		Items []json.RawMessage `json:"items"`
+		// OverallSavingsMs and OverallSavingsBytes are the estimated
+		// savings of an opportunity.
+		OverallSavingsMs    *float64 `json:"overallSavingsMs"`
+		OverallSavingsBytes *float64 `json:"overallSavingsBytes"`
+		// Data is the image of a screenshot, as a data URL, and Timing when
+		// it was taken in milliseconds.
+		Data   string  `json:"data"`
+		Timing float64 `json:"timing"`
+	} `json:"details"`
+}
+
+// Items decodes the rows of the details table of an audit into T, usually a
+// struct with the columns of interest. Rows that don't decode into T, such as
+// rows with a column of an unexpected type, are skipped rather than failing
+// the whole table.
+func Items[T any](a Audit) []T {
+	var items []T
+	for _, raw := range a.Details.Items {
+		var item T
+		if err := json.Unmarshal(raw, &item); err == nil {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// response is the subset of a runPagespeed response the client reads.
+type response struct {
+	LighthouseResult *struct {
+		LighthouseVersion string `json:"lighthouseVersion"`
+		RequestedURL      string `json:"requestedUrl"`
+		FinalURL          string `json:"finalUrl"`
+		FetchTime         string `json:"fetchTime"`
+		ConfigSettings    struct {
+			FormFactor string `json:"formFactor"`
+		} `json:"configSettings"`
+		Categories map[string]struct {
+			Score     *float64 `json:"score"`
+			AuditRefs []struct {
+				ID string `json:"id"`
+			} `json:"auditRefs"`
+		} `json:"categories"`
+		Audits       map[string]Audit `json:"audits"`
+		RuntimeError *struct {
+			Code    string `json:"code"`
+			Message string `json:"message"`
+		} `json:"runtimeError"`
+	} `json:"lighthouseResult"`
+	AnalysisUTCTimestamp    string            `json:"analysisUTCTimestamp"`
+	LoadingExperience       loadingExperience `json:"loadingExperience"`
+	OriginLoadingExperience loadingExperience `json:"originLoadingExperience"`
+	Error                   *apiError         `json:"error"`
+
+	// retryAfter is the delay of the response's Retry-After header.
+	retryAfter time.Duration
+	// raw is the body of the response.
+	raw []byte
+}
+
+type loadingExperience struct {
+	OriginFallback  bool   `json:"origin_fallback"`
+	OverallCategory string `json:"overall_category"`
+	Metrics         map[string]struct {
+		Percentile    *float64 `json:"percentile"`
+		Distributions []struct {
+			Proportion float64 `json:"proportion"`
+		} `json:"distributions"`
+	} `json:"metrics"`
+}
+
+func (l loadingExperience) percentiles() map[string]float64 {
+	out := map[string]float64{}
+	for name, m := range l.Metrics {
+		if m.Percentile != nil {
+			out[name] = *m.Percentile
+		}
+	}
+	return out
+}
+
+// distributions returns the proportions of the ranges of every metric that
+// has all three of them.
+func (l loadingExperience) distributions() map[string][]float64 {
+	out := map[string][]float64{}
+	for name, m := range l.Metrics {
+		if len(m.Distributions) != 3 {
+			continue
+		}
+		proportions := make([]float64, len(m.Distributions))
+		for i, d := range m.Distributions {
+			proportions[i] = d.Proportion
+		}
+		out[name] = proportions
+	}
+	return out
+}
+
+// result checks that r holds a Lighthouse result with a performance category
+// and converts it to a Result.
+func (r *response) result() (*Result, error) {
+	lh := r.LighthouseResult
+	if lh == nil {
+		return nil, errors.New("invalid response structure: missing 'lighthouseResult'")
+	}
+	// A run that failed still has a result, with the error and no scores.
+	if e := lh.RuntimeError; e != nil && e.Code != "" && e.Code != "NO_ERROR" {
+		return nil, &RuntimeError{Code: e.Code, Message: e.Message}
+	}
+	if lh.Categories == nil {
+		return nil, errors.New("invalid response structure: missing 'categories'")
+	}
+	if _, ok := lh.Categories["performance"]; !ok {
+		return nil, errors.New("invalid response structure: missing 'performance' category")
+	}
+
+	res := &Result{
+		Categories:              map[string]float64{},
+		CategoryAudits:          map[string][]string{},
+		LighthouseVersion:       lh.LighthouseVersion,
+		FormFactor:              lh.ConfigSettings.FormFactor,
+		FetchTime:               lh.FetchTime,
+		AnalysisTime:            r.AnalysisUTCTimestamp,
+		RequestedURL:            lh.RequestedURL,
+		FinalURL:                lh.FinalURL,
+		Audits:                  lh.Audits,
+		LoadingExperience:       r.LoadingExperience.percentiles(),
+		OriginLoadingExperience: r.OriginLoadingExperience.percentiles(),
+		Distributions:           r.LoadingExperience.distributions(),
+		OriginDistributions:     r.OriginLoadingExperience.distributions(),
+		OverallCategory:         r.LoadingExperience.OverallCategory,
+		OriginOverallCategory:   r.OriginLoadingExperience.OverallCategory,
+		OriginFallback:          r.LoadingExperience.OriginFallback,
+		Raw:                     r.raw,
+	}
+	for name, c := range lh.Categories {
+		if c.Score != nil {
+			res.Categories[name] = *c.Score
+		}
+		for _, ref := range c.AuditRefs {
+			res.CategoryAudits[name] = append(res.CategoryAudits[name], ref.ID)
+		}
+	}
+	if res.Audits == nil {
+		res.Audits = map[string]Audit{}
+	}
+	return res, nil
+}
+
+// RuntimeError is returned for a run in which Lighthouse failed to analyze
+// the page, e.g. because it didn't load or painted nothing.
+type RuntimeError struct {
+	// Code is the Lighthouse error code, such as "NO_FCP" or
+	// "ERRORED_DOCUMENT_REQUEST".
+	Code    string
+	Message string
+}
+
+func (e *RuntimeError) Error() string {
+	return fmt.Sprintf("Lighthouse runtime error %s: %s", e.Code, e.Message)
+}
+
+// permanentRuntimeErrors are the codes of the runtime errors that are about
+// the page rather than the run, so another run fails the same way: a name
+// that doesn't resolve, an HTTP error or a bad certificate, a document that
+// isn't HTML or a page that paints nothing.
+var permanentRuntimeErrors = []string{
+	"INVALID_URL",
+	"DNS_FAILURE",
+	"ERRORED_DOCUMENT_REQUEST",
+	"INSECURE_DOCUMENT_REQUEST",
+	"NOT_HTML",
+	"NO_FCP",
+}
+
+// Permanent reports whether retrying the run is pointless.
+func (e *RuntimeError) Permanent() bool {
+	return slices.Contains(permanentRuntimeErrors, e.Code)
+}
+
+// ParseLighthouseResult converts a Lighthouse report, as written by the
+// Lighthouse CLI with --output=json, to a Result. The report has no field
+// data, and Raw wraps it like a PSI response so that it is archived in the
+// same format.
+func ParseLighthouseResult(lhr []byte) (*Result, error) {
+	raw := make([]byte, 0, len(lhr)+len(`{"lighthouseResult":}`))
+	raw = append(raw, `{"lighthouseResult":`...)
+	raw = append(raw, lhr...)
+	raw = append(raw, '}')
+	var data response
+	if err := json.Unmarshal(raw, &data); err != nil {
+		return nil, fmt.Errorf("decoding Lighthouse report: %v", err)
+	}
+	data.raw = raw
+	return data.result()
+}
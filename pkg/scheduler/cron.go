@@ -0,0 +1,187 @@
+package scheduler
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cronSchedule runs at the times matching a standard five-field cron
+// expression: minute, hour, day of month, month and day of week.
+type cronSchedule struct {
+	expr                          string
+	minute, hour, dom, month, dow uint64
+	// domAny and dowAny record a "*" day field. When both day fields are
+	// restricted, a day matching either of them matches, as in cron.
+	domAny, dowAny bool
+	loc            *time.Location
+}
+
+// cronField describes the range and names of a cron field.
+type cronField struct {
+	name     string
+	min, max int
+	names    []string
+}
+
+var cronFields = [5]cronField{
+	{name: "minute", min: 0, max: 59},
+	{name: "hour", min: 0, max: 23},
+	{name: "day of month", min: 1, max: 31},
+	{name: "month", min: 1, max: 12, names: []string{"jan", "feb", "mar", "apr", "may", "jun", "jul", "aug", "sep", "oct", "nov", "dec"}},
+	// 7 is accepted for Sunday like in most cron implementations.
+	{name: "day of week", min: 0, max: 7, names: []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}},
+}
+
+var cronMacros = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+// NewCron returns a schedule firing at the times matching the cron
+// expression expr, e.g. "*/15 * * * *" or "0 6 * * mon-fri", evaluated in
+// loc. The macros @hourly, @daily, @weekly, @monthly and @yearly are
+// accepted, and a CRON_TZ=<zone> prefix overrides loc.
+func NewCron(expr string, loc *time.Location) (Schedule, error) {
+	s := &cronSchedule{expr: strings.TrimSpace(expr), loc: loc}
+	spec := s.expr
+	if zone, rest, ok := strings.Cut(spec, " "); ok && strings.HasPrefix(zone, "CRON_TZ=") {
+		l, err := time.LoadLocation(strings.TrimPrefix(zone, "CRON_TZ="))
+		if err != nil {
+			return nil, fmt.Errorf("cron %q: %v", expr, err)
+		}
+		s.loc, spec = l, strings.TrimSpace(rest)
+	}
+	if macro, ok := cronMacros[spec]; ok {
+		spec = macro
+	}
+	fields := strings.Fields(spec)
+	if len(fields) != len(cronFields) {
+		return nil, fmt.Errorf("cron %q: expected 5 fields (minute hour day-of-month month day-of-week), got %d", expr, len(fields))
+	}
+	sets := make([]uint64, len(fields))
+	for i, f := range fields {
+		set, err := cronFields[i].parse(f)
+		if err != nil {
+			return nil, fmt.Errorf("cron %q: %v", expr, err)
+		}
+		sets[i] = set
+	}
+	s.minute, s.hour, s.dom, s.month, s.dow = sets[0], sets[1], sets[2], sets[3], sets[4]
+	if s.dow&(1<<7) != 0 {
+		s.dow |= 1
+	}
+	s.domAny, s.dowAny = fields[2] == "*", fields[4] == "*"
+	if s.Next(time.Now()).IsZero() {
+		return nil, fmt.Errorf("cron %q never fires", expr)
+	}
+	return s, nil
+}
+
+// parse returns the bit set of the values matched by a comma-separated list
+// of values, ranges and steps.
+func (f cronField) parse(field string) (uint64, error) {
+	var set uint64
+	for _, part := range strings.Split(field, ",") {
+		rng, stepStr, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			var err error
+			if step, err = strconv.Atoi(stepStr); err != nil || step < 1 {
+				return 0, fmt.Errorf("invalid step %q in %s field", stepStr, f.name)
+			}
+		}
+		lo, hi := f.min, f.max
+		if rng != "*" {
+			loStr, hiStr, isRange := strings.Cut(rng, "-")
+			var err error
+			if lo, err = f.value(loStr); err != nil {
+				return 0, err
+			}
+			hi = lo
+			if isRange {
+				if hi, err = f.value(hiStr); err != nil {
+					return 0, err
+				}
+			} else if hasStep {
+				// "a/n" means from a to the end of the range.
+				hi = f.max
+			}
+			if hi < lo {
+				return 0, fmt.Errorf("invalid range %q in %s field", rng, f.name)
+			}
+		}
+		for v := lo; v <= hi; v += step {
+			set |= 1 << v
+		}
+	}
+	return set, nil
+}
+
+// value parses a number or name of the field.
+func (f cronField) value(s string) (int, error) {
+	for i, name := range f.names {
+		if strings.EqualFold(s, name) {
+			return f.min + i, nil
+		}
+	}
+	v, err := strconv.Atoi(s)
+	if err != nil || v < f.min || v > f.max {
+		return 0, fmt.Errorf("invalid value %q in %s field, must be between %d and %d", s, f.name, f.min, f.max)
+	}
+	return v, nil
+}
+
+// cronHorizon bounds the search for the next match, so expressions like
+// "0 0 31 2 *" that never fire end the search.
+const cronHorizon = 5 * 366 * 24 * time.Hour
+
+func (s *cronSchedule) Next(t time.Time) time.Time {
+	// The next minute is taken from the instant rather than the wall time,
+	// which repeats an hour when daylight saving time ends.
+	next := t.In(s.loc).Truncate(time.Minute).Add(time.Minute)
+	limit := t.Add(cronHorizon)
+	for next.Before(limit) {
+		prev := next
+		y, m, d := next.Date()
+		switch {
+		case s.month&(1<<uint(m)) == 0:
+			next = time.Date(y, m+1, 1, 0, 0, 0, 0, s.loc)
+		case !s.dayMatches(next):
+			next = time.Date(y, m, d+1, 0, 0, 0, 0, s.loc)
+		case s.hour&(1<<uint(next.Hour())) == 0:
+			next = time.Date(y, m, d, next.Hour()+1, 0, 0, 0, s.loc)
+		case s.minute&(1<<uint(next.Minute())) == 0:
+			next = next.Add(time.Minute)
+		default:
+			return next
+		}
+		// Daylight saving transitions can map a wall time backwards.
+		if !next.After(prev) {
+			next = prev.Add(time.Minute)
+		}
+	}
+	return time.Time{}
+}
+
+func (s *cronSchedule) dayMatches(t time.Time) bool {
+	dom := s.dom&(1<<uint(t.Day())) != 0
+	dow := s.dow&(1<<uint(t.Weekday())) != 0
+	if !s.domAny && !s.dowAny {
+		return dom || dow
+	}
+	return dom && dow
+}
+
+func (s *cronSchedule) String() string {
+	if s.loc != time.Local && !strings.HasPrefix(s.expr, "CRON_TZ=") {
+		return fmt.Sprintf("cron %q (%s)", s.expr, s.loc)
+	}
+	return fmt.Sprintf("cron %q", s.expr)
+}
@@ -0,0 +1,149 @@
+package scheduler
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// fires returns the first n times s fires after t.
+func fires(s Schedule, t time.Time, n int) []time.Time {
+	var times []time.Time
+	for range n {
+		t = s.Next(t)
+		times = append(times, t)
+	}
+	return times
+}
+
+func TestCronNext(t *testing.T) {
+	// 2026-03-06 is a Friday.
+	friday := time.Date(2026, 3, 6, 12, 7, 30, 0, time.UTC)
+	at := func(day, hour, minute int) time.Time {
+		return time.Date(2026, 3, day, hour, minute, 0, 0, time.UTC)
+	}
+	tests := []struct {
+		expr string
+		t    time.Time
+		want []time.Time
+	}{
+		{"* * * * *", friday, []time.Time{at(6, 12, 8), at(6, 12, 9), at(6, 12, 10)}},
+		{"*/15 * * * *", friday, []time.Time{at(6, 12, 15), at(6, 12, 30), at(6, 12, 45)}},
+		{"*/15 * * * *", at(6, 12, 15), []time.Time{at(6, 12, 30), at(6, 12, 45), at(6, 13, 0)}},
+		{"5,35 * * * *", friday, []time.Time{at(6, 12, 35), at(6, 13, 5), at(6, 13, 35)}},
+		{"10-12 13 * * *", friday, []time.Time{at(6, 13, 10), at(6, 13, 11), at(6, 13, 12)}},
+		{"0 9-17/4 * * *", friday, []time.Time{at(6, 13, 0), at(6, 17, 0), at(7, 9, 0)}},
+		{"20/20 * * * *", friday, []time.Time{at(6, 12, 20), at(6, 12, 40), at(6, 13, 20)}},
+		{"0 6 * * mon-fri", friday, []time.Time{at(9, 6, 0), at(10, 6, 0), at(11, 6, 0)}},
+		{"0 6 * * SAT,sun", friday, []time.Time{at(7, 6, 0), at(8, 6, 0), at(14, 6, 0)}},
+		{"0 0 * * 7", friday, []time.Time{at(8, 0, 0), at(15, 0, 0), at(22, 0, 0)}},
+		{"0 0 1,15 * *", friday, []time.Time{at(15, 0, 0), time.Date(2026, 4, 1, 0, 0, 0, 0, time.UTC), time.Date(2026, 4, 15, 0, 0, 0, 0, time.UTC)}},
+		// Restricting both day fields fires on the days matching either.
+		{"0 0 13 * fri", friday, []time.Time{at(13, 0, 0), at(20, 0, 0), at(27, 0, 0)}},
+		{"0 0 10 * fri", friday, []time.Time{at(10, 0, 0), at(13, 0, 0), at(20, 0, 0)}},
+		{"0 0 * feb,apr *", friday, []time.Time{time.Date(2026, 4, 1, 0, 0, 0, 0, time.UTC), time.Date(2026, 4, 2, 0, 0, 0, 0, time.UTC), time.Date(2026, 4, 3, 0, 0, 0, 0, time.UTC)}},
+		{"0 0 31 * *", friday, []time.Time{at(31, 0, 0), time.Date(2026, 5, 31, 0, 0, 0, 0, time.UTC), time.Date(2026, 7, 31, 0, 0, 0, 0, time.UTC)}},
+		{"0 0 29 2 *", friday, []time.Time{time.Date(2028, 2, 29, 0, 0, 0, 0, time.UTC), time.Date(2032, 2, 29, 0, 0, 0, 0, time.UTC), time.Date(2036, 2, 29, 0, 0, 0, 0, time.UTC)}},
+		{"@hourly", friday, []time.Time{at(6, 13, 0), at(6, 14, 0), at(6, 15, 0)}},
+		{"@daily", friday, []time.Time{at(7, 0, 0), at(8, 0, 0), at(9, 0, 0)}},
+		{"@weekly", friday, []time.Time{at(8, 0, 0), at(15, 0, 0), at(22, 0, 0)}},
+		{"@monthly", friday, []time.Time{time.Date(2026, 4, 1, 0, 0, 0, 0, time.UTC), time.Date(2026, 5, 1, 0, 0, 0, 0, time.UTC), time.Date(2026, 6, 1, 0, 0, 0, 0, time.UTC)}},
+		{" @yearly ", friday, []time.Time{time.Date(2027, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(2028, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(2029, 1, 1, 0, 0, 0, 0, time.UTC)}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			s, err := NewCron(tt.expr, time.UTC)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := fires(s, tt.t, len(tt.want))
+			for i := range tt.want {
+				if !got[i].Equal(tt.want[i]) {
+					t.Errorf("fires at %v, want %v", got, tt.want)
+					break
+				}
+			}
+		})
+	}
+}
+
+func TestNewCronInvalid(t *testing.T) {
+	tests := []struct {
+		expr string
+		// err is a part of the expected error.
+		err string
+	}{
+		{"", "expected 5 fields"},
+		{"* * * *", "expected 5 fields (minute hour day-of-month month day-of-week), got 4"},
+		{"* * * * * *", "got 6"},
+		{"@reboot", "got 1"},
+		{"60 * * * *", `invalid value "60" in minute field, must be between 0 and 59`},
+		{"* 24 * * *", `invalid value "24" in hour field`},
+		{"* * 0 * *", `invalid value "0" in day of month field`},
+		{"* * * 13 *", `invalid value "13" in month field`},
+		{"* * * * 8", `invalid value "8" in day of week field`},
+		{"* * * * fri-", `invalid value "" in day of week field`},
+		{"* * * smarch *", `invalid value "smarch" in month field`},
+		{"*/0 * * * *", `invalid step "0" in minute field`},
+		{"*/x * * * *", `invalid step "x" in minute field`},
+		{"30-10 * * * *", `invalid range "30-10" in minute field`},
+		{"1,,2 * * * *", `invalid value "" in minute field`},
+		{"0 0 31 2 *", "never fires"},
+		{"0 0 30 feb *", "never fires"},
+		{"CRON_TZ=Nowhere/City 0 * * * *", `cron "CRON_TZ=Nowhere/City 0 * * * *": unknown time zone Nowhere/City`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			s, err := NewCron(tt.expr, time.UTC)
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("got %v, error %v, want error %q", s, err, tt.err)
+			}
+		})
+	}
+}
+
+func TestCronAcrossDST(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Skipf("no time zone data: %v", err)
+	}
+	utc := func(month time.Month, day, hour, minute int) time.Time {
+		return time.Date(2026, month, day, hour, minute, 0, 0, time.UTC)
+	}
+	// Berlin skips from 02:00 to 03:00 on 2026-03-29, and goes back from
+	// 03:00 to 02:00 on 2026-10-25, both at 01:00 UTC.
+	tests := []struct {
+		name, expr string
+		t          time.Time
+		want       []time.Time
+	}{
+		{"hourly over the gap", "0 * * * *", utc(3, 28, 23, 30), []time.Time{utc(3, 29, 0, 0), utc(3, 29, 1, 0), utc(3, 29, 2, 0)}},
+		// A time in the skipped hour doesn't exist that day.
+		{"daily in the gap", "30 2 * * *", utc(3, 28, 12, 0), []time.Time{utc(3, 30, 0, 30), utc(3, 31, 0, 30)}},
+		{"daily after the gap", "0 3 * * *", utc(3, 28, 12, 0), []time.Time{utc(3, 29, 1, 0), utc(3, 30, 1, 0)}},
+		// The repeated hour fires twice, as it lasts two hours.
+		{"half-hourly over the overlap", "0,30 * * * *", utc(10, 24, 23, 45), []time.Time{utc(10, 25, 0, 0), utc(10, 25, 0, 30), utc(10, 25, 1, 0), utc(10, 25, 1, 30), utc(10, 25, 2, 0)}},
+		// A daily time of the repeated hour fires once.
+		{"daily in the overlap", "30 2 * * *", utc(10, 24, 12, 0), []time.Time{utc(10, 25, 1, 30), utc(10, 26, 1, 30)}},
+		{"CRON_TZ", "CRON_TZ=Europe/Berlin 0 6 * * *", utc(3, 28, 12, 0), []time.Time{utc(3, 29, 4, 0), utc(3, 30, 4, 0)}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			loc := berlin
+			if strings.HasPrefix(tt.expr, "CRON_TZ=") {
+				loc = time.UTC
+			}
+			s, err := NewCron(tt.expr, loc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := fires(s, tt.t, len(tt.want))
+			for i := range tt.want {
+				if !got[i].Equal(tt.want[i]) {
+					t.Errorf("fires at %v, want %v", got, tt.want)
+					break
+				}
+			}
+		})
+	}
+}
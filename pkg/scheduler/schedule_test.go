@@ -0,0 +1,85 @@
+package scheduler
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMinutesNext(t *testing.T) {
+	s := NewMinutes([]int{30, 0})
+	tests := []struct {
+		t, want time.Time
+	}{
+		{time.Date(2026, 3, 2, 12, 7, 30, 0, time.UTC), time.Date(2026, 3, 2, 12, 30, 0, 0, time.UTC)},
+		{time.Date(2026, 3, 2, 12, 30, 0, 0, time.UTC), time.Date(2026, 3, 2, 13, 0, 0, 0, time.UTC)},
+		{time.Date(2026, 3, 2, 23, 45, 0, 0, time.UTC), time.Date(2026, 3, 3, 0, 0, 0, 0, time.UTC)},
+	}
+	for _, tt := range tests {
+		if got := s.Next(tt.t); !got.Equal(tt.want) {
+			t.Errorf("Next(%s) = %s, want %s", tt.t, got, tt.want)
+		}
+	}
+}
+
+func TestIntervalNext(t *testing.T) {
+	start := time.Date(2026, 3, 2, 12, 7, 30, 0, time.UTC)
+	tests := []struct {
+		name  string
+		every time.Duration
+		align bool
+		t     time.Time
+		want  time.Time
+	}{
+		{"before start", 10 * time.Minute, false, start.Add(-time.Hour), start},
+		{"at start", 10 * time.Minute, false, start, start.Add(10 * time.Minute)},
+		{"between runs", 10 * time.Minute, false, start.Add(25 * time.Minute), start.Add(30 * time.Minute)},
+		{"at a run", 10 * time.Minute, false, start.Add(30 * time.Minute), start.Add(40 * time.Minute)},
+		{"long interval", 6 * time.Hour, false, start.Add(7 * time.Hour), start.Add(12 * time.Hour)},
+		{"aligned before the hour", 10 * time.Minute, true, time.Date(2026, 3, 2, 11, 59, 0, 0, time.UTC), time.Date(2026, 3, 2, 12, 0, 0, 0, time.UTC)},
+		{"aligned at start", 10 * time.Minute, true, start, time.Date(2026, 3, 2, 12, 10, 0, 0, time.UTC)},
+		{"aligned at a run", 10 * time.Minute, true, time.Date(2026, 3, 2, 12, 20, 0, 0, time.UTC), time.Date(2026, 3, 2, 12, 30, 0, 0, time.UTC)},
+		{"aligned next hour", 30 * time.Minute, true, time.Date(2026, 3, 2, 13, 45, 0, 0, time.UTC), time.Date(2026, 3, 2, 14, 0, 0, 0, time.UTC)},
+		{"aligned long interval", 6 * time.Hour, true, start, time.Date(2026, 3, 2, 18, 0, 0, 0, time.UTC)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewInterval(tt.every, start, tt.align)
+			if got := s.Next(tt.t); !got.Equal(tt.want) {
+				t.Errorf("Next(%s) = %s, want %s", tt.t, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestInLocationAcrossDST(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Skipf("no time zone data: %v", err)
+	}
+	kolkata, err := time.LoadLocation("Asia/Kolkata")
+	if err != nil {
+		t.Skipf("no time zone data: %v", err)
+	}
+	// Berlin switches from CET (+1) to CEST (+2) at 01:00 UTC on 2026-03-29.
+	spring := time.Date(2026, 3, 29, 1, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name  string
+		sched Schedule
+		t     time.Time
+		want  time.Time
+	}{
+		{"minutes before the switch", InLocation(NewMinutes([]int{30}), berlin), spring.Add(-50 * time.Minute), spring.Add(-30 * time.Minute)},
+		{"minutes over the switch", InLocation(NewMinutes([]int{0}), berlin), spring.Add(-30 * time.Minute), spring},
+		{"minutes after the switch", InLocation(NewMinutes([]int{0}), berlin), spring, spring.Add(time.Hour)},
+		{"aligned interval over the switch", InLocation(NewInterval(time.Hour, spring.Add(-3*time.Hour).In(berlin), true), berlin), spring.Add(-10 * time.Minute), spring},
+		{"half-hour offset", InLocation(NewMinutes([]int{0}), kolkata), time.Date(2026, 3, 2, 12, 0, 0, 0, time.UTC), time.Date(2026, 3, 2, 12, 30, 0, 0, time.UTC)},
+		{"aligned to a half-hour offset", InLocation(NewInterval(time.Hour, time.Date(2026, 3, 2, 12, 10, 0, 0, kolkata), true), kolkata), time.Date(2026, 3, 2, 6, 40, 0, 0, time.UTC), time.Date(2026, 3, 2, 7, 30, 0, 0, time.UTC)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.sched.Next(tt.t); !got.Equal(tt.want) {
+				t.Errorf("Next(%s) = %s, want %s", tt.t, got.UTC(), tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,224 @@
+// Package scheduler triggers periodic runs at the times of a Schedule: fixed
+// minutes of every hour, a fixed interval or a cron expression.
+package scheduler
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Schedule computes when the next scheduled run is due.
+type Schedule interface {
+	// Next returns the first run time strictly after t, or the zero time
+	// if no run is planned.
+	Next(t time.Time) time.Time
+	fmt.Stringer
+}
+
+// minuteSchedule runs at fixed minutes of every hour.
+type minuteSchedule []int
+
+// NewMinutes returns a schedule firing at the given minutes of every hour. At
+// least one minute is required.
+func NewMinutes(minutes []int) Schedule {
+	sorted := append(minuteSchedule(nil), minutes...)
+	sort.Ints(sorted)
+	return sorted
+}
+
+func (s minuteSchedule) Next(t time.Time) time.Time {
+	hour := startOfHour(t)
+	for _, m := range s {
+		if candidate := hour.Add(time.Duration(m) * time.Minute); candidate.After(t) {
+			return candidate
+		}
+	}
+	return hour.Add(time.Hour + time.Duration(s[0])*time.Minute)
+}
+
+func (s minuteSchedule) String() string {
+	return fmt.Sprintf("minutes %v of every hour", []int(s))
+}
+
+// intervalSchedule runs every interval, counted from anchor.
+type intervalSchedule struct {
+	every  time.Duration
+	anchor time.Time
+}
+
+// NewInterval returns a schedule firing every interval starting at start, or
+// at the top of the hour following start when align is set.
+func NewInterval(every time.Duration, start time.Time, align bool) Schedule {
+	anchor := start
+	if align {
+		anchor = startOfHour(start)
+	}
+	return intervalSchedule{every: every, anchor: anchor}
+}
+
+func (s intervalSchedule) Next(t time.Time) time.Time {
+	if t.Before(s.anchor) {
+		return s.anchor
+	}
+	n := t.Sub(s.anchor)/s.every + 1
+	return s.anchor.Add(n * s.every)
+}
+
+func (s intervalSchedule) String() string {
+	return fmt.Sprintf("every %s", s.every)
+}
+
+// locationSchedule evaluates a schedule in a time zone.
+type locationSchedule struct {
+	Schedule
+	loc *time.Location
+}
+
+// InLocation returns sched evaluated in loc instead of the location of the
+// times passed to Next, so the minutes of every hour and intervals aligned
+// to the hour follow loc's offset.
+func InLocation(sched Schedule, loc *time.Location) Schedule {
+	if loc == nil || loc == time.Local {
+		return sched
+	}
+	return locationSchedule{Schedule: sched, loc: loc}
+}
+
+func (s locationSchedule) Next(t time.Time) time.Time {
+	return s.Schedule.Next(t.In(s.loc))
+}
+
+func (s locationSchedule) String() string {
+	return fmt.Sprintf("%s (%s)", s.Schedule, s.loc)
+}
+
+// Clock tells the time and creates the timers of Run, so tests can simulate
+// the passing of time.
+type Clock interface {
+	Now() time.Time
+	NewTimer(d time.Duration) Timer
+}
+
+// Timer is a timer created by a Clock, like time.Timer.
+type Timer interface {
+	C() <-chan time.Time
+	Reset(d time.Duration) bool
+	Stop() bool
+}
+
+// RealClock is the Clock of the system time.
+var RealClock Clock = realClock{}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time { return time.Now() }
+
+func (realClock) NewTimer(d time.Duration) Timer { return realTimer{time.NewTimer(d)} }
+
+type realTimer struct{ *time.Timer }
+
+func (t realTimer) C() <-chan time.Time { return t.Timer.C }
+
+// idlePoll is how often Run asks a schedule that plans no run again.
+const idlePoll = time.Minute
+
+// untilNext returns how long to wait for next from now, or idlePoll if it is
+// zero.
+func untilNext(now, next time.Time) time.Duration {
+	if next.IsZero() {
+		return idlePoll
+	}
+	return next.Sub(now)
+}
+
+// setNextRun sets g to the Unix time of next, 0 if it is zero.
+func setNextRun(g prometheus.Gauge, next time.Time) {
+	if next.IsZero() {
+		g.Set(0)
+		return
+	}
+	g.Set(float64(next.UnixNano()) / 1e9)
+}
+
+// startOfHour returns the beginning of t's hour in t's location.
+func startOfHour(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), 0, 0, 0, t.Location())
+}
+
+// Overlap policies for a scheduled run that is due while the previous one is
+// still in flight.
+const (
+	OverlapSkip  = "skip"
+	OverlapQueue = "queue"
+)
+
+// testHookRunFinished is called once a run has finished and the scheduler
+// considers it done, so tests can wait for it.
+var testHookRunFinished = func() {}
+
+// Run triggers run with the due time at every time produced by sched, as
+// told by clock, until ctx is done. Runs execute on their own goroutine, so
+// a run that overruns the next slot doesn't delay the scheduler. A slot that
+// is due while a run is in flight is skipped, or with the queue policy
+// started once the current run finishes; at most one run is queued. Either
+// way it is counted in overlapped. While sched plans no run, returning the
+// zero time, it is asked again every idlePoll. next is set to the time of
+// the next run as a Unix timestamp, 0 while none is planned.
+func Run(ctx context.Context, clock Clock, logger *slog.Logger, sched Schedule, overlap string, overlapped *prometheus.CounterVec, next prometheus.Gauge, run func(due time.Time)) {
+	var busy atomic.Bool
+	trigger := make(chan time.Time, 1)
+	go func() {
+		for due := range trigger {
+			busy.Store(true)
+			run(due)
+			busy.Store(false)
+			testHookRunFinished()
+		}
+	}()
+
+	now := clock.Now()
+	nextRun := sched.Next(now)
+	setNextRun(next, nextRun)
+	logger.Info("Scheduler started", "schedule", sched.String(), "next_run", nextRun)
+	timer := clock.NewTimer(untilNext(now, nextRun))
+	defer timer.Stop()
+	defer close(trigger)
+	for {
+		select {
+		case <-timer.C():
+		case <-ctx.Done():
+			return
+		}
+		due := nextRun
+		now := clock.Now()
+		nextRun = sched.Next(now)
+		setNextRun(next, nextRun)
+		if due.IsZero() {
+			if !nextRun.IsZero() {
+				logger.Info("Next scheduled fetch run", "next_run", nextRun)
+			}
+			timer.Reset(untilNext(now, nextRun))
+			continue
+		}
+
+		switch {
+		case !busy.Load() && len(trigger) == 0:
+			trigger <- due
+		case overlap == OverlapQueue && len(trigger) == 0:
+			trigger <- due
+			overlapped.WithLabelValues("queued").Inc()
+			logger.Warn("Previous fetch run still in progress, queueing scheduled run", "due", due)
+		default:
+			overlapped.WithLabelValues("skipped").Inc()
+			logger.Warn("Previous fetch run still in progress, skipping scheduled run", "due", due)
+		}
+		logger.Info("Next scheduled fetch run", "next_run", nextRun)
+		timer.Reset(untilNext(now, nextRun))
+	}
+}
@@ -0,0 +1,274 @@
+package scheduler
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// fakeClock is a Clock whose time only moves when the test fires its timer.
+// Run creates a single timer, and every Reset of it marks the end of an
+// iteration of Run's loop.
+type fakeClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timer  *fakeTimer
+	resets chan struct{}
+}
+
+type fakeTimer struct {
+	clock *fakeClock
+	ch    chan time.Time
+	when  time.Time
+}
+
+func newFakeClock(now time.Time) *fakeClock {
+	return &fakeClock{now: now, resets: make(chan struct{}, 1)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) NewTimer(d time.Duration) Timer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.timer = &fakeTimer{clock: c, ch: make(chan time.Time, 1), when: c.now.Add(d)}
+	c.resets <- struct{}{}
+	return c.timer
+}
+
+func (t *fakeTimer) C() <-chan time.Time { return t.ch }
+
+func (t *fakeTimer) Reset(d time.Duration) bool {
+	t.clock.mu.Lock()
+	t.when = t.clock.now.Add(d)
+	t.clock.mu.Unlock()
+	t.clock.resets <- struct{}{}
+	return true
+}
+
+func (t *fakeTimer) Stop() bool { return true }
+
+// waitReset waits for Run to create or reset its timer.
+func (c *fakeClock) waitReset(t *testing.T) {
+	t.Helper()
+	select {
+	case <-c.resets:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the scheduler to reset its timer")
+	}
+}
+
+// pending returns the time the timer fires at.
+func (c *fakeClock) pending() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.timer.when
+}
+
+// fire moves the time to the timer's and fires it, returning the new time.
+func (c *fakeClock) fire() time.Time {
+	c.mu.Lock()
+	c.now = c.timer.when
+	now, ch := c.now, c.timer.ch
+	c.mu.Unlock()
+	ch <- now
+	return now
+}
+
+// schedulerRun runs Run with a fakeClock starting at start until the test
+// ends.
+type schedulerRun struct {
+	clock      *fakeClock
+	overlapped *prometheus.CounterVec
+	next       prometheus.Gauge
+	finished   chan struct{}
+}
+
+func startRun(t *testing.T, start time.Time, sched Schedule, overlap string, run func(due time.Time)) *schedulerRun {
+	t.Helper()
+	r := &schedulerRun{
+		clock:      newFakeClock(start),
+		overlapped: prometheus.NewCounterVec(prometheus.CounterOpts{Name: "overlapped_total"}, []string{"action"}),
+		next:       prometheus.NewGauge(prometheus.GaugeOpts{Name: "next_run"}),
+		finished:   make(chan struct{}, 10),
+	}
+	testHookRunFinished = func() { r.finished <- struct{}{} }
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		Run(ctx, r.clock, slog.New(slog.NewTextHandler(io.Discard, nil)), sched, overlap, r.overlapped, r.next, run)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+		testHookRunFinished = func() {}
+	})
+	r.clock.waitReset(t)
+	return r
+}
+
+func (r *schedulerRun) nextRun() time.Time {
+	return time.Unix(0, int64(testutil.ToFloat64(r.next)*1e9)).UTC().Round(time.Second)
+}
+
+func (r *schedulerRun) counted(action string) int {
+	return int(testutil.ToFloat64(r.overlapped.WithLabelValues(action)))
+}
+
+func receive[T any](t *testing.T, ch <-chan T) T {
+	t.Helper()
+	select {
+	case v := <-ch:
+		return v
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out")
+		panic("unreachable")
+	}
+}
+
+var quarterHours = NewMinutes([]int{0, 15, 30, 45})
+
+func TestRunMissesNoSlot(t *testing.T) {
+	start := time.Date(2026, 3, 2, 12, 7, 30, 0, time.UTC)
+	started := make(chan time.Time, 10)
+	r := startRun(t, start, quarterHours, OverlapSkip, func(due time.Time) { started <- due })
+
+	if got, want := r.nextRun(), start.Add(7*time.Minute+30*time.Second); !got.Equal(want) {
+		t.Fatalf("next run before the first run = %s, want %s", got, want)
+	}
+	var dues []time.Time
+	for r.clock.pending().Before(start.Add(time.Hour)) {
+		now := r.clock.fire()
+		r.clock.waitReset(t)
+		if got, want := r.nextRun(), now.Add(15*time.Minute); !got.Equal(want) {
+			t.Errorf("next run after the run of %s = %s, want %s", now, got, want)
+		}
+		dues = append(dues, receive(t, started))
+		receive(t, r.finished)
+	}
+
+	want := []time.Time{
+		time.Date(2026, 3, 2, 12, 15, 0, 0, time.UTC),
+		time.Date(2026, 3, 2, 12, 30, 0, 0, time.UTC),
+		time.Date(2026, 3, 2, 12, 45, 0, 0, time.UTC),
+		time.Date(2026, 3, 2, 13, 0, 0, 0, time.UTC),
+	}
+	if len(dues) != len(want) {
+		t.Fatalf("runs due at %v, want %v", dues, want)
+	}
+	for i := range want {
+		if !dues[i].Equal(want[i]) {
+			t.Errorf("run %d due at %s, want %s", i, dues[i], want[i])
+		}
+	}
+	if n := r.counted("skipped") + r.counted("queued"); n != 0 {
+		t.Errorf("%d runs overlapped, want none", n)
+	}
+}
+
+// overrun runs Run for an hour of quarter-hour slots whose first run lasts
+// the whole hour, and returns the due times of the runs started.
+func overrun(t *testing.T, overlap string) (*schedulerRun, []time.Time) {
+	t.Helper()
+	start := time.Date(2026, 3, 2, 12, 7, 30, 0, time.UTC)
+	started := make(chan time.Time, 10)
+	release := make(chan struct{})
+	r := startRun(t, start, quarterHours, overlap, func(due time.Time) {
+		started <- due
+		<-release
+	})
+
+	dues := []time.Time{}
+	for r.clock.pending().Before(start.Add(time.Hour)) {
+		r.clock.fire()
+		r.clock.waitReset(t)
+		if len(dues) == 0 {
+			dues = append(dues, receive(t, started))
+		}
+	}
+	close(release)
+	receive(t, r.finished)
+	if overlap == OverlapQueue {
+		dues = append(dues, receive(t, started))
+		receive(t, r.finished)
+	}
+	return r, dues
+}
+
+func TestRunSkipsSlotsOfOverrunningRun(t *testing.T) {
+	r, dues := overrun(t, OverlapSkip)
+	if want := time.Date(2026, 3, 2, 12, 15, 0, 0, time.UTC); len(dues) != 1 || !dues[0].Equal(want) {
+		t.Errorf("runs due at %v, want only %s", dues, want)
+	}
+	if got := r.counted("skipped"); got != 3 {
+		t.Errorf("skipped %d runs, want 3", got)
+	}
+	if got := r.counted("queued"); got != 0 {
+		t.Errorf("queued %d runs, want none", got)
+	}
+}
+
+func TestRunQueuesOneSlotOfOverrunningRun(t *testing.T) {
+	r, dues := overrun(t, OverlapQueue)
+	want := []time.Time{
+		time.Date(2026, 3, 2, 12, 15, 0, 0, time.UTC),
+		time.Date(2026, 3, 2, 12, 30, 0, 0, time.UTC),
+	}
+	if len(dues) != 2 || !dues[0].Equal(want[0]) || !dues[1].Equal(want[1]) {
+		t.Errorf("runs due at %v, want %v", dues, want)
+	}
+	if got := r.counted("queued"); got != 1 {
+		t.Errorf("queued %d runs, want 1", got)
+	}
+	if got := r.counted("skipped"); got != 2 {
+		t.Errorf("skipped %d runs, want 2", got)
+	}
+}
+
+func TestRunCronAcrossDST(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Skipf("no time zone data: %v", err)
+	}
+	sched, err := NewCron("0,30 * * * *", berlin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Berlin goes back from 03:00 CEST to 02:00 CET at 01:00 UTC.
+	start := time.Date(2026, 10, 25, 0, 10, 0, 0, time.UTC)
+	started := make(chan time.Time, 10)
+	r := startRun(t, start, sched, OverlapSkip, func(due time.Time) { started <- due })
+
+	var dues []time.Time
+	for range 4 {
+		r.clock.fire()
+		r.clock.waitReset(t)
+		dues = append(dues, receive(t, started))
+		receive(t, r.finished)
+	}
+	want := []time.Time{
+		time.Date(2026, 10, 25, 0, 30, 0, 0, time.UTC),
+		time.Date(2026, 10, 25, 1, 0, 0, 0, time.UTC),
+		time.Date(2026, 10, 25, 1, 30, 0, 0, time.UTC),
+		time.Date(2026, 10, 25, 2, 0, 0, 0, time.UTC),
+	}
+	for i := range want {
+		if !dues[i].Equal(want[i]) {
+			t.Fatalf("runs due at %v, want %v", dues, want)
+		}
+	}
+	if got, want := r.nextRun(), time.Date(2026, 10, 25, 2, 30, 0, 0, time.UTC); !got.Equal(want) {
+		t.Errorf("next run = %s, want %s", got, want)
+	}
+}
@@ -0,0 +1,227 @@
+// Package webpagetest is a client for the WebPageTest API. It submits a
+// test, polls it until it completes and converts the median run into a
+// psi.Result, so that its metrics are exported like those of a PSI run.
+package webpagetest
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/yahyasahaja/prometheus-exporter-pagespeed-insight/pkg/psi"
+)
+
+// DefaultEndpoint is the public WebPageTest server.
+const DefaultEndpoint = "https://www.webpagetest.org"
+
+// DefaultPollInterval is how often a running test is polled.
+const DefaultPollInterval = 10 * time.Second
+
+// Config configures a Client.
+type Config struct {
+	// APIKey authenticates the requests. Private instances may not need
+	// one.
+	APIKey string
+	// BaseURL is the WebPageTest server, DefaultEndpoint when empty.
+	BaseURL string
+	// Location is the test location and browser, such as
+	// "ec2-us-east-1:Chrome", the server's default when empty.
+	Location string
+	// Timeout bounds a test from its submission to its result. Zero means
+	// no timeout.
+	Timeout time.Duration
+	// PollInterval is how often a running test is polled,
+	// DefaultPollInterval when zero.
+	PollInterval time.Duration
+	// HTTPClient makes the API requests, http.DefaultClient when nil.
+	HTTPClient *http.Client
+}
+
+// Client runs WebPageTest tests. It is safe for concurrent use.
+type Client struct {
+	apiKey       string
+	baseURL      string
+	location     string
+	timeout      time.Duration
+	pollInterval time.Duration
+	httpClient   *http.Client
+}
+
+// New returns a Client for cfg.
+func New(cfg Config) *Client {
+	c := &Client{
+		apiKey:       cfg.APIKey,
+		baseURL:      strings.TrimSuffix(cfg.BaseURL, "/"),
+		location:     cfg.Location,
+		timeout:      cfg.Timeout,
+		pollInterval: cfg.PollInterval,
+		httpClient:   cfg.HTTPClient,
+	}
+	if c.baseURL == "" {
+		c.baseURL = DefaultEndpoint
+	}
+	if c.pollInterval == 0 {
+		c.pollInterval = DefaultPollInterval
+	}
+	if c.httpClient == nil {
+		c.httpClient = http.DefaultClient
+	}
+	return c
+}
+
+// metrics maps the Lighthouse audits a Result reports to the metrics of
+// the first view of a WebPageTest run.
+var metrics = map[string]string{
+	"first-contentful-paint":   "firstContentfulPaint",
+	"largest-contentful-paint": "chromeUserTiming.LargestContentfulPaint",
+	"cumulative-layout-shift":  "chromeUserTiming.CumulativeLayoutShift",
+	"total-blocking-time":      "TotalBlockingTime",
+	"speed-index":              "SpeedIndex",
+	// TTFB includes the DNS lookup and connection, which the audit of
+	// Lighthouse doesn't.
+	"server-response-time": "TTFB",
+	"total-byte-weight":    "bytesIn",
+	"dom-size":             "domElements",
+}
+
+// envelope is the wrapper of every WebPageTest API response.
+type envelope struct {
+	StatusCode int             `json:"statusCode"`
+	StatusText string          `json:"statusText"`
+	Data       json.RawMessage `json:"data"`
+}
+
+// Run tests pageURL, emulating a phone for the mobile strategy, waits for
+// the test to complete and returns its median run. The metrics are reported
+// as the numeric values of the corresponding Lighthouse audits; there are no
+// category scores.
+func (c *Client) Run(ctx context.Context, pageURL, strategy string) (*psi.Result, error) {
+	if c.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.timeout)
+		defer cancel()
+	}
+	params := url.Values{"url": {pageURL}, "f": {"json"}, "runs": {"1"}, "fvonly": {"1"}}
+	if strategy == "mobile" {
+		params.Set("mobile", "1")
+	}
+	if c.location != "" {
+		params.Set("location", c.location)
+	}
+	var submitted struct {
+		TestID string `json:"testId"`
+	}
+	if _, err := c.get(ctx, "/runtest.php", params, &submitted); err != nil {
+		return nil, fmt.Errorf("submitting the test: %w", err)
+	}
+	if submitted.TestID == "" {
+		return nil, fmt.Errorf("submitting the test: no test ID in the response")
+	}
+
+	for {
+		status, err := c.get(ctx, "/testStatus.php", url.Values{"test": {submitted.TestID}, "f": {"json"}}, nil)
+		if err != nil {
+			return nil, fmt.Errorf("test %s: %w", submitted.TestID, err)
+		}
+		// 1xx are queued and running tests.
+		if status >= 200 {
+			break
+		}
+		select {
+		case <-time.After(c.pollInterval):
+		case <-ctx.Done():
+			return nil, fmt.Errorf("test %s: %w", submitted.TestID, ctx.Err())
+		}
+	}
+
+	var result struct {
+		Completed int64 `json:"completed"`
+		Median    struct {
+			FirstView map[string]any `json:"firstView"`
+		} `json:"median"`
+	}
+	raw, err := c.getRaw(ctx, "/jsonResult.php", url.Values{"test": {submitted.TestID}})
+	if err != nil {
+		return nil, fmt.Errorf("test %s: %w", submitted.TestID, err)
+	}
+	var env envelope
+	if err := json.Unmarshal(raw, &env); err != nil {
+		return nil, fmt.Errorf("test %s: decoding the result: %v", submitted.TestID, err)
+	}
+	if env.StatusCode >= 400 {
+		return nil, fmt.Errorf("test %s: WebPageTest error %d: %s", submitted.TestID, env.StatusCode, env.StatusText)
+	}
+	if err := json.Unmarshal(env.Data, &result); err != nil {
+		return nil, fmt.Errorf("test %s: decoding the result: %v", submitted.TestID, err)
+	}
+	if result.Median.FirstView == nil {
+		return nil, fmt.Errorf("test %s: the result has no successful run", submitted.TestID)
+	}
+	res := &psi.Result{
+		FormFactor:   strategy,
+		RequestedURL: pageURL,
+		Audits:       map[string]psi.Audit{},
+		Raw:          raw,
+	}
+	if result.Completed > 0 {
+		res.FetchTime = time.Unix(result.Completed, 0).UTC().Format(time.RFC3339)
+	}
+	for audit, metric := range metrics {
+		if v, ok := result.Median.FirstView[metric].(float64); ok {
+			res.Audits[audit] = psi.Audit{NumericValue: &v}
+		}
+	}
+	return res, nil
+}
+
+// get requests path with params and decodes the data of the response into
+// data unless it is nil. It returns the status code of the envelope, and an
+// error for codes of 400 and above.
+func (c *Client) get(ctx context.Context, path string, params url.Values, data any) (int, error) {
+	raw, err := c.getRaw(ctx, path, params)
+	if err != nil {
+		return 0, err
+	}
+	var env envelope
+	if err := json.Unmarshal(raw, &env); err != nil {
+		return 0, fmt.Errorf("decoding the response: %v", err)
+	}
+	if env.StatusCode >= 400 {
+		return env.StatusCode, fmt.Errorf("WebPageTest error %d: %s", env.StatusCode, env.StatusText)
+	}
+	if data != nil {
+		if err := json.Unmarshal(env.Data, data); err != nil {
+			return 0, fmt.Errorf("decoding the response: %v", err)
+		}
+	}
+	return env.StatusCode, nil
+}
+
+// getRaw requests path with params and returns the body of the response.
+func (c *Client) getRaw(ctx context.Context, path string, params url.Values) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.baseURL+path+"?"+params.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if c.apiKey != "" {
+		req.Header.Set("X-WPT-API-KEY", c.apiKey)
+	}
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected HTTP status %s", resp.Status)
+	}
+	return body, nil
+}
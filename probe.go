@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/yahyasahaja/prometheus-exporter-pagespeed-insight/pkg/collector"
+	"github.com/yahyasahaja/prometheus-exporter-pagespeed-insight/pkg/psi"
+)
+
+// probeTimeoutMargin is subtracted from the scrape timeout sent by Prometheus,
+// so a probe answers before the scrape is abandoned.
+const probeTimeoutMargin = 500 * time.Millisecond
+
+// probeModule is a named set of /probe settings from the config file.
+type probeModule struct {
+	Strategy string
+	Options  psi.RetryPolicy
+	Request  psi.RequestOptions
+}
+
+// probe serves /probe?target=&strategy=&module=, fetching the target during
+// the scrape like the blackbox exporter. The response holds only that
+// target's metrics, from a registry built for the request, plus probe_success
+// and probe_duration_seconds. Without a module the run uses the --fetch.*
+// options and the strategy defaults to mobile; a strategy in the request
+// overrides the module's. Probes without a module are answered from the
+// result cache of /execute while it's fresh, unless ?refresh=true is passed.
+func (e *exporter) probe(w http.ResponseWriter, r *http.Request) {
+	if !e.guard.authorize(w, r) {
+		return
+	}
+	q := r.URL.Query()
+	module := probeModule{Strategy: "mobile", Options: e.fetchDefaults, Request: psi.RequestOptions{Categories: e.categories, Locale: e.locale}}
+	if name := q.Get("module"); name != "" {
+		var ok bool
+		if module, ok = e.probeModules[name]; !ok {
+			http.Error(w, fmt.Sprintf("Unknown module %q", name), http.StatusBadRequest)
+			return
+		}
+	}
+	strategy := q.Get("strategy")
+	if strategy == "" {
+		strategy = module.Strategy
+	}
+	t, err := parseExecuteTarget(q.Get("target"), strategy, q.Get("scope"))
+	if err == nil {
+		t.Labels, err = e.parseExecuteLabels(q)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := e.guard.allowURL(t.URL); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	t.Options = module.Options
+
+	ctx := r.Context()
+	if v := r.Header.Get("X-Prometheus-Scrape-Timeout-Seconds"); v != "" {
+		if seconds, err := strconv.ParseFloat(v, 64); err == nil && seconds > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, time.Duration(seconds*float64(time.Second))-probeTimeoutMargin)
+			defer cancel()
+		}
+	}
+
+	// The registry of the probe only has the labels set by the request.
+	results := collector.New(collector.Opts{Namespace: e.namespace, TargetLabels: slices.Sorted(maps.Keys(t.Labels)), AllAudits: e.allAudits})
+	success := prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: e.namespace,
+		Name:      "probe_success",
+		Help:      "Whether the PSI run of the probe succeeded (1) or failed (0)",
+	})
+	duration := prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: e.namespace,
+		Name:      "probe_duration_seconds",
+		Help:      "How long the probe took, including retries",
+	})
+	cached := prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: e.namespace,
+		Name:      "probe_cached",
+		Help:      "Whether the probe was answered from the result cache (1) rather than a PSI run (0)",
+	})
+	registry := prometheus.NewRegistry()
+	prometheus.WrapRegistererWith(e.constLabels, registry).MustRegister(results, success, duration, cached)
+
+	logger := e.logger.With("site", t.URL, "strategy", t.Strategy)
+	// Modules request other categories or locales than the cached results.
+	cacheable := e.cache != nil && q.Get("module") == ""
+	if cacheable && q.Get("refresh") != "true" {
+		if res, fetchedAt, ok := e.cache.get(t); ok {
+			e.metrics.cacheHits.Inc()
+			results.Restore(t.series(), collector.Saved{Result: res, FetchTime: fetchedAt, Success: true, LastSuccess: fetchedAt})
+			success.Set(1)
+			cached.Set(1)
+			promhttp.HandlerFor(registry, promhttp.HandlerOpts{}).ServeHTTP(w, r)
+			return
+		}
+	}
+	if cacheable {
+		e.metrics.cacheMisses.Inc()
+	}
+
+	logger.Debug("Probing PSI data")
+	start := time.Now()
+	res, err := e.client.WithRetryPolicy(t.Options).WithRequestOptions(module.Request).Run(ctx, t.URL, t.Strategy)
+	duration.Set(time.Since(start).Seconds())
+	if err != nil {
+		logger.Error("Probe failed", "err", err)
+	} else {
+		extracted := results.Set(logger, t.series(), res, e.detailedAudits)
+		success.Set(1)
+		if cacheable {
+			e.cache.put(t, extracted)
+		}
+	}
+
+	promhttp.HandlerFor(registry, promhttp.HandlerOpts{}).ServeHTTP(w, r)
+}
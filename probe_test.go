@@ -0,0 +1,85 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/yahyasahaja/prometheus-exporter-pagespeed-insight/pkg/collector"
+)
+
+func TestProbeCache(t *testing.T) {
+	var runs atomic.Int32
+	e := newTestExporter(t, func(w http.ResponseWriter, r *http.Request) {
+		runs.Add(1)
+		answerRun(w, r)
+	})
+	e.namespace = "psi"
+	e.cache = newResultCache(time.Minute, 10)
+	score := 0.9
+	e.cache.put(cacheTarget("https://example.com"), &collector.Result{PerformanceScore: &score})
+
+	tests := []struct {
+		name, query string
+		runs        int32
+		// lines are lines of the expected metrics.
+		lines []string
+	}{
+		{
+			name:  "cached",
+			query: "target=https://example.com/",
+			lines: []string{
+				`psi_performance_score{site="https://example.com",strategy="mobile"} 0.9`,
+				"psi_probe_cached 1",
+				"psi_probe_success 1",
+			},
+		},
+		{
+			name:  "refresh",
+			query: "target=https://example.com/&refresh=true",
+			runs:  1,
+			lines: []string{
+				`psi_performance_score{site="https://example.com",strategy="mobile"} 0.5`,
+				"psi_probe_cached 0",
+				"psi_probe_success 1",
+			},
+		},
+		{
+			// The refreshed result replaced the cached one.
+			name:  "cached after the refresh",
+			query: "target=https://example.com/",
+			runs:  1,
+			lines: []string{
+				`psi_performance_score{site="https://example.com",strategy="mobile"} 0.5`,
+				"psi_probe_cached 1",
+			},
+		},
+		{
+			name:  "other strategy",
+			query: "target=https://example.com/&strategy=desktop",
+			runs:  2,
+			lines: []string{
+				`psi_performance_score{site="https://example.com",strategy="desktop"} 0.5`,
+				"psi_probe_cached 0",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := serve(e.probe, http.MethodGet, "/probe?"+tt.query, "")
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status %d %q, want 200", rec.Code, rec.Body)
+			}
+			for _, line := range tt.lines {
+				if !strings.Contains(rec.Body.String(), "\n"+line+"\n") {
+					t.Errorf("metrics %q lack %q", rec.Body, line)
+				}
+			}
+			if n := runs.Load(); n != tt.runs {
+				t.Errorf("ran PSI %d times, want %d", n, tt.runs)
+			}
+		})
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"time"
+
+	"github.com/yahyasahaja/prometheus-exporter-pagespeed-insight/pkg/scheduler"
+)
+
+// profileLabel is the label set on the series of the targets of a scan
+// profile.
+const profileLabel = "profile"
+
+// fileScanProfile is a named kind of scan in the config file, e.g. a light
+// performance-only scan run often and a full one run daily. A target listing
+// profiles is scanned once per profile, each on its own schedule.
+type fileScanProfile struct {
+	// Cron replaces the schedule of the target for the profile's scans.
+	Cron string `yaml:"cron"`
+	// Categories and Runs override those of the target.
+	Categories []string `yaml:"categories"`
+	Runs       int      `yaml:"runs"`
+	// Timeout overrides the timeout of the target, as full scans take longer.
+	Timeout *time.Duration `yaml:"timeout"`
+	// DetailedAudits exports the Lighthouse diagnostics of the profile's
+	// scans, as --detailed-audits does for every target.
+	DetailedAudits bool `yaml:"detailed_audits"`
+	// AllAudits exports every audit of the profile's scans, as
+	// --export.all-audits does for every target.
+	AllAudits bool `yaml:"all_audits"`
+}
+
+// scanProfile is a validated scan profile of the config file.
+type scanProfile struct {
+	Schedule       scheduler.Schedule
+	Categories     []string
+	Runs           int
+	Timeout        time.Duration
+	DetailedAudits bool
+	AllAudits      bool
+}
+
+// scanProfiles validates the scan profiles of the config file, whose
+// schedules are evaluated in loc. Every invalid profile is reported.
+func (c *fileConfig) scanProfiles(loc *time.Location) (map[string]scanProfile, []error) {
+	profiles := map[string]scanProfile{}
+	var errs []error
+	for _, name := range slices.Sorted(maps.Keys(c.ScanProfiles)) {
+		fp := c.ScanProfiles[name]
+		if !tenantNameRE.MatchString(name) {
+			errs = append(errs, fmt.Errorf("scan_profiles.%s: invalid name: must be letters, digits, '_' and '-'", name))
+			continue
+		}
+		p := scanProfile{Categories: fp.Categories, Runs: fp.Runs, DetailedAudits: fp.DetailedAudits, AllAudits: fp.AllAudits}
+		valid := true
+		if fp.Cron != "" {
+			var err error
+			if p.Schedule, err = scheduler.NewCron(fp.Cron, loc); err != nil {
+				errs = append(errs, fmt.Errorf("scan_profiles.%s: %v", name, err))
+				valid = false
+			}
+		}
+		for _, category := range fp.Categories {
+			if err := validateCategory(category); err != nil {
+				errs = append(errs, fmt.Errorf("scan_profiles.%s: %v", name, err))
+				valid = false
+			}
+		}
+		if fp.Runs != 0 {
+			if err := validateRuns(fp.Runs); err != nil {
+				errs = append(errs, fmt.Errorf("scan_profiles.%s: %v", name, err))
+				valid = false
+			}
+		}
+		if fp.Timeout != nil {
+			p.Timeout = *fp.Timeout
+		}
+		if valid {
+			profiles[name] = p
+		}
+	}
+	return profiles, errs
+}
+
+// apply returns t scanned with the profile name: labeled with it, on the
+// profile's schedule and with its categories, runs, timeout and audits.
+func (p scanProfile) apply(t target, name string) target {
+	t.Profile = name
+	t.Labels = maps.Clone(t.Labels)
+	if t.Labels == nil {
+		t.Labels = map[string]string{}
+	}
+	t.Labels[profileLabel] = name
+	if p.Schedule != nil {
+		t.Schedule = p.Schedule
+	}
+	if len(p.Categories) > 0 {
+		t.Categories = p.Categories
+	}
+	if p.Runs != 0 {
+		t.Runs = p.Runs
+	}
+	if p.Timeout != 0 {
+		t.Options.Timeout = p.Timeout
+	}
+	t.DetailedAudits = p.DetailedAudits
+	t.AllAudits = p.AllAudits
+	return t
+}
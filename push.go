@@ -0,0 +1,285 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log/slog"
+	"maps"
+	"math"
+	"net/http"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/push"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/yahyasahaja/prometheus-exporter-pagespeed-insight/pkg/collector"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	// pushJobName is the default job of pushed metrics and the service name
+	// of OTLP exports.
+	pushJobName  = "psi_exporter"
+	pushAttempts = 4
+	pushTimeout  = 30 * time.Second
+)
+
+// pusher sends the current metric values to a Pushgateway and/or a
+// remote_write endpoint after each fetch run, for environments that cannot
+// be scraped.
+type pusher struct {
+	gatherer       prometheus.Gatherer
+	client         *http.Client
+	gatewayURL     string
+	remoteWriteURL string
+	// job and instance identify the pushed metrics, as the Pushgateway
+	// grouping key and as labels of the remote_write series.
+	job      string
+	instance string
+	failures *prometheus.CounterVec
+	logger   *slog.Logger
+}
+
+// newPusher returns a pusher pushing as job and instance, the host name when
+// instance is empty.
+func newPusher(gatherer prometheus.Gatherer, gatewayURL, remoteWriteURL, job, instance string, failures *prometheus.CounterVec, logger *slog.Logger) *pusher {
+	if instance == "" {
+		var err error
+		if instance, err = os.Hostname(); err != nil {
+			instance = "unknown"
+		}
+	}
+	return &pusher{
+		gatherer:       gatherer,
+		client:         &http.Client{Timeout: pushTimeout},
+		gatewayURL:     gatewayURL,
+		remoteWriteURL: remoteWriteURL,
+		job:            job,
+		instance:       instance,
+		failures:       failures,
+		logger:         logger,
+	}
+}
+
+// push sends the current metrics to every configured destination. Samples
+// sent via remote_write are stamped with completedAt; the Pushgateway does
+// not accept timestamps and records its own push time instead.
+func (p *pusher) push(completedAt time.Time) {
+	if p.gatewayURL != "" {
+		p.withRetry("pushgateway", func() error {
+			return push.New(p.gatewayURL, p.job).
+				Client(p.client).
+				Gatherer(p.gatherer).
+				Grouping("instance", p.instance).
+				Push()
+		})
+	}
+	if p.remoteWriteURL != "" {
+		p.withRetry("remote_write", func() error {
+			return p.remoteWrite(completedAt)
+		})
+	}
+}
+
+// withRetry runs fn with exponential backoff, counting a failure when every
+// attempt failed.
+func (p *pusher) withRetry(destination string, fn func() error) {
+	logger := p.logger.With("destination", destination)
+	delay := time.Second
+	var err error
+	for attempt := 1; attempt <= pushAttempts; attempt++ {
+		if err = fn(); err == nil {
+			logger.Debug("Pushed metrics")
+			return
+		}
+		logger.Debug("Error pushing metrics", "attempt", attempt, "err", err)
+		if attempt < pushAttempts {
+			time.Sleep(delay)
+			delay *= 2
+		}
+	}
+	p.failures.WithLabelValues(destination).Inc()
+	logger.Error("Failed to push metrics", "attempts", pushAttempts, "err", err)
+}
+
+// remoteWrite encodes the gathered metrics as a remote_write WriteRequest and
+// posts it to the remote_write endpoint.
+func (p *pusher) remoteWrite(ts time.Time) error {
+	families, err := p.gatherer.Gather()
+	if err != nil {
+		return fmt.Errorf("gathering metrics: %v", err)
+	}
+	return p.writeFamilies(families, ts)
+}
+
+// writeFamilies posts families to the remote_write endpoint, stamping the
+// samples without a timestamp of their own with ts.
+func (p *pusher) writeFamilies(families []*dto.MetricFamily, ts time.Time) error {
+	body := snappy.Encode(nil, encodeWriteRequest(families, map[string]string{
+		"job":      p.job,
+		"instance": p.instance,
+	}, ts))
+
+	req, err := http.NewRequest(http.MethodPost, p.remoteWriteURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	drainBody(resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("remote_write endpoint returned HTTP %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// backfillRemoteWrite sends the history of the current targets to the
+// remote_write endpoint, one request per target with every point stamped
+// with its fetch time, so the endpoint also gets the results fetched before
+// it was configured. Only the metrics a budget can limit are in the history.
+func (e *exporter) backfillRemoteWrite() {
+	targets := e.currentTargets()
+	e.logger.Info("Backfilling the history via remote_write", "targets", len(targets))
+	names := slices.Sorted(maps.Keys(budgetMetrics))
+	for _, t := range targets {
+		points := e.history.targetPoints(t, time.Time{}, time.Now())
+		if len(points) == 0 {
+			continue
+		}
+		labels := e.backfillLabels(t)
+		var families []*dto.MetricFamily
+		for _, name := range names {
+			mf := &dto.MetricFamily{Name: proto.String(prometheus.BuildFQName(e.namespace, "", name)), Type: dto.MetricType_GAUGE.Enum()}
+			seriesLabels := labels
+			if strings.HasPrefix(name, "field_") {
+				seriesLabels = append(slices.Clone(labels), &dto.LabelPair{Name: proto.String("scope"), Value: proto.String(t.Scope)})
+			}
+			for _, p := range points {
+				v, ok := budgetMetrics[name](&collector.Result{PerformanceScore: p.PerformanceScore, CategoryScores: p.CategoryScores, Metrics: p.Metrics, FieldData: p.FieldData})
+				if !ok {
+					continue
+				}
+				mf.Metric = append(mf.Metric, &dto.Metric{Label: seriesLabels, Gauge: &dto.Gauge{Value: proto.Float64(v)}, TimestampMs: proto.Int64(p.Time.UnixMilli())})
+			}
+			if len(mf.Metric) > 0 {
+				families = append(families, mf)
+			}
+		}
+		e.pusher.withRetry("remote_write", func() error {
+			return e.pusher.writeFamilies(families, time.Now())
+		})
+		e.logger.Debug("Backfilled the history of a target", "site", t.URL, "strategy", t.Strategy, "points", len(points))
+	}
+}
+
+// backfillLabels returns the labels of t's series, like those of the
+// exported metrics: the constant labels, site, strategy and custom labels.
+func (e *exporter) backfillLabels(t target) []*dto.LabelPair {
+	var labels []*dto.LabelPair
+	for name, value := range e.constLabels {
+		labels = append(labels, &dto.LabelPair{Name: proto.String(name), Value: proto.String(value)})
+	}
+	names := append([]string{"site", "strategy"}, e.metrics.results.TargetLabelNames()...)
+	for i, value := range e.metrics.targetValues(t) {
+		labels = append(labels, &dto.LabelPair{Name: proto.String(names[i]), Value: proto.String(value)})
+	}
+	return labels
+}
+
+// encodeWriteRequest serializes metric families into a remote_write
+// WriteRequest protobuf. Histograms and summaries are flattened into their
+// classic _bucket/_sum/_count and quantile series. Samples are stamped with
+// ts unless the metric carries its own timestamp.
+func encodeWriteRequest(families []*dto.MetricFamily, extra map[string]string, ts time.Time) []byte {
+	var millis int64
+	var buf []byte
+	appendSeries := func(name string, labels []*dto.LabelPair, add map[string]string, value float64) {
+		pairs := map[string]string{"__name__": name}
+		for k, v := range extra {
+			pairs[k] = v
+		}
+		for _, l := range labels {
+			pairs[l.GetName()] = l.GetValue()
+		}
+		for k, v := range add {
+			pairs[k] = v
+		}
+		names := make([]string, 0, len(pairs))
+		for k := range pairs {
+			names = append(names, k)
+		}
+		sort.Strings(names)
+
+		var series []byte
+		for _, k := range names {
+			var label []byte
+			label = protowire.AppendTag(label, 1, protowire.BytesType)
+			label = protowire.AppendString(label, k)
+			label = protowire.AppendTag(label, 2, protowire.BytesType)
+			label = protowire.AppendString(label, pairs[k])
+			series = protowire.AppendTag(series, 1, protowire.BytesType)
+			series = protowire.AppendBytes(series, label)
+		}
+		var sample []byte
+		sample = protowire.AppendTag(sample, 1, protowire.Fixed64Type)
+		sample = protowire.AppendFixed64(sample, math.Float64bits(value))
+		sample = protowire.AppendTag(sample, 2, protowire.VarintType)
+		sample = protowire.AppendVarint(sample, uint64(millis))
+		series = protowire.AppendTag(series, 2, protowire.BytesType)
+		series = protowire.AppendBytes(series, sample)
+
+		buf = protowire.AppendTag(buf, 1, protowire.BytesType)
+		buf = protowire.AppendBytes(buf, series)
+	}
+
+	for _, mf := range families {
+		name := mf.GetName()
+		for _, m := range mf.GetMetric() {
+			millis = ts.UnixMilli()
+			if m.TimestampMs != nil {
+				millis = m.GetTimestampMs()
+			}
+			labels := m.GetLabel()
+			switch mf.GetType() {
+			case dto.MetricType_COUNTER:
+				appendSeries(name, labels, nil, m.GetCounter().GetValue())
+			case dto.MetricType_GAUGE:
+				appendSeries(name, labels, nil, m.GetGauge().GetValue())
+			case dto.MetricType_UNTYPED:
+				appendSeries(name, labels, nil, m.GetUntyped().GetValue())
+			case dto.MetricType_SUMMARY:
+				s := m.GetSummary()
+				for _, q := range s.GetQuantile() {
+					appendSeries(name, labels, map[string]string{"quantile": formatFloat(q.GetQuantile())}, q.GetValue())
+				}
+				appendSeries(name+"_sum", labels, nil, s.GetSampleSum())
+				appendSeries(name+"_count", labels, nil, float64(s.GetSampleCount()))
+			case dto.MetricType_HISTOGRAM:
+				h := m.GetHistogram()
+				for _, b := range h.GetBucket() {
+					appendSeries(name+"_bucket", labels, map[string]string{"le": formatFloat(b.GetUpperBound())}, float64(b.GetCumulativeCount()))
+				}
+				appendSeries(name+"_bucket", labels, map[string]string{"le": "+Inf"}, float64(h.GetSampleCount()))
+				appendSeries(name+"_sum", labels, nil, h.GetSampleSum())
+				appendSeries(name+"_count", labels, nil, float64(h.GetSampleCount()))
+			}
+		}
+	}
+	return buf
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"strconv"
+	"sync"
+	"time"
+	_ "time/tzdata"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/yahyasahaja/prometheus-exporter-pagespeed-insight/pkg/psi"
+)
+
+// quotaTracker estimates the remaining daily quota of each API key from the
+// requests made with it since the quota last reset. Requests made by other
+// clients of the same keys aren't seen, so the estimate is an upper bound.
+type quotaTracker struct {
+	keys  int
+	limit int
+	loc   *time.Location
+	desc  *prometheus.Desc
+
+	mu sync.Mutex
+	// day is the quota day the counts belong to, in loc.
+	day  string
+	used map[int]int
+}
+
+// newQuotaTracker returns a quotaTracker of keys API keys with a daily quota
+// of limit requests each.
+func newQuotaTracker(namespace string, keys, limit int) *quotaTracker {
+	loc, err := time.LoadLocation(psi.QuotaResetZone)
+	if err != nil {
+		loc = time.UTC
+	}
+	return &quotaTracker{
+		keys:  keys,
+		limit: limit,
+		loc:   loc,
+		desc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "", "api_quota_remaining"),
+			"Estimated number of PSI API requests left in the daily quota of each API key",
+			[]string{"key_index"}, nil,
+		),
+		used: map[int]int{},
+	}
+}
+
+// record counts a request made with the key at keyIndex. Requests refused
+// for the key's quota don't consume it.
+func (q *quotaTracker) record(keyIndex int, outcome string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.rollover(time.Now())
+	if outcome != psi.OutcomeQuotaExceeded {
+		q.used[keyIndex]++
+	}
+	// The keys of config file targets get the indexes after the global
+	// keys once they are first used.
+	q.keys = max(q.keys, keyIndex+1)
+}
+
+// rollover resets the counts when the quota day has changed.
+func (q *quotaTracker) rollover(now time.Time) {
+	if day := now.In(q.loc).Format(time.DateOnly); day != q.day {
+		q.day = day
+		clear(q.used)
+	}
+}
+
+// Describe implements prometheus.Collector.
+func (q *quotaTracker) Describe(ch chan<- *prometheus.Desc) {
+	ch <- q.desc
+}
+
+// Collect implements prometheus.Collector.
+func (q *quotaTracker) Collect(ch chan<- prometheus.Metric) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.rollover(time.Now())
+	for i := range q.keys {
+		ch <- prometheus.MustNewConstMetric(q.desc, prometheus.GaugeValue, float64(max(q.limit-q.used[i], 0)), strconv.Itoa(i))
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"sync"
+	"time"
+)
+
+// baselinePolicy defines the performance score a target is expected to keep.
+// A score below the baseline by more than Margin is a regression.
+type baselinePolicy struct {
+	// Score is a static baseline. Without one, the baseline is the average
+	// score of the target's last Runs successful fetches.
+	Score *float64
+	Runs  int
+	// Margin is how far below the baseline a score may drop, on the 0-1
+	// scale of the score.
+	Margin float64
+}
+
+func (p *baselinePolicy) validate() error {
+	if p.Score != nil && (*p.Score < 0 || *p.Score > 1) {
+		return fmt.Errorf("baseline score %g must be between 0 and 1", *p.Score)
+	}
+	if p.Score == nil && p.Runs < 1 {
+		return errors.New("baseline needs a score or at least 1 run")
+	}
+	if p.Margin < 0 || p.Margin > 1 {
+		return fmt.Errorf("baseline margin %g must be between 0 and 1", p.Margin)
+	}
+	return nil
+}
+
+func (p *baselinePolicy) String() string {
+	if p.Score != nil {
+		return fmt.Sprintf("%g-%g", *p.Score, p.Margin)
+	}
+	return fmt.Sprintf("avg(%d runs)-%g", p.Runs, p.Margin)
+}
+
+// regressions keeps the recent performance scores of the targets with a
+// rolling baseline.
+type regressions struct {
+	mu sync.Mutex
+	// scores are the scores of the last runs of each target, oldest first.
+	scores map[string][]float64
+}
+
+// observe records score for t and returns t's baseline before it, false if
+// there is none yet because t had no earlier run with a rolling baseline.
+func (r *regressions) observe(t target, score float64) (float64, bool) {
+	p := t.Baseline
+	if p.Score != nil {
+		return *p.Score, true
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.scores == nil {
+		r.scores = map[string][]float64{}
+	}
+	key := t.URL + "|" + t.Strategy + "|" + t.Backend + "|" + t.Profile
+	prev := r.scores[key]
+	next := append(slices.Clone(prev), score)
+	// The policy may have shrunk on reload.
+	if len(next) > p.Runs {
+		next = next[len(next)-p.Runs:]
+	}
+	r.scores[key] = next
+	if len(prev) == 0 {
+		return 0, false
+	}
+	if len(prev) > p.Runs {
+		prev = prev[len(prev)-p.Runs:]
+	}
+	var sum float64
+	for _, s := range prev {
+		sum += s
+	}
+	return sum / float64(len(prev)), true
+}
+
+// seed records the scores of earlier runs, oldest first, as if observed.
+func (r *regressions) seed(t target, scores []float64) {
+	for _, s := range scores {
+		r.observe(t, s)
+	}
+}
+
+// checkRegression compares score, of a successful fetch of t, with t's
+// baseline and exports the outcome.
+func (e *exporter) checkRegression(t target, score float64, logger *slog.Logger) {
+	baseline, ok := e.regressions.observe(t, score)
+	if !ok {
+		return
+	}
+	regressed := score < baseline-t.Baseline.Margin
+	e.metrics.scoreBaseline.WithLabelValues(e.metrics.targetValues(t)...).Set(baseline)
+	e.metrics.scoreDelta.WithLabelValues(e.metrics.targetValues(t)...).Set(score - baseline)
+	e.metrics.scoreRegression.WithLabelValues(e.metrics.targetValues(t)...).Set(boolFloat(regressed))
+	if regressed {
+		logger.Warn("Performance score regressed", "score", score, "baseline", baseline, "margin", t.Baseline.Margin)
+	}
+	if e.notifier != nil {
+		e.notifier.update(notification{Kind: "regression", Site: t.URL, Strategy: t.Strategy, Metric: "performance_score", Value: score, Threshold: baseline - t.Baseline.Margin, Labels: t.Labels, Time: time.Now()}, regressed)
+	}
+}
+
+// seedRegressions feeds the rolling baselines with the scores of the history,
+// so they survive restarts.
+func (e *exporter) seedRegressions() {
+	for _, t := range e.currentTargets() {
+		if t.Baseline == nil || t.Baseline.Score != nil {
+			continue
+		}
+		e.regressions.seed(t, e.history.recentScores(t, t.Baseline.Runs))
+	}
+}
+
+func boolFloat(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
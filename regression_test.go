@@ -0,0 +1,148 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/yahyasahaja/prometheus-exporter-pagespeed-insight/pkg/collector"
+)
+
+// ptr returns a pointer to v, for the optional bounds of baselines and
+// budgets.
+func ptr(v float64) *float64 { return &v }
+
+func TestBaselinePolicyValidate(t *testing.T) {
+	tests := []struct {
+		policy baselinePolicy
+		// err is a part of the expected error, empty for a valid policy.
+		err string
+	}{
+		{baselinePolicy{Score: ptr(0.9), Margin: 0.05}, ""},
+		{baselinePolicy{Score: ptr(0)}, ""},
+		{baselinePolicy{Score: ptr(1), Margin: 1}, ""},
+		{baselinePolicy{Runs: 1}, ""},
+		{baselinePolicy{Score: ptr(1.5)}, "between 0 and 1"},
+		{baselinePolicy{Score: ptr(-0.1)}, "between 0 and 1"},
+		{baselinePolicy{}, "needs a score or at least 1 run"},
+		{baselinePolicy{Runs: 5, Margin: -0.1}, "margin -0.1 must be between 0 and 1"},
+		{baselinePolicy{Runs: 5, Margin: 1.1}, "margin 1.1 must be between 0 and 1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.policy.String(), func(t *testing.T) {
+			err := tt.policy.validate()
+			switch {
+			case tt.err == "" && err != nil:
+				t.Errorf("got error %v, want none", err)
+			case tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)):
+				t.Errorf("got error %v, want %q", err, tt.err)
+			}
+		})
+	}
+}
+
+// regressionSeries returns the number of regression series e exports.
+func regressionSeries(t *testing.T, e *exporter) int {
+	t.Helper()
+	return testutil.CollectAndCount(e.metrics.scoreBaseline) +
+		testutil.CollectAndCount(e.metrics.scoreDelta) +
+		testutil.CollectAndCount(e.metrics.scoreRegression)
+}
+
+func TestCheckRegressionStatic(t *testing.T) {
+	// The margins are exact in binary, so the edges are exact too.
+	policy := &baselinePolicy{Score: ptr(0.75), Margin: 0.25}
+	tests := []struct {
+		name      string
+		score     float64
+		regressed float64
+	}{
+		{"above the baseline", 0.875, 0},
+		{"at the baseline", 0.75, 0},
+		{"within the margin", 0.625, 0},
+		{"at the margin", 0.5, 0},
+		{"below the margin", 0.49, 1},
+		{"zero", 0, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := &exporter{metrics: newMetrics(collector.Opts{Namespace: "psi"}, "")}
+			page := target{URL: "https://example.com", Strategy: "mobile", Baseline: policy}
+			e.checkRegression(page, tt.score, discard)
+			values := e.metrics.targetValues(page)
+			if got := testutil.ToFloat64(e.metrics.scoreBaseline.WithLabelValues(values...)); got != 0.75 {
+				t.Errorf("baseline %g, want 0.75", got)
+			}
+			if got, want := testutil.ToFloat64(e.metrics.scoreDelta.WithLabelValues(values...)), tt.score-0.75; got != want {
+				t.Errorf("delta %g, want %g", got, want)
+			}
+			if got := testutil.ToFloat64(e.metrics.scoreRegression.WithLabelValues(values...)); got != tt.regressed {
+				t.Errorf("regression %g, want %g", got, tt.regressed)
+			}
+		})
+	}
+}
+
+func TestCheckRegressionRolling(t *testing.T) {
+	e := &exporter{metrics: newMetrics(collector.Opts{Namespace: "psi", TargetLabels: []string{"team"}}, "")}
+	page := target{
+		URL: "https://example.com", Strategy: "mobile", Labels: map[string]string{"team": "web"},
+		Baseline: &baselinePolicy{Runs: 2, Margin: 0.125},
+	}
+
+	// Without an earlier run there is no baseline, and nothing is exported.
+	e.checkRegression(page, 0.5, discard)
+	if n := regressionSeries(t, e); n != 0 {
+		t.Fatalf("exported %d series without a baseline, want none", n)
+	}
+
+	// The baseline is the average of the last 2 runs before the score.
+	for _, step := range []struct {
+		score, baseline, regressed float64
+	}{
+		{1, 0.5, 0},
+		{0.625, 0.75, 0},
+		{0.5, 0.8125, 1},
+		{0.5, 0.5625, 0},
+	} {
+		e.checkRegression(page, step.score, discard)
+		want := strings.NewReader(`
+# HELP psi_score_baseline Baseline performance score of the target (0-1 scale), static or the average of its last runs
+# TYPE psi_score_baseline gauge
+psi_score_baseline{site="https://example.com",strategy="mobile",team="web"} ` + strconv.FormatFloat(step.baseline, 'g', -1, 64) + `
+# HELP psi_score_regression Whether the latest performance score of the target is below its baseline by more than the margin (1) or not (0)
+# TYPE psi_score_regression gauge
+psi_score_regression{site="https://example.com",strategy="mobile",team="web"} ` + strconv.FormatFloat(step.regressed, 'g', -1, 64) + `
+`)
+		if err := testutil.CollectAndCompare(e.metrics.scoreBaseline, want, "psi_score_baseline"); err != nil {
+			t.Errorf("after %g: %v", step.score, err)
+		}
+		want.Seek(0, 0)
+		if err := testutil.CollectAndCompare(e.metrics.scoreRegression, want, "psi_score_regression"); err != nil {
+			t.Errorf("after %g: %v", step.score, err)
+		}
+	}
+
+	// Another strategy of the same URL has a baseline of its own.
+	desktop := page
+	desktop.Strategy = "desktop"
+	if _, ok := e.regressions.observe(desktop, 0.9); ok {
+		t.Error("desktop got the baseline of mobile")
+	}
+}
+
+func TestRegressionsSeed(t *testing.T) {
+	var r regressions
+	page := target{URL: "https://example.com", Strategy: "mobile", Baseline: &baselinePolicy{Runs: 3}}
+	// Only the last 3 seeded scores count.
+	r.seed(page, []float64{0, 0.25, 0.5, 0.75})
+	if baseline, ok := r.observe(page, 1); !ok || baseline != 0.5 {
+		t.Errorf("got baseline %g, %t, want 0.5", baseline, ok)
+	}
+	// A policy shrunk on reload averages fewer runs.
+	page.Baseline = &baselinePolicy{Runs: 1}
+	if baseline, ok := r.observe(page, 0); !ok || baseline != 1 {
+		t.Errorf("got baseline %g, %t after shrinking the policy, want 1", baseline, ok)
+	}
+}
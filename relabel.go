@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// Actions of the site_relabel rules of the config file.
+const (
+	relabelReplace            = "replace"
+	relabelStripScheme        = "strip_scheme"
+	relabelStripTrailingSlash = "strip_trailing_slash"
+	relabelDropQuery          = "drop_query"
+)
+
+// fileRelabel is a site_relabel rule of the config file.
+type fileRelabel struct {
+	Action      string `yaml:"action"`
+	Regex       string `yaml:"regex"`
+	Replacement string `yaml:"replacement"`
+}
+
+// siteRule rewrites the site label of targets. The regex of drop_query
+// selects the query parameters to drop, all of them without one.
+type siteRule struct {
+	action      string
+	regex       *regexp.Regexp
+	replacement string
+}
+
+// siteRules validates the site_relabel rules of the config file.
+func (c *fileConfig) siteRules() ([]siteRule, []error) {
+	var rules []siteRule
+	var errs []error
+	for i, f := range c.SiteRelabel {
+		rule := siteRule{action: f.Action, replacement: f.Replacement}
+		switch f.Action {
+		case relabelReplace, relabelDropQuery:
+			if f.Action == relabelDropQuery && f.Replacement != "" {
+				errs = append(errs, fmt.Errorf("site_relabel[%d]: replacement only applies to the replace action", i))
+				continue
+			}
+			if f.Regex == "" && f.Action == relabelReplace {
+				errs = append(errs, fmt.Errorf("site_relabel[%d]: replace requires a regex", i))
+				continue
+			}
+			if f.Regex != "" {
+				re, err := regexp.Compile(f.Regex)
+				if err != nil {
+					errs = append(errs, fmt.Errorf("site_relabel[%d]: invalid regex: %v", i, err))
+					continue
+				}
+				rule.regex = re
+			}
+		case relabelStripScheme, relabelStripTrailingSlash:
+			if f.Regex != "" || f.Replacement != "" {
+				errs = append(errs, fmt.Errorf("site_relabel[%d]: regex and replacement don't apply to %s", i, f.Action))
+				continue
+			}
+		default:
+			errs = append(errs, fmt.Errorf("site_relabel[%d]: invalid action %q: must be %s, %s, %s or %s", i, f.Action, relabelReplace, relabelStripScheme, relabelStripTrailingSlash, relabelDropQuery))
+			continue
+		}
+		rules = append(rules, rule)
+	}
+	return rules, errs
+}
+
+// relabelSite returns the site label of the target URL u after applying
+// rules in order.
+func relabelSite(rules []siteRule, u string) string {
+	site := u
+	for _, r := range rules {
+		switch r.action {
+		case relabelReplace:
+			site = r.regex.ReplaceAllString(site, r.replacement)
+		case relabelStripScheme:
+			if i := strings.Index(site, "://"); i >= 0 {
+				site = site[i+len("://"):]
+			}
+		case relabelStripTrailingSlash:
+			site = strings.TrimRight(site, "/")
+		case relabelDropQuery:
+			base, query, _ := strings.Cut(site, "?")
+			if r.regex == nil {
+				site = base
+				continue
+			}
+			// Only the parameters whose name matches are dropped.
+			params, err := url.ParseQuery(query)
+			if err != nil {
+				site = base
+				continue
+			}
+			for name := range params {
+				if r.regex.MatchString(name) {
+					params.Del(name)
+				}
+			}
+			site = base
+			if len(params) > 0 {
+				site += "?" + params.Encode()
+			}
+		}
+	}
+	return site
+}
+
+// checkSiteCollisions returns an error for every pair of targets whose site
+// labels were relabeled to the same value, which would export the same
+// series twice.
+func checkSiteCollisions(targets []target) []error {
+	var errs []error
+	seen := map[string]string{}
+	for _, t := range targets {
+		key := t.site() + "|" + t.Strategy
+		if other, ok := seen[key]; ok && other != t.URL {
+			errs = append(errs, fmt.Errorf("site_relabel maps both %s and %s to the site label %q", other, t.URL, t.site()))
+			continue
+		}
+		seen[key] = t.URL
+	}
+	return errs
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// siteRulesOf returns the validated rules of the site_relabel entries rules.
+func siteRulesOf(t *testing.T, rules ...fileRelabel) []siteRule {
+	t.Helper()
+	parsed, errs := (&fileConfig{SiteRelabel: rules}).siteRules()
+	if len(errs) > 0 {
+		t.Fatal(errs)
+	}
+	return parsed
+}
+
+func TestRelabelSite(t *testing.T) {
+	tests := []struct {
+		name  string
+		rules []fileRelabel
+		url   string
+		want  string
+	}{
+		{name: "no rules", url: "https://example.com/shop?q=1", want: "https://example.com/shop?q=1"},
+
+		// The regexes aren't anchored, every match is replaced.
+		{name: "replace", rules: []fileRelabel{{Action: "replace", Regex: `www\.`}}, url: "https://www.example.com/www.html", want: "https://example.com/html"},
+		{name: "replace anchored", rules: []fileRelabel{{Action: "replace", Regex: `^https://www\.`, Replacement: "https://"}}, url: "https://www.example.com/www.html", want: "https://example.com/www.html"},
+		{name: "replace with groups", rules: []fileRelabel{{Action: "replace", Regex: `^https://([^/]+)/shop/.*$`, Replacement: "$1 shop"}}, url: "https://example.com/shop/shoes/42", want: "example.com shop"},
+		{name: "replace no match", rules: []fileRelabel{{Action: "replace", Regex: `^http://`}}, url: "https://example.com", want: "https://example.com"},
+
+		{name: "strip scheme", rules: []fileRelabel{{Action: "strip_scheme"}}, url: "https://example.com/a", want: "example.com/a"},
+		{name: "strip scheme only once", rules: []fileRelabel{{Action: "strip_scheme"}}, url: "https://example.com/?next=https://other.example", want: "example.com/?next=https://other.example"},
+		{name: "strip trailing slashes", rules: []fileRelabel{{Action: "strip_trailing_slash"}}, url: "https://example.com/a//", want: "https://example.com/a"},
+
+		// drop_query drops the matching parameters and keeps the others.
+		{name: "drop the query", rules: []fileRelabel{{Action: "drop_query"}}, url: "https://example.com/shop?b=2&a=1", want: "https://example.com/shop"},
+		{name: "drop matching parameters", rules: []fileRelabel{{Action: "drop_query", Regex: `^(utm_|gclid$)`}}, url: "https://example.com/?q=1&utm_source=x&gclid=y&gclid_id=z&xutm_a=b", want: "https://example.com/?gclid_id=z&q=1&xutm_a=b"},
+		{name: "drop unanchored parameters", rules: []fileRelabel{{Action: "drop_query", Regex: `utm_`}}, url: "https://example.com/?q=1&utm_source=x&xutm_a=b", want: "https://example.com/?q=1"},
+		{name: "drop every parameter", rules: []fileRelabel{{Action: "drop_query", Regex: `.`}}, url: "https://example.com/?utm_source=x", want: "https://example.com/"},
+		{name: "drop from no query", rules: []fileRelabel{{Action: "drop_query", Regex: `^utm_`}}, url: "https://example.com/shop", want: "https://example.com/shop"},
+		{name: "drop from a malformed query", rules: []fileRelabel{{Action: "drop_query", Regex: `^utm_`}}, url: "https://example.com/?q=%zz", want: "https://example.com/"},
+
+		{
+			name:  "rules in order",
+			rules: []fileRelabel{{Action: "drop_query"}, {Action: "strip_scheme"}, {Action: "strip_trailing_slash"}, {Action: "replace", Regex: `^www\.`}},
+			url:   "https://www.example.com/shop/?utm_source=x",
+			want:  "example.com/shop",
+		},
+		{
+			// The scheme is gone before the anchored replace sees the URL.
+			name:  "anchored replace after strip_scheme",
+			rules: []fileRelabel{{Action: "strip_scheme"}, {Action: "replace", Regex: `^https://www\.`}},
+			url:   "https://www.example.com",
+			want:  "www.example.com",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := relabelSite(siteRulesOf(t, tt.rules...), tt.url); got != tt.want {
+				t.Errorf("relabelSite(%q) = %q, want %q", tt.url, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSiteRules(t *testing.T) {
+	rules, errs := (&fileConfig{SiteRelabel: []fileRelabel{
+		{Action: "replace", Regex: `^www\.`},
+		{Action: "replace"},
+		{Action: "replace", Regex: `(`},
+		{Action: "drop_query"},
+		{Action: "drop_query", Regex: `^utm_`, Replacement: "x"},
+		{Action: "strip_scheme", Regex: `^https`},
+		{Action: "strip_trailing_slash", Replacement: "/"},
+		{Action: "keep"},
+		{},
+	}}).siteRules()
+	if len(rules) != 2 {
+		t.Errorf("got %d rules, want 2", len(rules))
+	}
+	want := []string{
+		"site_relabel[1]: replace requires a regex",
+		"site_relabel[2]: invalid regex: error parsing regexp",
+		"site_relabel[4]: replacement only applies to the replace action",
+		"site_relabel[5]: regex and replacement don't apply to strip_scheme",
+		"site_relabel[6]: regex and replacement don't apply to strip_trailing_slash",
+		`site_relabel[7]: invalid action "keep": must be replace, strip_scheme, strip_trailing_slash or drop_query`,
+		`site_relabel[8]: invalid action ""`,
+	}
+	if len(errs) != len(want) {
+		t.Fatalf("got errors %v, want %q", errs, want)
+	}
+	for i, err := range errs {
+		if !strings.Contains(err.Error(), want[i]) {
+			t.Errorf("got error %v, want %q", err, want[i])
+		}
+	}
+}
+
+func TestCheckSiteCollisions(t *testing.T) {
+	targets := []target{
+		{URL: "https://example.com?utm_source=a", Site: "https://example.com", Strategy: "mobile"},
+		{URL: "https://example.com?utm_source=a", Site: "https://example.com", Strategy: "desktop"},
+		// The same URL twice, with another scope, doesn't collide.
+		{URL: "https://example.com?utm_source=a", Site: "https://example.com", Strategy: "mobile", Scope: scopeOrigin},
+		{URL: "https://example.com?utm_source=b", Site: "https://example.com", Strategy: "mobile"},
+		// A URL collides with the relabeled site of another one too.
+		{URL: "https://example.com", Strategy: "desktop"},
+	}
+	errs := checkSiteCollisions(targets)
+	want := []string{
+		`site_relabel maps both https://example.com?utm_source=a and https://example.com?utm_source=b to the site label "https://example.com"`,
+		`site_relabel maps both https://example.com?utm_source=a and https://example.com to the site label "https://example.com"`,
+	}
+	if len(errs) != len(want) {
+		t.Fatalf("got errors %v, want %q", errs, want)
+	}
+	for i, err := range errs {
+		if err.Error() != want[i] {
+			t.Errorf("got error %v, want %q", err, want[i])
+		}
+	}
+}
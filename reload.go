@@ -0,0 +1,138 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"maps"
+	"net/http"
+	"os"
+	"os/signal"
+	"slices"
+	"sync"
+	"syscall"
+)
+
+// reloader re-reads the configuration on SIGHUP and POST /-/reload and swaps
+// the exporter's targets for the new ones.
+type reloader struct {
+	mu sync.Mutex
+	// base is the configuration as parsed from the command line, before
+	// the config file was applied to it.
+	base config
+	fs   *flag.FlagSet
+	e    *exporter
+	// keys are the API keys rotated by the exporter's client.
+	keys []string
+}
+
+// reload resolves the configuration again and replaces the monitored targets
+// and the API keys, so a rotated --apikey-file is picked up. Series of removed
+// targets, and of targets whose labels changed, are deleted. Other settings,
+// including the global schedule, keep their startup values; the schedules of
+// config file targets and the tenants are reloaded with them. Reloads
+// that would change the set of custom label names are refused, since the
+// label names of registered metrics are fixed.
+func (r *reloader) reload() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	e := r.e
+
+	c := r.base
+	s, errs := c.resolve(r.fs)
+	if err := errors.Join(errs...); err != nil {
+		e.metrics.reloadSuccess.Set(0)
+		return err
+	}
+	if !slices.Equal(s.labelNames, e.metrics.results.TargetLabelNames()) {
+		e.metrics.reloadSuccess.Set(0)
+		return fmt.Errorf("custom label names changed from %v to %v, which requires a restart", e.metrics.results.TargetLabelNames(), s.labelNames)
+	}
+
+	if !slices.Equal(s.keys, r.keys) {
+		if err := e.client.SetKeys(s.keys); err != nil {
+			e.metrics.reloadSuccess.Set(0)
+			return err
+		}
+		r.keys = s.keys
+		config := e.currentConfig()
+		config.APIKeys = len(s.keys)
+		e.setConfig(config)
+		e.logger.Info("Reloaded API keys", "keys", len(s.keys))
+	}
+
+	old := map[string]target{}
+	for _, t := range e.currentTargets() {
+		old[t.key()] = t
+	}
+	kept := map[string]bool{}
+	added := 0
+	for _, t := range s.targets {
+		prev, ok := old[t.key()]
+		// A target whose categories changed is replaced, so the scores of
+		// categories it no longer requests don't linger.
+		if ok && prev.Site == t.Site && maps.Equal(prev.Labels, t.Labels) && slices.Equal(prev.Categories, t.Categories) {
+			kept[t.key()] = true
+			continue
+		}
+		added++
+	}
+	removed := 0
+	for key, t := range old {
+		if !kept[key] {
+			e.metrics.results.Delete(t.series())
+			e.metrics.deleteTarget(t)
+			if e.notifier != nil {
+				e.notifier.forget(t)
+			}
+			removed++
+		}
+	}
+
+	e.setTargets(s.targets)
+	e.setTenants(s.tenants)
+	e.updatePauseMetrics()
+	e.status.setTargets(s.targets)
+	for _, t := range s.duplicates {
+		e.logger.Warn("Ignoring duplicate target", "site", t.URL, "strategy", t.Strategy)
+	}
+	e.metrics.reloadSuccess.Set(1)
+	e.metrics.reloadTime.SetToCurrentTime()
+	e.logger.Info("Reloaded configuration", "targets", len(s.targets), "added", added, "removed", removed)
+	return nil
+}
+
+// watchSignals reloads the configuration whenever the process receives SIGHUP.
+func (r *reloader) watchSignals() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	for range hup {
+		if err := r.reload(); err != nil {
+			r.e.logger.Error("Failed to reload configuration", "err", err)
+		}
+	}
+}
+
+// handleReload serves POST /-/reload.
+func (r *reloader) handleReload(w http.ResponseWriter, _ *http.Request) {
+	if err := r.reload(); err != nil {
+		r.e.logger.Error("Failed to reload configuration", "err", err)
+		http.Error(w, fmt.Sprintf("Failed to reload configuration: %v", err), http.StatusInternalServerError)
+		return
+	}
+	fmt.Fprintln(w, "Configuration reloaded")
+}
+
+// currentTargets returns the targets monitored by scheduled runs.
+func (e *exporter) currentTargets() []target {
+	e.targetsMu.RLock()
+	defer e.targetsMu.RUnlock()
+	return e.targets
+}
+
+func (e *exporter) setTargets(targets []target) {
+	e.metrics.targetsConfigured.Set(float64(len(targets)))
+	e.targetsMu.Lock()
+	defer e.targetsMu.Unlock()
+	e.targets = targets
+}
@@ -0,0 +1,522 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/yahyasahaja/prometheus-exporter-pagespeed-insight/pkg/psi"
+)
+
+// reportPruneInterval is how often reports older than --reports.retention
+// are deleted.
+const reportPruneInterval = time.Hour
+
+// reportTimeFormat is the time of a report in its key, which sorts
+// chronologically.
+const reportTimeFormat = "20060102T150405.000Z"
+
+// reportTimeout bounds each request to the report store.
+const reportTimeout = 30 * time.Second
+
+// Reports are stored by reportUploadWorkers uploads at a time, and at most
+// reportQueueSize more wait for one, holding their responses in memory.
+const (
+	reportUploadWorkers = 4
+	reportQueueSize     = 50
+)
+
+// maxReportNameBytes is the longest file name most file systems accept, which
+// bounds each segment of a report key.
+const maxReportNameBytes = 255
+
+// errReportNotFound is returned by reportStore.get for missing reports.
+var errReportNotFound = errors.New("report not found")
+
+// errReportQueueFull is returned when too many reports wait to be stored.
+var errReportQueueFull = errors.New("too many reports waiting to be stored")
+
+// reportStore keeps the archived reports by key, a slash-separated path
+// relative to the store's directory or prefix.
+type reportStore interface {
+	put(ctx context.Context, key string, body []byte) error
+	get(ctx context.Context, key string) ([]byte, error)
+	// list returns the keys starting with prefix.
+	list(ctx context.Context, prefix string) ([]string, error)
+	delete(ctx context.Context, key string) error
+	// String describes the location of the store.
+	String() string
+}
+
+// newReportStore returns the store of --reports.url: a local directory, or
+// s3://bucket/prefix and gs://bucket/prefix for S3 and Google Cloud Storage.
+// S3 requests are signed with the AWS_* environment variables and sent to
+// s3Endpoint, GCS requests are authenticated with the Application Default
+// Credentials. Nothing is requested yet.
+func newReportStore(rawURL, s3Endpoint string, client *http.Client) (reportStore, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Scheme == "" || u.Scheme == "file" {
+		dir := rawURL
+		if err == nil && u.Scheme == "file" {
+			dir = u.Path
+		}
+		return &dirReportStore{dir: dir}, nil
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("invalid --reports.url %q: missing the bucket", rawURL)
+	}
+	prefix := strings.Trim(u.Path, "/")
+	switch u.Scheme {
+	case "s3":
+		return newS3ReportStore(u.Host, prefix, s3Endpoint, client)
+	case "gs":
+		creds, err := psi.FindDefaultCredentials(client)
+		if err != nil {
+			return nil, fmt.Errorf("--reports.url: %v", err)
+		}
+		return &gcsReportStore{bucket: u.Host, prefix: prefix, tokens: creds, client: client, baseURL: gcsBaseURL}, nil
+	}
+	return nil, fmt.Errorf("invalid --reports.url %q: must be a directory, s3://bucket/prefix or gs://bucket/prefix", rawURL)
+}
+
+// report identifies an archived report.
+type report struct {
+	ID  string `json:"id"`
+	URL string `json:"url"`
+	// URLTruncated reports that URL is only the start of the URL, whose
+	// report is stored under a hashed name.
+	URLTruncated bool      `json:"url_truncated,omitempty"`
+	Strategy     string    `json:"strategy"`
+	Time         time.Time `json:"time"`
+}
+
+// reportKey returns the key of the report of the run of url with strategy at
+// at: the escaped URL, the strategy and the time, so the reports of a target
+// share a prefix.
+func reportKey(u, strategy string, at time.Time) string {
+	return reportPrefix(u, strategy) + at.UTC().Format(reportTimeFormat) + ".json"
+}
+
+// reportPrefix returns the prefix of the keys of the reports of url with
+// strategy, or of every strategy if it is empty.
+func reportPrefix(u, strategy string) string {
+	prefix := reportURLName(u) + "/"
+	if strategy != "" {
+		prefix += strategy + "/"
+	}
+	return prefix
+}
+
+// reportURLName returns the escaped URL u, the first segment of the keys of
+// its reports. Escaped URLs longer than maxReportNameBytes are cut short and
+// end with "!" and the SHA-256 of u instead, which doesn't occur in escaped
+// URLs.
+func reportURLName(u string) string {
+	escaped := url.QueryEscape(u)
+	if len(escaped) <= maxReportNameBytes {
+		return escaped
+	}
+	sum := sha256.Sum256([]byte(u))
+	cut := maxReportNameBytes - 1 - 2*len(sum)
+	// An escape isn't cut in half.
+	if i := strings.LastIndexByte(escaped[cut-2:cut], '%'); i >= 0 {
+		cut -= 2 - i
+	}
+	return escaped[:cut] + "!" + hex.EncodeToString(sum[:])
+}
+
+// parseReportKey returns the report of key, and false if key isn't one of
+// reportKey. Keys with empty, "." or ".." segments are rejected, as they
+// would be resolved to other files by the stores.
+func parseReportKey(key string) (report, bool) {
+	parts := strings.Split(key, "/")
+	if len(parts) != 3 || !strings.HasSuffix(parts[2], ".json") {
+		return report{}, false
+	}
+	if slices.ContainsFunc(parts, func(p string) bool { return p == "" || p == "." || p == ".." }) {
+		return report{}, false
+	}
+	escaped, hash, truncated := strings.Cut(parts[0], "!")
+	if truncated {
+		if sum, err := hex.DecodeString(hash); err != nil || len(sum) != sha256.Size {
+			return report{}, false
+		}
+	}
+	u, err := url.QueryUnescape(escaped)
+	if err != nil {
+		return report{}, false
+	}
+	at, err := time.Parse(reportTimeFormat, strings.TrimSuffix(parts[2], ".json"))
+	if err != nil {
+		return report{}, false
+	}
+	return report{ID: base64.RawURLEncoding.EncodeToString([]byte(key)), URL: u, URLTruncated: truncated, Strategy: parts[1], Time: at}, true
+}
+
+// reportIDKey returns the key of a report ID, and false if it isn't valid.
+func reportIDKey(id string) (string, bool) {
+	key, err := base64.RawURLEncoding.DecodeString(id)
+	if err != nil {
+		return "", false
+	}
+	if _, ok := parseReportKey(string(key)); !ok {
+		return "", false
+	}
+	return string(key), true
+}
+
+// reportArchive stores the complete PSI response of every successful run.
+type reportArchive struct {
+	store reportStore
+	// retention is how long reports are kept, forever when zero.
+	retention time.Duration
+	// screenshots also archives the final screenshot and the filmstrip of
+	// every report.
+	screenshots bool
+	failures    prometheus.Counter
+
+	// uploads stores the reports in the background, so a slow store doesn't
+	// hold up the fetches, and pending counts the reports not stored yet.
+	uploads *workerPool
+	pending inFlight
+}
+
+func newReportArchive(store reportStore, retention time.Duration, screenshots bool, failures prometheus.Counter) *reportArchive {
+	return &reportArchive{
+		store:       store,
+		retention:   retention,
+		screenshots: screenshots,
+		failures:    failures,
+		uploads:     newWorkerPool(reportUploadWorkers, reportQueueSize),
+	}
+}
+
+// archive queues the response of res, the run of t at at, to be stored and
+// returns the ID the report will have. Failures to store it are logged to
+// logger.
+func (a *reportArchive) archive(logger *slog.Logger, t target, at time.Time, res *psi.Result) (string, error) {
+	key := reportKey(t.URL, t.Strategy, at)
+	a.pending.add(1)
+	if !a.uploads.trySubmit(func() {
+		defer a.pending.add(-1)
+		if err := a.upload(key, res); err != nil {
+			a.failures.Inc()
+			logger.Error("Failed to archive the Lighthouse report", "err", err)
+		}
+	}) {
+		a.pending.add(-1)
+		a.failures.Inc()
+		return "", errReportQueueFull
+	}
+	return base64.RawURLEncoding.EncodeToString([]byte(key)), nil
+}
+
+// upload stores the report with key of res, and its screenshots.
+func (a *reportArchive) upload(key string, res *psi.Result) error {
+	ctx, cancel := context.WithTimeout(context.Background(), reportTimeout)
+	defer cancel()
+	if err := a.store.put(ctx, key, res.Raw); err != nil {
+		return fmt.Errorf("archiving the report to %s: %v", a.store, err)
+	}
+	if a.screenshots {
+		if err := a.archiveScreenshots(ctx, key, res); err != nil {
+			return fmt.Errorf("archiving the screenshots to %s: %v", a.store, err)
+		}
+	}
+	return nil
+}
+
+// prune deletes the reports older than the retention, with their
+// screenshots, and returns how many reports.
+func (a *reportArchive) prune(ctx context.Context) (int, error) {
+	keys, err := a.store.list(ctx, "")
+	if err != nil {
+		return 0, err
+	}
+	cutoff := time.Now().Add(-a.retention)
+	deleted := 0
+	for _, key := range keys {
+		reportKey, screenshot := screenshotKeyReport(key)
+		if !screenshot {
+			reportKey = key
+		}
+		r, ok := parseReportKey(reportKey)
+		if !ok || !r.Time.Before(cutoff) {
+			continue
+		}
+		if err := a.store.delete(ctx, key); err != nil {
+			return deleted, err
+		}
+		if !screenshot {
+			deleted++
+		}
+	}
+	return deleted, nil
+}
+
+// pruneExpired prunes the reports on startup and every reportPruneInterval,
+// unless they are kept forever.
+func (a *reportArchive) pruneExpired(logger *slog.Logger) {
+	if a.retention == 0 {
+		return
+	}
+	for {
+		deleted, err := a.prune(context.Background())
+		if err != nil {
+			logger.Error("Failed to delete expired reports", "store", a.store.String(), "err", err)
+		} else if deleted > 0 {
+			logger.Info("Deleted expired reports", "store", a.store.String(), "reports", deleted)
+		}
+		time.Sleep(reportPruneInterval)
+	}
+}
+
+// Limits of the reports listed by /api/v1/reports.
+const (
+	defaultReportLimit = 20
+	maxReportLimit     = 1000
+)
+
+// lighthouseViewerURL is the Lighthouse report viewer, which renders the
+// report at the URL of its jsonurl parameter.
+const lighthouseViewerURL = "https://googlechrome.github.io/lighthouse/viewer/"
+
+// reportView is a report listed by /api/v1/reports.
+type reportView struct {
+	report
+	// ReportURL is the path of the report, and ViewerURL opens it in the
+	// Lighthouse viewer.
+	ReportURL string `json:"report_url"`
+	ViewerURL string `json:"viewer_url"`
+	// ScreenshotsURL lists the screenshots, with --reports.screenshots.
+	ScreenshotsURL string `json:"screenshots_url,omitempty"`
+}
+
+// serveList serves GET /api/v1/reports?site=&strategy=&limit= with the
+// archived reports, newest first.
+func (a *reportArchive) serveList(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	var site, strategy string
+	if q.Get("site") != "" {
+		var err error
+		if site, err = normalizeTargetURL(q.Get("site")); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if strategy = q.Get("strategy"); strategy != "" {
+		if err := validateStrategy(strategy); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	limit := defaultReportLimit
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxReportLimit {
+			http.Error(w, fmt.Sprintf("invalid limit %q: must be between 1 and %d", v, maxReportLimit), http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+
+	prefix := ""
+	if site != "" {
+		prefix = reportPrefix(site, strategy)
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), reportTimeout)
+	defer cancel()
+	keys, err := a.store.list(ctx, prefix)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to list the reports: %v", err), http.StatusBadGateway)
+		return
+	}
+	var reports []report
+	for _, key := range keys {
+		rep, ok := parseReportKey(key)
+		if !ok || strategy != "" && rep.Strategy != strategy {
+			continue
+		}
+		// The hashed name of a long URL matches the site exactly.
+		if site != "" {
+			rep.URL, rep.URLTruncated = site, false
+		}
+		reports = append(reports, rep)
+	}
+	slices.SortFunc(reports, func(a, b report) int {
+		return b.Time.Compare(a.Time)
+	})
+	views := []reportView{}
+	for _, rep := range reports[:min(limit, len(reports))] {
+		reportPath := "/api/v1/reports/" + rep.ID
+		view := reportView{
+			report:    rep,
+			ReportURL: reportPath,
+			ViewerURL: lighthouseViewerURL + "?jsonurl=" + url.QueryEscape(requestOrigin(r)+reportPath+"?format=lighthouse"),
+		}
+		if a.screenshots {
+			view.ScreenshotsURL = reportPath + "/screenshots"
+		}
+		views = append(views, view)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(views)
+}
+
+// requestOrigin returns the scheme and host the request was sent to,
+// honoring the X-Forwarded-Proto of a reverse proxy.
+func requestOrigin(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	if proto := r.Header.Get("X-Forwarded-Proto"); proto == "http" || proto == "https" {
+		scheme = proto
+	}
+	return scheme + "://" + r.Host
+}
+
+// serveReport serves GET /api/v1/reports/{id} with the archived PSI
+// response, or with format=lighthouse only its Lighthouse result.
+func (a *reportArchive) serveReport(w http.ResponseWriter, r *http.Request) {
+	key, ok := reportIDKey(r.PathValue("id"))
+	if !ok {
+		http.Error(w, "Report not found", http.StatusNotFound)
+		return
+	}
+	format := r.URL.Query().Get("format")
+	if format != "" && format != "lighthouse" {
+		http.Error(w, fmt.Sprintf("invalid format %q: must be lighthouse", format), http.StatusBadRequest)
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), reportTimeout)
+	defer cancel()
+	body, err := a.store.get(ctx, key)
+	if errors.Is(err, errReportNotFound) {
+		http.Error(w, "Report not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to read the report: %v", err), http.StatusBadGateway)
+		return
+	}
+	if format == "lighthouse" {
+		var resp struct {
+			LighthouseResult json.RawMessage `json:"lighthouseResult"`
+		}
+		if err := json.Unmarshal(body, &resp); err != nil || resp.LighthouseResult == nil {
+			http.Error(w, "The report has no Lighthouse result", http.StatusUnprocessableEntity)
+			return
+		}
+		body = resp.LighthouseResult
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(body)
+}
+
+// dirReportStore keeps the reports as files below dir.
+type dirReportStore struct {
+	dir string
+}
+
+func (s *dirReportStore) String() string {
+	return s.dir
+}
+
+// path returns the file of key, which must be below dir.
+func (s *dirReportStore) path(key string) (string, error) {
+	dir := filepath.Clean(s.dir)
+	p := filepath.Join(dir, filepath.FromSlash(key))
+	if !strings.HasPrefix(p, dir+string(filepath.Separator)) {
+		return "", fmt.Errorf("report key %q is outside of %s", key, s.dir)
+	}
+	return p, nil
+}
+
+// put writes the report to a temporary file first, so a crash never leaves
+// a truncated report behind.
+func (s *dirReportStore) put(_ context.Context, key string, body []byte) error {
+	p, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+		return err
+	}
+	tmp := p + ".tmp"
+	if err := os.WriteFile(tmp, body, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, p)
+}
+
+func (s *dirReportStore) get(_ context.Context, key string) ([]byte, error) {
+	p, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+	body, err := os.ReadFile(p)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, errReportNotFound
+	}
+	return body, err
+}
+
+func (s *dirReportStore) list(_ context.Context, prefix string) ([]string, error) {
+	var keys []string
+	err := filepath.WalkDir(s.dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) && p == s.dir {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() || strings.HasSuffix(p, ".tmp") {
+			return nil
+		}
+		rel, err := filepath.Rel(s.dir, p)
+		if err != nil {
+			return err
+		}
+		if key := filepath.ToSlash(rel); strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+		return nil
+	})
+	return keys, err
+}
+
+// delete removes the report or screenshot and the directories it leaves
+// empty.
+func (s *dirReportStore) delete(_ context.Context, key string) error {
+	p, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(p); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	for dir := path.Dir(key); dir != "."; dir = path.Dir(dir) {
+		p, err := s.path(dir)
+		if err != nil || os.Remove(p) != nil {
+			break
+		}
+	}
+	return nil
+}
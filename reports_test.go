@@ -0,0 +1,247 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/yahyasahaja/prometheus-exporter-pagespeed-insight/pkg/psi"
+)
+
+// blockingStore is a report store whose puts wait for release, failing for
+// the keys of failing URLs.
+type blockingStore struct {
+	dirReportStore
+	release chan struct{}
+	failing string
+}
+
+func (s *blockingStore) put(ctx context.Context, key string, body []byte) error {
+	<-s.release
+	if strings.HasPrefix(key, reportPrefix(s.failing, "")) {
+		return errors.New("access denied")
+	}
+	return s.dirReportStore.put(ctx, key, body)
+}
+
+func newTestArchive(store reportStore) *reportArchive {
+	return newReportArchive(store, 0, false, prometheus.NewCounter(prometheus.CounterOpts{Name: "failures"}))
+}
+
+func TestReportArchiveQueue(t *testing.T) {
+	store := &blockingStore{dirReportStore: dirReportStore{dir: t.TempDir()}, release: make(chan struct{}), failing: "https://example.com/down"}
+	a := newTestArchive(store)
+	at := time.Date(2026, 3, 2, 12, 0, 0, 0, time.UTC)
+	res := &psi.Result{Raw: []byte(psiRun)}
+
+	// The reports are queued while the store is blocked, up to the workers
+	// and the queue, and the others are dropped.
+	var ids []string
+	for i := range reportUploadWorkers + reportQueueSize + 2 {
+		page := target{URL: "https://example.com", Strategy: "mobile"}
+		if i == 0 {
+			page.URL = store.failing
+		}
+		id, err := a.archive(discard, page, at.Add(time.Duration(i)*time.Second), res)
+		switch {
+		case errors.Is(err, errReportQueueFull):
+			if id != "" {
+				t.Errorf("got ID %q for a dropped report", id)
+			}
+		case err != nil:
+			t.Fatal(err)
+		default:
+			ids = append(ids, id)
+		}
+		// Waiting for the workers to take the first reports keeps the
+		// count exact.
+		if i < reportUploadWorkers {
+			for len(a.uploads.queue) > 0 {
+				time.Sleep(time.Millisecond)
+			}
+		}
+	}
+	if want := reportUploadWorkers + reportQueueSize; len(ids) != want {
+		t.Fatalf("queued %d reports, want %d", len(ids), want)
+	}
+	if got := testutil.ToFloat64(a.failures); got != 2 {
+		t.Errorf("counted %g failures for the dropped reports, want 2", got)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	if a.pending.wait(ctx) {
+		t.Error("no report pending while the store is blocked")
+	}
+	cancel()
+	close(store.release)
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if !a.pending.wait(ctx) {
+		t.Fatalf("%d reports still pending", a.pending.count())
+	}
+	if got := testutil.ToFloat64(a.failures); got != 3 {
+		t.Errorf("counted %g failures, want 3 with the failed upload", got)
+	}
+	// Every queued report but the failed one is stored under its ID.
+	for _, id := range ids[1:] {
+		key, ok := reportIDKey(id)
+		if !ok {
+			t.Fatalf("invalid report ID %q", id)
+		}
+		if body, err := store.get(context.Background(), key); err != nil || string(body) != psiRun {
+			t.Errorf("report %s: %q, %v", key, body, err)
+		}
+	}
+}
+
+func TestReportURLName(t *testing.T) {
+	short := "https://example.com/checkout?step=1"
+	if got, want := reportURLName(short), "https%3A%2F%2Fexample.com%2Fcheckout%3Fstep%3D1"; got != want {
+		t.Errorf("reportURLName(%q) = %q, want %q", short, got, want)
+	}
+
+	long := "https://example.com/search?q=" + strings.Repeat("a", 300)
+	// The escaped query starts at byte 41, and the name is cut at byte 190
+	// before, within and after an escape.
+	escapes := []string{
+		"https://example.com/search?q=" + strings.Repeat("a", 147) + strings.Repeat("/", 40),
+		"https://example.com/search?q=" + strings.Repeat("a", 148) + strings.Repeat("/", 40),
+		"https://example.com/search?q=" + strings.Repeat("a", 149) + strings.Repeat("/", 40),
+	}
+	names := map[string]bool{}
+	for _, u := range append([]string{long, long + "b"}, escapes...) {
+		name := reportURLName(u)
+		if len(name) > maxReportNameBytes {
+			t.Errorf("name of %q has %d bytes, want at most %d", u, len(name), maxReportNameBytes)
+		}
+		if names[name] {
+			t.Errorf("name %q of %q isn't unique", name, u)
+		}
+		names[name] = true
+
+		r, ok := parseReportKey(reportKey(u, "mobile", time.Date(2026, 3, 2, 12, 0, 0, 0, time.UTC)))
+		if !ok {
+			t.Fatalf("the report key of %q doesn't parse", u)
+		}
+		if !r.URLTruncated || len(r.URL) < 100 || !strings.HasPrefix(u, r.URL) {
+			t.Errorf("got URL %q, truncated %t, want the start of %q", r.URL, r.URLTruncated, u)
+		}
+	}
+
+	// A long URL can be stored in a directory.
+	a := newTestArchive(&dirReportStore{dir: t.TempDir()})
+	id, err := a.archive(discard, target{URL: long, Strategy: "mobile"}, time.Now(), &psi.Result{Raw: []byte(psiRun)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !a.pending.wait(context.Background()) || testutil.ToFloat64(a.failures) != 0 {
+		t.Fatal("failed to store the report of a long URL")
+	}
+	// It is listed with its full URL when queried by site.
+	var listed []reportView
+	decode(t, serve(a.serveList, http.MethodGet, "/api/v1/reports?site="+strings.ReplaceAll(long, "?", "%3F"), ""), &listed)
+	if len(listed) != 1 || listed[0].ID != id || listed[0].URL != long || listed[0].URLTruncated {
+		t.Errorf("listed %+v, want the report of the long URL", listed)
+	}
+	decode(t, serve(a.serveList, http.MethodGet, "/api/v1/reports", ""), &listed)
+	if len(listed) != 1 || !listed[0].URLTruncated {
+		t.Errorf("listed %+v, want the report with its URL truncated", listed)
+	}
+}
+
+func TestParseReportKeyHash(t *testing.T) {
+	name := reportURLName("https://example.com/?q=" + strings.Repeat("a", 300))
+	escaped, hash, _ := strings.Cut(name, "!")
+	for _, segment := range []string{escaped + "!", escaped + "!" + hash[:63], escaped + "!" + strings.Repeat("z", 64), escaped + "!" + hash + "!" + hash} {
+		if _, ok := parseReportKey(segment + "/mobile/20260302T120000.000Z.json"); ok {
+			t.Errorf("parsed the report key with the invalid name %q", segment)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(t.TempDir(), name), nil, 0o600); err != nil {
+		t.Errorf("name %q isn't a valid file name: %v", name, err)
+	}
+}
+
+func TestServeReportOutsideStore(t *testing.T) {
+	dir := t.TempDir()
+	reports := filepath.Join(dir, "reports")
+	a := newTestArchive(&dirReportStore{dir: reports})
+	at := time.Date(2026, 3, 2, 12, 0, 0, 0, time.UTC)
+	id, err := a.archive(discard, target{URL: "https://example.com", Strategy: "mobile"}, at, &psi.Result{Raw: []byte(psiRun)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.pending.wait(context.Background())
+	// Files next to the store that keys with dot segments would resolve to.
+	const secret = `{"secret": true}`
+	for _, name := range []string{"secret.json", "mobile/20260302T120000.000Z.json", "reports.json"} {
+		p := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(secret), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/v1/reports/{id}", a.serveReport)
+	mux.HandleFunc("GET /api/v1/reports/{id}/screenshots/{name}", a.serveScreenshot)
+
+	if rec := serve(mux.ServeHTTP, http.MethodGet, "/api/v1/reports/"+id, ""); rec.Code != http.StatusOK || rec.Body.String() != psiRun {
+		t.Fatalf("got %d %q for the archived report", rec.Code, rec.Body)
+	}
+	encode := func(key string) string { return base64.RawURLEncoding.EncodeToString([]byte(key)) }
+	paths := []string{
+		// IDs of keys with dot or empty segments.
+		"/api/v1/reports/" + encode("../mobile/20260302T120000.000Z.json"),
+		"/api/v1/reports/" + encode("./mobile/20260302T120000.000Z.json"),
+		"/api/v1/reports/" + encode("https%3A%2F%2Fexample.com/../20260302T120000.000Z.json"),
+		"/api/v1/reports/" + encode("https%3A%2F%2Fexample.com/./20260302T120000.000Z.json"),
+		"/api/v1/reports/" + encode("/mobile/20260302T120000.000Z.json"),
+		"/api/v1/reports/" + encode("https%3A%2F%2Fexample.com//20260302T120000.000Z.json"),
+		"/api/v1/reports/" + encode("../../reports.json/mobile/20260302T120000.000Z.json"),
+		"/api/v1/reports/" + encode("../secret.json"),
+		// An escaped dot segment is a file name of its own within the store.
+		"/api/v1/reports/" + encode("%2e%2e/mobile/20260302T120000.000Z.json"),
+		"/api/v1/reports/" + encode("%2E%2E/mobile/20260302T120000.000Z.json"),
+		// Paths rather than IDs.
+		"/api/v1/reports/%2e%2e",
+		"/api/v1/reports/..%2Fsecret.json",
+		"/api/v1/reports/..%2F..%2Fsecret.json",
+		"/api/v1/reports/%2e%2e%2Fmobile%2F20260302T120000.000Z.json",
+		"/api/v1/reports/" + id + "/screenshots/..%2F..%2F..%2Fsecret.json",
+		"/api/v1/reports/" + encode("../mobile/20260302T120000.000Z.json") + "/screenshots/final-0ms.jpg",
+	}
+	for _, p := range paths {
+		rec := serve(mux.ServeHTTP, http.MethodGet, p, "")
+		if rec.Code != http.StatusNotFound {
+			t.Errorf("GET %s: status %d %q, want 404", p, rec.Code, rec.Body)
+		}
+		if strings.Contains(rec.Body.String(), secret) {
+			t.Errorf("GET %s served a file outside of the store", p)
+		}
+	}
+	// Unescaped dot segments are cleaned by the mux, which redirects to
+	// another endpoint rather than serving a report.
+	for _, p := range []string{"/api/v1/reports/..", "/api/v1/reports/.", "/api/v1/reports/" + id + "/screenshots/../../../secret.json"} {
+		if rec := serve(mux.ServeHTTP, http.MethodGet, p, ""); rec.Code != http.StatusTemporaryRedirect || strings.Contains(rec.Body.String(), secret) {
+			t.Errorf("GET %s: status %d %q, want a redirect", p, rec.Code, rec.Body)
+		}
+	}
+
+	// The directory store refuses keys outside of it regardless.
+	s := &dirReportStore{dir: reports}
+	for _, key := range []string{"../secret.json", "a/../../secret.json", ".."} {
+		if _, err := s.get(context.Background(), key); err == nil || errors.Is(err, errReportNotFound) {
+			t.Errorf("get(%q) got error %v, want the key refused", key, err)
+		}
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/yahyasahaja/prometheus-exporter-pagespeed-insight/pkg/scheduler"
+	"gopkg.in/yaml.v3"
+)
+
+// ruleFile is a Prometheus rule file.
+type ruleFile struct {
+	Groups []ruleGroup `yaml:"groups"`
+}
+
+type ruleGroup struct {
+	Name  string         `yaml:"name"`
+	Rules []alertingRule `yaml:"rules"`
+}
+
+type alertingRule struct {
+	Alert       string            `yaml:"alert"`
+	Expr        string            `yaml:"expr"`
+	For         string            `yaml:"for,omitempty"`
+	Labels      map[string]string `yaml:"labels,omitempty"`
+	Annotations map[string]string `yaml:"annotations,omitempty"`
+}
+
+// ruleGenerator derives Prometheus alerting rules from the budgets and SLOs
+// of the targets, so the alerts follow the config file.
+type ruleGenerator struct {
+	namespace string
+	// global is the schedule of the targets without their own.
+	global scheduler.Schedule
+	// cycles is the number of intervals between the runs of a target its
+	// metric must stay outside a budget for before the alert fires.
+	cycles int
+}
+
+// rules returns the rule file of targets, with the durations of the budget
+// alerts derived from the schedules after now.
+func (g ruleGenerator) rules(targets []target, now time.Time) ruleFile {
+	budgets := ruleGroup{Name: g.namespace + "-budgets", Rules: []alertingRule{}}
+	for _, t := range targets {
+		sched := t.Schedule
+		if sched == nil {
+			sched = g.global
+		}
+		var forDuration string
+		if interval := typicalInterval(sched, now); interval > 0 {
+			forDuration = shortDuration(interval * time.Duration(g.cycles))
+		}
+		for _, b := range t.Budgets {
+			budgets.Rules = append(budgets.Rules, alertingRule{
+				Alert:  "PageSpeedBudgetExceeded",
+				Expr:   g.budgetExpr(t, b),
+				For:    forDuration,
+				Labels: map[string]string{"metric": b.Metric},
+				Annotations: map[string]string{
+					"summary": fmt.Sprintf("The %s of {{ $labels.site }} ({{ $labels.strategy }}) is {{ $value }}, outside its budget %s", b.Metric, strings.TrimPrefix(b.String(), b.Metric)),
+				},
+			})
+		}
+	}
+
+	slos := ruleGroup{Name: g.namespace + "-slos", Rules: []alertingRule{}}
+	for _, s := range targetSLOs(targets) {
+		name := strconv.Quote(s.Name)
+		slos.Rules = append(slos.Rules, alertingRule{
+			Alert: "PageSpeedErrorBudgetExhausted",
+			Expr:  fmt.Sprintf("%s_slo_error_budget_remaining{slo=%s} <= 0", g.namespace, name),
+			Annotations: map[string]string{
+				"summary": fmt.Sprintf("{{ $labels.site }} ({{ $labels.strategy }}) spent the error budget of the SLO %s", s.Name),
+			},
+		})
+		// The budget runs out before the end of the window when it is spent
+		// too fast both recently and over the longest window.
+		windows := slices.Clone(s.BurnRateWindows)
+		slices.Sort(windows)
+		expr := fmt.Sprintf("%s_slo_burn_rate{slo=%s,window=%q} > 1", g.namespace, name, shortDuration(windows[0]))
+		if len(windows) > 1 {
+			expr += fmt.Sprintf(" and ignoring(window) %s_slo_burn_rate{slo=%s,window=%q} > 1", g.namespace, name, shortDuration(windows[len(windows)-1]))
+		}
+		slos.Rules = append(slos.Rules, alertingRule{
+			Alert: "PageSpeedErrorBudgetBurn",
+			Expr:  expr,
+			Annotations: map[string]string{
+				"summary": fmt.Sprintf("{{ $labels.site }} ({{ $labels.strategy }}) spends the error budget of the SLO %s too fast", s.Name),
+			},
+		})
+	}
+
+	var f ruleFile
+	for _, group := range []ruleGroup{budgets, slos} {
+		if len(group.Rules) > 0 {
+			f.Groups = append(f.Groups, group)
+		}
+	}
+	return f
+}
+
+// budgetExpr returns the expression selecting the value of b's metric of t
+// while it is outside the budget.
+func (g ruleGenerator) budgetExpr(t target, b budget) string {
+	labels := map[string]string{"site": t.site(), "strategy": t.Strategy}
+	for name, value := range t.Labels {
+		if value != "" {
+			labels[name] = value
+		}
+	}
+	// The field data of a page and of its origin are told apart by scope.
+	if strings.HasPrefix(b.Metric, "field_") {
+		labels["scope"] = t.Scope
+	}
+	var matchers []string
+	for _, name := range slices.Sorted(maps.Keys(labels)) {
+		matchers = append(matchers, name+"="+strconv.Quote(labels[name]))
+	}
+	selector := g.namespace + "_" + b.Metric + "{" + strings.Join(matchers, ",") + "}"
+	var conditions []string
+	if b.Min != nil {
+		conditions = append(conditions, selector+" < "+strconv.FormatFloat(*b.Min, 'g', -1, 64))
+	}
+	if b.Max != nil {
+		conditions = append(conditions, selector+" > "+strconv.FormatFloat(*b.Max, 'g', -1, 64))
+	}
+	return strings.Join(conditions, " or ")
+}
+
+// targetSLOs returns the SLOs of targets, each once.
+func targetSLOs(targets []target) []slo {
+	var slos []slo
+	for _, t := range targets {
+		for _, s := range t.SLOs {
+			if !slices.ContainsFunc(slos, func(o slo) bool { return o.Name == s.Name }) {
+				slos = append(slos, s)
+			}
+		}
+	}
+	return slos
+}
+
+// typicalInterval returns the median interval between the runs of sched in
+// the week after now, zero if it has fewer than two runs in it.
+func typicalInterval(sched scheduler.Schedule, now time.Time) time.Duration {
+	var intervals []time.Duration
+	end := now.Add(7 * 24 * time.Hour)
+	prev := nextRun(sched, now)
+	for !prev.IsZero() && prev.Before(end) && len(intervals) < 10000 {
+		next := nextRun(sched, prev)
+		if next.IsZero() {
+			break
+		}
+		intervals = append(intervals, next.Sub(prev))
+		prev = next
+	}
+	if len(intervals) == 0 {
+		return 0
+	}
+	slices.Sort(intervals)
+	return intervals[len(intervals)/2]
+}
+
+// writeRules writes the rule file of targets to w as YAML.
+func (g ruleGenerator) writeRules(w io.Writer, targets []target) error {
+	enc := yaml.NewEncoder(w)
+	enc.SetIndent(2)
+	if err := enc.Encode(g.rules(targets, time.Now())); err != nil {
+		return err
+	}
+	return enc.Close()
+}
+
+// serveRules serves GET /rules with the rule file of the current targets.
+func (e *exporter) serveRules(g ruleGenerator) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/yaml")
+		if err := g.writeRules(w, e.currentTargets()); err != nil {
+			e.logger.Error("Failed to write the alerting rules", "err", err)
+		}
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/yahyasahaja/prometheus-exporter-pagespeed-insight/pkg/scheduler"
+)
+
+// runSchedule plans the scheduled runs of the exporter: those of the global
+// schedule and of the targets with their own schedule. It reads the current
+// targets, so schedules added by a reload take effect.
+type runSchedule struct {
+	e *exporter
+	// global is the schedule of the targets without their own, nil if they
+	// are only fetched through /execute.
+	global scheduler.Schedule
+}
+
+func (s runSchedule) Next(t time.Time) time.Time {
+	next := nextRun(s.global, t)
+	for _, target := range s.e.currentTargets() {
+		if n := nextRun(target.Schedule, t); !n.IsZero() && (next.IsZero() || n.Before(next)) {
+			next = n
+		}
+	}
+	return next
+}
+
+func (s runSchedule) String() string {
+	own := 0
+	for _, t := range s.e.currentTargets() {
+		if t.Schedule != nil {
+			own++
+		}
+	}
+	name := "no scheduled fetches"
+	if s.global != nil {
+		name = s.global.String()
+	}
+	if own == 0 {
+		return name
+	}
+	return fmt.Sprintf("%s, %d targets with their own schedule", name, own)
+}
+
+// due returns the targets whose schedule fires at the run time due.
+func (s runSchedule) due(due time.Time) []target {
+	var targets []target
+	for _, t := range s.e.currentTargets() {
+		sched := t.Schedule
+		if sched == nil {
+			sched = s.global
+		}
+		// Next returns due for the run time right before it.
+		if nextRun(sched, due.Add(-time.Nanosecond)).Equal(due) {
+			targets = append(targets, t)
+		}
+	}
+	return targets
+}
+
+// nextRun returns the first run time of sched after t, or the zero time for
+// a nil schedule.
+func nextRun(sched scheduler.Schedule, t time.Time) time.Time {
+	if sched == nil {
+		return time.Time{}
+	}
+	return sched.Next(t)
+}
+
+// scheduleName returns the description of sched, empty for a nil schedule.
+func scheduleName(sched scheduler.Schedule) string {
+	if sched == nil {
+		return ""
+	}
+	return sched.String()
+}
+
+// The ways fetches of a scheduled run are spread until the next run.
+const (
+	// spreadNone queues every fetch when the run starts.
+	spreadNone = "none"
+	// spreadEven queues the fetches at equal distances.
+	spreadEven = "even"
+	// spreadRandom queues the fetches at random times.
+	spreadRandom = "random"
+)
+
+// spreadOffsets returns when each of n fetches is queued, relative to the
+// start of a run followed by the next one after window. The offsets stay
+// within the first (n-1)/n of the window, so the last fetch has as much time
+// to finish as the others. They are all zero without a spread mode or window.
+func spreadOffsets(mode string, n int, window time.Duration) []time.Duration {
+	offsets := make([]time.Duration, n)
+	if n == 0 || window <= 0 {
+		return offsets
+	}
+	slot := window / time.Duration(n)
+	switch mode {
+	case spreadEven:
+		for i := range offsets {
+			offsets[i] = time.Duration(i) * slot
+		}
+	case spreadRandom:
+		if span := window - slot; span > 0 {
+			for i := range offsets {
+				offsets[i] = rand.N(span)
+			}
+			slices.Sort(offsets)
+		}
+	}
+	return offsets
+}
+
+// maintenanceWindow is a recurring period without scheduled fetches, e.g.
+// during nightly deploys, starting at the times of start.
+type maintenanceWindow struct {
+	start    scheduler.Schedule
+	duration time.Duration
+}
+
+// parseMaintenanceWindow parses a window given as "<cron> for <duration>",
+// e.g. "0 2 * * * for 2h", evaluated in loc.
+func parseMaintenanceWindow(spec string, loc *time.Location) (maintenanceWindow, error) {
+	i := strings.LastIndex(spec, " for ")
+	if i < 0 {
+		return maintenanceWindow{}, fmt.Errorf("%q: expected \"<cron> for <duration>\"", spec)
+	}
+	duration, err := time.ParseDuration(strings.TrimSpace(spec[i+len(" for "):]))
+	if err != nil || duration <= 0 {
+		return maintenanceWindow{}, fmt.Errorf("%q: invalid duration, must be positive like 2h", spec)
+	}
+	start, err := scheduler.NewCron(spec[:i], loc)
+	if err != nil {
+		return maintenanceWindow{}, err
+	}
+	return maintenanceWindow{start: start, duration: duration}, nil
+}
+
+// end returns when the window in progress at t ends, or the zero time if
+// none is.
+func (w maintenanceWindow) end(t time.Time) time.Time {
+	// The latest start before t, if any, is the first one after t-duration.
+	start := w.start.Next(t.Add(-w.duration))
+	if start.After(t) {
+		return time.Time{}
+	}
+	return start.Add(w.duration)
+}
+
+func (w maintenanceWindow) String() string {
+	return fmt.Sprintf("%s for %s", w.start, w.duration)
+}
+
+// inMaintenance returns when the maintenance windows in progress at t end,
+// or the zero time outside of them.
+func (e *exporter) inMaintenance(t time.Time) time.Time {
+	var until time.Time
+	for _, w := range e.maintenance {
+		if end := w.end(t); end.After(until) {
+			until = end
+		}
+	}
+	return until
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// maintenanceWindows parses the maintenance windows specs in loc.
+func maintenanceWindows(t *testing.T, loc *time.Location, specs ...string) []maintenanceWindow {
+	t.Helper()
+	var windows []maintenanceWindow
+	for _, spec := range specs {
+		w, err := parseMaintenanceWindow(spec, loc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		windows = append(windows, w)
+	}
+	return windows
+}
+
+func TestInMaintenance(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Skipf("no time zone data: %v", err)
+	}
+	e := &exporter{maintenance: maintenanceWindows(t, berlin, "0 23 * * * for 2h", "0 2 * * sun for 30m", "0 1 29 3 * for 2h")}
+	utc := func(day, hour, minute int) time.Time {
+		return time.Date(2026, 3, day, hour, minute, 0, 0, time.UTC)
+	}
+	tests := []struct {
+		name    string
+		t, want time.Time
+	}{
+		// Berlin is an hour ahead of UTC until 2026-03-29.
+		{"before the window", utc(2, 21, 59), time.Time{}},
+		{"window starts", utc(2, 22, 0), utc(3, 0, 0)},
+		{"after midnight", utc(2, 23, 30), utc(3, 0, 0)},
+		{"window ends", utc(3, 0, 0), time.Time{}},
+		{"weekly window", utc(8, 1, 10), utc(8, 1, 30)},
+		{"weekly window on another day", utc(9, 1, 10), time.Time{}},
+		// The clocks moving forward don't shorten the window.
+		{"window over the DST switch", utc(29, 1, 30), utc(29, 2, 0)},
+		{"after the DST switch", utc(29, 2, 0), time.Time{}},
+		// The daily window starts at 23:00 of summer time afterwards.
+		{"summer time", utc(29, 21, 0), utc(29, 23, 0)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := e.inMaintenance(tt.t); !got.Equal(tt.want) {
+				t.Errorf("inMaintenance(%s) = %s, want %s", tt.t, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRunTargetsMaintenance(t *testing.T) {
+	var runs atomic.Int32
+	e := newTestExporter(t, func(w http.ResponseWriter, r *http.Request) {
+		runs.Add(1)
+		answerRun(w, r)
+	})
+	targets := []target{
+		{URL: "https://a.example", Strategy: "mobile", Scope: scopePage},
+		{URL: "https://b.example", Strategy: "mobile", Scope: scopePage},
+	}
+	// at returns a time zone in which it is now hour:minute.
+	at := func(hour, minute int) *time.Location {
+		now := time.Now().UTC()
+		offset := time.Duration(hour)*time.Hour + time.Duration(minute)*time.Minute - (time.Duration(now.Hour())*time.Hour + time.Duration(now.Minute())*time.Minute)
+		return time.FixedZone("test", int(offset.Seconds()))
+	}
+	noon := at(12, 0)
+	tomorrow := time.Now().In(noon).AddDate(0, 0, 1).Weekday().String()[:3]
+	tests := []struct {
+		name    string
+		loc     *time.Location
+		windows []string
+		runs    int32
+	}{
+		{"no window", noon, nil, 2},
+		{"inside the window", noon, []string{"0 11 * * * for 2h"}, 0},
+		{"after the window", noon, []string{"0 10 * * * for 1h"}, 2},
+		{"before the window", noon, []string{"30 13 * * * for 1h"}, 2},
+		{"window crossing midnight, before midnight", at(23, 30), []string{"0 23 * * * for 2h"}, 0},
+		{"window crossing midnight, after midnight", at(0, 30), []string{"0 23 * * * for 2h"}, 0},
+		{"after a window crossing midnight", at(1, 30), []string{"0 23 * * * for 2h"}, 2},
+		{"window of another weekday", noon, []string{"0 11 * * " + tomorrow + " for 2h"}, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			runs.Store(0)
+			e.maintenance = maintenanceWindows(t, tt.loc, tt.windows...)
+			if failed := e.runTargets(targets, 0); failed != 0 {
+				t.Errorf("%d fetches failed", failed)
+			}
+			if n := runs.Load(); n != tt.runs {
+				t.Errorf("ran PSI %d times, want %d", n, tt.runs)
+			}
+		})
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/yahyasahaja/prometheus-exporter-pagespeed-insight/pkg/psi"
+)
+
+// screenshotName matches the file names of the archived screenshots: the
+// final screenshot and the filmstrip frames, with when they were taken.
+var screenshotName = regexp.MustCompile(`^(final|frame)-(\d+)ms\.(jpg|png|webp)$`)
+
+// screenshotExtensions maps the image types of data URLs to extensions.
+var screenshotExtensions = map[string]string{
+	"image/jpeg": "jpg",
+	"image/png":  "png",
+	"image/webp": "webp",
+}
+
+// screenshot is an image of a run archived with its report.
+type screenshot struct {
+	Name string `json:"name"`
+	// Final is true for the final screenshot, false for a filmstrip frame.
+	Final bool `json:"final"`
+	// TimingMs is when the image was taken after the navigation started.
+	TimingMs int    `json:"timing_ms"`
+	URL      string `json:"url"`
+}
+
+// decodeDataURL returns the image of a base64 data URL and its extension,
+// and false unless it is one of screenshotExtensions.
+func decodeDataURL(dataURL string) ([]byte, string, bool) {
+	meta, data, ok := strings.Cut(strings.TrimPrefix(dataURL, "data:"), ",")
+	mediaType, encoding, _ := strings.Cut(meta, ";")
+	ext := screenshotExtensions[mediaType]
+	if !ok || ext == "" || encoding != "base64" {
+		return nil, "", false
+	}
+	image, err := base64.StdEncoding.DecodeString(data)
+	if err != nil {
+		return nil, "", false
+	}
+	return image, ext, true
+}
+
+// screenshots returns the final screenshot and the filmstrip frames of res by
+// file name. Images that aren't base64 data URLs are skipped.
+func screenshots(res *psi.Result) map[string][]byte {
+	images := map[string][]byte{}
+	add := func(kind string, timing float64, dataURL string) {
+		if image, ext, ok := decodeDataURL(dataURL); ok {
+			images[fmt.Sprintf("%s-%dms.%s", kind, int(timing), ext)] = image
+		}
+	}
+	if final := res.Audits["final-screenshot"].Details; final.Data != "" {
+		add("final", final.Timing, final.Data)
+	}
+	type frame struct {
+		Timing float64 `json:"timing"`
+		Data   string  `json:"data"`
+	}
+	for _, f := range psi.Items[frame](res.Audits["screenshot-thumbnails"]) {
+		add("frame", f.Timing, f.Data)
+	}
+	return images
+}
+
+// screenshotPrefix returns the prefix of the keys of the screenshots of the
+// report with key.
+func screenshotPrefix(key string) string {
+	return strings.TrimSuffix(key, ".json") + "/"
+}
+
+// archiveScreenshots stores the screenshots of res next to the report with
+// key.
+func (a *reportArchive) archiveScreenshots(ctx context.Context, key string, res *psi.Result) error {
+	for name, image := range screenshots(res) {
+		if err := a.store.put(ctx, screenshotPrefix(key)+name, image); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// screenshotKeyReport returns the key of the report a screenshot key belongs
+// to, and false if key isn't the key of a screenshot.
+func screenshotKeyReport(key string) (string, bool) {
+	i := strings.LastIndex(key, "/")
+	if i < 0 || !screenshotName.MatchString(key[i+1:]) {
+		return "", false
+	}
+	reportKey := key[:i] + ".json"
+	if _, ok := parseReportKey(reportKey); !ok {
+		return "", false
+	}
+	return reportKey, true
+}
+
+// serveScreenshots serves GET /api/v1/reports/{id}/screenshots with the
+// screenshots of the report, the filmstrip frames in order and then the
+// final screenshot.
+func (a *reportArchive) serveScreenshots(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	key, ok := reportIDKey(id)
+	if !ok {
+		http.Error(w, "Report not found", http.StatusNotFound)
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), reportTimeout)
+	defer cancel()
+	keys, err := a.store.list(ctx, screenshotPrefix(key))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to list the screenshots: %v", err), http.StatusBadGateway)
+		return
+	}
+	shots := []screenshot{}
+	for _, k := range keys {
+		m := screenshotName.FindStringSubmatch(strings.TrimPrefix(k, screenshotPrefix(key)))
+		if m == nil {
+			continue
+		}
+		timing, _ := strconv.Atoi(m[2])
+		shots = append(shots, screenshot{
+			Name:     m[0],
+			Final:    m[1] == "final",
+			TimingMs: timing,
+			URL:      "/api/v1/reports/" + id + "/screenshots/" + m[0],
+		})
+	}
+	slices.SortFunc(shots, func(a, b screenshot) int {
+		if a.Final != b.Final {
+			if a.Final {
+				return 1
+			}
+			return -1
+		}
+		return a.TimingMs - b.TimingMs
+	})
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(shots)
+}
+
+// serveScreenshot serves GET /api/v1/reports/{id}/screenshots/{name} with
+// the image.
+func (a *reportArchive) serveScreenshot(w http.ResponseWriter, r *http.Request) {
+	key, ok := reportIDKey(r.PathValue("id"))
+	m := screenshotName.FindStringSubmatch(r.PathValue("name"))
+	if !ok || m == nil {
+		http.Error(w, "Screenshot not found", http.StatusNotFound)
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), reportTimeout)
+	defer cancel()
+	image, err := a.store.get(ctx, screenshotPrefix(key)+m[0])
+	if errors.Is(err, errReportNotFound) {
+		http.Error(w, "Screenshot not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to read the screenshot: %v", err), http.StatusBadGateway)
+		return
+	}
+	w.Header().Set("Content-Type", mime.TypeByExtension("."+m[3]))
+	w.Write(image)
+}
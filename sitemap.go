@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// defaultSitemapMaxPages caps the pages taken from a sitemap that doesn't
+// set max_pages.
+const defaultSitemapMaxPages = 100
+
+// sitemapMaxDepth bounds the nesting of sitemap indexes.
+const sitemapMaxDepth = 3
+
+// sitemapMaxSize is the largest sitemap read, the limit of the sitemap
+// protocol for uncompressed files.
+const sitemapMaxSize = 50 << 20
+
+// sitemapClient fetches the sitemaps of config file targets.
+var sitemapClient = &http.Client{Timeout: 30 * time.Second}
+
+// fileSitemap declares a config file target as the pages of a sitemap.
+type fileSitemap struct {
+	URL string `yaml:"url"`
+	// Include and Exclude are regular expressions matched against the page
+	// URLs. A page is kept if it matches any Include, or Include is empty,
+	// and no Exclude.
+	Include  []string `yaml:"include"`
+	Exclude  []string `yaml:"exclude"`
+	MaxPages int      `yaml:"max_pages"`
+}
+
+// sitemapDoc is either a urlset listing pages or a sitemapindex listing
+// further sitemaps.
+type sitemapDoc struct {
+	XMLName  xml.Name
+	URLs     []sitemapLoc `xml:"url"`
+	Sitemaps []sitemapLoc `xml:"sitemap"`
+}
+
+type sitemapLoc struct {
+	Loc string `xml:"loc"`
+}
+
+// pages fetches the sitemap, following sitemap indexes, and returns the page
+// URLs passing the filters, up to MaxPages.
+func (s *fileSitemap) pages() ([]string, error) {
+	include, err := compileRegexps(s.Include)
+	if err != nil {
+		return nil, fmt.Errorf("sitemap include: %v", err)
+	}
+	exclude, err := compileRegexps(s.Exclude)
+	if err != nil {
+		return nil, fmt.Errorf("sitemap exclude: %v", err)
+	}
+	maxPages := s.MaxPages
+	if maxPages == 0 {
+		maxPages = defaultSitemapMaxPages
+	}
+	if maxPages < 0 {
+		return nil, fmt.Errorf("sitemap max_pages must be positive")
+	}
+
+	c := &sitemapCrawl{include: include, exclude: exclude, maxPages: maxPages, seen: map[string]bool{}}
+	if err := c.crawl(s.URL, 0); err != nil {
+		return nil, err
+	}
+	return c.pages, nil
+}
+
+type sitemapCrawl struct {
+	include, exclude []*regexp.Regexp
+	maxPages         int
+	seen             map[string]bool
+	pages            []string
+}
+
+func (c *sitemapCrawl) crawl(url string, depth int) error {
+	if c.seen[url] || len(c.pages) >= c.maxPages {
+		return nil
+	}
+	c.seen[url] = true
+	doc, err := fetchSitemap(url)
+	if err != nil {
+		return err
+	}
+
+	switch doc.XMLName.Local {
+	case "sitemapindex":
+		if depth >= sitemapMaxDepth {
+			return fmt.Errorf("sitemap %s: sitemap indexes nested more than %d levels", url, sitemapMaxDepth)
+		}
+		for _, sm := range doc.Sitemaps {
+			if err := c.crawl(strings.TrimSpace(sm.Loc), depth+1); err != nil {
+				return err
+			}
+		}
+	case "urlset":
+		for _, u := range doc.URLs {
+			page := strings.TrimSpace(u.Loc)
+			if !c.keep(page) {
+				continue
+			}
+			if len(c.pages) >= c.maxPages {
+				break
+			}
+			c.pages = append(c.pages, page)
+		}
+	default:
+		return fmt.Errorf("sitemap %s: unexpected root element <%s>", url, doc.XMLName.Local)
+	}
+	return nil
+}
+
+func (c *sitemapCrawl) keep(page string) bool {
+	if page == "" || c.seen[page] {
+		return false
+	}
+	c.seen[page] = true
+	for _, re := range c.exclude {
+		if re.MatchString(page) {
+			return false
+		}
+	}
+	if len(c.include) == 0 {
+		return true
+	}
+	for _, re := range c.include {
+		if re.MatchString(page) {
+			return true
+		}
+	}
+	return false
+}
+
+// fetchSitemap fetches and decodes the sitemap at url, which may be
+// gzip-compressed.
+func fetchSitemap(url string) (*sitemapDoc, error) {
+	resp, err := sitemapClient.Get(url)
+	if err != nil {
+		return nil, fmt.Errorf("fetching sitemap: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching sitemap %s: unexpected status %s", url, resp.Status)
+	}
+
+	var body io.Reader = bufio.NewReader(io.LimitReader(resp.Body, sitemapMaxSize))
+	// Sitemaps are often served as .xml.gz files, which the transport
+	// doesn't decompress as they aren't sent with Content-Encoding: gzip.
+	if magic, _ := body.(*bufio.Reader).Peek(2); len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(body)
+		if err != nil {
+			return nil, fmt.Errorf("decompressing sitemap %s: %v", url, err)
+		}
+		defer gz.Close()
+		body = io.LimitReader(gz, sitemapMaxSize)
+	}
+
+	var doc sitemapDoc
+	if err := xml.NewDecoder(body).Decode(&doc); err != nil {
+		return nil, fmt.Errorf("parsing sitemap %s: %v", url, err)
+	}
+	return &doc, nil
+}
+
+func compileRegexps(exprs []string) ([]*regexp.Regexp, error) {
+	res := make([]*regexp.Regexp, 0, len(exprs))
+	for _, expr := range exprs {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, re)
+	}
+	return res, nil
+}
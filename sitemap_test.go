@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// urlset returns a sitemap listing pages.
+func urlset(pages ...string) string {
+	var b strings.Builder
+	b.WriteString(`<?xml version="1.0" encoding="UTF-8"?><urlset xmlns="http://www.sitemaps.org/schemas/sitemap/0.9">`)
+	for _, p := range pages {
+		fmt.Fprintf(&b, "<url><loc> %s </loc></url>", p)
+	}
+	b.WriteString("</urlset>")
+	return b.String()
+}
+
+// sitemapIndex returns a sitemap index listing sitemaps.
+func sitemapIndex(sitemaps ...string) string {
+	var b strings.Builder
+	b.WriteString(`<sitemapindex xmlns="http://www.sitemaps.org/schemas/sitemap/0.9">`)
+	for _, s := range sitemaps {
+		fmt.Fprintf(&b, "<sitemap><loc>%s</loc></sitemap>", s)
+	}
+	b.WriteString("</sitemapindex>")
+	return b.String()
+}
+
+func TestSitemapPages(t *testing.T) {
+	var gz bytes.Buffer
+	w := gzip.NewWriter(&gz)
+	w.Write([]byte(urlset("https://example.com/blog/a", "https://example.com/blog/b")))
+	w.Close()
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		docs := map[string]string{
+			"/sitemap.xml": sitemapIndex(server.URL+"/pages.xml", server.URL+"/blog.xml.gz", server.URL+"/pages.xml"),
+			"/pages.xml":   urlset("https://example.com/", "https://example.com/shop", "https://example.com/", "https://example.com/admin/login"),
+			"/blog.xml.gz": gz.String(),
+			"/loop.xml":    sitemapIndex(server.URL + "/nested.xml"),
+			"/nested.xml":  sitemapIndex(server.URL + "/deeper.xml"),
+			"/deeper.xml":  sitemapIndex(server.URL + "/deepest.xml"),
+			"/deepest.xml": sitemapIndex(server.URL + "/pages.xml"),
+			"/partial.xml": sitemapIndex(server.URL+"/pages.xml", server.URL+"/missing.xml"),
+			"/feed.xml":    `<rss><channel></channel></rss>`,
+			"/broken.xml":  `<urlset><url><loc>https://example.com/`,
+		}
+		doc, ok := docs[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(doc))
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		name    string
+		sitemap fileSitemap
+		want    []string
+		// err is a part of the expected error.
+		err string
+	}{
+		{
+			name:    "urlset",
+			sitemap: fileSitemap{URL: server.URL + "/pages.xml"},
+			want:    []string{"https://example.com/", "https://example.com/shop", "https://example.com/admin/login"},
+		},
+		{
+			name:    "index with a gzipped sitemap",
+			sitemap: fileSitemap{URL: server.URL + "/sitemap.xml"},
+			want:    []string{"https://example.com/", "https://example.com/shop", "https://example.com/admin/login", "https://example.com/blog/a", "https://example.com/blog/b"},
+		},
+		{
+			name:    "include and exclude",
+			sitemap: fileSitemap{URL: server.URL + "/sitemap.xml", Include: []string{"/blog/", "/shop$"}, Exclude: []string{"/b$"}},
+			want:    []string{"https://example.com/shop", "https://example.com/blog/a"},
+		},
+		{
+			name:    "exclude only",
+			sitemap: fileSitemap{URL: server.URL + "/sitemap.xml", Exclude: []string{"/admin/", "/blog/"}},
+			want:    []string{"https://example.com/", "https://example.com/shop"},
+		},
+		{
+			name:    "max pages",
+			sitemap: fileSitemap{URL: server.URL + "/sitemap.xml", MaxPages: 4},
+			want:    []string{"https://example.com/", "https://example.com/shop", "https://example.com/admin/login", "https://example.com/blog/a"},
+		},
+		{
+			name:    "nested too deep",
+			sitemap: fileSitemap{URL: server.URL + "/loop.xml"},
+			err:     "sitemap indexes nested more than 3 levels",
+		},
+		{
+			name:    "not a sitemap",
+			sitemap: fileSitemap{URL: server.URL + "/feed.xml"},
+			err:     "unexpected root element <rss>",
+		},
+		{
+			name:    "malformed",
+			sitemap: fileSitemap{URL: server.URL + "/broken.xml"},
+			err:     "parsing sitemap",
+		},
+		{
+			name:    "missing",
+			sitemap: fileSitemap{URL: server.URL + "/missing.xml"},
+			err:     "unexpected status 404 Not Found",
+		},
+		{
+			name:    "missing nested sitemap",
+			sitemap: fileSitemap{URL: server.URL + "/partial.xml"},
+			err:     "/missing.xml: unexpected status 404 Not Found",
+		},
+		{
+			name:    "invalid include",
+			sitemap: fileSitemap{URL: server.URL + "/pages.xml", Include: []string{"("}},
+			err:     "sitemap include: error parsing regexp",
+		},
+		{
+			name:    "negative max pages",
+			sitemap: fileSitemap{URL: server.URL + "/pages.xml", MaxPages: -1},
+			err:     "sitemap max_pages must be positive",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.sitemap.pages()
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Errorf("got pages %q, error %v, want error %q", got, err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("got pages %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/yahyasahaja/prometheus-exporter-pagespeed-insight/pkg/collector"
+)
+
+// Defaults of the optional fields of an SLO.
+const defaultSLOWindow = 30 * 24 * time.Hour
+
+var defaultBurnRateWindows = []time.Duration{time.Hour, 6 * time.Hour, 24 * time.Hour}
+
+// slo is a service level objective over the runs of every target: the ratio
+// of runs in the last Window whose metric is within Threshold should be at
+// least Objective.
+type slo struct {
+	Name      string
+	Threshold budget
+	Objective float64
+	Window    time.Duration
+	// BurnRateWindows are the windows over which the burn rate is reported.
+	BurnRateWindows []time.Duration
+}
+
+func (s slo) String() string {
+	return fmt.Sprintf("%s(%s %g%% over %s)", s.Name, s.Threshold, s.Objective*100, shortDuration(s.Window))
+}
+
+// fileSLO is an SLO in the config file.
+type fileSLO struct {
+	Name            string          `yaml:"name"`
+	Metric          string          `yaml:"metric"`
+	Min             *float64        `yaml:"min"`
+	Max             *float64        `yaml:"max"`
+	Objective       float64         `yaml:"objective"`
+	Window          time.Duration   `yaml:"window"`
+	BurnRateWindows []time.Duration `yaml:"burn_rate_windows"`
+}
+
+// slos validates the SLOs of the config file.
+func (c *fileConfig) slos() ([]slo, []error) {
+	var slos []slo
+	var errs []error
+	for i, f := range c.SLOs {
+		if f.Name == "" {
+			errs = append(errs, fmt.Errorf("slos[%d]: name is required", i))
+			continue
+		}
+		if slices.ContainsFunc(slos, func(s slo) bool { return s.Name == f.Name }) {
+			errs = append(errs, fmt.Errorf("slos[%d]: duplicate name %q", i, f.Name))
+			continue
+		}
+		threshold, err := parseBudgets(map[string]fileBudget{f.Metric: {Min: f.Min, Max: f.Max}})
+		if err != nil {
+			errs = append(errs, fmt.Errorf("slos[%d]: %v", i, err))
+			continue
+		}
+		if f.Objective <= 0 || f.Objective >= 1 {
+			errs = append(errs, fmt.Errorf("slos[%d]: objective %g must be between 0 and 1, e.g. 0.95", i, f.Objective))
+			continue
+		}
+		s := slo{Name: f.Name, Threshold: threshold[0], Objective: f.Objective, Window: f.Window, BurnRateWindows: f.BurnRateWindows}
+		if s.Window == 0 {
+			s.Window = defaultSLOWindow
+		}
+		if s.BurnRateWindows == nil {
+			s.BurnRateWindows = defaultBurnRateWindows
+		}
+		if s.Window < 0 || slices.ContainsFunc(s.BurnRateWindows, func(d time.Duration) bool { return d <= 0 || d > s.Window }) {
+			errs = append(errs, fmt.Errorf("slos[%d]: window and burn_rate_windows must be positive, and burn_rate_windows at most the window", i))
+			continue
+		}
+		slos = append(slos, s)
+	}
+	return slos, errs
+}
+
+// errSLOsWithoutHistory is returned for SLOs without --history.file.
+var errSLOsWithoutHistory = errors.New("slos require --history.file")
+
+// sloCollector exports the SLOs of the targets, computed at scrape time from
+// the history.
+type sloCollector struct {
+	e                                      *exporter
+	objective, runs, good, remaining, burn *prometheus.Desc
+}
+
+func newSLOCollector(e *exporter, namespace string) *sloCollector {
+	desc := func(name, help string, extra ...string) *prometheus.Desc {
+		labels := append([]string{"slo", "site", "strategy"}, e.metrics.results.TargetLabelNames()...)
+		return prometheus.NewDesc(prometheus.BuildFQName(namespace, "slo", name), help, append(labels, extra...), nil)
+	}
+	return &sloCollector{
+		e:         e,
+		objective: desc("objective", "Target ratio of runs within the SLO's threshold"),
+		runs:      desc("runs", "Number of runs of the target in the SLO's window with a value of its metric"),
+		good:      desc("good_ratio", "Ratio of the runs in the SLO's window within its threshold"),
+		remaining: desc("error_budget_remaining", "Ratio of the SLO's error budget left in its window, negative once overspent"),
+		burn:      desc("burn_rate", "Rate at which the runs in the window spend the SLO's error budget, 1 spending it exactly over the SLO's window", "window"),
+	}
+}
+
+// Describe implements prometheus.Collector.
+func (c *sloCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, d := range []*prometheus.Desc{c.objective, c.runs, c.good, c.remaining, c.burn} {
+		ch <- d
+	}
+}
+
+// Collect implements prometheus.Collector.
+func (c *sloCollector) Collect(ch chan<- prometheus.Metric) {
+	now := time.Now()
+	for _, t := range c.e.currentTargets() {
+		for _, s := range t.SLOs {
+			points := c.e.history.targetPoints(t, now.Add(-s.Window), now)
+			total, bad := sloCount(s, points, time.Time{})
+			if total == 0 {
+				continue
+			}
+			budget := 1 - s.Objective
+			labels := append([]string{s.Name}, c.e.metrics.targetValues(t)...)
+			ch <- prometheus.MustNewConstMetric(c.objective, prometheus.GaugeValue, s.Objective, labels...)
+			ch <- prometheus.MustNewConstMetric(c.runs, prometheus.GaugeValue, float64(total), labels...)
+			ch <- prometheus.MustNewConstMetric(c.good, prometheus.GaugeValue, 1-float64(bad)/float64(total), labels...)
+			ch <- prometheus.MustNewConstMetric(c.remaining, prometheus.GaugeValue, 1-float64(bad)/float64(total)/budget, labels...)
+			for _, w := range s.BurnRateWindows {
+				total, bad := sloCount(s, points, now.Add(-w))
+				if total == 0 {
+					continue
+				}
+				ch <- prometheus.MustNewConstMetric(c.burn, prometheus.GaugeValue, float64(bad)/float64(total)/budget, append(labels, shortDuration(w))...)
+			}
+		}
+	}
+}
+
+// shortDuration formats d like time.Duration.String without its zero
+// minutes and seconds, e.g. 6h rather than 6h0m0s.
+func shortDuration(d time.Duration) string {
+	s := d.String()
+	if strings.HasSuffix(s, "m0s") {
+		s = s[:len(s)-2]
+	}
+	if strings.HasSuffix(s, "h0m") {
+		s = s[:len(s)-2]
+	}
+	return s
+}
+
+// sloCount returns how many of points since from have a value of the SLO's
+// metric, and how many of those are outside its threshold.
+func sloCount(s slo, points []historyPoint, from time.Time) (total, bad int) {
+	value := budgetMetrics[s.Threshold.Metric]
+	for _, p := range points {
+		// SLOs count fetches, not the backfilled CrUX periods.
+		if p.Time.Before(from) || p.Source != "" {
+			continue
+		}
+		v, ok := value(&collector.Result{PerformanceScore: p.PerformanceScore, CategoryScores: p.CategoryScores, Metrics: p.Metrics, FieldData: p.FieldData})
+		if !ok {
+			continue
+		}
+		total++
+		if s.Threshold.margin(v) < 0 {
+			bad++
+		}
+	}
+	return total, bad
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/yahyasahaja/prometheus-exporter-pagespeed-insight/pkg/collector"
+)
+
+func TestFileConfigSLOs(t *testing.T) {
+	tests := []struct {
+		name string
+		slos []fileSLO
+		want []string
+		// errs are parts of the expected errors, in order.
+		errs []string
+	}{
+		{
+			name: "defaults",
+			slos: []fileSLO{{Name: "fast", Metric: "performance_score", Min: ptr(0.9), Objective: 0.95}},
+			want: []string{"fast(performance_score>=0.9 95% over 720h)"},
+		},
+		{
+			name: "windows",
+			slos: []fileSLO{{Name: "lcp", Metric: "largest_contentful_paint", Max: ptr(2500), Objective: 0.99, Window: 7 * 24 * time.Hour, BurnRateWindows: []time.Duration{time.Hour, 7 * 24 * time.Hour}}},
+			want: []string{"lcp(largest_contentful_paint<=2500 99% over 168h)"},
+		},
+		{
+			name: "invalid",
+			slos: []fileSLO{
+				{Metric: "performance_score", Min: ptr(0.9), Objective: 0.95},
+				{Name: "fast", Metric: "performance_score", Min: ptr(0.9), Objective: 0.95},
+				{Name: "fast", Metric: "speed_index", Max: ptr(3000), Objective: 0.95},
+				{Name: "unknown", Metric: "psi_speed_index", Max: ptr(3000), Objective: 0.95},
+				{Name: "unbounded", Metric: "speed_index", Objective: 0.95},
+				{Name: "always", Metric: "speed_index", Max: ptr(3000), Objective: 1},
+				{Name: "never", Metric: "speed_index", Max: ptr(3000)},
+				{Name: "negative", Metric: "speed_index", Max: ptr(3000), Objective: 0.95, Window: -time.Hour},
+				{Name: "long burn", Metric: "speed_index", Max: ptr(3000), Objective: 0.95, Window: time.Hour, BurnRateWindows: []time.Duration{2 * time.Hour}},
+				{Name: "zero burn", Metric: "speed_index", Max: ptr(3000), Objective: 0.95, BurnRateWindows: []time.Duration{0}},
+			},
+			want: []string{"fast(performance_score>=0.9 95% over 720h)"},
+			errs: []string{
+				"slos[0]: name is required",
+				`slos[2]: duplicate name "fast"`,
+				`slos[3]: invalid budget metric "psi_speed_index"`,
+				"slos[4]: budget of speed_index needs a min or a max",
+				"slos[5]: objective 1 must be between 0 and 1",
+				"slos[6]: objective 0 must be between 0 and 1",
+				"slos[7]: window and burn_rate_windows must be positive",
+				"slos[8]: window and burn_rate_windows must be positive",
+				"slos[9]: window and burn_rate_windows must be positive",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			slos, errs := (&fileConfig{SLOs: tt.slos}).slos()
+			var got []string
+			for _, s := range slos {
+				got = append(got, s.String())
+			}
+			if strings.Join(got, "\n") != strings.Join(tt.want, "\n") {
+				t.Errorf("got SLOs %q, want %q", got, tt.want)
+			}
+			if len(errs) != len(tt.errs) {
+				t.Fatalf("got errors %v, want %q", errs, tt.errs)
+			}
+			for i, err := range errs {
+				if !strings.Contains(err.Error(), tt.errs[i]) {
+					t.Errorf("got error %v, want %q", err, tt.errs[i])
+				}
+			}
+		})
+	}
+}
+
+func TestSLOCollector(t *testing.T) {
+	fast := slo{
+		Name:            "fast",
+		Threshold:       budget{Metric: "performance_score", Min: ptr(0.9)},
+		Objective:       0.75,
+		Window:          24 * time.Hour,
+		BurnRateWindows: []time.Duration{time.Hour, 6 * time.Hour, 24 * time.Hour},
+	}
+	now := time.Now()
+	point := func(ago time.Duration, score float64) historyPoint {
+		return historyPoint{Time: now.Add(-ago), URL: "https://example.com", Strategy: "mobile", PerformanceScore: ptr(score)}
+	}
+	crux := point(5*time.Minute, 0)
+	crux.Source = sourceCrUXHistory
+	light := point(5*time.Minute, 0)
+	light.Profile = "light"
+	desktop := point(5*time.Minute, 0)
+	desktop.Strategy = "desktop"
+	h := &historyStore{points: []historyPoint{
+		// Too old for the window.
+		point(25*time.Hour, 0),
+		point(20*time.Hour, 0.95),
+		point(3*time.Hour, 0.9),
+		// Without a score, the point doesn't count.
+		{Time: now.Add(-2 * time.Hour), URL: "https://example.com", Strategy: "mobile"},
+		point(30*time.Minute, 0.5),
+		point(10*time.Minute, 1),
+		// The CrUX periods and the points of other targets don't count.
+		crux, light, desktop,
+	}}
+	e := &exporter{
+		metrics: newMetrics(collector.Opts{Namespace: "psi", TargetLabels: []string{"team"}}, ""),
+		history: h,
+		targets: []target{
+			{URL: "https://example.com", Strategy: "mobile", Labels: map[string]string{"team": "web"}, SLOs: []slo{fast}},
+			// Without runs in the window, a target has no SLO series.
+			{URL: "https://other.example", Strategy: "mobile", SLOs: []slo{fast}},
+		},
+	}
+
+	// 1 of the 4 runs is bad, which spends the whole budget of 25%.
+	want := `
+# HELP psi_slo_burn_rate Rate at which the runs in the window spend the SLO's error budget, 1 spending it exactly over the SLO's window
+# TYPE psi_slo_burn_rate gauge
+psi_slo_burn_rate{site="https://example.com",slo="fast",strategy="mobile",team="web",window="1h"} 2
+psi_slo_burn_rate{site="https://example.com",slo="fast",strategy="mobile",team="web",window="24h"} 1
+psi_slo_burn_rate{site="https://example.com",slo="fast",strategy="mobile",team="web",window="6h"} 1.3333333333333333
+# HELP psi_slo_error_budget_remaining Ratio of the SLO's error budget left in its window, negative once overspent
+# TYPE psi_slo_error_budget_remaining gauge
+psi_slo_error_budget_remaining{site="https://example.com",slo="fast",strategy="mobile",team="web"} 0
+# HELP psi_slo_good_ratio Ratio of the runs in the SLO's window within its threshold
+# TYPE psi_slo_good_ratio gauge
+psi_slo_good_ratio{site="https://example.com",slo="fast",strategy="mobile",team="web"} 0.75
+# HELP psi_slo_objective Target ratio of runs within the SLO's threshold
+# TYPE psi_slo_objective gauge
+psi_slo_objective{site="https://example.com",slo="fast",strategy="mobile",team="web"} 0.75
+# HELP psi_slo_runs Number of runs of the target in the SLO's window with a value of its metric
+# TYPE psi_slo_runs gauge
+psi_slo_runs{site="https://example.com",slo="fast",strategy="mobile",team="web"} 4
+`
+	if err := testutil.CollectAndCompare(newSLOCollector(e, "psi"), strings.NewReader(want)); err != nil {
+		t.Error(err)
+	}
+
+	// Half of the runs being bad overspends the budget twice.
+	h.points = append(h.points, point(2*time.Minute, 0.25), point(time.Minute, 0.5))
+	want = `
+# HELP psi_slo_error_budget_remaining Ratio of the SLO's error budget left in its window, negative once overspent
+# TYPE psi_slo_error_budget_remaining gauge
+psi_slo_error_budget_remaining{site="https://example.com",slo="fast",strategy="mobile",team="web"} -1
+`
+	if err := testutil.CollectAndCompare(newSLOCollector(e, "psi"), strings.NewReader(want), "psi_slo_error_budget_remaining"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestShortDuration(t *testing.T) {
+	for d, want := range map[time.Duration]string{
+		30 * time.Second:                   "30s",
+		time.Minute:                        "1m",
+		90 * time.Minute:                   "1h30m",
+		time.Hour:                          "1h",
+		720 * time.Hour:                    "720h",
+		time.Hour + time.Second:            "1h0m1s",
+		time.Minute + 500*time.Millisecond: "1m0.5s",
+	} {
+		if got := shortDuration(d); got != want {
+			t.Errorf("shortDuration(%s) = %q, want %q", d, got, want)
+		}
+	}
+}
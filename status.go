@@ -0,0 +1,236 @@
+package main
+
+import (
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/yahyasahaja/prometheus-exporter-pagespeed-insight/pkg/collector"
+	"github.com/yahyasahaja/prometheus-exporter-pagespeed-insight/pkg/scheduler"
+)
+
+// targetState is the fetch state of a single target shown by /targets.
+type targetState struct {
+	URL      string `json:"url"`
+	Strategy string `json:"strategy"`
+	Scope    string `json:"scope"`
+	// Backend is empty for PSI.
+	Backend string `json:"backend,omitempty"`
+	// Profile is the scan profile of the target, if any.
+	Profile             string     `json:"profile,omitempty"`
+	LastAttempt         *time.Time `json:"last_attempt,omitempty"`
+	LastSuccess         *time.Time `json:"last_success,omitempty"`
+	LastFailure         *time.Time `json:"last_failure,omitempty"`
+	LastError           string     `json:"last_error,omitempty"`
+	ConsecutiveFailures int        `json:"consecutive_failures"`
+	// QuarantinedUntil is set while scheduled runs skip the target after
+	// too many consecutive failures.
+	QuarantinedUntil *time.Time `json:"quarantined_until,omitempty"`
+	PerformanceScore *float64   `json:"performance_score,omitempty"`
+	// CategoryScores, Metrics and AuditScores are those of the last
+	// successful fetch.
+	CategoryScores map[string]float64 `json:"category_scores,omitempty"`
+	Metrics        map[string]float64 `json:"metrics,omitempty"`
+	AuditScores    map[string]float64 `json:"audit_scores,omitempty"`
+	NextRun        *time.Time         `json:"next_run,omitempty"`
+	// Timeout, MaxRetries and InitialBackoff are the effective fetch options.
+	Timeout        string `json:"timeout"`
+	MaxRetries     int    `json:"max_retries"`
+	InitialBackoff string `json:"initial_backoff"`
+	// Categories are the target's own categories, empty for those of
+	// --categories.
+	Categories []string `json:"categories,omitempty"`
+	// Schedule is the target's own schedule, empty for the global one.
+	Schedule string `json:"schedule,omitempty"`
+	Priority int    `json:"priority,omitempty"`
+	schedule scheduler.Schedule
+}
+
+func newTargetState(t target) *targetState {
+	return &targetState{
+		URL:            t.URL,
+		Strategy:       t.Strategy,
+		Scope:          t.Scope,
+		Backend:        t.Backend,
+		Profile:        t.Profile,
+		Timeout:        t.Options.Timeout.String(),
+		MaxRetries:     t.Options.MaxRetries,
+		InitialBackoff: t.Options.InitialBackoff.String(),
+		Categories:     t.Categories,
+		Schedule:       scheduleName(t.Schedule),
+		Priority:       t.Priority,
+		schedule:       t.Schedule,
+	}
+}
+
+// targetStatus tracks the fetch state of every target. Scheduled targets are
+// registered up front so they are listed before their first fetch; targets
+// fetched only through /execute are added when first attempted.
+type targetStatus struct {
+	mu        sync.Mutex
+	states    map[string]*targetState
+	scheduled map[string]bool
+	// schedule is the global schedule, nil without one.
+	schedule scheduler.Schedule
+}
+
+func newTargetStatus(targets []target, sched scheduler.Schedule) *targetStatus {
+	s := &targetStatus{states: map[string]*targetState{}, scheduled: map[string]bool{}, schedule: sched}
+	for _, t := range targets {
+		s.states[t.key()] = newTargetState(t)
+		s.scheduled[t.key()] = true
+	}
+	return s
+}
+
+// setTargets replaces the scheduled targets after a reload. States of
+// targets that are no longer scheduled are dropped, and new targets are
+// listed right away.
+func (s *targetStatus) setTargets(targets []target) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	scheduled := map[string]bool{}
+	for _, t := range targets {
+		scheduled[t.key()] = true
+		st := s.state(t)
+		st.Timeout = t.Options.Timeout.String()
+		st.MaxRetries = t.Options.MaxRetries
+		st.InitialBackoff = t.Options.InitialBackoff.String()
+		st.Categories = t.Categories
+		st.Schedule = scheduleName(t.Schedule)
+		st.Priority = t.Priority
+		st.schedule = t.Schedule
+	}
+	for key := range s.scheduled {
+		if !scheduled[key] {
+			delete(s.states, key)
+		}
+	}
+	s.scheduled = scheduled
+}
+
+// state returns the state of t, creating it if needed. s.mu must be held.
+func (s *targetStatus) state(t target) *targetState {
+	st, ok := s.states[t.key()]
+	if !ok {
+		st = newTargetState(t)
+		s.states[t.key()] = st
+	}
+	return st
+}
+
+// attempted records the start of a fetch of t.
+func (s *targetStatus) attempted(t target, at time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.state(t).LastAttempt = &at
+}
+
+// succeeded records a successful fetch of t.
+func (s *targetStatus) succeeded(t target, at time.Time, result *collector.Result) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st := s.state(t)
+	st.LastSuccess = &at
+	st.LastError = ""
+	st.ConsecutiveFailures = 0
+	st.QuarantinedUntil = nil
+	st.PerformanceScore = result.PerformanceScore
+	st.CategoryScores = result.CategoryScores
+	st.Metrics = result.Metrics
+	st.AuditScores = result.AuditScores
+}
+
+// failed records a fetch of t that failed after all retries and returns the
+// number of consecutive failures of t.
+func (s *targetStatus) failed(t target, at time.Time, err error) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st := s.state(t)
+	st.LastFailure = &at
+	st.LastError = err.Error()
+	st.ConsecutiveFailures++
+	return st.ConsecutiveFailures
+}
+
+// quarantine makes scheduled runs skip t until the given time.
+func (s *targetStatus) quarantine(t target, until time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.state(t).QuarantinedUntil = &until
+}
+
+// quarantined reports whether scheduled runs skip t at now.
+func (s *targetStatus) quarantined(t target, now time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	until := s.state(t).QuarantinedUntil
+	return until != nil && now.Before(*until)
+}
+
+// list returns a copy of every target's state, sorted by URL, strategy and
+// scope.
+func (s *targetStatus) list() []targetState {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	out := make([]targetState, 0, len(s.states))
+	for key, st := range s.states {
+		row := *st
+		sched := st.schedule
+		if sched == nil {
+			sched = s.schedule
+		}
+		if next := nextRun(sched, now); s.scheduled[key] && !next.IsZero() {
+			row.NextRun = &next
+		}
+		out = append(out, row)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].URL != out[j].URL {
+			return out[i].URL < out[j].URL
+		}
+		if out[i].Strategy != out[j].Strategy {
+			return out[i].Strategy < out[j].Strategy
+		}
+		return out[i].Scope < out[j].Scope
+	})
+	return out
+}
+
+var targetsTemplate = template.Must(template.New("targets").Funcs(template.FuncMap{
+	"ts": func(t *time.Time) string {
+		if t == nil {
+			return "-"
+		}
+		return t.UTC().Format(time.RFC3339)
+	},
+}).Parse(`<!DOCTYPE html>
+<html>
+<head><title>PSI Exporter targets</title></head>
+<body>
+<h1>Targets</h1>
+<table border="1" cellpadding="4">
+<tr><th>Site</th><th>Strategy</th><th>Scope</th><th>Last attempt</th><th>Last success</th><th>Last failure</th><th>Consecutive failures</th><th>Quarantined until</th><th>Performance score</th><th>Next run</th><th>Timeout</th><th>Max retries</th><th>Initial backoff</th><th>Last error</th></tr>
+{{range .}}<tr><td>{{.URL}}</td><td>{{.Strategy}}</td><td>{{.Scope}}</td><td>{{ts .LastAttempt}}</td><td>{{ts .LastSuccess}}</td><td>{{ts .LastFailure}}</td><td>{{.ConsecutiveFailures}}</td><td>{{ts .QuarantinedUntil}}</td><td>{{with .PerformanceScore}}{{.}}{{else}}-{{end}}</td><td>{{ts .NextRun}}</td><td>{{.Timeout}}</td><td>{{.MaxRetries}}</td><td>{{.InitialBackoff}}</td><td>{{.LastError}}</td></tr>
+{{end}}</table>
+</body>
+</html>
+`))
+
+// targetsStatus lists the fetch state of every target, as an HTML table for
+// browsers and as JSON otherwise or with ?format=json.
+func (e *exporter) targetsStatus(w http.ResponseWriter, r *http.Request) {
+	states := e.status.list()
+	if r.URL.Query().Get("format") != "json" && strings.Contains(r.Header.Get("Accept"), "text/html") {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		targetsTemplate.Execute(w, states)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(states)
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/yahyasahaja/prometheus-exporter-pagespeed-insight/pkg/psi"
+	"gopkg.in/yaml.v3"
+)
+
+// targetsFileDebounce delays a reload after a change to --targets.file, so
+// that a file written in several steps is read once it is complete.
+const targetsFileDebounce = time.Second
+
+// targetGroup is an entry of --targets.file, in the format of Prometheus
+// file_sd and http_sd: a list of URLs sharing a set of labels.
+type targetGroup struct {
+	Targets []string          `yaml:"targets" json:"targets"`
+	Labels  map[string]string `yaml:"labels" json:"labels"`
+	// Strategies limits the group to some strategies, by default all. It
+	// is an extension of the Prometheus format.
+	Strategies []string `yaml:"strategies" json:"strategies,omitempty"`
+}
+
+// loadTargetsFile reads the JSON or YAML target groups at path and expands
+// them into one target per URL and strategy, fetched with opts. Groups
+// without strategies get strats. URLs prefixed with "origin:" export
+// origin-level field data as with --urls. Every invalid entry is reported.
+func loadTargetsFile(path string, strats []string, opts psi.RetryPolicy) ([]target, []error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, []error{fmt.Errorf("reading --targets.file: %v", err)}
+	}
+	// JSON is a subset of YAML, so one decoder handles both formats.
+	var groups []targetGroup
+	dec := yaml.NewDecoder(bytes.NewReader(raw))
+	dec.KnownFields(true)
+	if err := dec.Decode(&groups); err != nil && len(bytes.TrimSpace(raw)) > 0 {
+		return nil, []error{fmt.Errorf("parsing --targets.file %s: %v", path, err)}
+	}
+
+	return expandTargetGroups("--targets.file", groups, strats, opts)
+}
+
+// expandTargetGroups expands target groups read from source into one target
+// per URL and strategy, fetched with opts. Groups without strategies get
+// strats. Every invalid entry is reported.
+func expandTargetGroups(source string, groups []targetGroup, strats []string, opts psi.RetryPolicy) ([]target, []error) {
+	var targets []target
+	var errs []error
+	for i, g := range groups {
+		if err := validateTargetLabels(g.Labels); err != nil {
+			errs = append(errs, fmt.Errorf("%s group %d: %v", source, i, err))
+			continue
+		}
+		wanted := map[string]bool{}
+		for _, s := range g.Strategies {
+			if err := validateStrategy(s); err != nil {
+				errs = append(errs, fmt.Errorf("%s group %d: %v", source, i, err))
+			}
+			wanted[s] = true
+		}
+		if len(g.Strategies) == 0 {
+			for _, s := range strats {
+				wanted[s] = true
+			}
+		}
+		expanded, groupErrs := expandTargets(g.Targets, strategies, opts)
+		for _, err := range groupErrs {
+			errs = append(errs, fmt.Errorf("%s group %d: %v", source, i, err))
+		}
+		for _, t := range expanded {
+			if !wanted[t.Strategy] {
+				continue
+			}
+			t.Labels = g.Labels
+			targets = append(targets, t)
+		}
+	}
+	return targets, errs
+}
+
+// watchTargetsFile calls reload whenever the file at path changes. The
+// directory is watched rather than the file itself, so the file may be
+// replaced atomically by renaming a new version over it.
+func watchTargetsFile(path string, logger *slog.Logger, reload func()) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	path = filepath.Clean(path)
+	if err := watcher.Add(filepath.Dir(path)); err != nil {
+		watcher.Close()
+		return err
+	}
+
+	go func() {
+		var debounce <-chan time.Time
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if filepath.Clean(event.Name) != path || event.Op == fsnotify.Chmod {
+					continue
+				}
+				debounce = time.After(targetsFileDebounce)
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				logger.Warn("Error watching --targets.file", "err", err)
+			case <-debounce:
+				debounce = nil
+				logger.Info("Targets file changed, reloading", "path", path)
+				reload()
+			}
+		}
+	}()
+	return nil
+}
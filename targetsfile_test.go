@@ -0,0 +1,156 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/yahyasahaja/prometheus-exporter-pagespeed-insight/pkg/psi"
+)
+
+func TestLoadTargetsFile(t *testing.T) {
+	tests := []struct {
+		name, content string
+		want          []string
+		// errs are parts of the expected errors, in order.
+		errs []string
+	}{
+		{
+			name: "yaml",
+			content: `
+- targets: [https://example.com/, "origin:https://example.com/"]
+  labels: {team: web}
+- targets: [https://example.com/blog]
+  strategies: [desktop]
+`,
+			want: []string{
+				"https://example.com|mobile|page", "https://example.com|desktop|page",
+				"https://example.com|mobile|origin", "https://example.com|desktop|origin",
+				"https://example.com/blog|desktop|page",
+			},
+		},
+		{
+			name:    "json",
+			content: `[{"targets": ["https://example.com/"], "labels": {"team": "web"}, "strategies": ["mobile"]}]`,
+			want:    []string{"https://example.com|mobile|page"},
+		},
+		{
+			name:    "empty file",
+			content: " \n",
+		},
+		{
+			name: "invalid entries",
+			content: `
+- targets: [example.com, https://example.com/]
+- targets: [https://example.com/labels]
+  labels: {team-name: x}
+- targets: [https://example.com/strategy]
+  strategies: [tablet, mobile]
+`,
+			want: []string{"https://example.com|mobile|page", "https://example.com|desktop|page", "https://example.com/strategy|mobile|page"},
+			errs: []string{
+				`--targets.file group 0: invalid URL "example.com": missing scheme`,
+				`--targets.file group 1: invalid label name "team-name"`,
+				`--targets.file group 2: invalid strategy "tablet"`,
+			},
+		},
+		{
+			name:    "unknown field",
+			content: `[{"targets": ["https://example.com/"], "strategy": "mobile"}]`,
+			errs:    []string{"field strategy not found"},
+		},
+		{
+			name:    "malformed",
+			content: `[{"targets": ["https://example.com/"]`,
+			errs:    []string{"parsing --targets.file"},
+		},
+	}
+	opts := psi.RetryPolicy{Timeout: time.Minute}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "targets.yml")
+			if err := os.WriteFile(path, []byte(tt.content), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			targets, errs := loadTargetsFile(path, strategies, opts)
+			if got := targetKeys(targets); !slices.Equal(got, tt.want) {
+				t.Errorf("got targets %q, want %q", got, tt.want)
+			}
+			var got []string
+			for _, err := range errs {
+				got = append(got, err.Error())
+			}
+			if len(got) != len(tt.errs) {
+				t.Fatalf("got errors %q, want %q", got, tt.errs)
+			}
+			for i, err := range got {
+				if !strings.Contains(err, tt.errs[i]) {
+					t.Errorf("got error %q, want %q", err, tt.errs[i])
+				}
+			}
+		})
+	}
+
+	// Labels are set on every target of their group only.
+	path := filepath.Join(t.TempDir(), "targets.yml")
+	os.WriteFile(path, []byte("[{targets: [https://a.example], labels: {team: a}}, {targets: [https://b.example]}]"), 0o644)
+	targets, _ := loadTargetsFile(path, []string{"mobile"}, opts)
+	if len(targets) != 2 || targets[0].Labels["team"] != "a" || targets[1].Labels != nil || targets[0].Options != opts {
+		t.Errorf("got targets %+v", targets)
+	}
+
+	if _, errs := loadTargetsFile(filepath.Join(t.TempDir(), "missing.yml"), strategies, opts); len(errs) != 1 || !strings.Contains(errs[0].Error(), "reading --targets.file") {
+		t.Errorf("got errors %v for a missing file", errs)
+	}
+}
+
+func TestWatchTargetsFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "targets.yml")
+	write := func(name, content string) {
+		t.Helper()
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("targets.yml", "[{targets: [https://a.example, https://b.example]}]")
+	reloads := make(chan []string, 10)
+	err := watchTargetsFile(path, discard, func() {
+		targets, _ := loadTargetsFile(path, []string{"mobile"}, psi.RetryPolicy{})
+		reloads <- targetKeys(targets)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	reloaded := func(want ...string) {
+		t.Helper()
+		select {
+		case got := <-reloads:
+			if !slices.Equal(got, want) {
+				t.Errorf("reloaded targets %q, want %q", got, want)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatal("the change didn't reload the targets")
+		}
+	}
+
+	// Other files of the directory are ignored.
+	write("other.yml", "[]")
+	// A target disappears, and comes back when the file is replaced by
+	// renaming a new version over it.
+	write("targets.yml", "[{targets: [https://a.example]}]")
+	reloaded("https://a.example|mobile|page")
+	write("targets.yml.tmp", "[{targets: [https://a.example, https://b.example]}]")
+	if err := os.Rename(filepath.Join(dir, "targets.yml.tmp"), path); err != nil {
+		t.Fatal(err)
+	}
+	reloaded("https://a.example|mobile|page", "https://b.example|mobile|page")
+	select {
+	case got := <-reloads:
+		t.Errorf("reloaded %q without a change", got)
+	case <-time.After(2 * targetsFileDebounce):
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"maps"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// tenantLabel is the label set on the series of the targets of a tenant.
+const tenantLabel = "tenant"
+
+// tenantNameRE matches tenant names, which are also a path segment of
+// /metrics/<tenant>.
+var tenantNameRE = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+
+// fileTenant is a tenant in the config file: a team sharing the exporter,
+// with its own targets, API key and labels.
+type fileTenant struct {
+	Name string `yaml:"name"`
+	// APIKey bills the requests of the tenant's targets that don't set their
+	// own api_key, so one team doesn't use up another's quota.
+	APIKey string `yaml:"api_key"`
+	// Labels are added to every target of the tenant. Those of a target take
+	// precedence.
+	Labels map[string]string `yaml:"labels"`
+	// TokenFile holds the bearer token required by /metrics/<tenant>, which
+	// is open to everyone without it.
+	TokenFile string       `yaml:"token_file"`
+	Targets   []fileTarget `yaml:"targets"`
+}
+
+// tenant is a validated tenant of the config file.
+type tenant struct {
+	Name string
+	// APIKey is the key of the targets of the tenant without their own, or
+	// empty.
+	APIKey string
+	// Token is required by /metrics/<tenant> unless empty.
+	Token string
+}
+
+// tenants validates the tenants of the config file and reads their tokens.
+func (c *fileConfig) tenants() ([]tenant, []error) {
+	var tenants []tenant
+	var errs []error
+	for i, ft := range c.Tenants {
+		if !tenantNameRE.MatchString(ft.Name) {
+			errs = append(errs, fmt.Errorf("tenants[%d]: invalid name %q: must be letters, digits, '_' and '-'", i, ft.Name))
+			continue
+		}
+		if slices.ContainsFunc(tenants, func(t tenant) bool { return t.Name == ft.Name }) {
+			errs = append(errs, fmt.Errorf("tenants[%d]: duplicate name %q", i, ft.Name))
+			continue
+		}
+		if err := validateTargetLabels(ft.Labels); err != nil {
+			errs = append(errs, fmt.Errorf("tenants[%d]: %v", i, err))
+			continue
+		}
+		t := tenant{Name: ft.Name, APIKey: strings.TrimSpace(ft.APIKey)}
+		if ft.TokenFile != "" {
+			var err error
+			if t.Token, err = readTokenFile(ft.TokenFile); err != nil {
+				errs = append(errs, fmt.Errorf("tenants[%d]: token_file: %v", i, err))
+				continue
+			}
+		}
+		tenants = append(tenants, t)
+	}
+	return tenants, errs
+}
+
+// fileTargetEntry is a target of the config file, either of targets or of
+// a tenant.
+type fileTargetEntry struct {
+	// path locates the target in the file for error messages.
+	path   string
+	target fileTarget
+	// tenant is the name of the target's tenant, if any.
+	tenant string
+}
+
+// targetEntries returns the targets of the config file followed by those of
+// its tenants, with the tenant's API key and labels applied.
+func (c *fileConfig) targetEntries() []fileTargetEntry {
+	var entries []fileTargetEntry
+	for i, ft := range c.Targets {
+		entries = append(entries, fileTargetEntry{path: fmt.Sprintf("targets[%d]", i), target: ft})
+	}
+	for i, tn := range c.Tenants {
+		for j, ft := range tn.Targets {
+			if strings.TrimSpace(ft.APIKey) == "" {
+				ft.APIKey = tn.APIKey
+			}
+			if len(tn.Labels) > 0 {
+				labels := maps.Clone(tn.Labels)
+				maps.Copy(labels, ft.Labels)
+				ft.Labels = labels
+			}
+			entries = append(entries, fileTargetEntry{path: fmt.Sprintf("tenants[%d].targets[%d]", i, j), target: ft, tenant: tn.Name})
+		}
+	}
+	return entries
+}
+
+// tenantGatherer returns the series of g labeled with the tenant name, so
+// that a tenant only sees the metrics of its own targets.
+func tenantGatherer(g prometheus.Gatherer, name string) prometheus.Gatherer {
+	return prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		mfs, err := g.Gather()
+		var out []*dto.MetricFamily
+		for _, mf := range mfs {
+			var metrics []*dto.Metric
+			for _, m := range mf.Metric {
+				if slices.ContainsFunc(m.Label, func(l *dto.LabelPair) bool { return l.GetName() == tenantLabel && l.GetValue() == name }) {
+					metrics = append(metrics, m)
+				}
+			}
+			if len(metrics) > 0 {
+				mf.Metric = metrics
+				out = append(out, mf)
+			}
+		}
+		return out, err
+	})
+}
+
+// currentTenants returns the tenants of the config file by name.
+func (e *exporter) currentTenants() map[string]tenant {
+	e.targetsMu.RLock()
+	defer e.targetsMu.RUnlock()
+	return e.tenants
+}
+
+func (e *exporter) setTenants(tenants []tenant) {
+	byName := make(map[string]tenant, len(tenants))
+	for _, t := range tenants {
+		byName[t.Name] = t
+	}
+	e.targetsMu.Lock()
+	defer e.targetsMu.Unlock()
+	e.tenants = byName
+}
+
+// tenantMetrics serves GET /metrics/{tenant} with the series of the
+// tenant's targets from g, requiring the tenant's token if it has one.
+func (e *exporter) tenantMetrics(g prometheus.Gatherer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		t, ok := e.currentTenants()[r.PathValue("tenant")]
+		if !ok {
+			http.Error(w, "Tenant not found", http.StatusNotFound)
+			return
+		}
+		if t.Token != "" {
+			token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(t.Token)) != 1 {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="psi-exporter"`)
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+		}
+		promhttp.HandlerFor(tenantGatherer(g, t.Name), promhttp.HandlerOpts{}).ServeHTTP(w, r)
+	}
+}
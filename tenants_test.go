@@ -0,0 +1,83 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestTenantMetrics(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	score := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "psi_score"}, []string{"site", tenantLabel})
+	registry.MustRegister(score)
+	score.WithLabelValues("https://shop.example", "shop").Set(0.9)
+	score.WithLabelValues("https://shop.example/cart", "shop").Set(0.8)
+	score.WithLabelValues("https://blog.example", "blog").Set(0.7)
+	score.WithLabelValues("https://example.com", "").Set(0.6)
+
+	e := newTestExporter(t, answerRun)
+	e.setTenants([]tenant{{Name: "shop", Token: "shop-token"}, {Name: "blog", Token: "blog-token"}, {Name: "docs"}})
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /metrics/{tenant}", e.tenantMetrics(registry))
+	get := func(path, token string) (int, string) {
+		r := httptest.NewRequest(http.MethodGet, path, nil)
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, r)
+		return rec.Code, rec.Body.String()
+	}
+
+	// A tenant sees the series of its own targets only.
+	code, body := get("/metrics/shop", "shop-token")
+	if code != http.StatusOK {
+		t.Fatalf("status %d %q, want 200", code, body)
+	}
+	for _, want := range []string{`psi_score{site="https://shop.example",tenant="shop"} 0.9`, `psi_score{site="https://shop.example/cart",tenant="shop"} 0.8`} {
+		if !strings.Contains(body, want) {
+			t.Errorf("body %q lacks %q", body, want)
+		}
+	}
+	if strings.Contains(body, "blog") || strings.Contains(body, "https://example.com") {
+		t.Errorf("body %q has the series of other targets", body)
+	}
+	// A tenant without series of its own gets none.
+	if code, body := get("/metrics/docs", ""); code != http.StatusOK || body != "" {
+		t.Errorf("got %d %q for the tenant without targets, want nothing", code, body)
+	}
+
+	// The token of another tenant doesn't do.
+	for _, token := range []string{"blog-token", "", "shop-token "} {
+		if code, body := get("/metrics/shop", token); code != http.StatusUnauthorized || strings.Contains(body, "psi_score") {
+			t.Errorf("token %q: got %d %q, want 401", token, code, body)
+		}
+	}
+	if code, _ := get("/metrics/unknown", "shop-token"); code != http.StatusNotFound {
+		t.Errorf("status %d for an unknown tenant, want 404", code)
+	}
+}
+
+func TestFileConfigTenants(t *testing.T) {
+	tenants, errs := (&fileConfig{Tenants: []fileTenant{
+		{Name: "shop", APIKey: " shop-key "},
+		{Name: "blog"},
+		{Name: "shop"},
+		{Name: "a/b"},
+	}}).tenants()
+	if len(tenants) != 2 || tenants[0].APIKey != "shop-key" || tenants[1].APIKey != "" {
+		t.Errorf("got tenants %+v, want shop with its key and blog", tenants)
+	}
+	want := []string{`tenants[2]: duplicate name "shop"`, `tenants[3]: invalid name "a/b"`}
+	if len(errs) != len(want) {
+		t.Fatalf("got errors %v, want %q", errs, want)
+	}
+	for i, err := range errs {
+		if !strings.HasPrefix(err.Error(), want[i]) {
+			t.Errorf("got error %v, want %q", err, want[i])
+		}
+	}
+}
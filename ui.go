@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// uiScoreThreshold is the lowest performance score shown as passing, the
+// start of Lighthouse's green range.
+const uiScoreThreshold = 0.9
+
+// uiMetric is a lab metric shown by /ui with the upper bound of its "good"
+// range, as published for the Core Web Vitals.
+type uiMetric struct {
+	audit, name, unit string
+	good              float64
+}
+
+// uiMetrics are the lab metrics shown by /ui. Lab runs don't measure
+// interactions, so Total Blocking Time stands in for INP.
+var uiMetrics = []uiMetric{
+	{"largest-contentful-paint", "LCP", "ms", 2500},
+	{"cumulative-layout-shift", "CLS", "", 0.1},
+	{"total-blocking-time", "TBT", "ms", 200},
+	{"first-contentful-paint", "FCP", "ms", 1800},
+}
+
+// uiValue is a value shown by /ui with whether it is within its threshold.
+type uiValue struct {
+	Text string
+	Pass bool
+	// Known is false when the last fetch had no value.
+	Known bool
+}
+
+// uiRow is a target as shown by /ui.
+type uiRow struct {
+	URL, Strategy, Scope string
+	Score                uiValue
+	Metrics              []uiValue
+	// Profile is the scan profile of the target, if any.
+	Profile string
+	// Status summarizes the last fetches.
+	Status      string
+	LastSuccess *time.Time
+	LastError   string
+}
+
+var uiTemplate = template.Must(template.New("ui").Funcs(template.FuncMap{
+	"ts": func(t *time.Time) string {
+		if t == nil {
+			return "-"
+		}
+		return t.UTC().Format(time.RFC3339)
+	},
+}).Parse(`<!DOCTYPE html>
+<html>
+<head><title>PSI Exporter</title>
+<style>
+.pass { background: #cfc; }
+.fail { background: #fcc; }
+</style>
+</head>
+<body>
+<h1>PSI Exporter</h1>
+{{with .Job}}<p>Queued <a href="/jobs/{{.}}">job {{.}}</a>. Reload the page once it is done.</p>{{end}}
+<p>Passing means a performance score of at least {{.ScoreThreshold}} and lab metrics within the "good" range: {{range $i, $m := .Thresholds}}{{if $i}}, {{end}}{{$m}}{{end}}.</p>
+<table border="1" cellpadding="4">
+<tr><th>Site</th><th>Strategy</th><th>Performance score</th>{{range .Names}}<th>{{.}}</th>{{end}}<th>Status</th><th>Last success</th><th></th></tr>
+{{range .Rows}}<tr><td>{{.URL}}</td><td>{{.Strategy}}{{with .Profile}} ({{.}}){{end}}</td>{{template "value" .Score}}{{range .Metrics}}{{template "value" .}}{{end}}<td title="{{.LastError}}">{{.Status}}</td><td>{{ts .LastSuccess}}</td>
+<td><form method="post" action="/ui/run"><input type="hidden" name="url" value="{{.URL}}"><input type="hidden" name="strategy" value="{{.Strategy}}"><input type="hidden" name="scope" value="{{.Scope}}"><input type="hidden" name="profile" value="{{.Profile}}"><button type="submit">Run now</button></form></td></tr>
+{{end}}</table>
+<p><a href="/targets">Fetch details</a> - <a href="/metrics">Metrics</a></p>
+</body>
+</html>
+{{define "value"}}{{if .Known}}<td class="{{if .Pass}}pass{{else}}fail{{end}}">{{.Text}}</td>{{else}}<td>-</td>{{end}}{{end}}
+`))
+
+// ui serves /ui, an overview of the latest score and lab metrics of every
+// target against their thresholds, with a button to fetch a target now.
+func (e *exporter) ui(w http.ResponseWriter, r *http.Request) {
+	var rows []uiRow
+	now := time.Now()
+	for _, st := range e.status.list() {
+		row := uiRow{URL: st.URL, Strategy: st.Strategy, Scope: st.Scope, Profile: st.Profile, LastSuccess: st.LastSuccess, LastError: st.LastError}
+		if st.PerformanceScore != nil {
+			score := *st.PerformanceScore
+			row.Score = uiValue{Text: strconv.FormatFloat(score, 'f', 2, 64), Pass: score >= uiScoreThreshold, Known: true}
+		}
+		for _, m := range uiMetrics {
+			v, ok := st.Metrics[m.audit]
+			row.Metrics = append(row.Metrics, uiValue{Text: strconv.FormatFloat(v, 'f', -1, 64) + m.unit, Pass: v <= m.good, Known: ok})
+		}
+		switch {
+		case st.QuarantinedUntil != nil && now.Before(*st.QuarantinedUntil):
+			row.Status = "quarantined until " + st.QuarantinedUntil.UTC().Format(time.RFC3339)
+		case st.ConsecutiveFailures > 0:
+			row.Status = fmt.Sprintf("failing (%d in a row)", st.ConsecutiveFailures)
+		case st.LastSuccess != nil:
+			row.Status = "ok"
+		case st.LastAttempt != nil:
+			row.Status = "fetching"
+		default:
+			row.Status = "not fetched yet"
+		}
+		rows = append(rows, row)
+	}
+
+	var names, thresholds []string
+	for _, m := range uiMetrics {
+		names = append(names, m.name)
+		thresholds = append(thresholds, fmt.Sprintf("%s ≤ %s%s", m.name, strconv.FormatFloat(m.good, 'f', -1, 64), m.unit))
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	uiTemplate.Execute(w, struct {
+		Job            string
+		ScoreThreshold float64
+		Thresholds     []string
+		Names          []string
+		Rows           []uiRow
+	}{r.URL.Query().Get("job"), uiScoreThreshold, thresholds, names, rows})
+}
+
+// uiRun serves the "Run now" buttons of /ui, queueing a fetch of the target
+// with its own options and labels and redirecting back to /ui. The page
+// carries no token, so only monitored targets are fetched, within the rate
+// limit of --execute.client-rate-limit.
+func (e *exporter) uiRun(w http.ResponseWriter, r *http.Request) {
+	if !e.guard.limit(w, r) {
+		return
+	}
+	t, err := parseExecuteTarget(r.FormValue("url"), r.FormValue("strategy"), r.FormValue("scope"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	t.Profile = r.FormValue("profile")
+	targets := e.currentTargets()
+	i := slices.IndexFunc(targets, func(monitored target) bool { return monitored.key() == t.key() })
+	if i < 0 {
+		e.guard.reject("url_not_allowed")
+		http.Error(w, "Only monitored targets can be fetched from /ui", http.StatusForbidden)
+		return
+	}
+	t = targets[i]
+	j := e.jobs.create(t)
+	if !e.pool.trySubmit(func() { e.runJob(j) }) {
+		e.jobs.finish(j.ID, nil, errQueueFull)
+		http.Error(w, errQueueFull.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	e.logger.Info("Queued fetch from /ui", "site", t.URL, "strategy", t.Strategy, "job", j.ID)
+	http.Redirect(w, r, "/ui?job="+url.QueryEscape(j.ID), http.StatusSeeOther)
+}